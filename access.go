@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/auth"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/httpsigclient"
+)
+
+// 投稿の読み出しの可否。ActivityPub には読み出しの認可という仕組みが
+// 無く、Mastodon 等はフォロワー限定の投稿を取りに来るとき GET にも
+// HTTP Signature を付ける (authorized fetch)。署名者が誰かを確かめ、
+// 投稿の宛先と突き合わせて出し分ける。
+//
+// 匿名の読み手には public と unlisted しか見せない。フォロワー限定は
+// 承認済みのフォロワーと宛先に、direct は宛先にだけ見せる。投稿した
+// actor (と、その Actor を管理する primary) は全部見られる。
+
+// statusReader は投稿を読みに来た相手。
+type statusReader struct {
+	// owner は投稿した actor か primary として認証している。
+	owner bool
+	// actorURI は HTTP Signature で確かめた署名者。署名が無いか検証に
+	// 失敗したら空。
+	actorURI string
+	// follower は actorURI が承認済みのフォロワーである。
+	follower bool
+}
+
+// anonymousReader は匿名の読み手。public と unlisted だけを読める。
+var anonymousReader = statusReader{}
+
+// identifyReader は r の読み手を調べる。署名の検証には公開鍵の取得が
+// 要るので、制限付きの投稿を見せるか決める必要があるときだけ呼ぶこと。
+func identifyReader(ctx context.Context, r *http.Request, actor *config.ActorConfig) statusReader {
+	if ownerAuthenticated(r, actor) {
+		return statusReader{owner: true}
+	}
+	signer := verifiedFetcher(ctx, r, actor)
+	if signer == "" {
+		return anonymousReader
+	}
+	reader := statusReader{actorURI: signer}
+	item, err := client.GetKV(ctx, actorScoped(actor, datastore.KVFollowers), signer)
+	switch {
+	case err == nil:
+		reader.follower = item.State == datastore.FollowStateAccepted
+	case !errors.Is(err, datastore.ErrNotFound):
+		// 引けなければフォロワーでないものとして扱う。見せすぎるより
+		// 見せない方がよい。
+		logf("follower lookup for %v failed: %v", signer, err)
+	}
+	return reader
+}
+
+// ownerAuthenticated は r が actor 本人か primary の Bearer / Cookie を
+// 持っているかを返す。ブラウザでログインするのは primary だけなので、
+// sub actor の投稿も primary のセッションで見られるようにする。
+func ownerAuthenticated(r *http.Request, actor *config.ActorConfig) bool {
+	for _, a := range []*auth.Authenticator{authenticatorFor(actor), primaryAuthenticator()} {
+		if a == nil {
+			continue
+		}
+		if ok, _ := a.Authenticated(r); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// verifiedFetcher は GET に付いた HTTP Signature を検証し、署名した actor
+// の URI を返す。署名が無い・検証できない・ブロックしている相手なら空。
+// どれも匿名として扱えば済むので、エラーにはしない。
+func verifiedFetcher(ctx context.Context, r *http.Request, actor *config.ActorConfig) string {
+	keyID, err := httpsigclient.KeyIDFromRequest(r)
+	if err != nil {
+		if !errors.Is(err, httpsigclient.ErrNoSignature) {
+			logf("fetch of %v has a bad signature: %v", r.URL.Path, err)
+		}
+		return ""
+	}
+	pem, owner, err := publicKeyForKeyID(ctx, actor, keyID)
+	if err != nil {
+		logf("cannot resolve the key %v of a fetch: %v", keyID, err)
+		return ""
+	}
+	if err := httpsigclient.Verify(r, nil, pem); err != nil {
+		logf("fetch signed by %v did not verify: %v", keyID, err)
+		return ""
+	}
+	if blockedSender(ctx, owner, keyID) {
+		return ""
+	}
+	return owner
+}
+
+// canRead は reader が actor の note を読めるかを返す。note は Note でも
+// それを包む Create でもよい (宛先は同じ)。
+func (reader statusReader) canRead(actor *config.ActorConfig, note *activitystream.Object) bool {
+	if reader.owner {
+		return true
+	}
+	switch noteVisibility(note, followersURI(actor)) {
+	case visibilityPublic, visibilityUnlisted:
+		return true
+	case visibilityFollowers:
+		if reader.follower {
+			return true
+		}
+	}
+	return reader.actorURI != "" && addressedTo(note, reader.actorURI)
+}
+
+// restricted は note が public でも unlisted でもないかを返す。
+func restricted(actor *config.ActorConfig, note *activitystream.Object) bool {
+	v := noteVisibility(note, followersURI(actor))
+	return v != visibilityPublic && v != visibilityUnlisted
+}
+
+// readerForStatus は note を読もうとしている r の読み手を返す。公開の
+// 投稿なら誰が読んでもよいので、署名の検証を省いて匿名として返す。
+func readerForStatus(ctx context.Context, r *http.Request, actor *config.ActorConfig, notes ...*activitystream.Object) statusReader {
+	for _, n := range notes {
+		if restricted(actor, n) {
+			return identifyReader(ctx, r, actor)
+		}
+	}
+	return anonymousReader
+}
+
+// listable は outbox や投稿一覧に create を出してよいかを返す。direct は
+// 本人が読むときも一覧には出さない。宛先の相手との私信であって、
+// 「この actor の投稿」として並べるものではないため (本人のタイムライン
+// には出る)。
+func (reader statusReader) listable(actor *config.ActorConfig, create *activitystream.Object) bool {
+	if noteVisibility(create, followersURI(actor)) == visibilityDirect {
+		return false
+	}
+	return reader.canRead(actor, create)
+}
+
+// listableCreates は outbox の Create から reader の一覧に出せないものを
+// 除く。
+func listableCreates(reader statusReader, actor *config.ActorConfig, creates []*activitystream.Object) []*activitystream.Object {
+	kept := make([]*activitystream.Object, 0, len(creates))
+	for _, c := range creates {
+		if reader.listable(actor, c) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
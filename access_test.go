@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/auth"
+	"github.com/nna774/s.nna774.net/datastore"
+)
+
+// 投稿した actor か primary の Bearer を持つ読み手だけを本人として扱う。
+func TestOwnerAuthenticated(t *testing.T) {
+	withTestConfig(t)
+	saved := authenticators
+	t.Cleanup(func() { authenticators = saved })
+	authenticators = map[string]*auth.Authenticator{}
+	for _, name := range []string{"nana", "bot"} {
+		a, err := auth.New(name+"-token", "session-secret", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authenticators[name] = a
+	}
+	bot, _ := Config.ActorByLocalPart("bot")
+	primary := Config.PrimaryActor()
+
+	for _, tt := range []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{"匿名", "", false},
+		{"本人のトークン", "bot-token", true},
+		{"primary のトークン", "nana-token", true},
+		{"誤ったトークン", "wrong", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/u/bot/status/1", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if got := ownerAuthenticated(r, bot); got != tt.want {
+				t.Errorf("ownerAuthenticated = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// bot のトークンで primary の投稿は読めない。
+	r := httptest.NewRequest(http.MethodGet, "/u/nana/status/1", nil)
+	r.Header.Set("Authorization", "Bearer bot-token")
+	if ownerAuthenticated(r, primary) {
+		t.Error("the bot token was accepted for the primary actor")
+	}
+}
+
+// 公開範囲と読み手の組み合わせごとの可否。
+func TestStatusReaderCanRead(t *testing.T) {
+	withTestConfig(t)
+	actor := Config.PrimaryActor()
+	followers := followersURI(actor)
+	const alice = "https://a.example/users/alice"
+	const bob = "https://b.example/users/bob"
+
+	public := &activitystream.Object{To: []string{activitystream.ToPublic}, Cc: []string{followers}}
+	unlisted := &activitystream.Object{To: []string{followers}, Cc: []string{activitystream.ToPublic}}
+	followersOnly := &activitystream.Object{To: []string{followers}, Cc: []string{alice}}
+	direct := &activitystream.Object{To: []string{alice}}
+
+	owner := statusReader{owner: true}
+	follower := statusReader{actorURI: bob, follower: true}
+	addressee := statusReader{actorURI: alice}
+	stranger := statusReader{actorURI: bob}
+
+	for _, tt := range []struct {
+		name   string
+		reader statusReader
+		note   *activitystream.Object
+		want   bool
+	}{
+		{"匿名で public", anonymousReader, public, true},
+		{"匿名で unlisted", anonymousReader, unlisted, true},
+		{"匿名でフォロワー限定", anonymousReader, followersOnly, false},
+		{"匿名で direct", anonymousReader, direct, false},
+		{"フォロワーでフォロワー限定", follower, followersOnly, true},
+		{"フォロワーで direct", follower, direct, false},
+		{"宛先でフォロワー限定", addressee, followersOnly, true},
+		{"宛先で direct", addressee, direct, true},
+		{"無関係な署名者でフォロワー限定", stranger, followersOnly, false},
+		{"本人で direct", owner, direct, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.reader.canRead(actor, tt.note); got != tt.want {
+				t.Errorf("canRead = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// direct は読める相手でも一覧には出さない。
+	if owner.listable(actor, direct) {
+		t.Error("a direct status is listable")
+	}
+	if !follower.listable(actor, followersOnly) {
+		t.Error("a followers-only status is not listable for a follower")
+	}
+}
+
+// 公開の投稿しか無ければ、署名を検証せずに匿名として扱う (datastore にも
+// 鍵の取得にも触れない)。
+func TestReaderForPublicStatusSkipsVerification(t *testing.T) {
+	withTestConfig(t)
+	actor := Config.PrimaryActor()
+	public := &activitystream.Object{To: []string{activitystream.ToPublic}}
+	r := httptest.NewRequest(http.MethodGet, "/u/nana/status/1", nil)
+	r.Header.Set("Signature", `keyId="https://a.example/users/alice#main-key",signature="x"`)
+	if got := readerForStatus(r.Context(), r, actor, public); got != anonymousReader {
+		t.Errorf("readerForStatus = %+v, want anonymous", got)
+	}
+}
+
+// objectStore は objects の投稿だけを持ち、KV は空の datastore.Client。
+// ほかのメソッドは nil の埋め込みに届いて panic する。
+type objectStore struct {
+	datastore.Client
+	objects map[int]*activitystream.Object
+}
+
+func (s objectStore) GetObject(ctx context.Context, name string, id int) (*activitystream.Object, error) {
+	if o, ok := s.objects[id]; ok {
+		return o, nil
+	}
+	return nil, datastore.ErrNotFound
+}
+
+func (s objectStore) QueryKV(ctx context.Context, pk string) ([]*datastore.KVItem, error) {
+	return nil, nil
+}
+
+// フォロワー限定の投稿は、匿名にはいいねした人の一覧も 404 にすること。
+func TestStatusLikesHidesRestrictedStatus(t *testing.T) {
+	withTestConfig(t)
+	actor := Config.PrimaryActor()
+	saved := client
+	t.Cleanup(func() { client = saved })
+	client = objectStore{objects: map[int]*activitystream.Object{
+		1: {ID: "https://s.example/u/nana/status/1", Type: activitystream.NoteType, To: []string{followersURI(actor)}},
+	}}
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/u/nana/status/1/likes", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /u/nana/status/1/likes = %v, want 404", rec.Code)
+	}
+}
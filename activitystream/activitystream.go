@@ -25,17 +25,24 @@ const (
 
 const (
 	AcceptType                = "Accept"
+	AddType                   = "Add"
 	AnnounceType              = "Announce"
+	BlockType                 = "Block"
+	CollectionType            = "Collection"
 	CreateType                = "Create"
 	DeleteType                = "Delete"
+	EmojiType                 = "Emoji"
 	FollowType                = "Follow"
+	HashtagType               = "Hashtag"
 	ImageType                 = "Image"
 	LikeType                  = "Like"
+	LinkType                  = "Link"
 	MentionType               = "Mention"
 	NoteType                  = "Note"
 	OrderedCollectionType     = "OrderedCollection"
 	OrderedCollectionPageType = "OrderedCollectionPage"
 	PersonType                = "Person"
+	QuestionType              = "Question"
 	// ServiceType は bot 等の自動投稿アカウントを表す。Mastodon 等はこれを
 	// 見て自動化されたアカウントであることを表示する。
 	ServiceType = "Service"
@@ -43,8 +50,11 @@ const (
 	// Mastodon がプロフィールの追加情報の表現に使っているため合わせる。
 	PropertyValueType = "PropertyValue"
 	RejectType        = "Reject"
-	UndoType          = "Undo"
-	UpdateType        = "Update"
+	RemoveType        = "Remove"
+	// TombstoneType は削除済みのオブジェクトの跡。
+	TombstoneType = "Tombstone"
+	UndoType      = "Undo"
+	UpdateType    = "Update"
 )
 
 // Ref は ActivityPub の「文字列 URI または埋め込みオブジェクト」を表す。
@@ -168,18 +178,33 @@ type Object struct {
 	Content   string `json:"content,omitempty"`
 	MediaType string `json:"mediaType,omitempty"`
 	Published string `json:"published,omitempty"`
+	// Updated は編集された Note が持つ最終編集時刻。Mastodon はこれを見て
+	// 「編集済み」と表示する。
+	Updated   string `json:"updated,omitempty"`
 	Sensitive *bool  `json:"sensitive,omitempty"`
+	// FormerType と Deleted は Tombstone だけが持つ。
+	FormerType string `json:"formerType,omitempty"`
+	Deleted    string `json:"deleted,omitempty"`
 
 	AttributedTo *Ref `json:"attributedTo,omitempty"`
 	Actor        *Ref `json:"actor,omitempty"`
 	Object       *Ref `json:"object,omitempty"`
 	Target       *Ref `json:"target,omitempty"`
 	InReplyTo    *Ref `json:"inReplyTo,omitempty"`
+	// Replies は返信のコレクション。自分の投稿では URI だけを載せる。
+	Replies *Ref `json:"replies,omitempty"`
+	// Conversation は会話全体のコレクション (context)。@context とは別物。
+	// 載せてくる実装は一部だけで、自分の投稿には付けない。
+	Conversation *Ref `json:"context,omitempty"`
 
 	To Strings `json:"to,omitempty"`
 	Cc Strings `json:"cc,omitempty"`
 
-	Icon       *Object `json:"icon,omitempty"`
+	Icon *Object `json:"icon,omitempty"`
+	// Source は content の元になった平文。Content と MediaType だけを
+	// 使う。自分の投稿を編集するときに、HTML ではなく書いたときの文面を
+	// 編集欄に出すために持つ。
+	Source     *Object `json:"source,omitempty"`
 	Tag        Objects `json:"tag,omitempty"`
 	Attachment Objects `json:"attachment,omitempty"`
 	// Value は ActivityStreams には無いが、PropertyValue が持っている。
@@ -195,16 +220,50 @@ type Object struct {
 	Liked             string     `json:"liked,omitempty"`
 	Endpoints         *Endpoints `json:"endpoints,omitempty"`
 	PublicKey         *PublicKey `json:"publicKey,omitempty"`
+	// Featured は固定した投稿のコレクション。Mastodon の拡張。
+	Featured string `json:"featured,omitempty"`
 
 	TotalItems *int   `json:"totalItems,omitempty"`
 	First      string `json:"first,omitempty"`
-	Last       string `json:"last,omitempty"`
-	Next       string `json:"next,omitempty"`
-	Prev       string `json:"prev,omitempty"`
-	PartOf     string `json:"partOf,omitempty"`
+	// FirstPage は first が文字列ではなく埋め込みのページで来たときの中身。
+	// Mastodon は投稿の replies の最初のページを id 無しで埋め込む。
+	FirstPage *Object `json:"-"`
+	Last      string  `json:"last,omitempty"`
+	Next      string  `json:"next,omitempty"`
+	Prev      string  `json:"prev,omitempty"`
+	PartOf    string  `json:"partOf,omitempty"`
 	// OrderedItems は要素がオブジェクトのことも裸の URI 文字列のことも
 	// ある。outbox は前者、followers / following は後者。
 	OrderedItems []*Ref `json:"orderedItems,omitempty"`
+	// Items は順序の無い Collection / CollectionPage の要素。Mastodon の
+	// replies のページはこちらを使う。
+	Items []*Ref `json:"items,omitempty"`
+
+	// OneOf / AnyOf は Question (投票) の選択肢。前者は単一選択、後者は
+	// 複数選択。選択肢は name を持つ Note で、票数は replies の
+	// totalItems に入る。
+	OneOf Objects `json:"oneOf,omitempty"`
+	AnyOf Objects `json:"anyOf,omitempty"`
+	// EndTime は締め切りの予定、Closed は締め切った時刻。
+	EndTime string `json:"endTime,omitempty"`
+	Closed  Closed `json:"closed,omitempty"`
+	// VotersCount は投票した人数。Mastodon の拡張。複数選択では票の合計と
+	// 一致しない。
+	VotersCount *int `json:"votersCount,omitempty"`
+
+	// QuoteURL・MisskeyQuote・QuoteURI は引用した投稿の URI。同じものを
+	// 実装ごとに違う名前で持つ。それぞれ Misskey と新しい Mastodon、
+	// Misskey の旧称、Fedibird が使う。QuotedURI で読む。
+	QuoteURL     string `json:"quoteUrl,omitempty"`
+	MisskeyQuote string `json:"_misskey_quote,omitempty"`
+	QuoteURI     string `json:"quoteUri,omitempty"`
+
+	// Width・Height・Blurhash は添付の画像の大きさとぼかしたプレビュー。
+	// リモートのクライアントは読み込む前にこれで場所を取っておく。Blurhash
+	// は Mastodon の拡張 (toot:blurhash)。Mastodon は名前だけを見る。
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	Blurhash string `json:"blurhash,omitempty"`
 
 	// Recipient は ActivityStreams の語彙には無い。通知として保存すると
 	// きに、どのローカル actor (localpart) 宛の出来事かを付記するための
@@ -212,13 +271,39 @@ type Object struct {
 	Recipient string `json:"recipient,omitempty"`
 }
 
+// Closed は Question の closed。ActivityStreams では日時でも真偽値でも
+// よい。Mastodon は日時を出す。true は時刻の分からない締め切り済みとして
+// "true" で持ち、false は空と同じに扱う。
+type Closed string
+
+func (c *Closed) UnmarshalJSON(b []byte) error {
+	switch string(bytes.TrimSpace(b)) {
+	case "true":
+		*c = "true"
+		return nil
+	case "false", "null":
+		*c = ""
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*c = Closed(s)
+	return nil
+}
+
 // UnmarshalJSON は url を単一文字列・Link オブジェクト・それらの配列の
 // いずれで来ても受ける。Bridgy Fed の web サイト actor 等は url を配列で
 // 返す。表示に使うのは1つで足りるため先頭の非空値だけを拾う。
+//
+// first も文字列と埋め込みのページの両方を受ける。埋め込みなら中身を
+// FirstPage に置く。
 func (o *Object) UnmarshalJSON(b []byte) error {
 	type objectAlias Object
 	aux := struct {
-		URL json.RawMessage `json:"url,omitempty"`
+		URL   json.RawMessage `json:"url,omitempty"`
+		First *Ref            `json:"first,omitempty"`
 		*objectAlias
 	}{objectAlias: (*objectAlias)(o)}
 	if err := json.Unmarshal(b, &aux); err != nil {
@@ -229,6 +314,8 @@ func (o *Object) UnmarshalJSON(b []byte) error {
 		return fmt.Errorf("decoding url failed: %w", err)
 	}
 	o.URL = u
+	o.First = aux.First.ID()
+	o.FirstPage = aux.First.Item()
 	return nil
 }
 
@@ -315,13 +402,15 @@ func FetchActorInfo(ctx context.Context, actor string) (*Object, error) {
 	return &o, nil
 }
 
-// propertyValueContext は PropertyValue と value の語彙を定義する。
-// Mastodon は type の名前だけを見ていて @context を読まないが、JSON-LD と
-// して読む実装のために定義しておく。
-var propertyValueContext = map[string]string{
+// actorContext は actor が使う ActivityStreams 外の語彙 (PropertyValue と
+// value、featured) を定義する。Mastodon は名前だけを見ていて @context を
+// 読まないが、JSON-LD として読む実装のために定義しておく。
+var actorContext = map[string]interface{}{
 	"schema":        "http://schema.org#",
 	"PropertyValue": "schema:PropertyValue",
 	"value":         "schema:value",
+	"toot":          "http://joinmastodon.org/ns#",
+	"featured":      map[string]string{"@id": "toot:featured", "@type": "@id"},
 }
 
 // NewPropertyValue はプロフィールの追加情報を1項目作る。value が http(s)
@@ -341,7 +430,7 @@ func NewPropertyValue(name string, value string) *Object {
 
 func NewUserResource(id string, actorType string, name string, iconURI string, iconMediaType string, preferredUsername string, inbox string, outbox string, followers string, following string, summary string, keyID string, publicKey string, attachment Objects) *Object {
 	return &Object{
-		Context:    []interface{}{ContextActivityStreams, ContextSecurityV1, propertyValueContext},
+		Context:    []interface{}{ContextActivityStreams, ContextSecurityV1, actorContext},
 		ID:         id,
 		Type:       actorType,
 		URL:        id,
@@ -399,6 +488,28 @@ func NewFollow(followID string, actorID string, targetID string) *Object {
 	}
 }
 
+func NewBlock(blockID string, actorID string, targetID string) *Object {
+	return &Object{
+		Context: ContextActivityStreams,
+		ID:      blockID,
+		Type:    BlockType,
+		Actor:   URIRef(actorID),
+		Object:  URIRef(targetID),
+	}
+}
+
+// NewTombstone は削除した id の跡を作る。元のオブジェクトと同じ id を
+// 持たせ、formerType に元の type を残す。
+func NewTombstone(id string, formerType string, deleted string) *Object {
+	return &Object{
+		Context:    ContextActivityStreams,
+		ID:         id,
+		Type:       TombstoneType,
+		FormerType: formerType,
+		Deleted:    deleted,
+	}
+}
+
 func NewUndo(activity *Object, actorID string, undoID string) *Object {
 	return &Object{
 		Context: ContextActivityStreams,
@@ -437,6 +548,20 @@ func NewCreate(createID string, actor string, to []string, cc []string, obj *Obj
 	}
 }
 
+// NewUpdate は obj を新しい内容に置き換えたことを知らせる。受け取った側は
+// obj の id で既存のものを探して差し替える。
+func NewUpdate(updateID string, actor string, to []string, cc []string, obj *Object) *Object {
+	return &Object{
+		Context: ContextActivityStreams,
+		ID:      updateID,
+		Type:    UpdateType,
+		To:      to,
+		Cc:      cc,
+		Actor:   URIRef(actor),
+		Object:  ObjectRef(obj),
+	}
+}
+
 func NewLike(likeID string, actorID string, objectID string) *Object {
 	return &Object{
 		Context: ContextActivityStreams,
@@ -470,6 +595,31 @@ func NewDelete(deleteID string, actor string, to []string, objectID string) *Obj
 	}
 }
 
+// NewAdd は objectID を target のコレクションに足したことを知らせる。
+// 投稿の固定 (featured への追加) に使う。
+func NewAdd(addID string, actorID string, objectID string, target string) *Object {
+	return &Object{
+		Context: ContextActivityStreams,
+		ID:      addID,
+		Type:    AddType,
+		Actor:   URIRef(actorID),
+		Object:  URIRef(objectID),
+		Target:  URIRef(target),
+	}
+}
+
+// NewRemove は NewAdd の逆。
+func NewRemove(removeID string, actorID string, objectID string, target string) *Object {
+	return &Object{
+		Context: ContextActivityStreams,
+		ID:      removeID,
+		Type:    RemoveType,
+		Actor:   URIRef(actorID),
+		Object:  URIRef(objectID),
+		Target:  URIRef(target),
+	}
+}
+
 func NewTag(tagType string, name string, href string) *Object {
 	return &Object{
 		Type: tagType,
@@ -484,6 +634,86 @@ func NewMention(name string, actorURI string) *Object {
 	return NewTag(MentionType, name, actorURI)
 }
 
+// NewEmoji はカスタム絵文字の tag。name は ":shortcode:" の形。Mastodon は
+// id と icon.url で絵文字を見分け、画像を取り込む。
+func NewEmoji(id string, name string, mediaType string, iconURL string) *Object {
+	return &Object{
+		ID:   id,
+		Type: EmojiType,
+		Name: name,
+		Icon: &Object{
+			Type:      ImageType,
+			MediaType: mediaType,
+			URL:       iconURL,
+		},
+	}
+}
+
+// NewPollOption は Question の選択肢を1つ作る。Mastodon と同じく、票数は
+// replies に埋め込んだ Collection の totalItems で表す。
+func NewPollOption(name string, votes int) *Object {
+	return &Object{
+		Type:    NoteType,
+		Name:    name,
+		Replies: ObjectRef(&Object{Type: CollectionType, TotalItems: &votes}),
+	}
+}
+
+// quoteContext は引用のための語彙。Note の @context に足す。
+var quoteContext = map[string]interface{}{
+	"misskey":        "https://misskey-hub.net/ns#",
+	"quoteUrl":       "as:quoteUrl",
+	"_misskey_quote": "misskey:_misskey_quote",
+}
+
+// NewQuoteLink は FEP-e232 の引用の Link。tag に入れる。mediaType で
+// ActivityPub のオブジェクトへのリンクだと示す。
+func NewQuoteLink(href string) *Object {
+	return &Object{
+		Type:      LinkType,
+		MediaType: ActivityStreamsContentType,
+		Href:      href,
+		Name:      "RE: " + href,
+	}
+}
+
+// SetQuote は o を uri の投稿の引用にする。quoteUrl と _misskey_quote の
+// 両方と、FEP-e232 の Link の tag を載せる。読む側は実装ごとにどれか1つ
+// しか見ない。何度呼んでも Link は1つ。
+func (o *Object) SetQuote(uri string) {
+	o.QuoteURL = uri
+	o.MisskeyQuote = uri
+	o.Context = []interface{}{ContextActivityStreams, quoteContext}
+	for _, t := range o.Tag {
+		if isQuoteLink(t) && t.Href == uri {
+			return
+		}
+	}
+	o.Tag = append(o.Tag, NewQuoteLink(uri))
+}
+
+// QuotedURI は o が引用している投稿の URI を返す。引用でなければ空。
+func (o *Object) QuotedURI() string {
+	for _, uri := range []string{o.QuoteURL, o.MisskeyQuote, o.QuoteURI} {
+		if uri != "" {
+			return uri
+		}
+	}
+	for _, t := range o.Tag {
+		if isQuoteLink(t) {
+			return t.Href
+		}
+	}
+	return ""
+}
+
+// isQuoteLink は tag が FEP-e232 の投稿へのリンクかを返す。mediaType は
+// 2通りの書き方がある。
+func isQuoteLink(t *Object) bool {
+	return t != nil && t.Type == LinkType && t.Href != "" &&
+		(t.MediaType == ActivityStreamsContentType || t.MediaType == ContentType)
+}
+
 func NewOrderedCollection(id string, totalItems int, first string, last string) *Object {
 	return &Object{
 		Context:    ContextActivityStreams,
@@ -512,6 +742,24 @@ func NewOrderedCollectionOfIDs(id string, ids []string) *Object {
 	}
 }
 
+// NewOrderedCollectionOfObjects はオブジェクトを埋め込んだまま orderedItems
+// に持つ OrderedCollection を作る。featured はこの形で返す。受け取った側が
+// 1件ずつ取りに来ずに済む。
+func NewOrderedCollectionOfObjects(id string, objects []*Object) *Object {
+	total := len(objects)
+	items := make([]*Ref, 0, len(objects))
+	for _, o := range objects {
+		items = append(items, ObjectRef(o))
+	}
+	return &Object{
+		Context:      ContextActivityStreams,
+		ID:           id,
+		Type:         OrderedCollectionType,
+		TotalItems:   &total,
+		OrderedItems: items,
+	}
+}
+
 func NewOrderedCollectionPage(id string, partOf string, next string, prev string, orderedItems []*Object) *Object {
 	items := make([]*Ref, 0, len(orderedItems))
 	for _, o := range orderedItems {
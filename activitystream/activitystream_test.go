@@ -246,6 +246,20 @@ func TestMarshalDoesNotDropTypeSpecificFields(t *testing.T) {
 			t.Fatalf("orderedItems has %d entries, want 1", len(items))
 		}
 	})
+
+	t.Run("Update", func(t *testing.T) {
+		note := NewNote("https://s.nna774.net/u/nana/status/1", "2026-07-28T00:00:00Z", "", "<p>yo</p>", "https://s.nna774.net/u/nana", []string{ToPublic}, nil, nil)
+		note.Updated = "2026-07-28T00:05:00Z"
+		note.Source = &Object{Content: "yo", MediaType: "text/plain"}
+		got := marshalToMap(t, NewUpdate("https://s.nna774.net/u/nana/status/1#updates/1", "https://s.nna774.net/u/nana", note.To, nil, note))
+		obj, _ := got["object"].(map[string]interface{})
+		if got["type"] != UpdateType || obj["updated"] != note.Updated {
+			t.Errorf("type = %v, object.updated = %v", got["type"], obj["updated"])
+		}
+		if src, _ := obj["source"].(map[string]interface{}); src["content"] != "yo" {
+			t.Errorf("object.source = %v", obj["source"])
+		}
+	})
 }
 
 // 本番 DynamoDB に 2023 年から入っている実データ。モデルを変えるたびに、
@@ -525,3 +539,162 @@ func marshalToMap(t *testing.T, v interface{}) map[string]interface{} {
 	}
 	return m
 }
+
+// Mastodon の Note は replies に Collection を埋め込み、その first に
+// 最初のページを id 無しで埋め込む。first を文字列としか読めないと
+// Note ごと読めなくなる。
+func TestDecodeNoteWithEmbeddedRepliesPage(t *testing.T) {
+	const raw = `{
+		"id": "https://m.example/users/alice/statuses/1",
+		"type": "Note",
+		"content": "<p>hi</p>",
+		"replies": {
+			"id": "https://m.example/users/alice/statuses/1/replies",
+			"type": "Collection",
+			"first": {
+				"type": "CollectionPage",
+				"next": "https://m.example/users/alice/statuses/1/replies?only_other_accounts=true&page=true",
+				"partOf": "https://m.example/users/alice/statuses/1/replies",
+				"items": []
+			}
+		}
+	}`
+	var note Object
+	if err := json.Unmarshal([]byte(raw), &note); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	replies := note.Replies.Item()
+	if replies == nil {
+		t.Fatal("replies was not decoded as an object")
+	}
+	if replies.First != "" || replies.FirstPage == nil {
+		t.Fatalf("First = %q, FirstPage = %v; want the embedded page", replies.First, replies.FirstPage)
+	}
+	if got, want := replies.FirstPage.Next, "https://m.example/users/alice/statuses/1/replies?only_other_accounts=true&page=true"; got != want {
+		t.Errorf("FirstPage.Next = %q, want %q", got, want)
+	}
+
+	// 文字列の first はこれまでどおり読める。
+	var coll Object
+	if err := json.Unmarshal([]byte(`{"type":"OrderedCollection","first":"https://m.example/outbox?page=true"}`), &coll); err != nil {
+		t.Fatal(err)
+	}
+	if coll.First != "https://m.example/outbox?page=true" || coll.FirstPage != nil {
+		t.Errorf("First = %q, FirstPage = %v", coll.First, coll.FirstPage)
+	}
+}
+
+// Mastodon は Add / Remove の target が actor の featured であるときだけ
+// 固定として扱う。object は投稿の URI のままでよい。
+func TestAddAndRemoveCarryTarget(t *testing.T) {
+	const featured = "https://s.nna774.net/u/nana/featured"
+	for _, a := range []*Object{
+		NewAdd("https://s.nna774.net/add/1", "https://s.nna774.net/u/nana", "https://s.nna774.net/u/nana/status/1", featured),
+		NewRemove("https://s.nna774.net/remove/1", "https://s.nna774.net/u/nana", "https://s.nna774.net/u/nana/status/1", featured),
+	} {
+		got := marshalToMap(t, a)
+		if got["target"] != featured || got["object"] != "https://s.nna774.net/u/nana/status/1" {
+			t.Errorf("%v = %v", a.Type, got)
+		}
+	}
+}
+
+// Mastodon は Emoji の icon.url から画像を取り込む。icon が平たい URL では
+// なく Image であること。
+func TestEmojiCarriesImageIcon(t *testing.T) {
+	got := marshalToMap(t, NewEmoji("https://s.nna774.net/emoji/blob", ":blob:", "image/png", "https://s.nna774.net/emoji/blob"))
+	icon, _ := got["icon"].(map[string]interface{})
+	if got["type"] != EmojiType || got["name"] != ":blob:" || icon["type"] != ImageType || icon["url"] != "https://s.nna774.net/emoji/blob" {
+		t.Errorf("NewEmoji = %v", got)
+	}
+}
+
+// closed は実装によって締め切り時刻だったり true だったりする。どちらでも
+// 締め切りとして読み、false や null は締め切っていないとして読むこと。
+func TestDecodeQuestion(t *testing.T) {
+	const raw = `{
+		"id": "https://m.example/users/alice/statuses/2",
+		"type": "Question",
+		"endTime": "2026-10-18T00:00:00Z",
+		"closed": "2026-10-18T00:00:00Z",
+		"votersCount": 3,
+		"oneOf": [
+			{"type": "Note", "name": "yes", "replies": {"type": "Collection", "totalItems": 2}},
+			{"type": "Note", "name": "no", "replies": {"type": "Collection", "totalItems": 1}}
+		]
+	}`
+	var q Object
+	if err := json.Unmarshal([]byte(raw), &q); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if q.Type != QuestionType || len(q.OneOf) != 2 || q.VotersCount == nil || *q.VotersCount != 3 || q.Closed == "" {
+		t.Fatalf("Question = %+v", q)
+	}
+	if c := q.OneOf[0].Replies.Item(); c == nil || c.TotalItems == nil || *c.TotalItems != 2 {
+		t.Errorf("votes of %q = %+v", q.OneOf[0].Name, c)
+	}
+
+	for raw, want := range map[string]bool{`true`: true, `false`: false, `null`: false} {
+		var q Object
+		if err := json.Unmarshal([]byte(`{"type":"Question","closed":`+raw+`}`), &q); err != nil {
+			t.Fatalf("closed %v: %v", raw, err)
+		}
+		if got := q.Closed != ""; got != want {
+			t.Errorf("closed %v decoded as %q", raw, q.Closed)
+		}
+	}
+}
+
+// 選択肢の票数は Mastodon と同じく replies.totalItems に入れる。0票でも
+// 省かないこと。
+func TestPollOptionCarriesVotes(t *testing.T) {
+	got := marshalToMap(t, NewPollOption("yes", 0))
+	replies, _ := got["replies"].(map[string]interface{})
+	if got["type"] != NoteType || got["name"] != "yes" || replies["type"] != CollectionType || replies["totalItems"] != float64(0) {
+		t.Errorf("NewPollOption = %v", got)
+	}
+}
+
+// 引用は quoteUrl・_misskey_quote・Link の tag の全部に載せること。何度
+// 付けても Link が増えないこと。
+func TestSetQuote(t *testing.T) {
+	const quoted = "https://m.example/users/alice/statuses/1"
+	note := NewNote("https://s.nna774.net/u/nana/status/1", "", "", "<p>hi</p>", "https://s.nna774.net/u/nana", nil, nil, nil)
+	note.SetQuote(quoted)
+	note.SetQuote(quoted)
+	got := marshalToMap(t, note)
+	tags, _ := got["tag"].([]interface{})
+	if got["quoteUrl"] != quoted || got["_misskey_quote"] != quoted || len(tags) != 1 {
+		t.Fatalf("quote = %v", got)
+	}
+	link, _ := tags[0].(map[string]interface{})
+	if link["type"] != LinkType || link["href"] != quoted || link["mediaType"] != ActivityStreamsContentType {
+		t.Errorf("link = %v", link)
+	}
+	if note.QuotedURI() != quoted {
+		t.Errorf("QuotedURI = %q", note.QuotedURI())
+	}
+}
+
+// 読むときはどの書き方でも引用として読めること。ただのリンクは引用では
+// ない。
+func TestQuotedURI(t *testing.T) {
+	const quoted = "https://m.example/notes/1"
+	for _, raw := range []string{
+		`{"type":"Note","quoteUri":"` + quoted + `"}`,
+		`{"type":"Note","_misskey_quote":"` + quoted + `"}`,
+		`{"type":"Note","tag":[{"type":"Link","mediaType":"application/activity+json","href":"` + quoted + `"}]}`,
+	} {
+		var note Object
+		if err := json.Unmarshal([]byte(raw), &note); err != nil {
+			t.Fatal(err)
+		}
+		if got := note.QuotedURI(); got != quoted {
+			t.Errorf("QuotedURI(%v) = %q", raw, got)
+		}
+	}
+	note := Object{Tag: Objects{{Type: LinkType, MediaType: "text/html", Href: quoted}}}
+	if got := note.QuotedURI(); got != "" {
+		t.Errorf("a plain link is read as a quote: %q", got)
+	}
+}
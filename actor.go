@@ -46,6 +46,9 @@ func fetchObject(ctx context.Context, actor *config.ActorConfig, uri string) (*a
 	if !isFetchableURI(uri) {
 		return nil, fmt.Errorf("refusing to fetch %v", uri)
 	}
+	if domainBlocked(ctx, hostOf(uri)) {
+		return nil, fmt.Errorf("refusing to fetch %v from a blocked domain", uri)
+	}
 	resp, err := signerFor(actor).GetWithSign(ctx, uri)
 	if err != nil {
 		return nil, fmt.Errorf("fetching %v failed: %w", uri, err)
@@ -128,6 +131,7 @@ func cacheActorInfo(ctx context.Context, actor *config.ActorConfig, actorURI str
 		Name:              name,
 		IconURL:           iconURL,
 		PreferredUsername: remote.PreferredUsername,
+		Emoji:             noteEmoji(remote.Tag),
 		At:                nowRFC3339(),
 		TTL:               time.Now().Add(actorInfoTTL).Unix(),
 	}); err != nil {
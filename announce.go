@@ -11,6 +11,7 @@ import (
 	"github.com/nna774/s.nna774.net/config"
 	"github.com/nna774/s.nna774.net/datastore"
 	"github.com/nna774/s.nna774.net/httperror"
+	"github.com/nna774/s.nna774.net/web"
 )
 
 // announceStatusHandler は自分のブースト (Announce) を id から表示する。
@@ -53,6 +54,7 @@ type announcePage struct {
 	pageBase
 	AnnounceURI string
 	Name        string
+	NameEmoji   web.Emoji
 	AuthorURI   string
 	Acct        string
 	IconURL     string
@@ -60,6 +62,7 @@ type announcePage struct {
 	// 自分でブーストした場合に、著者名をリンクにしないための出し分けに使う。
 	Mine        bool
 	Content     string
+	Emoji       web.Emoji
 	Attachments []attachmentItem
 	Published   string
 	InReplyTo   string
@@ -79,11 +82,13 @@ func htmlAnnounceHandler(w http.ResponseWriter, r *http.Request, primary *config
 		pageBase:    newPageBase(r, primary.Name+" のRT: "+excerpt(note.Content, 40)),
 		AnnounceURI: announce.ID,
 		Name:        authorName(ctx, authorURI),
+		NameEmoji:   cachedEmoji(ctx, authorURI),
 		AuthorURI:   authorURI,
 		Acct:        acctFor(ctx, authorURI),
 		IconURL:     cachedIconURL(ctx, authorURI),
 		Mine:        authorURI == primary.ID(),
 		Content:     note.Content,
+		Emoji:       noteEmoji(note.Tag),
 		Attachments: noteAttachments(note),
 		Published:   announce.Published,
 		InReplyTo:   note.InReplyTo.ID(),
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/httperror"
+)
+
+// ブロックは actor 単位とドメイン単位の2種類を持つ。どちらもインスタンス
+// 全体で共有する。1人用のインスタンスで、嫌がらせやスパムは bot にも
+// 同じように来るため、actor ごとに分けても手間が増えるだけである。
+//
+// ブロックした相手からの Activity は inbox で署名の検証より前に弾く。
+// 検証には相手の鍵を取りに行く必要があり、スパムのたびにそれをやると
+// こちらの実行時間を食われる。
+
+// blockedSender は inbox に届いた Activity の送り主がブロック対象かを
+// 返す。actor と keyId の両方のドメインを見る。keyId だけ別のドメインに
+// 置いてくる実装もあるため。
+func blockedSender(ctx context.Context, actorURI string, keyID string) bool {
+	if actorBlocked(ctx, actorURI) {
+		return true
+	}
+	if domainBlocked(ctx, hostOf(actorURI)) {
+		return true
+	}
+	return keyID != "" && domainBlocked(ctx, hostOf(keyID))
+}
+
+// actorBlocked は actorURI をブロックしているかを返す。
+func actorBlocked(ctx context.Context, actorURI string) bool {
+	if actorURI == "" {
+		return false
+	}
+	_, err := client.GetKV(ctx, datastore.KVBlocks, actorURI)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		logf("block lookup for %v failed: %v", actorURI, err)
+	}
+	return err == nil
+}
+
+// domainBlocked は host かその親ドメインをブロックしているかを返す。
+// Mastodon と同じく、ドメインのブロックはサブドメインにも効く。
+func domainBlocked(ctx context.Context, host string) bool {
+	for _, d := range parentDomains(host) {
+		_, err := client.GetKV(ctx, datastore.KVDomainBlocks, d)
+		if err == nil {
+			return true
+		}
+		if !errors.Is(err, datastore.ErrNotFound) {
+			logf("domain block lookup for %v failed: %v", d, err)
+		}
+	}
+	return false
+}
+
+// parentDomains は host 自身と、ラベルを2つ以上残した親ドメインを近い順に
+// 返す。"a.b.example" なら a.b.example と b.example。example のような
+// トップレベルだけのものはブロックの単位にならないので含めない。
+func parentDomains(host string) []string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return nil
+	}
+	domains := []string{host}
+	for {
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+		if !strings.Contains(host, ".") {
+			break
+		}
+		domains = append(domains, host)
+	}
+	return domains
+}
+
+// domainMatches は host が domain そのものかそのサブドメインかを返す。
+func domainMatches(host string, domain string) bool {
+	host = strings.ToLower(host)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// normalizeDomain は入力欄に書かれたドメインを KV のキーの形にする。
+// URL や @user@host を貼られても受ける。
+func normalizeDomain(input string) (string, error) {
+	input = strings.TrimSpace(input)
+	if i := strings.LastIndexByte(input, '@'); i >= 0 && !strings.Contains(input, "/") {
+		input = input[i+1:]
+	}
+	if strings.Contains(input, "://") {
+		u, err := url.Parse(input)
+		if err != nil {
+			return "", err
+		}
+		input = u.Hostname()
+	}
+	domain := strings.ToLower(strings.TrimSuffix(input, "."))
+	if domain == "" || strings.ContainsAny(domain, "/:? ") || !strings.Contains(domain, ".") {
+		return "", fmt.Errorf("%q is not a domain", input)
+	}
+	return domain, nil
+}
+
+// isBlockedBy は actor が actorURI にブロックされているかを返す。ブロック
+// されている相手には配信しない。
+func isBlockedBy(ctx context.Context, actor *config.ActorConfig, actorURI string) bool {
+	_, err := client.GetKV(ctx, actorScoped(actor, datastore.KVBlockedBy), actorURI)
+	return err == nil
+}
+
+// blockActivityID は base から actor ごとの Block の id を作る。ブロックは
+// 全ローカル actor から送るが、KV には1件しか持たないので、解除の Undo で
+// 同じ id を組み立て直せるように決まった形で派生させる。
+func blockActivityID(base string, actor *config.ActorConfig) string {
+	return base + "/" + actor.LocalPart()
+}
+
+// blockActor は actorURI をブロックする。
+//
+// 全ローカル actor のフォロー関係を両方向とも消し、Block を送る。Block を
+// 受けた Mastodon 互換の実装は向こう側のフォロー関係も消すので、以後は
+// 相手のタイムラインにもこちらの投稿が届かなくなる。
+func blockActor(ctx context.Context, actorURI string) error {
+	primary := Config.PrimaryActor()
+	item := &datastore.KVItem{
+		PK:         datastore.KVBlocks,
+		SK:         actorURI,
+		ActivityID: newActivityID("block"),
+		At:         nowRFC3339(),
+	}
+	// 相手のサーバが落ちていてもブロック自体はする。Block を送れないだけ
+	// である。
+	remote, err := fetchActor(ctx, primary, actorURI)
+	if err != nil {
+		logf("cannot fetch %v to send a Block: %v", actorURI, err)
+	} else {
+		item.Name, item.IconURL = actorDisplay(remote)
+		item.PreferredUsername = remote.PreferredUsername
+		item.Inbox = remote.InboxURI()
+	}
+	if err := client.PutKV(ctx, item); err != nil {
+		return err
+	}
+
+	for _, a := range Config.Actors {
+		for _, partition := range []string{datastore.KVFollowers, datastore.KVFollowing} {
+			if err := client.DeleteKV(ctx, actorScoped(a, partition), actorURI); err != nil {
+				return fmt.Errorf("removing %v from %v: %w", actorURI, actorScoped(a, partition), err)
+			}
+		}
+		if item.Inbox == "" {
+			continue
+		}
+		block := activitystream.NewBlock(blockActivityID(item.ActivityID, a), a.ID(), actorURI)
+		if err := enqueueDelivery(ctx, a.LocalPart(), item.Inbox, block); err != nil {
+			logf("cannot queue a Block of %v from %v: %v", actorURI, a.ID(), err)
+		}
+	}
+	logf("blocked %v", actorURI)
+	return nil
+}
+
+// unblockActor はブロックを解除し、送った Block を Undo で取り消す。
+// フォロー関係は戻らない。
+func unblockActor(ctx context.Context, actorURI string) error {
+	item, err := client.GetKV(ctx, datastore.KVBlocks, actorURI)
+	if err != nil {
+		return err
+	}
+	if err := client.DeleteKV(ctx, datastore.KVBlocks, actorURI); err != nil {
+		return err
+	}
+	if item.Inbox != "" {
+		for _, a := range Config.Actors {
+			block := activitystream.NewBlock(blockActivityID(item.ActivityID, a), a.ID(), actorURI)
+			undo := activitystream.NewUndo(block, a.ID(), newActivityID("undo"))
+			if err := enqueueDelivery(ctx, a.LocalPart(), item.Inbox, undo); err != nil {
+				logf("cannot queue an Undo(Block) of %v from %v: %v", actorURI, a.ID(), err)
+			}
+		}
+	}
+	logf("unblocked %v", actorURI)
+	return nil
+}
+
+// blockDomain は domain をブロックし、そこにいるフォロワーとフォロー先を
+// 全ローカル actor から外す。ドメイン単位では Block を送らない (Mastodon と
+// 同じく、相手のサーバには知らせずに黙って切る)。
+func blockDomain(ctx context.Context, domain string) error {
+	if err := client.PutKV(ctx, &datastore.KVItem{
+		PK: datastore.KVDomainBlocks,
+		SK: domain,
+		At: nowRFC3339(),
+	}); err != nil {
+		return err
+	}
+	removed := 0
+	for _, a := range Config.Actors {
+		for _, partition := range []string{datastore.KVFollowers, datastore.KVFollowing} {
+			items, err := client.QueryKV(ctx, actorScoped(a, partition))
+			if err != nil {
+				return fmt.Errorf("listing %v: %w", actorScoped(a, partition), err)
+			}
+			for _, it := range items {
+				if !domainMatches(hostOf(it.SK), domain) {
+					continue
+				}
+				if err := client.DeleteKV(ctx, it.PK, it.SK); err != nil {
+					return fmt.Errorf("removing %v from %v: %w", it.SK, it.PK, err)
+				}
+				removed++
+			}
+		}
+	}
+	logf("blocked domain %v (%d relationships removed)", domain, removed)
+	return nil
+}
+
+// blockHandler は相手からの Block を記録する。primary / sub actor どちらの
+// inbox からも呼ばれる。
+//
+// ブロックされた側ができるのは、相手に何も届けないことだけである。
+// フォロー関係を両方向とも消し、以後 mention などで直接送ろうとしても
+// isBlockedBy で外す。
+func blockHandler(w http.ResponseWriter, r *http.Request, actor *config.ActorConfig, in *activitystream.Object) httperror.HttpError {
+	ctx := r.Context()
+	actorID := in.Actor.ID()
+	if in.Object.ID() != actor.ID() {
+		return httperror.StatusUnprocessableEntity(
+			fmt.Sprintf("Block targets %v, not this actor", in.Object.ID()), nil)
+	}
+	if err := client.PutKV(ctx, &datastore.KVItem{
+		PK:         actorScoped(actor, datastore.KVBlockedBy),
+		SK:         actorID,
+		ActivityID: in.ID,
+		At:         nowRFC3339(),
+	}); err != nil {
+		return httperror.StatusInternalServerError("cannot record the block", err)
+	}
+	for _, partition := range []string{datastore.KVFollowers, datastore.KVFollowing} {
+		if err := client.DeleteKV(ctx, actorScoped(actor, partition), actorID); err != nil {
+			return httperror.StatusInternalServerError("cannot remove the relationship", err)
+		}
+	}
+	logf("%v blocked %v", actorID, actor.ID())
+	respondText(w, http.StatusAccepted, "accepted\n")
+	return nil
+}
+
+// --- /admin/blocks ------------------------------------------------------
+
+type blockListItem struct {
+	// Target は actor の URI かドメイン。解除のフォームにそのまま載せる。
+	Target  string
+	Name    string
+	Acct    string
+	IconURL string
+	At      string
+}
+
+type adminBlocksPage struct {
+	pageBase
+	Actors  []blockListItem
+	Domains []blockListItem
+	// BlockedBy は primary actor をブロックしている相手。こちらからは
+	// 何もできないが、配信していない理由を確かめられるように出す。
+	BlockedBy []blockListItem
+}
+
+// adminBlocksHandler はブロックの一覧と追加・解除のフォームを出す。
+func adminBlocksHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	page := adminBlocksPage{pageBase: newPageBase(r, "ブロック")}
+	page.NoIndex = true
+
+	actors, err := client.QueryKV(ctx, datastore.KVBlocks)
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot list the blocks", err)
+	}
+	page.Actors = blockListItems(actors)
+	domains, err := client.QueryKV(ctx, datastore.KVDomainBlocks)
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot list the domain blocks", err)
+	}
+	page.Domains = blockListItems(domains)
+	blockedBy, err := client.QueryKV(ctx, actorScoped(Config.PrimaryActor(), datastore.KVBlockedBy))
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot list who blocks us", err)
+	}
+	page.BlockedBy = blockListItems(blockedBy)
+	knownActors := map[string]*datastore.KVItem{}
+	for i := range page.BlockedBy {
+		page.BlockedBy[i].Name, page.BlockedBy[i].IconURL = actorDisplayCached(ctx, knownActors, page.BlockedBy[i].Target)
+	}
+	return renderPage(w, "admin_blocks", page)
+}
+
+// blockListItems は KV の項目を新しい順の一覧にする。
+func blockListItems(items []*datastore.KVItem) []blockListItem {
+	list := make([]blockListItem, 0, len(items))
+	for _, it := range items {
+		list = append(list, blockListItem{
+			Target:  it.SK,
+			Name:    it.Name,
+			Acct:    acctFromItem(it, it.SK),
+			IconURL: it.IconURL,
+			At:      it.At,
+		})
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].At > list[j].At })
+	return list
+}
+
+// blockRequest はブロックの追加・解除の要求。actor と domain のどちらか
+// 一方を指定する。
+type blockRequest struct {
+	Actor  string `json:"actor"`
+	Domain string `json:"domain"`
+}
+
+func parseBlockRequest(r *http.Request) (blockRequest, httperror.HttpError) {
+	var req blockRequest
+	if isFormRequest(r) {
+		if err := r.ParseForm(); err != nil {
+			return req, httperror.StatusUnprocessableEntity("bad form", err)
+		}
+		req.Actor = r.PostFormValue("actor")
+		req.Domain = r.PostFormValue("domain")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, httperror.StatusUnprocessableEntity("bad request", err)
+	}
+	req.Actor = strings.TrimSpace(req.Actor)
+	req.Domain = strings.TrimSpace(req.Domain)
+	if (req.Actor == "") == (req.Domain == "") {
+		return req, httperror.StatusUnprocessableEntity("specify exactly one of actor or domain", nil)
+	}
+	return req, nil
+}
+
+// createBlockHandler は actor かドメインをブロックする。
+func createBlockHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	req, herr := parseBlockRequest(r)
+	if herr != nil {
+		return herr
+	}
+	if req.Domain != "" {
+		domain, err := normalizeDomain(req.Domain)
+		if err != nil {
+			return httperror.StatusUnprocessableEntity("bad domain", err)
+		}
+		if domainMatches(hostOf(Config.Origin), domain) {
+			return httperror.StatusUnprocessableEntity("cannot block this instance", nil)
+		}
+		if err := blockDomain(ctx, domain); err != nil {
+			return httperror.StatusInternalServerError("cannot block the domain", err)
+		}
+	} else {
+		// URI でも @user@host でも受ける。
+		actorURI, err := resolveActorURI(ctx, req.Actor)
+		if err != nil {
+			return httperror.StatusUnprocessableEntity("cannot resolve that actor", err)
+		}
+		if isLocalActor(actorURI) {
+			return httperror.StatusUnprocessableEntity("cannot block a local actor", nil)
+		}
+		if err := blockActor(ctx, actorURI); err != nil {
+			return httperror.StatusInternalServerError("cannot block the actor", err)
+		}
+	}
+	return respondBlockDone(w, r)
+}
+
+// deleteBlockHandler はブロックを解除する。
+func deleteBlockHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	req, herr := parseBlockRequest(r)
+	if herr != nil {
+		return herr
+	}
+	if req.Domain != "" {
+		domain, err := normalizeDomain(req.Domain)
+		if err != nil {
+			return httperror.StatusUnprocessableEntity("bad domain", err)
+		}
+		if err := client.DeleteKV(ctx, datastore.KVDomainBlocks, domain); err != nil {
+			return httperror.StatusInternalServerError("cannot unblock the domain", err)
+		}
+		logf("unblocked domain %v", domain)
+	} else if err := unblockActor(ctx, req.Actor); err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return httperror.StatusNotFound("not blocking that actor", err)
+		}
+		return httperror.StatusInternalServerError("cannot unblock the actor", err)
+	}
+	return respondBlockDone(w, r)
+}
+
+func respondBlockDone(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	if isFormRequest(r) {
+		http.Redirect(w, r, "/admin/blocks", http.StatusSeeOther)
+		return nil
+	}
+	respondText(w, http.StatusOK, "ok\n")
+	return nil
+}
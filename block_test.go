@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+func TestParentDomains(t *testing.T) {
+	for host, want := range map[string][]string{
+		"a.b.example.com": {"a.b.example.com", "b.example.com", "example.com"},
+		"Example.COM.":    {"example.com"},
+		"localhost":       {"localhost"},
+		"":                nil,
+	} {
+		if got := parentDomains(host); !reflect.DeepEqual(got, want) {
+			t.Errorf("parentDomains(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestDomainMatches(t *testing.T) {
+	for _, c := range []struct {
+		host, domain string
+		want         bool
+	}{
+		{"spam.example", "spam.example", true},
+		{"a.spam.example", "spam.example", true},
+		{"A.Spam.Example", "spam.example", true},
+		// 文字列の末尾が一致するだけの別ドメインは巻き込まない。
+		{"notspam.example", "spam.example", false},
+		{"spam.example.net", "spam.example", false},
+	} {
+		if got := domainMatches(c.host, c.domain); got != c.want {
+			t.Errorf("domainMatches(%q, %q) = %v, want %v", c.host, c.domain, got, c.want)
+		}
+	}
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	for in, want := range map[string]string{
+		" Spam.Example ":                 "spam.example",
+		"https://spam.example/users/x":   "spam.example",
+		"@x@spam.example":                "spam.example",
+		"spam.example.":                  "spam.example",
+		"https://spam.example:8443/path": "spam.example",
+	} {
+		if got, err := normalizeDomain(in); err != nil || got != want {
+			t.Errorf("normalizeDomain(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "localhost", "spam example", "spam.example/x"} {
+		if got, err := normalizeDomain(in); err == nil {
+			t.Errorf("normalizeDomain(%q) = %q, want an error", in, got)
+		}
+	}
+}
+
+// 解除の Undo で同じ id を組み立て直せること。actor ごとに別の id になる
+// こと (相手は id で重複を排除する)。
+func TestBlockActivityID(t *testing.T) {
+	withTestConfig(t)
+	nana, _ := Config.ActorByLocalPart("nana")
+	bot, _ := Config.ActorByLocalPart("bot")
+	const base = "https://s.example/block/1"
+	if blockActivityID(base, nana) != blockActivityID(base, nana) {
+		t.Errorf("blockActivityID is not stable")
+	}
+	if blockActivityID(base, nana) == blockActivityID(base, bot) {
+		t.Errorf("blockActivityID is shared between actors")
+	}
+}
+
+func TestParseBlockRequest(t *testing.T) {
+	form := func(v url.Values) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/admin/blocks", strings.NewReader(v.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	req, herr := parseBlockRequest(form(url.Values{"domain": {" spam.example "}}))
+	if herr != nil || req.Domain != "spam.example" || req.Actor != "" {
+		t.Errorf("parseBlockRequest = %+v, %v", req, herr)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/admin/blocks", strings.NewReader(`{"actor":"@x@spam.example"}`))
+	r.Header.Set("Content-Type", "application/json")
+	if req, herr := parseBlockRequest(r); herr != nil || req.Actor != "@x@spam.example" {
+		t.Errorf("parseBlockRequest = %+v, %v", req, herr)
+	}
+	for _, v := range []url.Values{{}, {"actor": {"x"}, "domain": {"spam.example"}}} {
+		if _, herr := parseBlockRequest(form(v)); herr == nil || herr.Code() != http.StatusUnprocessableEntity {
+			t.Errorf("parseBlockRequest(%v) = %v, want 422", v, herr)
+		}
+	}
+}
+
+// 他の actor 宛ての Block は datastore に触る前に弾く。
+func TestBlockHandlerRejectsOtherTarget(t *testing.T) {
+	withTestConfig(t)
+	in := activitystream.NewBlock("https://a.example/blocks/1", "https://a.example/users/alice", "https://s.example/u/bot")
+	r := httptest.NewRequest(http.MethodPost, "/u/nana/inbox", nil)
+	herr := blockHandler(httptest.NewRecorder(), r, Config.PrimaryActor(), in)
+	if herr == nil || herr.Code() != http.StatusUnprocessableEntity {
+		t.Errorf("blockHandler = %v, want 422", herr)
+	}
+}
+
+func TestAdminBlocksPageRenders(t *testing.T) {
+	page := adminBlocksPage{
+		pageBase: pageBase{Title: "ブロック", SiteName: "nana", LocalPart: "nana", Handle: "@nana", Authed: true},
+		Actors:   []blockListItem{{Target: "https://spam.example/users/x", Acct: "@x@spam.example"}},
+		Domains:  []blockListItem{{Target: "spam.example"}},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "admin_blocks", page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`name="actor" value="https://spam.example/users/x"`, `name="domain" value="spam.example"`, `action="/admin/blocks/remove"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("page does not contain %q", want)
+		}
+	}
+}
+
+func TestBlockRoutes(t *testing.T) {
+	r := newRouter()
+	for _, c := range []struct{ method, path string }{
+		{http.MethodGet, "/admin/blocks"},
+		{http.MethodPost, "/admin/blocks"},
+		{http.MethodPost, "/admin/blocks/remove"},
+	} {
+		if h, _, _ := r.Lookup(c.method, c.path); h == nil {
+			t.Errorf("%v %v has no handler", c.method, c.path)
+		}
+	}
+}
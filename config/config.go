@@ -8,8 +8,10 @@ import (
 	"errors"
 	"fmt"
 	"mime"
+	"net/url"
 	"os"
 	"path"
+	"regexp"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -34,11 +36,18 @@ type Config struct {
 	// primary actor だけが行うため、Actor ごとではなくインスタンスに1つ。
 	SessionSecretParameter string `yaml:"session_secret_parameter"`
 	// GyazoAccessTokenParameter は画像投稿で使う Gyazo API のアクセス
-	// トークン。空なら画像投稿機能は無効。全 Actor で共有する。
+	// トークン。media の backend が gyazo のときに使い、空なら画像投稿
+	// 機能は無効。全 Actor で共有する。
 	GyazoAccessTokenParameter string `yaml:"gyazo_access_token_parameter"`
+	// Media は投稿に添付する画像の置き場所。
+	Media MediaConfig `yaml:"media"`
 
 	Actors []*ActorConfig `yaml:"actors"`
 
+	// Emoji はインスタンスのカスタム絵文字。投稿本文の :shortcode: を
+	// 画像にする。
+	Emoji []*Emoji `yaml:"emoji"`
+
 	sessionSecret    string
 	gyazoAccessToken string
 }
@@ -97,6 +106,88 @@ type Field struct {
 	Value string `yaml:"value"`
 }
 
+// 画像の置き場所の種類。
+const (
+	MediaBackendGyazo = "gyazo"
+	// MediaBackendLocal は開発用。ファイルシステムに置き、/media/ から
+	// 配る。Lambda ではファイルが残らないので使えない。
+	MediaBackendLocal = "local"
+	MediaBackendS3    = "s3"
+)
+
+// MediaConfig は画像の置き場所の設定。Backend を省略すると gyazo。
+type MediaConfig struct {
+	Backend string `yaml:"backend"`
+	// LocalDir は local のときの置き場所。省略すると media。
+	LocalDir string        `yaml:"local_dir"`
+	S3       S3MediaConfig `yaml:"s3"`
+	// MaxImageEdge は置く画像の長辺の上限 (px)。これより大きい画像は縮めて
+	// から置く。省略すると DefaultMaxImageEdge。
+	MaxImageEdge int `yaml:"max_image_edge"`
+}
+
+// DefaultMaxImageEdge は MaxImageEdge の既定値。スマートフォンの写真
+// (4000px 級) を、タイムラインで見るのに足りる大きさまで縮める。
+const DefaultMaxImageEdge = 2048
+
+// S3MediaConfig は S3 互換のストレージの設定。資格情報は AWS SDK の既定の
+// 探し方 (Lambda の実行ロール・環境変数) で得る。
+type S3MediaConfig struct {
+	Bucket string `yaml:"bucket"`
+	// Region は省略するとインスタンスのリージョン。
+	Region string `yaml:"region"`
+	// Endpoint は S3 互換のストレージ (MinIO 等) の URL。省略すると AWS の
+	// S3。バケットはパスに入れる (path style)。
+	Endpoint string `yaml:"endpoint"`
+	// Prefix はオブジェクトのキーの先頭に付ける。
+	Prefix string `yaml:"prefix"`
+	// PublicURL は置いた画像を外から読む URL の先頭。CloudFront やバケット
+	// の公開 URL。キーをこの後ろに付けたものが添付の URL になる。
+	PublicURL string `yaml:"public_url"`
+}
+
+// MediaBackend は Backend の既定値を補ったもの。
+func (c *Config) MediaBackend() string {
+	if c.Media.Backend == "" {
+		return MediaBackendGyazo
+	}
+	return c.Media.Backend
+}
+
+// MediaLocalDir は LocalDir の既定値を補ったもの。
+func (c *Config) MediaLocalDir() string {
+	if c.Media.LocalDir == "" {
+		return "media"
+	}
+	return c.Media.LocalDir
+}
+
+// MediaMaxImageEdge は MaxImageEdge の既定値を補ったもの。
+func (c *Config) MediaMaxImageEdge() int {
+	if c.Media.MaxImageEdge == 0 {
+		return DefaultMaxImageEdge
+	}
+	return c.Media.MaxImageEdge
+}
+
+// Emoji はカスタム絵文字1つ。Shortcode は前後のコロンを含まない。URL は
+// 画像の実体の置き場所で、外へは /emoji/:shortcode として出す。置き場所を
+// 移してもリモートが控えた URL が切れないようにするため。
+type Emoji struct {
+	Shortcode string `yaml:"shortcode"`
+	URL       string `yaml:"url"`
+}
+
+func (e *Emoji) MediaType() string {
+	if t := mime.TypeByExtension(path.Ext(e.URL)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// shortcodePattern は Mastodon が受け付ける shortcode と同じ。
+var shortcodePattern = regexp.MustCompile(`^[a-zA-Z0-9_]{2,}$`)
+
 // IsDevelopment はローカル実行かどうかを返す。秘密情報をファイルから
 // 読むか SSM から読むかの分岐に使う。
 func IsDevelopment() bool { return os.Getenv("ENV") == "development" }
@@ -144,6 +235,16 @@ func (c *Config) ActorByLocalPart(localPart string) (*ActorConfig, bool) {
 	return nil, false
 }
 
+// EmojiByShortcode は shortcode (コロン無し) の絵文字を探す。
+func (c *Config) EmojiByShortcode(shortcode string) (*Emoji, bool) {
+	for _, e := range c.Emoji {
+		if e.Shortcode == shortcode {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
 // 開発時の秘密情報は環境変数で渡す。SSM を引かずに動かせるようにする。
 const (
 	devAPITokenEnv         = "API_TOKEN"
@@ -293,6 +394,8 @@ func fetchParameters(ctx context.Context, region string, names ...string) (map[s
 
 // validate は Actors の整合性を確かめる。primary actor がちょうど1人、
 // localpart の重複が無いこと、actor_type が有効な値であることを見る。
+// 絵文字は shortcode の形と重複、URL が http(s) であることを見る。画像の
+// 置き場所は backend ごとに要るものが揃っているかを見る。
 func (c *Config) validate() error {
 	if len(c.Actors) == 0 {
 		return errors.New("at least one actor is required")
@@ -315,9 +418,45 @@ func (c *Config) validate() error {
 	if primaryCount != 1 {
 		return fmt.Errorf("exactly one actor must have primary: true, got %d", primaryCount)
 	}
+	seenShortcodes := map[string]bool{}
+	for _, e := range c.Emoji {
+		if !shortcodePattern.MatchString(e.Shortcode) {
+			return fmt.Errorf("emoji %q: shortcode must be 2 or more of [a-zA-Z0-9_]", e.Shortcode)
+		}
+		if seenShortcodes[e.Shortcode] {
+			return fmt.Errorf("duplicate emoji shortcode %q", e.Shortcode)
+		}
+		seenShortcodes[e.Shortcode] = true
+		if !isHTTPURL(e.URL) {
+			return fmt.Errorf("emoji %q: url must be an http(s) URL, got %q", e.Shortcode, e.URL)
+		}
+	}
+	switch c.MediaBackend() {
+	case MediaBackendGyazo, MediaBackendLocal:
+	case MediaBackendS3:
+		if c.Media.S3.Bucket == "" {
+			return errors.New("media: s3.bucket is required for the s3 backend")
+		}
+		if !isHTTPURL(c.Media.S3.PublicURL) {
+			return fmt.Errorf("media: s3.public_url must be an http(s) URL, got %q", c.Media.S3.PublicURL)
+		}
+		if c.Media.S3.Endpoint != "" && !isHTTPURL(c.Media.S3.Endpoint) {
+			return fmt.Errorf("media: s3.endpoint must be an http(s) URL, got %q", c.Media.S3.Endpoint)
+		}
+	default:
+		return fmt.Errorf("media: backend must be %q, %q or %q, got %q", MediaBackendGyazo, MediaBackendLocal, MediaBackendS3, c.Media.Backend)
+	}
+	if c.Media.MaxImageEdge < 0 {
+		return fmt.Errorf("media: max_image_edge must not be negative, got %d", c.Media.MaxImageEdge)
+	}
 	return nil
 }
 
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
 func LoadConfig(ctx context.Context, configFile string, region string) (*Config, error) {
 	cfg, err := os.ReadFile(configFile)
 	if err != nil {
@@ -156,3 +156,54 @@ func TestValidateRejectsBadActorType(t *testing.T) {
 		t.Error("validate() succeeded, want error for invalid actor_type")
 	}
 }
+
+func TestValidateEmoji(t *testing.T) {
+	actors := []*ActorConfig{{Username: "a@example.com", Primary: true, ActorType: ActorTypePerson}}
+	for _, tt := range []struct {
+		name    string
+		emoji   []*Emoji
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"valid", []*Emoji{{Shortcode: "blob_cat", URL: "https://example.com/blob.png"}}, false},
+		{"colons", []*Emoji{{Shortcode: ":blob:", URL: "https://example.com/blob.png"}}, true},
+		{"too short", []*Emoji{{Shortcode: "b", URL: "https://example.com/b.png"}}, true},
+		{"duplicate", []*Emoji{{Shortcode: "blob", URL: "https://example.com/1.png"}, {Shortcode: "blob", URL: "https://example.com/2.png"}}, true},
+		{"not http", []*Emoji{{Shortcode: "blob", URL: "data:image/png;base64,AAAA"}}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Actors: actors, Emoji: tt.emoji}
+			err := c.validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateMedia(t *testing.T) {
+	actors := []*ActorConfig{{Username: "a@example.com", Primary: true, ActorType: ActorTypePerson}}
+	for _, tt := range []struct {
+		name    string
+		media   MediaConfig
+		wantErr bool
+	}{
+		{"default", MediaConfig{}, false},
+		{"local", MediaConfig{Backend: MediaBackendLocal}, false},
+		{"s3", MediaConfig{Backend: MediaBackendS3, S3: S3MediaConfig{Bucket: "media", PublicURL: "https://media.example.com"}}, false},
+		{"minio", MediaConfig{Backend: MediaBackendS3, S3: S3MediaConfig{Bucket: "media", Endpoint: "http://localhost:9000", PublicURL: "http://localhost:9000/media"}}, false},
+		{"s3 without bucket", MediaConfig{Backend: MediaBackendS3, S3: S3MediaConfig{PublicURL: "https://media.example.com"}}, true},
+		{"s3 without public url", MediaConfig{Backend: MediaBackendS3, S3: S3MediaConfig{Bucket: "media"}}, true},
+		{"unknown", MediaConfig{Backend: "ftp"}, true},
+		{"max image edge", MediaConfig{MaxImageEdge: 1024}, false},
+		{"negative max image edge", MediaConfig{MaxImageEdge: -1}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Actors: actors, Media: tt.media}
+			err := c.validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/httperror"
+)
+
+// 会話ページ (/thread) は timeline の投稿の前後を、リモートの投稿も含めて
+// 辿って出す。個別投稿ページのスレッド (replies.go) は誰でも見られるので
+// 手元の索引しか使わないが、こちらは自分専用なのでリモートへ取りに行く。
+//
+// 上へは inReplyTo を辿り、下へは replies (と、あれば context) の
+// コレクションを辿る。1件ごとに HTTP を投げるので、Lambda の時間内に
+// 収まるよう取得回数・深さ・枝の数に上限を置く。上限に当たったら、
+// そこまでに取れた分だけで描く。
+
+const (
+	// conversationFetchLimit はリモートへの GET の総数の上限。投稿、
+	// コレクション、そのページのどれも1回と数える。
+	conversationFetchLimit = 30
+	// conversationDepthLimit は開いた投稿から下へ辿る段数の上限。
+	conversationDepthLimit = 4
+	// conversationFanOut は1つのコレクションから拾う要素の数の上限。
+	conversationFanOut = 20
+	// conversationTimeout は辿るのに使う時間の上限。web の Lambda の
+	// タイムアウト (30秒) より十分短くする。
+	conversationTimeout = 15 * time.Second
+)
+
+// conversation は1回の会話ページの描画で集めた投稿を持つ。
+type conversation struct {
+	actor *config.ActorConfig
+	// budget は残りのリモート取得回数。
+	budget int
+	notes  map[string]*activitystream.Object
+	// tried は一度取りに行った URI。取れなかったものを二度引かない。
+	tried map[string]bool
+	// indexed はローカルの投稿への返信の索引 (KVReplies)。初めて要る
+	// ときに全 actor の分をまとめて読む。
+	indexed []*datastore.KVItem
+	loaded  bool
+}
+
+func newConversation(actor *config.ActorConfig, budget int) *conversation {
+	return &conversation{
+		actor:  actor,
+		budget: budget,
+		notes:  map[string]*activitystream.Object{},
+		tried:  map[string]bool{},
+	}
+}
+
+// spend はリモート取得を1回分使う。使い切っていたら false。
+func (c *conversation) spend() bool {
+	if c.budget <= 0 {
+		return false
+	}
+	c.budget--
+	return true
+}
+
+// note は uri の投稿を返す。ローカルの投稿は手元から読む。自分専用の
+// ページなので宛先による出し分けはしない。リモートの投稿は取得回数が
+// 残っていれば取りに行く。
+func (c *conversation) note(ctx context.Context, uri string) *activitystream.Object {
+	if n, ok := c.notes[uri]; ok {
+		return n
+	}
+	if uri == "" || c.tried[uri] {
+		return nil
+	}
+	if owner, id, ok := actorAndIDFromStatusURI(uri); ok {
+		c.tried[uri] = true
+		n, herr := loadStatus(ctx, owner, id)
+		if herr != nil {
+			return nil
+		}
+		c.notes[uri] = n
+		return n
+	}
+	if !c.spend() {
+		return nil
+	}
+	c.tried[uri] = true
+	n, err := fetchVerifiedNote(ctx, c.actor, uri)
+	if err != nil {
+		logf("cannot fetch %v for a conversation: %v", uri, err)
+		return nil
+	}
+	c.notes[uri] = n
+	return n
+}
+
+// adopt はコレクションに埋め込まれて来た投稿を、取りに行かずに使う。
+// 信用するのはコレクションと同じオリジンのものだけ。他所の投稿を
+// 埋め込まれても、それが本物かはこちらからは分からない。
+func (c *conversation) adopt(item *activitystream.Object, origin string) {
+	if item == nil || c.notes[item.ID] != nil || !sameOrigin(item.ID, origin) {
+		return
+	}
+	if verifyFetchedNote(item, item.ID) != nil {
+		return
+	}
+	c.notes[item.ID] = item
+}
+
+// fetchCollection は origin と同じオリジンにあるコレクション (のページ) を
+// 取る。
+func (c *conversation) fetchCollection(ctx context.Context, uri, origin string) *activitystream.Object {
+	if uri == "" || c.tried[uri] || !sameOrigin(uri, origin) || !c.spend() {
+		return nil
+	}
+	c.tried[uri] = true
+	col, err := fetchObject(ctx, c.actor, uri)
+	if err != nil {
+		logf("cannot fetch %v for a conversation: %v", uri, err)
+		return nil
+	}
+	return col
+}
+
+// collectionItems は replies や context のコレクションの要素の URI を、
+// 最大 conversationFanOut 件返す。origin はそのコレクションを持つ投稿の
+// URI。ページは最初のものと、その次の1つまでしか見ない。Mastodon は
+// 最初のページに本人の返信だけを載せ、他人の返信を次のページに回す。
+func (c *conversation) collectionItems(ctx context.Context, ref *activitystream.Ref, origin string) []string {
+	col := ref.Item()
+	if col == nil {
+		col = c.fetchCollection(ctx, ref.ID(), origin)
+	}
+	if col == nil {
+		return nil
+	}
+	var uris []string
+	take := func(page *activitystream.Object) {
+		for _, it := range append(append([]*activitystream.Ref{}, page.OrderedItems...), page.Items...) {
+			if len(uris) >= conversationFanOut {
+				return
+			}
+			uri := it.ID()
+			if uri == "" || slices.Contains(uris, uri) {
+				continue
+			}
+			c.adopt(it.Item(), origin)
+			uris = append(uris, uri)
+		}
+	}
+	take(col)
+	page := col.FirstPage
+	if page == nil {
+		page = c.fetchCollection(ctx, col.First, origin)
+	}
+	if page == nil {
+		return uris
+	}
+	take(page)
+	if len(uris) < conversationFanOut {
+		if next := c.fetchCollection(ctx, page.Next, origin); next != nil {
+			take(next)
+		}
+	}
+	return uris
+}
+
+// expand は n への返信を集める。ローカルの投稿なら索引から、リモートの
+// 投稿なら replies コレクションから。
+func (c *conversation) expand(ctx context.Context, n *activitystream.Object) {
+	if _, _, ok := actorAndIDFromStatusURI(n.ID); ok {
+		c.expandIndexed(ctx, n.ID)
+		return
+	}
+	for _, uri := range c.collectionItems(ctx, n.Replies, n.ID) {
+		c.note(ctx, uri)
+	}
+}
+
+// expandIndexed はローカルの投稿 parent への返信を索引から集める。
+// リモートの返信は取れればそれを使い、取得回数を使い切っていたら索引に
+// 残っている本文で代用する。
+func (c *conversation) expandIndexed(ctx context.Context, parent string) {
+	if !c.loaded {
+		c.loaded = true
+		for _, a := range Config.Actors {
+			part, err := client.QueryKV(ctx, actorScoped(a, datastore.KVReplies))
+			if err != nil {
+				logf("loading the replies of %v failed: %v", a.ID(), err)
+				continue
+			}
+			c.indexed = append(c.indexed, part...)
+		}
+	}
+	for _, it := range repliesTo(c.indexed, parent) {
+		// 取りに行って取れなかった (消された等) ものは出さない。
+		if c.note(ctx, it.SK) != nil || c.tried[it.SK] {
+			continue
+		}
+		c.notes[it.SK] = &activitystream.Object{
+			ID:           it.SK,
+			Type:         activitystream.NoteType,
+			AttributedTo: activitystream.URIRef(it.TargetActor),
+			InReplyTo:    activitystream.URIRef(parent),
+			Content:      it.Content,
+			Summary:      it.Summary,
+			Published:    it.At,
+		}
+	}
+}
+
+// childrenOf は集めた投稿のうち parent への返信を古い順に返す。
+func (c *conversation) childrenOf(parent string) []*activitystream.Object {
+	var children []*activitystream.Object
+	for _, n := range c.notes {
+		if n.ID != parent && n.InReplyTo.ID() == parent {
+			children = append(children, n)
+		}
+	}
+	sort.SliceStable(children, func(i, j int) bool {
+		ti, tj := publishedTime(children[i].Published), publishedTime(children[j].Published)
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return children[i].ID < children[j].ID
+	})
+	return children
+}
+
+// ancestors は focus の返信先を遡り、古い順に返す。
+func (c *conversation) ancestors(ctx context.Context, focus *activitystream.Object) []*activitystream.Object {
+	var chain []*activitystream.Object
+	seen := map[string]bool{focus.ID: true}
+	for uri := focus.InReplyTo.ID(); uri != "" && !seen[uri] && len(chain) < threadAncestorLimit; {
+		seen[uri] = true
+		parent := c.note(ctx, uri)
+		if parent == nil {
+			break
+		}
+		chain = append(chain, parent)
+		uri = parent.InReplyTo.ID()
+	}
+	slices.Reverse(chain)
+	return chain
+}
+
+// descend は focus から下へ、段ごとに返信を集める。
+func (c *conversation) descend(ctx context.Context, focus *activitystream.Object) {
+	frontier := []*activitystream.Object{focus}
+	seen := map[string]bool{focus.ID: true}
+	for depth := 0; depth < conversationDepthLimit && len(frontier) > 0; depth++ {
+		var next []*activitystream.Object
+		for _, n := range frontier {
+			if ctx.Err() != nil {
+				return
+			}
+			c.expand(ctx, n)
+			for _, child := range c.childrenOf(n.ID) {
+				if !seen[child.ID] {
+					seen[child.ID] = true
+					next = append(next, child)
+				}
+			}
+		}
+		frontier = next
+	}
+}
+
+// conversationNode は描画する順に並べた投稿1件と字下げの段数。
+type conversationNode struct {
+	note  *activitystream.Object
+	depth int
+}
+
+// descendants は集めた投稿から focus の下の木を深さ優先で並べる。
+// 字下げは threadMaxDepth で止める。skip が true を返した投稿は、その
+// 下の返信ごと落とす。
+func (c *conversation) descendants(focus string, skip func(*activitystream.Object) bool) []conversationNode {
+	var nodes []conversationNode
+	seen := map[string]bool{focus: true}
+	var walk func(parent string, depth int)
+	walk = func(parent string, depth int) {
+		for _, n := range c.childrenOf(parent) {
+			if seen[n.ID] || skip(n) {
+				continue
+			}
+			seen[n.ID] = true
+			nodes = append(nodes, conversationNode{note: n, depth: min(depth, threadMaxDepth)})
+			walk(n.ID, depth+1)
+		}
+	}
+	walk(focus, 1)
+	return nodes
+}
+
+// conversationHandler は uri の投稿を中心に会話を出す。primary actor 専用。
+func conversationHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	uri := r.URL.Query().Get("uri")
+	if uri == "" {
+		return httperror.StatusUnprocessableEntity("uri is required", nil)
+	}
+	primary := Config.PrimaryActor()
+	ctx, cancel := context.WithTimeout(r.Context(), conversationTimeout)
+	defer cancel()
+
+	c := newConversation(primary, conversationFetchLimit)
+	focus := c.note(ctx, uri)
+	if focus == nil {
+		return httperror.StatusNotFound("cannot load the status", nil)
+	}
+	// 会話のコレクション (context) を持つ実装なら、返信を1つずつ辿るより
+	// 安い。要素は replies から来たものと同じく inReplyTo で木に組む。
+	for _, u := range c.collectionItems(ctx, focus.Conversation, focus.ID) {
+		c.note(ctx, u)
+	}
+	ancestors := c.ancestors(ctx, focus)
+	c.descend(ctx, focus)
+
+	// 描画の段は元の r の context で。辿るのに時間を使い切っていても、
+	// 集めた分は出す。
+	rctx := r.Context()
+	reactions := loadReactionState(rctx, primary)
+	filters := loadContentFilters(rctx, time.Now())
+	hidden := func(n *activitystream.Object) bool {
+		author := n.AttributedTo.ID()
+		if author == primary.ID() {
+			return false
+		}
+		action, _ := filters.verdict(n.Content)
+		return filters.muted(author) || action == filterHide
+	}
+	toItem := func(n *activitystream.Object, depth int) timelineItem {
+		author := n.AttributedTo.ID()
+		item := noteItem(n, author, n.Published, author == primary.ID(), reactions)
+		item.Depth = depth
+		if item.Mine {
+			if id, herr := statusIDFromURI(n.ID); herr == nil {
+				item.StatusID = id
+			}
+		} else if action, word := filters.verdict(n.Content); action == filterWarn {
+			item.FilterWarning = word
+		}
+		return item
+	}
+
+	var items []timelineItem
+	for _, n := range ancestors {
+		if !hidden(n) {
+			items = append(items, toItem(n, 0))
+		}
+	}
+	// 開いた投稿そのものは、ミュートやフィルタに当たっても出す。
+	focusItem := toItem(focus, 0)
+	focusItem.Focus = true
+	items = append(items, focusItem)
+	for _, node := range c.descendants(focus.ID, hidden) {
+		items = append(items, toItem(node.note, node.depth))
+	}
+	resolveItemAuthors(rctx, items)
+
+	page := timelinePage{
+		pageBase:  newPageBase(r, "会話"),
+		Items:     items,
+		InReplyTo: focus.ID,
+		Page:      1,
+		Thread:    true,
+	}
+	if !focusItem.Mine {
+		page.MentionPrefill = focusItem.AuthorURI
+	}
+	page.UnreadCount = len(unreadNotifications(rctx))
+	// 認証必須のページなので検索避けする。
+	page.NoIndex = true
+	page.CommitURL = commitURL()
+	return renderPage(w, "timeline", page)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+// Mastodon は replies の最初のページを埋め込み、要素を items に入れる。
+// 埋め込みの投稿は同じオリジンのものだけを取りに行かずに使うこと。
+// 取得回数が 0 なら次のページへは行かないこと。
+func TestConversationCollectionItems(t *testing.T) {
+	const origin = "https://a.example/users/alice/statuses/1"
+	self := &activitystream.Object{
+		ID:           "https://a.example/users/alice/statuses/2",
+		Type:         activitystream.NoteType,
+		Content:      "<p>続き</p>",
+		AttributedTo: activitystream.URIRef("https://a.example/users/alice"),
+		InReplyTo:    activitystream.URIRef(origin),
+	}
+	forged := &activitystream.Object{
+		ID:           "https://b.example/users/bob/statuses/3",
+		Type:         activitystream.NoteType,
+		Content:      "<p>なりすまし</p>",
+		AttributedTo: activitystream.URIRef("https://b.example/users/bob"),
+		InReplyTo:    activitystream.URIRef(origin),
+	}
+	replies := &activitystream.Object{
+		Type: "Collection",
+		FirstPage: &activitystream.Object{
+			Type: "CollectionPage",
+			Next: origin + "/replies?page=true",
+			Items: []*activitystream.Ref{
+				activitystream.ObjectRef(self),
+				activitystream.ObjectRef(forged),
+				activitystream.URIRef("https://c.example/notes/4"),
+				activitystream.URIRef("https://c.example/notes/4"),
+			},
+		},
+	}
+	c := newConversation(nil, 0)
+	got := c.collectionItems(t.Context(), activitystream.ObjectRef(replies), origin)
+	want := []string{self.ID, forged.ID, "https://c.example/notes/4"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("collectionItems = %v, want %v", got, want)
+	}
+	if c.notes[self.ID] == nil {
+		t.Error("the same-origin embedded note is not adopted")
+	}
+	if c.notes[forged.ID] != nil {
+		t.Error("a note embedded by another origin is adopted")
+	}
+}
+
+// 返信は深さ優先・古い順に並び、skip した投稿はその下ごと落ちること。
+// inReplyTo が循環していても止まること。
+func TestConversationDescendants(t *testing.T) {
+	c := newConversation(nil, 0)
+	add := func(id, parent, published string) {
+		c.notes[id] = &activitystream.Object{ID: id, InReplyTo: activitystream.URIRef(parent), Published: published}
+	}
+	add("focus", "loop", "2026-01-01T00:00:00Z")
+	add("loop", "focus", "2026-01-01T00:09:00Z")
+	add("b", "focus", "2026-01-01T00:02:00Z")
+	add("a", "focus", "2026-01-01T00:01:00Z")
+	add("a1", "a", "2026-01-01T00:03:00Z")
+	add("muted", "focus", "2026-01-01T00:04:00Z")
+	add("under-muted", "muted", "2026-01-01T00:05:00Z")
+
+	nodes := c.descendants("focus", func(n *activitystream.Object) bool { return n.ID == "muted" })
+	var got []string
+	for _, n := range nodes {
+		got = append(got, fmt.Sprintf("%v:%v", n.note.ID, n.depth))
+	}
+	want := "a:1 a1:2 b:1 loop:1"
+	if strings.Join(got, " ") != want {
+		t.Errorf("descendants = %v, want %v", got, want)
+	}
+}
+
+func TestConversationRoute(t *testing.T) {
+	if h, _, _ := newRouter().Lookup(http.MethodGet, "/thread"); h == nil {
+		t.Error("GET /thread has no handler")
+	}
+}
+
+// 会話ページは timeline のテンプレートで字下げして描く。ページ送りは
+// 出さず、timeline の各投稿には会話へのリンクが出ること。
+func TestConversationPageRenders(t *testing.T) {
+	base := pageBase{Title: "会話", SiteName: "nana", LocalPart: "nana", Handle: "@nana"}
+	page := timelinePage{
+		pageBase:  base,
+		Thread:    true,
+		Page:      1,
+		InReplyTo: "https://a.example/notes/1",
+		Items: []timelineItem{
+			{AuthorName: "alice", Content: "<p>root</p>", ObjectURI: "https://a.example/notes/1", Focus: true},
+			{AuthorName: "bob", Content: "<p>child</p>", ObjectURI: "https://b.example/notes/2", InReplyTo: "https://a.example/notes/1", Depth: 1},
+		},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "timeline", page); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{`class="thread-item depth-0 thread-focus"`, `class="thread-item depth-1"`, `name="in_reply_to" value="https://a.example/notes/1"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("thread page does not contain %q", want)
+		}
+	}
+	if strings.Contains(out, "会話を見る") || strings.Contains(out, "ページ目") {
+		t.Error("thread page shows timeline-only parts")
+	}
+
+	buf.Reset()
+	page.Thread = false
+	page.pageBase.Title = "タイムライン"
+	if err := web.Render(buf, "timeline", page); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `href="/thread?uri=https%3a%2f%2fb.example%2fnotes%2f2"`) {
+		t.Error("timeline does not link replies to the conversation")
+	}
+}
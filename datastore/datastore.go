@@ -3,6 +3,7 @@ package datastore
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 
@@ -16,6 +17,9 @@ import (
 var (
 	// ErrNotFound is key not found err
 	ErrNotFound = dynamo.ErrNotFound
+	// ErrConditionFailed は条件付きの書き込みで、条件が合わずに何も
+	// 書かなかったこと。
+	ErrConditionFailed = errors.New("condition failed")
 )
 
 type Order bool
@@ -47,6 +51,42 @@ type Client interface {
 	QueryKV(ctx context.Context, pk string) ([]*KVItem, error)
 	DeleteKV(ctx context.Context, pk, sk string) error
 	CountKV(ctx context.Context, pk string) (int, error)
+
+	// 以下は条件付きの書き込み。同じ項目を複数の実行が同時に触るときに、
+	// 読んでから書くまでの間に他が書いたものを上書きしないために使う。
+
+	// PutKVIfExists は項目がまだあるときだけ上書きする。無ければ
+	// ErrNotFound。
+	PutKVIfExists(ctx context.Context, item *KVItem) error
+	// PutKVIfAbsent は項目がまだ無いときだけ書く。あれば ErrConditionFailed。
+	PutKVIfAbsent(ctx context.Context, item *KVItem) error
+	// TakeKV は項目を消し、消す前の中身を返す。同時に呼ばれても中身を
+	// 受け取るのは1つだけで、他は ErrNotFound になる。
+	TakeKV(ctx context.Context, pk, sk string) (*KVItem, error)
+	// LeaseKV は項目の LeaseUntil が now 以前 (または無い) なら until に
+	// 書き換える。他が期限内の lease を持っているか、項目が無ければ
+	// ErrConditionFailed。
+	LeaseKV(ctx context.Context, pk, sk string, now, until int64) error
+	// LeasableKV は pk のうち LeaseUntil が now 以前の項目を、LeaseUntil の
+	// 古い順に最大 limit 件返す。LeaseUntil の索引 (kvLeaseIndex) を引く
+	// ので、まだ時刻の来ない項目は読まない。LeaseUntil の無い項目は
+	// 索引に載らず、返らない。
+	LeasableKV(ctx context.Context, pk string, now int64, limit int) ([]*KVItem, error)
+	// UpdateKV は項目の属性だけを u のとおりに書き換える。項目が無ければ
+	// 作る。読んでから PutKV で書き戻すのと違い、同時に書き換えても他の
+	// 変更を消さない。
+	UpdateKV(ctx context.Context, pk, sk string, u KVUpdate) error
+}
+
+// KVUpdate は UpdateKV で項目に施す変更。属性名は KVItem の dynamo タグ。
+// 1つの属性を複数に書かないこと。
+type KVUpdate struct {
+	Set map[string]interface{}
+	// SetIfAbsent は属性がまだ無いときだけ入れる。
+	SetIfAbsent map[string]interface{}
+	// Add は数の属性に足す。無ければ 0 に足す。
+	Add    map[string]int
+	Remove []string
 }
 
 // KV のパーティション。
@@ -76,6 +116,62 @@ const (
 	// KVActorInfo はフォロー関係にない相手の表示名とアイコンのキャッシュ。
 	// いいねやブーストは誰からでも来る。
 	KVActorInfo = "actorinfo"
+	// KVDeliveries は配信待ちの Activity。SK は積んだ順に並ぶようゼロ埋め
+	// したナノ秒と inbox を繋いだもの。1つの (actor, inbox, activity) の
+	// 組を1項目として持ち、届くか期限切れになるまで残る。
+	KVDeliveries = "deliveries"
+	// KVHostHealth は配信先ホストごとの到達状況。SK は inbox の URL の
+	// host 部。同じサーバの inbox と sharedInbox をまとめて1つとして扱う。
+	KVHostHealth = "hosthealth"
+	// KVBlocks / KVDomainBlocks はこちらからのブロック。インスタンス全体で
+	// 共有する。SK はそれぞれ actor の URI とドメイン。KVBlocks の
+	// ActivityID は送った Block の id の元で、ブロック解除の Undo に使う。
+	KVBlocks       = "blocks"
+	KVDomainBlocks = "domainblocks"
+	// KVBlockedBy は相手からのブロック。ブロックされたのはローカル actor
+	// 単位なので actor ごとに持つ。SK は相手の actor の URI。
+	KVBlockedBy = "blockedby"
+	// KVMutes はミュートした actor。SK は actor の URI。期限付きのものは
+	// TTL に期限を入れる (DynamoDB の TTL は消すのが遅れるので、読む側でも
+	// 期限を見る)。KVFilters は本文の語・正規表現によるフィルタで、SK は
+	// 作った時刻から振った id。どちらも表示にだけ効き、連合には関わらない。
+	KVMutes   = "mutes"
+	KVFilters = "filters"
+	// KVReplies は自分の投稿への返信の索引。返信先の投稿の持ち主ごとに
+	// 持ち、SK は返信の URI、InReplyTo に返信先の URI を入れる。SK を返信
+	// の側にしてあるのは、Delete (返信の URI しか来ない) で引かずに消す
+	// ため。公開・未収載の返信だけを入れる。
+	KVReplies = "replies"
+	// KVPins は固定した自分の投稿。actor ごとに持ち、SK は投稿の URI、
+	// At は固定した時刻。固定した順 (新しいものが先) に並べて出す。
+	KVPins = "pins"
+	// KVTags は自分たちの公開の投稿のハッシュタグの索引。タグごとに
+	// "tags#<正規化したタグ>" を PK にし、SK は投稿の URI、TargetActor は
+	// 投稿した actor、At は投稿の published。
+	KVTags = "tags"
+	// KVVotes は自分の投票 (Question) に届いた票。actor ごとに持ち、SK は
+	// 単一選択なら "投票の URI#投票者の URI"、複数選択なら
+	// "投票の URI#投票者の URI#選択肢"。Name は選んだ選択肢、TargetActor は
+	// 投票者。複数選択では1人が複数の項目を持つ。票数はここから数える。
+	KVVotes = "votes"
+	// KVMyVotes は自分がリモートの投票に入れた票。SK は投票の URI、Content
+	// は選んだ選択肢を改行で繋いだもの。
+	KVMyVotes = "myvotes"
+	// KVOpenPolls は締め切りの Update をまだ送っていない自分の投票。actor
+	// ごとに持ち、SK は投票の URI、At は endTime。送ったら消す。
+	KVOpenPolls = "openpolls"
+	// KVLinkCards はリンクのプレビュー (カード) の控え。SK はリンクの URL。
+	// Name は題、Content は説明、IconURL は画像、Summary はサイト名、At は
+	// 引いた時刻。Name が空なら引けなかったことの控え。TTL で消える。
+	KVLinkCards = "linkcards"
+	// KVRemoteNotes は公開のページに出すリモートの投稿の控え。SK は投稿の
+	// URI、Payload は投稿の JSON、At は引いた時刻。Payload が空なら
+	// 引けなかった (または Public 宛てでなかった) ことの控え。TTL で消える。
+	KVRemoteNotes = "remotenotes"
+	// KVScheduled は予約投稿。actor ごとに持ち、SK は控えた時刻から振った
+	// id。Payload は投稿の要求と添付の JSON、At は出す時刻 (RFC3339)。
+	// 出せずに諦めたものは State を failed にし、理由を LastError に残す。
+	KVScheduled = "scheduled"
 )
 
 // KVItem は KV テーブルの1項目。用途ごとに使うフィールドが異なるので
@@ -93,6 +189,9 @@ type KVItem struct {
 	// 構造は実装依存 (Misskey は内部 ID を使うなど) で信用できないため、
 	// 表示用に actor 自身の申告する preferredUsername を別途持つ。
 	PreferredUsername string `dynamo:"preferredUsername,omitempty"`
+	// Emoji はカスタム絵文字 (shortcode から画像の URL)。actor を控える
+	// 項目では表示名の、replies では本文のもの。tag の Emoji から作る。
+	Emoji map[string]string `dynamo:"emoji,omitempty"`
 	// ActivityID は Undo を受けたときに突き合わせる元の Follow の id。
 	ActivityID string `dynamo:"activityID,omitempty"`
 	// State は following で使う。pending か accepted。
@@ -118,6 +217,43 @@ type KVItem struct {
 	TimelineID  int    `dynamo:"timelineID,omitempty"`
 	Content     string `dynamo:"content,omitempty"`
 
+	// deliveries。Payload は配信する Activity の JSON、Sender は署名に
+	// 使うローカル actor の localpart。Attempts は失敗した回数、NextAttempt
+	// は次に送ってよい時刻 (RFC3339)、Deadline はこれを過ぎたら諦める時刻
+	// (RFC3339)。LastError は直近の失敗理由で、調査用に残す。送り先は
+	// Inbox に入れる。
+	Payload     string `dynamo:"payload,omitempty"`
+	Sender      string `dynamo:"sender,omitempty"`
+	Attempts    int    `dynamo:"attempts,omitempty"`
+	NextAttempt string `dynamo:"nextAttempt,omitempty"`
+	Deadline    string `dynamo:"deadline,omitempty"`
+	LastError   string `dynamo:"lastError,omitempty"`
+	// LeaseUntil は worker が job を握っている期限 (Unix 秒)。これを
+	// 過ぎるまで他の worker は同じ job を送らない。書き戻すときは
+	// NextAttempt と同じ時刻にする。
+	LeaseUntil int64 `dynamo:"leaseUntil,omitempty"`
+
+	// hosthealth。Failures は連続して失敗した回数で、1度でも届けば 0 に
+	// 戻る。FailingSince は連続失敗の始まり、LastSuccess は最後に届いた
+	// (2xx が返った) 時刻 (どちらも RFC3339)。4xx は Failures を 0 に戻すが
+	// LastSuccess は進めない。直近の失敗理由は LastError、最後に送ろうと
+	// した時刻は At に入れる。
+	Failures     int    `dynamo:"failures,omitempty"`
+	FailingSince string `dynamo:"failingSince,omitempty"`
+	LastSuccess  string `dynamo:"lastSuccess,omitempty"`
+
+	// filters。Pattern は照合する語か正規表現で、Regex が立っていれば後者。
+	// FilterAction は一致したときの扱い (hide か warn)。
+	Pattern      string `dynamo:"pattern,omitempty"`
+	Regex        bool   `dynamo:"regex,omitempty"`
+	FilterAction string `dynamo:"filterAction,omitempty"`
+
+	// replies。InReplyTo は返信先の投稿の URI、TargetActor は返信の著者。
+	// 本文は Content と Summary (CW) に控え、At に返信の published を
+	// 入れる。
+	InReplyTo string `dynamo:"inReplyTo,omitempty"`
+	Summary   string `dynamo:"summary,omitempty"`
+
 	// TTL は Unix 秒。0 なら期限なし。
 	TTL int64 `dynamo:"ttl,omitempty"`
 }
@@ -157,6 +293,9 @@ type client struct {
 const (
 	kvPartKey = "pk"
 	kvSortKey = "sk"
+	// kvLeaseIndex は KV テーブルの pk と leaseUntil の GSI (template.yml)。
+	// leaseUntil を持つ項目だけが載る。
+	kvLeaseIndex = "pk-leaseUntil-index"
 )
 
 func (c *client) PutKV(ctx context.Context, item *KVItem) error {
@@ -184,6 +323,76 @@ func (c *client) DeleteKV(ctx context.Context, pk, sk string) error {
 	return c.kvTable.Delete(kvPartKey, pk).Range(kvSortKey, sk).Run(ctx)
 }
 
+func (c *client) PutKVIfExists(ctx context.Context, item *KVItem) error {
+	err := c.kvTable.Put(item).If("attribute_exists($)", kvSortKey).Run(ctx)
+	if dynamo.IsCondCheckFailed(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (c *client) PutKVIfAbsent(ctx context.Context, item *KVItem) error {
+	err := c.kvTable.Put(item).If("attribute_not_exists($)", kvSortKey).Run(ctx)
+	if dynamo.IsCondCheckFailed(err) {
+		return ErrConditionFailed
+	}
+	return err
+}
+
+func (c *client) TakeKV(ctx context.Context, pk, sk string) (*KVItem, error) {
+	item := &KVItem{}
+	err := c.kvTable.Delete(kvPartKey, pk).Range(kvSortKey, sk).
+		If("attribute_exists($)", kvSortKey).OldValue(ctx, item)
+	if dynamo.IsCondCheckFailed(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (c *client) LeaseKV(ctx context.Context, pk, sk string, now, until int64) error {
+	err := c.kvTable.Update(kvPartKey, pk).Range(kvSortKey, sk).
+		Set("leaseUntil", until).
+		If("attribute_exists($)", kvSortKey).
+		If("attribute_not_exists('leaseUntil') OR 'leaseUntil' <= ?", now).
+		Run(ctx)
+	if dynamo.IsCondCheckFailed(err) {
+		return ErrConditionFailed
+	}
+	return err
+}
+
+func (c *client) LeasableKV(ctx context.Context, pk string, now int64, limit int) ([]*KVItem, error) {
+	items := []*KVItem{}
+	err := c.kvTable.Get(kvPartKey, pk).Index(kvLeaseIndex).
+		Range("leaseUntil", dynamo.LessOrEqual, now).
+		Limit(limit).
+		All(ctx, &items)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (c *client) UpdateKV(ctx context.Context, pk, sk string, u KVUpdate) error {
+	up := c.kvTable.Update(kvPartKey, pk).Range(kvSortKey, sk)
+	for name, v := range u.Set {
+		up = up.Set(name, v)
+	}
+	for name, v := range u.SetIfAbsent {
+		up = up.SetIfNotExists(name, v)
+	}
+	for name, n := range u.Add {
+		up = up.Add(name, n)
+	}
+	if len(u.Remove) > 0 {
+		up = up.Remove(u.Remove...)
+	}
+	return up.Run(ctx)
+}
+
 // CountKV は項目を持ち帰らずに件数だけ数える。フォロワー数の表示に使う。
 func (c *client) CountKV(ctx context.Context, pk string) (int, error) {
 	n, err := c.kvTable.Get(kvPartKey, pk).Count(ctx)
@@ -38,45 +38,32 @@ func appendToTimelineWithID(ctx context.Context, in *activitystream.Object) (int
 }
 
 // sendToInbox は actor の鍵で署名して1つの inbox に Activity を送る。
+// 結果は送り先ホストの到達状況 (deliveryhealth.go) にも記録する。
 func sendToInbox(ctx context.Context, actor *config.ActorConfig, to string, object *activitystream.Object) error {
 	buf := &bytes.Buffer{}
 	if err := json.NewEncoder(buf).Encode(object); err != nil {
 		return err
 	}
-	resp, err := signerFor(actor).RequestWithSign(ctx, http.MethodPost, to, buf.Bytes())
+	err := postToInbox(ctx, actor, to, buf.Bytes())
+	recordDeliveryResult(ctx, to, err)
 	if err != nil {
-		return fmt.Errorf("post to inbox %v failed: %w", to, err)
-	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-	if resp.StatusCode/100 != 2 {
-		return fmt.Errorf("inbox %v returned %v: %s", to, resp.Status, body)
+		return err
 	}
-	logf("delivered %v to %v (%v)", object.Type, to, resp.Status)
+	logf("delivered %v to %v", object.Type, to)
 	return nil
 }
 
-// sendToActor は actor を引いてその inbox に送る。
-func sendToActor(ctx context.Context, actor *config.ActorConfig, actorURI string, object *activitystream.Object) error {
-	remote, err := fetchActor(ctx, actor, actorURI)
+func postToInbox(ctx context.Context, actor *config.ActorConfig, to string, body []byte) error {
+	resp, err := signerFor(actor).RequestWithSign(ctx, http.MethodPost, to, body)
 	if err != nil {
-		return err
-	}
-	inbox := remote.InboxURI()
-	if inbox == "" {
-		return fmt.Errorf("actor %v advertises no inbox", actorURI)
+		return fmt.Errorf("post to inbox %v failed: %w", to, err)
 	}
-	return sendToInbox(ctx, actor, inbox, object)
-}
-
-// sendAccept は受け取った Activity をそのまま object に入れた Accept を返す。
-// inbox が既に分かっている場合は actor の再取得を省ける。
-func sendAccept(ctx context.Context, actor *config.ActorConfig, in *activitystream.Object, inbox string) error {
-	accept := activitystream.NewAccept(in, actor.ID(), newActivityID("accept"))
-	if inbox != "" {
-		return sendToInbox(ctx, actor, inbox, accept)
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return &inboxStatusError{Inbox: to, StatusCode: resp.StatusCode, Status: resp.Status, Body: string(respBody)}
 	}
-	return sendToActor(ctx, actor, in.Actor.ID(), accept)
+	return nil
 }
 
 // DeliveryError は配信の部分的な失敗をまとめる。1つの宛先が落ちても
@@ -91,13 +78,18 @@ func (e *DeliveryError) Error() string {
 
 // deliver は複数の inbox に同じ Activity を配信する。
 //
-// 1人用インスタンスで宛先が少ないため同期配信する。Lambda の 30 秒に
-// 収まらなくなったら、この関数を SQS 経由の非同期配信に差し替える。
+// その場では送らず、inbox ごとに配信キューへ積むだけにする。以前は同期で
+// 送っており、相手のサーバが一時的に落ちているとその投稿は二度と届かず、
+// 宛先が増えると Lambda の 30 秒に近づいていた。実際の送信とリトライは
+// drainDeliveries (deliveryqueue.go) が行う。ここで返すのは積めなかった
+// 宛先だけである。
+//
+// 何日も届いていないホストの inbox は skipDeadInboxes で外す。
 func deliver(ctx context.Context, actor *config.ActorConfig, inboxes []string, object *activitystream.Object) error {
 	failures := map[string]error{}
-	for _, inbox := range inboxes {
-		if err := sendToInbox(ctx, actor, inbox, object); err != nil {
-			logf("delivery to %v failed: %v", inbox, err)
+	for _, inbox := range skipDeadInboxes(ctx, inboxes) {
+		if err := enqueueDelivery(ctx, actor.LocalPart(), inbox, object); err != nil {
+			logf("enqueueing delivery to %v failed: %v", inbox, err)
 			failures[inbox] = err
 		}
 	}
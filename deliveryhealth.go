@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/httperror"
+)
+
+// 配信先ホストの死活判定。何か月も前に消えたサーバのフォロワーが残って
+// いると、投稿のたびにそこへの配信が失敗し続ける。
+const (
+	// deadHostAfter 連続で失敗し続けたホストには一時的に送らない。
+	deadHostAfter = 3 * 24 * time.Hour
+	// deadHostProbeInterval 送らなくなったホストにも、この間隔で1度だけ
+	// 送ってみる。戻ってきていればそこで通常に戻る。
+	deadHostProbeInterval = 24 * time.Hour
+)
+
+// inboxStatusError は inbox が 2xx 以外を返したことを表す。相手のサーバに
+// は届いているので、接続できなかった場合とは扱いを分ける。
+type inboxStatusError struct {
+	Inbox      string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *inboxStatusError) Error() string {
+	return fmt.Sprintf("inbox %v returned %v: %s", e.Inbox, e.Status, e.Body)
+}
+
+// hostUnreachable は err がホスト自体の不調 (接続できない・5xx) によるものか
+// を返す。4xx は相手のサーバが生きていて、この Activity を受け取らなかった
+// だけなので数えない。
+func hostUnreachable(err error) bool {
+	var se *inboxStatusError
+	if errors.As(err, &se) {
+		return se.StatusCode/100 == 5
+	}
+	return true
+}
+
+// permanentDeliveryError は送り直しても結果が変わらない失敗かを返す。
+// 410 Gone や署名の拒否を1日叩き続けても意味が無い。408 と 429 は
+// 時間を置けば通る見込みがあるので再試行する。
+func permanentDeliveryError(err error) bool {
+	var se *inboxStatusError
+	if !errors.As(err, &se) || se.StatusCode/100 != 4 {
+		return false
+	}
+	return se.StatusCode != http.StatusRequestTimeout && se.StatusCode != http.StatusTooManyRequests
+}
+
+// hostHealth は1つの配信先ホストの到達状況。
+type hostHealth struct {
+	Host         string
+	Failures     int
+	FailingSince time.Time
+	LastSuccess  time.Time
+	LastAttempt  time.Time
+	LastError    string
+}
+
+// dead は deadHostAfter 以上失敗し続けているかを返す。
+func (h *hostHealth) dead(now time.Time) bool {
+	return h.Failures > 0 && !h.FailingSince.IsZero() && now.Sub(h.FailingSince) >= deadHostAfter
+}
+
+// suppressed は今このホストへの配信を見送るべきかを返す。死んでいても
+// 前回の試行から deadHostProbeInterval 経っていれば送ってみる。
+func (h *hostHealth) suppressed(now time.Time) bool {
+	return h.dead(now) && now.Sub(h.LastAttempt) < deadHostProbeInterval
+}
+
+// recordResult は1回の送信の結果を反映する。sendErr が nil なら届いた。
+//
+// 返すのは同じ変更を KV の項目に施す UpdateKV の中身。配信 worker と
+// HTTP を受ける Function が同じホストの結果を同時に書くので、読んで
+// 書き戻すと互いの失敗の数や時刻を消してしまう。失敗の数は足し、
+// 失敗の始まりは無いときだけ入れる。
+func (h *hostHealth) recordResult(now time.Time, sendErr error) datastore.KVUpdate {
+	switch {
+	case sendErr == nil:
+		return h.recordSuccess(now)
+	case hostUnreachable(sendErr):
+		return h.recordFailure(now, sendErr)
+	default:
+		return h.recordReachable(now, sendErr)
+	}
+}
+
+func (h *hostHealth) recordSuccess(now time.Time) datastore.KVUpdate {
+	h.Failures = 0
+	h.FailingSince = time.Time{}
+	h.LastSuccess = now
+	h.LastAttempt = now
+	at := formatOptionalTime(now)
+	return datastore.KVUpdate{
+		Set:    map[string]interface{}{"failures": 0, "lastSuccess": at, "at": at},
+		Remove: []string{"failingSince"},
+	}
+}
+
+// recordReachable は相手のサーバが応えたが受け取らなかった (4xx) ことを
+// 記録する。ホストは生きているので失敗は数え直すが、届いてはいないので
+// LastSuccess は進めない。署名を拒み続けるホストが「最終到達」を毎回
+// 更新して、届いているように見えてしまうため。
+func (h *hostHealth) recordReachable(now time.Time, sendErr error) datastore.KVUpdate {
+	h.Failures = 0
+	h.FailingSince = time.Time{}
+	h.LastAttempt = now
+	h.LastError = sendErr.Error()
+	return datastore.KVUpdate{
+		Set:    map[string]interface{}{"failures": 0, "at": formatOptionalTime(now), "lastError": h.LastError},
+		Remove: []string{"failingSince"},
+	}
+}
+
+func (h *hostHealth) recordFailure(now time.Time, err error) datastore.KVUpdate {
+	if h.Failures == 0 {
+		h.FailingSince = now
+	}
+	h.Failures++
+	h.LastAttempt = now
+	h.LastError = err.Error()
+	// failingSince は失敗が 0 に戻るときに消すので、無ければ連続失敗の
+	// 始まりである。
+	return datastore.KVUpdate{
+		Set:         map[string]interface{}{"at": formatOptionalTime(now), "lastError": h.LastError},
+		SetIfAbsent: map[string]interface{}{"failingSince": formatOptionalTime(now)},
+		Add:         map[string]int{"failures": 1},
+	}
+}
+
+func hostHealthFromItem(it *datastore.KVItem) *hostHealth {
+	return &hostHealth{
+		Host:         it.SK,
+		Failures:     it.Failures,
+		FailingSince: parseOptionalTime(it.FailingSince),
+		LastSuccess:  parseOptionalTime(it.LastSuccess),
+		LastAttempt:  parseOptionalTime(it.At),
+		LastError:    it.LastError,
+	}
+}
+
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// parseOptionalTime は空や壊れた値をゼロ値として読む。死活の記録は
+// 失っても次の配信で作り直されるので、読めなくても止めない。
+func parseOptionalTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// loadHostHealth は記録のある全ホストの状況を host をキーにして返す。
+func loadHostHealth(ctx context.Context) (map[string]*hostHealth, error) {
+	items, err := client.QueryKV(ctx, datastore.KVHostHealth)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]*hostHealth, len(items))
+	for _, it := range items {
+		m[it.SK] = hostHealthFromItem(it)
+	}
+	return m, nil
+}
+
+// recordDeliveryResult は inbox への送信結果をホストの状況に反映する。
+// 記録できなくても配信そのものの成否は変わらないので、ログに残すだけに
+// する。
+func recordDeliveryResult(ctx context.Context, inbox string, sendErr error) {
+	host := hostOf(inbox)
+	if host == "" {
+		return
+	}
+	h := &hostHealth{Host: host}
+	if err := client.UpdateKV(ctx, datastore.KVHostHealth, host, h.recordResult(time.Now(), sendErr)); err != nil {
+		logf("recording the health of %v failed: %v", host, err)
+	}
+}
+
+// skipDeadInboxes は inboxes から死んでいるホストのものを除く。見送らずに
+// 様子見で送るホストには試行時刻を先に付けておき、続く投稿が同じホストに
+// 何度も様子見を積まないようにする。
+//
+// 状況を読めなかったときはすべて返す。送りすぎる方が、届かないより良い。
+func skipDeadInboxes(ctx context.Context, inboxes []string) []string {
+	health, err := loadHostHealth(ctx)
+	if err != nil {
+		logf("reading host health failed, delivering to every inbox: %v", err)
+		return inboxes
+	}
+	now := time.Now()
+	probed := map[string]bool{}
+	alive := make([]string, 0, len(inboxes))
+	for _, inbox := range inboxes {
+		h, ok := health[hostOf(inbox)]
+		if !ok || !h.dead(now) {
+			alive = append(alive, inbox)
+			continue
+		}
+		if probed[h.Host] {
+			alive = append(alive, inbox)
+			continue
+		}
+		if h.suppressed(now) {
+			continue
+		}
+		probed[h.Host] = true
+		h.LastAttempt = now
+		// 試行時刻だけを書く。項目を丸ごと書き戻すと、その間に記録された
+		// 送信の結果を消す。
+		probe := datastore.KVUpdate{Set: map[string]interface{}{"at": formatOptionalTime(now)}}
+		if err := client.UpdateKV(ctx, datastore.KVHostHealth, h.Host, probe); err != nil {
+			logf("recording a probe to %v failed: %v", h.Host, err)
+		}
+		logf("probing %v, unreachable since %v", h.Host, h.FailingSince.Format(time.RFC3339))
+		alive = append(alive, inbox)
+	}
+	return alive
+}
+
+// --- /admin/deliveries --------------------------------------------------
+
+// 配信先の状態。テンプレートで表示を分けるために使う。
+const (
+	hostStateOK      = "ok"
+	hostStateFailing = "failing"
+	hostStateDead    = "dead"
+	// hostStateUnknown はフォロワーはいるがまだ1度も送っていないホスト。
+	hostStateUnknown = "unknown"
+)
+
+type adminDeliveriesPage struct {
+	pageBase
+	Hosts []deliveryHostItem
+	// Dead / Failing は見出しに出す件数。
+	Dead    int
+	Failing int
+}
+
+type deliveryHostItem struct {
+	Host         string
+	State        string
+	Failures     int
+	FailingSince string
+	LastSuccess  string
+	LastAttempt  string
+	LastError    string
+	// Followers はこのホストにいる全ローカル actor のフォロワーの acct。
+	Followers []string
+}
+
+// hostStateRank は一覧の並び順。届いていないものを上に出す。
+var hostStateRank = map[string]int{hostStateDead: 0, hostStateFailing: 1, hostStateUnknown: 2, hostStateOK: 3}
+
+// adminDeliveriesHandler は配信先ホストごとの到達状況を一覧にする。どの
+// フォロワーに実際に届いているかを確かめるためのもの。
+func adminDeliveriesHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	health, err := loadHostHealth(ctx)
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot read the host health", err)
+	}
+	followers := map[string][]string{}
+	for _, actor := range Config.Actors {
+		items, err := client.QueryKV(ctx, actorScoped(actor, datastore.KVFollowers))
+		if err != nil {
+			return httperror.StatusInternalServerError("cannot list the followers", err)
+		}
+		for _, it := range items {
+			if it.State != datastore.FollowStateAccepted {
+				continue
+			}
+			target := it.SharedInbox
+			if target == "" {
+				target = it.Inbox
+			}
+			host := hostOf(target)
+			followers[host] = append(followers[host], acctFromItem(it, it.SK))
+		}
+	}
+
+	page := adminDeliveriesPage{pageBase: newPageBase(r, "配信先の状況")}
+	page.NoIndex = true
+	now := time.Now()
+	for host, h := range health {
+		item := deliveryHostItem{
+			Host:         host,
+			State:        hostStateOK,
+			Failures:     h.Failures,
+			FailingSince: formatOptionalTime(h.FailingSince),
+			LastSuccess:  formatOptionalTime(h.LastSuccess),
+			LastAttempt:  formatOptionalTime(h.LastAttempt),
+			LastError:    h.LastError,
+			Followers:    followers[host],
+		}
+		switch {
+		case h.dead(now):
+			item.State = hostStateDead
+			page.Dead++
+		case h.Failures > 0:
+			item.State = hostStateFailing
+			page.Failing++
+		}
+		page.Hosts = append(page.Hosts, item)
+	}
+	for host, accts := range followers {
+		if _, ok := health[host]; ok || host == "" {
+			continue
+		}
+		page.Hosts = append(page.Hosts, deliveryHostItem{Host: host, State: hostStateUnknown, Followers: accts})
+	}
+	sort.Slice(page.Hosts, func(i, j int) bool {
+		a, b := page.Hosts[i], page.Hosts[j]
+		if hostStateRank[a.State] != hostStateRank[b.State] {
+			return hostStateRank[a.State] < hostStateRank[b.State]
+		}
+		return a.Host < b.Host
+	})
+	return renderPage(w, "admin_deliveries", page)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+func TestHostHealthGoesDeadAndIsProbed(t *testing.T) {
+	start := time.Now()
+	h := &hostHealth{Host: "gone.example"}
+	h.recordFailure(start, errors.New("connection refused"))
+	h.recordFailure(start.Add(time.Hour), errors.New("connection refused"))
+	if h.Failures != 2 || !h.FailingSince.Equal(start) {
+		t.Fatalf("Failures = %d, FailingSince = %v; want 2 and %v", h.Failures, h.FailingSince, start)
+	}
+	if h.dead(start.Add(deadHostAfter - time.Minute)) {
+		t.Errorf("dead before deadHostAfter has passed")
+	}
+
+	now := start.Add(deadHostAfter)
+	h.recordFailure(now, errors.New("connection refused"))
+	if !h.dead(now) || !h.suppressed(now.Add(time.Minute)) {
+		t.Errorf("dead = %v, suppressed = %v; want both", h.dead(now), h.suppressed(now.Add(time.Minute)))
+	}
+	// 前回の試行から deadHostProbeInterval 経てば様子見で送る。
+	if h.suppressed(now.Add(deadHostProbeInterval)) {
+		t.Errorf("still suppressed after deadHostProbeInterval")
+	}
+
+	h.recordSuccess(now.Add(deadHostProbeInterval))
+	if h.Failures != 0 || !h.FailingSince.IsZero() || h.dead(now.Add(deadHostProbeInterval)) {
+		t.Errorf("not recovered after a success: %+v", h)
+	}
+}
+
+// 4xx はホストが生きている印だが、届いたわけではない。失敗の数は
+// 戻すが、最終到達は進めないこと。
+func TestHostHealthRecordsRejectionAsReachable(t *testing.T) {
+	start := time.Now()
+	h := &hostHealth{Host: "strict.example"}
+	h.recordResult(start, nil)
+	h.recordResult(start.Add(time.Hour), errors.New("connection refused"))
+	rejected := start.Add(2 * time.Hour)
+	h.recordResult(rejected, &inboxStatusError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"})
+	if h.Failures != 0 || !h.FailingSince.IsZero() {
+		t.Errorf("a 4xx was counted as a failure: %+v", h)
+	}
+	if !h.LastSuccess.Equal(start) || !h.LastAttempt.Equal(rejected) || !strings.Contains(h.LastError, "401") {
+		t.Errorf("after a 4xx = %+v, want LastSuccess %v and LastAttempt %v", h, start, rejected)
+	}
+}
+
+func TestHostHealthFromItem(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	want := &hostHealth{Host: "a.example", Failures: 4, FailingSince: now.Add(-time.Hour),
+		LastSuccess: now.Add(-2 * time.Hour), LastAttempt: now, LastError: "503"}
+	got := hostHealthFromItem(&datastore.KVItem{
+		PK: datastore.KVHostHealth, SK: "a.example", Failures: 4,
+		FailingSince: formatOptionalTime(want.FailingSince), LastSuccess: formatOptionalTime(want.LastSuccess),
+		At: formatOptionalTime(now), LastError: "503",
+	})
+	if *got != *want {
+		t.Errorf("hostHealthFromItem = %+v, want %+v", got, want)
+	}
+}
+
+// 送信の結果は読まずに書ける形にすること。失敗の数は足し、失敗の
+// 始まりは無いときだけ入れる。同時に書いても互いの結果を消さない。
+func TestHostHealthResultUpdates(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	at := formatOptionalTime(now)
+
+	failure := (&hostHealth{}).recordResult(now, errors.New("connection refused"))
+	if failure.Add["failures"] != 1 || failure.SetIfAbsent["failingSince"] != at || failure.Set["failures"] != nil ||
+		failure.Set["at"] != at || failure.Set["lastError"] != "connection refused" {
+		t.Errorf("failure = %+v", failure)
+	}
+	// 既に失敗していても同じ変更になる (読んだ値に依らない)。
+	again := (&hostHealth{Failures: 3, FailingSince: now.Add(-time.Hour)}).recordResult(now, errors.New("connection refused"))
+	if again.Add["failures"] != 1 || again.SetIfAbsent["failingSince"] != at {
+		t.Errorf("second failure = %+v", again)
+	}
+
+	success := (&hostHealth{}).recordResult(now, nil)
+	if success.Set["failures"] != 0 || success.Set["lastSuccess"] != at || len(success.Remove) != 1 || success.Remove[0] != "failingSince" {
+		t.Errorf("success = %+v", success)
+	}
+	rejected := (&hostHealth{}).recordResult(now, &inboxStatusError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"})
+	if rejected.Set["failures"] != 0 || rejected.Set["lastSuccess"] != nil || len(rejected.Remove) != 1 {
+		t.Errorf("rejected = %+v", rejected)
+	}
+}
+
+func TestDeliveryErrorClassification(t *testing.T) {
+	for _, tt := range []struct {
+		err         error
+		unreachable bool
+		permanent   bool
+	}{
+		{errors.New("dial tcp: connection refused"), true, false},
+		{&inboxStatusError{StatusCode: http.StatusBadGateway}, true, false},
+		{&inboxStatusError{StatusCode: http.StatusGone}, false, true},
+		{&inboxStatusError{StatusCode: http.StatusUnauthorized}, false, true},
+		{&inboxStatusError{StatusCode: http.StatusTooManyRequests}, false, false},
+		{&inboxStatusError{StatusCode: http.StatusRequestTimeout}, false, false},
+	} {
+		if got := hostUnreachable(tt.err); got != tt.unreachable {
+			t.Errorf("hostUnreachable(%v) = %v, want %v", tt.err, got, tt.unreachable)
+		}
+		if got := permanentDeliveryError(tt.err); got != tt.permanent {
+			t.Errorf("permanentDeliveryError(%v) = %v, want %v", tt.err, got, tt.permanent)
+		}
+	}
+}
+
+func TestAdminDeliveriesPageRenders(t *testing.T) {
+	page := adminDeliveriesPage{
+		pageBase: pageBase{Title: "配信先の状況", SiteName: "s", LocalPart: "nana", Handle: "@nana", Authed: true},
+		Hosts: []deliveryHostItem{
+			{Host: "gone.example", State: hostStateDead, Failures: 30, FailingSince: "2026-01-01T00:00:00Z",
+				LastAttempt: "2026-01-05T00:00:00Z", LastError: "connection refused", Followers: []string{"@a@gone.example"}},
+			{Host: "flaky.example", State: hostStateFailing, Failures: 2, LastError: "503"},
+			{Host: "new.example", State: hostStateUnknown, Followers: []string{"@b@new.example", "@c@new.example"}},
+			{Host: "ok.example", State: hostStateOK, LastSuccess: "2026-01-05T00:00:00Z"},
+		},
+		Dead: 1, Failing: 1,
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "admin_deliveries", page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"停止中", "2 回連続", "未配信", "@b@new.example, @c@new.example", "connection refused"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("page does not contain %q", want)
+		}
+	}
+}
+
+func TestAdminDeliveriesRoute(t *testing.T) {
+	if h, _, _ := newRouter().Lookup(http.MethodGet, "/admin/deliveries"); h == nil {
+		t.Errorf("GET /admin/deliveries has no handler")
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/datastore"
+)
+
+// 配信のリトライ間隔と打ち切り。最初は早めに、失敗が続くほど間を空ける。
+// 相手のサーバが数時間落ちていても届くよう、期限は1日取る。
+const (
+	deliveryInitialBackoff = time.Minute
+	deliveryMaxBackoff     = 2 * time.Hour
+	deliveryDeadline       = 24 * time.Hour
+	// deliveryAttemptTimeout は1件の送信に掛けてよい時間。応答しない
+	// サーバ1つで worker の実行時間を使い切らないようにする。
+	deliveryAttemptTimeout = 10 * time.Second
+	// deliveryBatchSize は worker が1回の起動で送る件数の上限。
+	deliveryBatchSize = 50
+	// deliveryLease は送る前に job を握る時間。1件を送って書き戻すまでに
+	// 足りればよいので、deliveryAttemptTimeout に余裕を持たせた長さにする。
+	// worker が途中で止まっても、これを過ぎれば次の起動が送り直す。
+	deliveryLease = time.Minute
+)
+
+// deliveryJob は配信待ちの1件。どの actor の鍵で、どの inbox に、何を
+// 送るかを持つ。
+type deliveryJob struct {
+	ID string
+	// Sender は署名に使うローカル actor の localpart。*config.ActorConfig を
+	// そのまま持たないのは、永続化して別の起動から読み戻すため。
+	Sender      string
+	Inbox       string
+	Activity    *activitystream.Object
+	Attempts    int
+	NextAttempt time.Time
+	Deadline    time.Time
+	LastError   string
+}
+
+// deliveryQueue は配信待ちの置き場。本番は DynamoDB (kvDeliveryQueue)、
+// make dev ではプロセス内のメモリ (memoryDeliveryQueue) を使う。
+type deliveryQueue interface {
+	Enqueue(ctx context.Context, job *deliveryJob) error
+	// Due は now の時点で送ってよいものを、送ってよくなった時刻の古い順に
+	// 最大 limit 件返す。
+	Due(ctx context.Context, now time.Time, limit int) ([]*deliveryJob, error)
+	// Reschedule は失敗した job の試行回数・次回時刻・失敗理由を書き戻す。
+	Reschedule(ctx context.Context, job *deliveryJob) error
+	Remove(ctx context.Context, id string) error
+	// Claim は送る直前に job を deliveryLease の間握る。起動が重なって
+	// 同じ job を2つの worker が Due で拾っても、送るのは Claim できた
+	// 方だけにする。他が握っていれば (または送り終えて消えていれば)
+	// false を返す。
+	Claim(ctx context.Context, id string, now time.Time) (bool, error)
+}
+
+// deliveries は配信キュー。setup で環境に応じたものを入れる。
+var deliveries deliveryQueue
+
+// newDeliveryJob は今すぐ送ってよい job を作る。
+func newDeliveryJob(sender string, inbox string, object *activitystream.Object, now time.Time) *deliveryJob {
+	return &deliveryJob{
+		// 同じ Activity を複数の inbox に積むので、時刻だけでは一意に
+		// ならない。inbox を足す。
+		ID:          fmt.Sprintf("%020d#%s", now.UnixNano(), inbox),
+		Sender:      sender,
+		Inbox:       inbox,
+		Activity:    object,
+		NextAttempt: now,
+		Deadline:    now.Add(deliveryDeadline),
+	}
+}
+
+// deliveryBackoff は attempts 回失敗した後に待つ時間。1分から倍々に
+// 伸ばし、deliveryMaxBackoff で頭打ちにする。
+func deliveryBackoff(attempts int) time.Duration {
+	d := deliveryInitialBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= deliveryMaxBackoff {
+			return deliveryMaxBackoff
+		}
+	}
+	return d
+}
+
+// enqueueDelivery は1つの inbox への配信を積む。実際に送るのは
+// drainDeliveries である。
+func enqueueDelivery(ctx context.Context, sender string, inbox string, object *activitystream.Object) error {
+	return deliveries.Enqueue(ctx, newDeliveryJob(sender, inbox, object, time.Now()))
+}
+
+// drainDeliveries は送ってよいものを順に送る。届いたもの、期限を過ぎた
+// もの、相手が受け取りを拒んだもの (4xx) はキューから外し、それ以外は
+// 間を空けて再試行させる。
+//
+// 1件の失敗で全体を止めない。返すのはキュー自体を読めなかったときだけ。
+func drainDeliveries(ctx context.Context, q deliveryQueue, now time.Time) error {
+	jobs, err := q.Due(ctx, now, deliveryBatchSize)
+	if err != nil {
+		return fmt.Errorf("cannot list pending deliveries: %w", err)
+	}
+	for _, job := range jobs {
+		if !hasTimeForAnotherAttempt(ctx) {
+			// 残りは次の起動に回す。
+			return nil
+		}
+		claimed, err := q.Claim(ctx, job.ID, time.Now())
+		if err != nil {
+			logf("claiming delivery job %v failed: %v", job.ID, err)
+			continue
+		}
+		if !claimed {
+			// 重なって起動した別の worker が送っている。
+			continue
+		}
+		sendErr := attemptDelivery(ctx, job)
+		if sendErr == nil {
+			if err := q.Remove(ctx, job.ID); err != nil {
+				logf("removing delivered job %v failed: %v", job.ID, err)
+			}
+			continue
+		}
+		job.Attempts++
+		job.LastError = sendErr.Error()
+		job.NextAttempt = now.Add(deliveryBackoff(job.Attempts))
+		if permanentDeliveryError(sendErr) || job.NextAttempt.After(job.Deadline) {
+			logf("giving up delivering %v to %v after %d attempts: %v",
+				job.Activity.Type, job.Inbox, job.Attempts, sendErr)
+			if err := q.Remove(ctx, job.ID); err != nil {
+				logf("removing expired job %v failed: %v", job.ID, err)
+			}
+			continue
+		}
+		logf("delivery of %v to %v failed (attempt %d), retrying at %v: %v",
+			job.Activity.Type, job.Inbox, job.Attempts, job.NextAttempt.Format(time.RFC3339), sendErr)
+		if err := q.Reschedule(ctx, job); err != nil {
+			logf("rescheduling job %v failed: %v", job.ID, err)
+		}
+	}
+	return nil
+}
+
+// hasTimeForAnotherAttempt は Lambda の残り時間で1件送り切れるかを返す。
+// 送信の途中で実行環境ごと止められると、届いたかどうか分からないまま
+// job が残る。
+func hasTimeForAnotherAttempt(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > deliveryAttemptTimeout
+}
+
+func attemptDelivery(ctx context.Context, job *deliveryJob) error {
+	actor, ok := Config.ActorByLocalPart(job.Sender)
+	if !ok {
+		// 設定から actor を消した後に残った job。二度と送れない。
+		return fmt.Errorf("no such local actor %q", job.Sender)
+	}
+	ctx, cancel := context.WithTimeout(ctx, deliveryAttemptTimeout)
+	defer cancel()
+	return sendToInbox(ctx, actor, job.Inbox, job.Activity)
+}
+
+// --- メモリ上のキュー (make dev 用) ------------------------------------
+
+// memoryDeliveryQueue はプロセス内だけのキュー。再起動で消えるので本番では
+// 使わない。dev サーバは自分で定期的に drainDeliveries を呼ぶ
+// (runDeliveryWorkerLoop)。
+type memoryDeliveryQueue struct {
+	mu     sync.Mutex
+	jobs   map[string]*deliveryJob
+	leases map[string]time.Time
+}
+
+func newMemoryDeliveryQueue() *memoryDeliveryQueue {
+	return &memoryDeliveryQueue{jobs: map[string]*deliveryJob{}, leases: map[string]time.Time{}}
+}
+
+func (q *memoryDeliveryQueue) Enqueue(ctx context.Context, job *deliveryJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j := *job
+	q.jobs[j.ID] = &j
+	// 次に送ってよい時刻までは握られているのと同じに扱う。
+	// kvDeliveryQueue の LeaseUntil と合わせる。
+	q.leases[j.ID] = j.NextAttempt
+	return nil
+}
+
+func (q *memoryDeliveryQueue) Due(ctx context.Context, now time.Time, limit int) ([]*deliveryJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	due := make([]*deliveryJob, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		if j.NextAttempt.After(now) {
+			continue
+		}
+		c := *j
+		due = append(due, &c)
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttempt.Equal(due[j].NextAttempt) {
+			return due[i].NextAttempt.Before(due[j].NextAttempt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+func (q *memoryDeliveryQueue) Reschedule(ctx context.Context, job *deliveryJob) error {
+	return q.Enqueue(ctx, job)
+}
+
+func (q *memoryDeliveryQueue) Remove(ctx context.Context, id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.jobs, id)
+	delete(q.leases, id)
+	return nil
+}
+
+func (q *memoryDeliveryQueue) Claim(ctx context.Context, id string, now time.Time) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.jobs[id]; !ok {
+		return false, nil
+	}
+	if until, ok := q.leases[id]; ok && until.After(now) {
+		return false, nil
+	}
+	q.leases[id] = now.Add(deliveryLease)
+	return true, nil
+}
+
+// --- DynamoDB 上のキュー (本番用) --------------------------------------
+
+// kvDeliveryQueue は KV テーブルの KVDeliveries パーティションに job を
+// 持つ。Due は LeaseUntil の索引を引き、時刻の来た job だけを読む。
+// LeaseUntil は積んだときと書き戻したときに NextAttempt にするので、
+// 落ちているサーバ宛てに溜まった job を毎回読み直さずに済む。
+type kvDeliveryQueue struct {
+	client datastore.Client
+}
+
+func (q *kvDeliveryQueue) Enqueue(ctx context.Context, job *deliveryJob) error {
+	item, err := deliveryJobToItem(job)
+	if err != nil {
+		return err
+	}
+	return q.client.PutKV(ctx, item)
+}
+
+func (q *kvDeliveryQueue) Due(ctx context.Context, now time.Time, limit int) ([]*deliveryJob, error) {
+	// 誰かが握っている job も LeaseUntil が先なので返らない。
+	items, err := q.client.LeasableKV(ctx, datastore.KVDeliveries, now.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	due := make([]*deliveryJob, 0, len(items))
+	for _, it := range items {
+		job, err := deliveryJobFromItem(it)
+		if err != nil {
+			logf("dropping broken delivery job %v: %v", it.SK, err)
+			if err := q.client.DeleteKV(ctx, datastore.KVDeliveries, it.SK); err != nil {
+				logf("removing broken delivery job %v failed: %v", it.SK, err)
+			}
+			continue
+		}
+		if job.NextAttempt.After(now) {
+			continue
+		}
+		due = append(due, job)
+	}
+	return due, nil
+}
+
+func (q *kvDeliveryQueue) Reschedule(ctx context.Context, job *deliveryJob) error {
+	return q.Enqueue(ctx, job)
+}
+
+func (q *kvDeliveryQueue) Remove(ctx context.Context, id string) error {
+	return q.client.DeleteKV(ctx, datastore.KVDeliveries, id)
+}
+
+// Claim は項目の LeaseUntil を条件付きで書き換える。LeaseUntil は積んだ
+// ときと書き戻したときに NextAttempt にしておくので、別の worker が先に
+// 送って Reschedule した job も、次の時刻までは Claim できない。
+func (q *kvDeliveryQueue) Claim(ctx context.Context, id string, now time.Time) (bool, error) {
+	err := q.client.LeaseKV(ctx, datastore.KVDeliveries, id, now.Unix(), now.Add(deliveryLease).Unix())
+	if errors.Is(err, datastore.ErrConditionFailed) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func deliveryJobToItem(job *deliveryJob) (*datastore.KVItem, error) {
+	payload, err := json.Marshal(job.Activity)
+	if err != nil {
+		return nil, err
+	}
+	return &datastore.KVItem{
+		PK:          datastore.KVDeliveries,
+		SK:          job.ID,
+		Inbox:       job.Inbox,
+		Payload:     string(payload),
+		Sender:      job.Sender,
+		Attempts:    job.Attempts,
+		NextAttempt: job.NextAttempt.UTC().Format(time.RFC3339),
+		Deadline:    job.Deadline.UTC().Format(time.RFC3339),
+		LastError:   job.LastError,
+		LeaseUntil:  job.NextAttempt.Unix(),
+		At:          nowRFC3339(),
+		// worker が止まっていても、期限を大きく過ぎたものは DynamoDB が
+		// 消す。
+		TTL: job.Deadline.Add(deliveryDeadline).Unix(),
+	}, nil
+}
+
+func deliveryJobFromItem(it *datastore.KVItem) (*deliveryJob, error) {
+	obj := &activitystream.Object{}
+	if err := json.Unmarshal([]byte(it.Payload), obj); err != nil {
+		return nil, err
+	}
+	next, err := time.Parse(time.RFC3339, it.NextAttempt)
+	if err != nil {
+		return nil, fmt.Errorf("bad nextAttempt: %w", err)
+	}
+	deadline, err := time.Parse(time.RFC3339, it.Deadline)
+	if err != nil {
+		return nil, fmt.Errorf("bad deadline: %w", err)
+	}
+	return &deliveryJob{
+		ID:          it.SK,
+		Sender:      it.Sender,
+		Inbox:       it.Inbox,
+		Activity:    obj,
+		Attempts:    it.Attempts,
+		NextAttempt: next,
+		Deadline:    deadline,
+		LastError:   it.LastError,
+	}, nil
+}
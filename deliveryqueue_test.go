@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/datastore"
+)
+
+func TestDeliveryBackoff(t *testing.T) {
+	for _, tt := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{7, 64 * time.Minute},
+		{8, deliveryMaxBackoff},
+		{100, deliveryMaxBackoff},
+	} {
+		if got := deliveryBackoff(tt.attempts); got != tt.want {
+			t.Errorf("deliveryBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// 同じ Activity を複数の inbox に積んでも job の id が衝突しないこと。
+func TestNewDeliveryJobIDsAreDistinctPerInbox(t *testing.T) {
+	now := time.Now()
+	act := &activitystream.Object{Type: activitystream.CreateType}
+	a := newDeliveryJob("nana", "https://a.example/inbox", act, now)
+	b := newDeliveryJob("nana", "https://b.example/inbox", act, now)
+	if a.ID == b.ID {
+		t.Errorf("job ids collide: %v", a.ID)
+	}
+	if !a.Deadline.Equal(now.Add(deliveryDeadline)) {
+		t.Errorf("Deadline = %v, want %v", a.Deadline, now.Add(deliveryDeadline))
+	}
+}
+
+func TestMemoryDeliveryQueueDue(t *testing.T) {
+	ctx := context.Background()
+	q := newMemoryDeliveryQueue()
+	now := time.Now()
+	act := &activitystream.Object{Type: activitystream.CreateType}
+
+	older := newDeliveryJob("nana", "https://a.example/inbox", act, now.Add(-2*time.Minute))
+	newer := newDeliveryJob("nana", "https://b.example/inbox", act, now.Add(-time.Minute))
+	later := newDeliveryJob("nana", "https://c.example/inbox", act, now)
+	later.NextAttempt = now.Add(time.Hour)
+	for _, j := range []*deliveryJob{newer, later, older} {
+		if err := q.Enqueue(ctx, j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	due, err := q.Due(ctx, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 2 || due[0].ID != older.ID || due[1].ID != newer.ID {
+		t.Fatalf("Due = %v, want [%v %v]", jobIDs(due), older.ID, newer.ID)
+	}
+
+	due, _ = q.Due(ctx, now, 1)
+	if len(due) != 1 || due[0].ID != older.ID {
+		t.Errorf("Due with limit 1 = %v, want [%v]", jobIDs(due), older.ID)
+	}
+
+	if err := q.Remove(ctx, older.ID); err != nil {
+		t.Fatal(err)
+	}
+	due, _ = q.Due(ctx, now.Add(2*time.Hour), 10)
+	if len(due) != 2 {
+		t.Errorf("Due after Remove = %v, want 2 jobs", jobIDs(due))
+	}
+}
+
+// 起動が重なっても、同じ job を握れるのは1つだけ。握った側が送れずに
+// 書き戻した job も、次の時刻までは握れない。
+func TestMemoryDeliveryQueueClaim(t *testing.T) {
+	ctx := context.Background()
+	q := newMemoryDeliveryQueue()
+	now := time.Now()
+	job := newDeliveryJob("nana", "https://a.example/inbox", &activitystream.Object{Type: activitystream.CreateType}, now)
+	if err := q.Enqueue(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := q.Claim(ctx, job.ID, now); !ok {
+		t.Fatal("a due job could not be claimed")
+	}
+	if ok, _ := q.Claim(ctx, job.ID, now.Add(time.Second)); ok {
+		t.Error("a claimed job was claimed again")
+	}
+	if ok, _ := q.Claim(ctx, job.ID, now.Add(deliveryLease)); !ok {
+		t.Error("an expired lease was not taken over")
+	}
+
+	job.NextAttempt = now.Add(time.Hour)
+	if err := q.Reschedule(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := q.Claim(ctx, job.ID, now.Add(2*deliveryLease)); ok {
+		t.Error("a rescheduled job was claimed before its next attempt")
+	}
+	if err := q.Remove(ctx, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := q.Claim(ctx, job.ID, now.Add(2*time.Hour)); ok {
+		t.Error("a removed job was claimed")
+	}
+}
+
+// 送れなかった job は試行回数を増やして後ろにずらし、期限を過ぎたら
+// 捨てる。送り主の actor が設定に無い job は必ず失敗するので、ネットワーク
+// に出ずにこの流れを確かめられる。
+func TestDrainDeliveriesReschedulesAndGivesUp(t *testing.T) {
+	withTestConfig(t)
+	ctx := context.Background()
+	q := newMemoryDeliveryQueue()
+	now := time.Now()
+	act := &activitystream.Object{Type: activitystream.CreateType}
+
+	retry := newDeliveryJob("nobody", "https://a.example/inbox", act, now)
+	expiring := newDeliveryJob("nobody", "https://b.example/inbox", act, now)
+	expiring.Deadline = now.Add(30 * time.Second)
+	for _, j := range []*deliveryJob{retry, expiring} {
+		if err := q.Enqueue(ctx, j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := drainDeliveries(ctx, q, now); err != nil {
+		t.Fatalf("drainDeliveries: %v", err)
+	}
+
+	if due, _ := q.Due(ctx, now, 10); len(due) != 0 {
+		t.Errorf("jobs still due right after a failed attempt: %v", jobIDs(due))
+	}
+	due, _ := q.Due(ctx, now.Add(deliveryDeadline), 10)
+	if len(due) != 1 || due[0].ID != retry.ID {
+		t.Fatalf("remaining jobs = %v, want [%v]", jobIDs(due), retry.ID)
+	}
+	if due[0].Attempts != 1 || due[0].LastError == "" {
+		t.Errorf("Attempts = %d, LastError = %q; want 1 and a message", due[0].Attempts, due[0].LastError)
+	}
+	if want := now.Add(deliveryBackoff(1)); !due[0].NextAttempt.Equal(want) {
+		t.Errorf("NextAttempt = %v, want %v", due[0].NextAttempt, want)
+	}
+}
+
+// KV に書いて読み戻しても中身が変わらないこと。時刻は秒に丸まる。
+func TestDeliveryJobItemRoundTrip(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	job := newDeliveryJob("bot", "https://a.example/inbox",
+		&activitystream.Object{ID: "https://s.example/u/bot/status/1/activity", Type: activitystream.CreateType}, now)
+	job.Attempts = 3
+	job.LastError = "503"
+
+	item, err := deliveryJobToItem(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.PK != datastore.KVDeliveries || item.SK != job.ID {
+		t.Errorf("key = %v/%v, want %v/%v", item.PK, item.SK, datastore.KVDeliveries, job.ID)
+	}
+	got, err := deliveryJobFromItem(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Sender != "bot" || got.Inbox != job.Inbox || got.Attempts != 3 || got.LastError != "503" ||
+		got.Activity.ID != job.Activity.ID || !got.NextAttempt.Equal(now) || !got.Deadline.Equal(job.Deadline) {
+		t.Errorf("round trip = %+v, want %+v", got, job)
+	}
+}
+
+func jobIDs(jobs []*deliveryJob) []string {
+	ids := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		ids = append(ids, j.ID)
+	}
+	return ids
+}
+
+// leasableStore は LeasableKV の引数を控え、items を返す。ほかのメソッドは
+// nil の埋め込みに届いて panic する。
+type leasableStore struct {
+	datastore.Client
+	items []*datastore.KVItem
+	now   int64
+	limit int
+}
+
+func (s *leasableStore) LeasableKV(ctx context.Context, pk string, now int64, limit int) ([]*datastore.KVItem, error) {
+	s.now, s.limit = now, limit
+	return s.items, nil
+}
+
+// Due はパーティションを丸ごと読まず、時刻の来た job を件数を限って
+// 索引から引くこと。
+func TestKVDeliveryQueueDueReadsOnlyLeasableJobs(t *testing.T) {
+	now := time.Now()
+	job := newDeliveryJob("nana", "https://a.example/inbox", &activitystream.Object{Type: activitystream.CreateType}, now.Add(-time.Minute))
+	item, err := deliveryJobToItem(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &leasableStore{items: []*datastore.KVItem{item}}
+	q := &kvDeliveryQueue{client: store}
+
+	due, err := q.Due(context.Background(), now, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.now != now.Unix() || store.limit != 5 {
+		t.Errorf("LeasableKV(now %v, limit %v), want (%v, 5)", store.now, store.limit, now.Unix())
+	}
+	if len(due) != 1 || due[0].ID != job.ID || due[0].Inbox != job.Inbox {
+		t.Errorf("Due = %v, want [%v]", jobIDs(due), job.ID)
+	}
+}
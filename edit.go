@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/httperror"
+)
+
+// statusHistoryKey は編集前の版を持つ連番テーブルの名前。投稿ごとに
+// 別の列を作り、版番号は1から振る。
+const statusHistoryKey = "statushistory"
+
+// statusHistoryName は投稿 id の編集履歴の列名。
+func statusHistoryName(actor *config.ActorConfig, id int) string {
+	return actorScoped(actor, fmt.Sprintf("%s:%d", statusHistoryKey, id))
+}
+
+// editStatusHandler は自分の投稿を書き換え、Update を配信する。
+// primary actor だけでなく sub actor (bot 等) も使える。
+//
+// 変えられるのは本文 (と本文から決まる mention) と CW だけ。公開範囲・
+// 返信先・添付は元のまま残す。Mastodon も公開範囲の変更は受け付けない。
+func editStatusHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	actor, herr := resolveActor(r)
+	if herr != nil {
+		return herr
+	}
+	id, herr := statusIDFromRequest(r)
+	if herr != nil {
+		return herr
+	}
+	req, err := parseStatusRequest(r)
+	if err != nil {
+		return httperror.StatusUnprocessableEntity("bad status request", err)
+	}
+
+	prev, herr := loadStatus(ctx, actor, id)
+	if herr != nil {
+		return herr
+	}
+	if err := requireContentOrAttachment(req.Content, prev.Attachment); err != nil {
+		return httperror.StatusUnprocessableEntity(err.Error(), nil)
+	}
+
+	mentions := collectMentions(ctx, actor, req.Content, req.Mentions)
+	now := time.Now().UTC()
+	note := editedNote(prev, req.Content, mentions, noteVisibility(prev, followersURI(actor)) == visibilityDirect, now)
+	applyContentWarning(note, req)
+
+	// 上書きする前に元の版を残す。逆順だと、保存に失敗したときに元の
+	// 本文がどこにも無くなる。
+	if err := appendStatusHistory(ctx, actor, id, prev); err != nil {
+		return httperror.StatusInternalServerError("cannot save the previous revision", err)
+	}
+	if err := saveStatus(ctx, actor, id, note); err != nil {
+		return httperror.StatusInternalServerError("cannot save the status", err)
+	}
+	recordReply(ctx, actor, note)
+	recordTags(ctx, actor, prev, note)
+	// outbox の Create も差し替える。outbox を読む相手が古い本文を
+	// 見ないように。連番は投稿と同じで、件数は変わらないので Inc しない。
+	if err := client.Put(ctx, actorScoped(actor, outboxKey), id, noteToCreate(note)); err != nil {
+		return httperror.StatusInternalServerError("cannot rewrite the outbox", err)
+	}
+
+	// Mastodon に倣い、Update の id は投稿の URI に編集時刻を付けたもの。
+	// 秒では同じ秒の2度の編集が同じ id になり、受け手に重複として捨て
+	// られるので、ナノ秒まで入れる。
+	update := activitystream.NewUpdate(
+		fmt.Sprintf("%s#updates/%d", note.ID, now.UnixNano()), actor.ID(), note.To, note.Cc, note)
+	inboxes, err := noteInboxes(ctx, actor, note, editRecipients(actor, prev, note, mentions))
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot list follower inboxes", err)
+	}
+	if err := deliver(ctx, actor, inboxes, update); err != nil {
+		logf("status %v was edited but delivery had failures: %v", note.ID, err)
+	}
+
+	if isFormRequest(r) {
+		http.Redirect(w, r, note.ID, http.StatusSeeOther)
+		return nil
+	}
+	return respondAsJSON(w, http.StatusOK, update)
+}
+
+// editedNote は prev の本文を text で置き換えた新しい版を作る。prev は
+// 履歴に残すので書き換えない。
+//
+// 新たに mention した相手は cc (direct なら to) に足す。外した相手は
+// 宛先から除かない。既に届いている相手に Update を送らないと、古い本文が
+// 残り続ける。
+func editedNote(prev *activitystream.Object, text string, mentions []mention, direct bool, now time.Time) *activitystream.Object {
+	note := *prev
+	note.Content = renderContent(text, mentions)
+	note.Tag = noteTags(text, mentions)
+	note.Source = noteSource(text)
+	// 引用は本文と tag に載っているので、作り直した後に戻す。
+	if quoted := prev.QuotedURI(); quoted != "" {
+		applyQuote(&note, quoted)
+	}
+	note.Updated = now.Format(time.RFC3339)
+	to := append([]string{}, prev.To...)
+	cc := append([]string{}, prev.Cc...)
+	for _, uri := range mentionURIs(mentions) {
+		if direct {
+			to = appendUnique(to, uri)
+		} else {
+			cc = appendUnique(cc, uri)
+		}
+	}
+	note.To, note.Cc = to, cc
+	return &note
+}
+
+// editRecipients は Update を mention 先として届ける相手。今の mention 先
+// だけでは、この編集で外した相手に届かず、古い本文が残り続ける。元の版の
+// mention 先と、宛先 (to・cc) に残っている個人を足す。以前の編集で外した
+// 相手も宛先には残っている (editedNote)。
+func editRecipients(actor *config.ActorConfig, prev, note *activitystream.Object, mentions []mention) []string {
+	uris := mentionURIs(mentions)
+	for _, uri := range noteMentionURIs(prev) {
+		uris = appendUnique(uris, uri)
+	}
+	followers := followersURI(actor)
+	for _, uri := range append(append([]string{}, note.To...), note.Cc...) {
+		if uri == activitystream.ToPublic || uri == followers {
+			continue
+		}
+		uris = appendUnique(uris, uri)
+	}
+	return uris
+}
+
+func appendStatusHistory(ctx context.Context, actor *config.ActorConfig, id int, prev *activitystream.Object) error {
+	name := statusHistoryName(actor, id)
+	rev, err := client.Inc(ctx, name)
+	if err != nil {
+		return err
+	}
+	return client.Put(ctx, name, rev, prev)
+}
+
+// statusHistoryLimit は個別投稿ページに出す編集履歴の件数の上限。
+const statusHistoryLimit = 20
+
+// statusHistory は編集前の版を新しい順に返す。一度も編集されていなければ
+// 空。
+func statusHistory(ctx context.Context, actor *config.ActorConfig, id int) ([]*activitystream.Object, error) {
+	revs, err := client.TakeObject(ctx, statusHistoryName(actor, id), datastore.Inf, statusHistoryLimit, datastore.Desc)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return nil, err
+	}
+	return revs, nil
+}
+
+// deleteStatusHistory は投稿の削除に合わせて編集履歴も消す。失敗しても
+// 投稿自体は消えているので、ログに残すだけにする。
+func deleteStatusHistory(ctx context.Context, actor *config.ActorConfig, id int) {
+	name := statusHistoryName(actor, id)
+	// 1つの投稿をこれより多く編集することは無い。
+	entries, err := client.TakeEntries(ctx, name, datastore.Inf, 1000, datastore.Desc)
+	if err != nil {
+		if !errors.Is(err, datastore.ErrNotFound) {
+			logf("listing the history of status %v failed: %v", id, err)
+		}
+		return
+	}
+	for _, e := range entries {
+		if err := client.DeleteObject(ctx, name, e.ID); err != nil {
+			logf("removing revision %v of status %v failed: %v", e.ID, id, err)
+		}
+	}
+}
+
+// noteSourceText は編集欄に出す元の文面。source を持たない投稿 (source を
+// 保存するようになる前のもの) は content の HTML から起こす。renderContent
+// の逆なので、段落は空行に、<br> は改行に戻す。
+func noteSourceText(note *activitystream.Object) string {
+	if note.Source != nil && note.Source.Content != "" {
+		return note.Source.Content
+	}
+	s := strings.ReplaceAll(note.Content, "</p><p>", "\n\n")
+	s = strings.ReplaceAll(s, "<br>", "\n")
+	return strings.TrimSpace(html.UnescapeString(stripTags(s)))
+}
+
+func noteMentionURIs(note *activitystream.Object) []string {
+	uris := make([]string, 0, len(note.Tag))
+	for _, t := range note.Tag {
+		if t.Type == activitystream.MentionType && t.Href != "" {
+			uris = append(uris, t.Href)
+		}
+	}
+	return uris
+}
+
+// --- 編集フォーム -----------------------------------------------------
+
+type statusEditPage struct {
+	pageBase
+	ActorLocalPart string
+	StatusID       int
+	ObjectURI      string
+	Source         string
+	// Mentions は本文に書かずに指定した mention 先も残すため、今の
+	// mention 先をすべて空白区切りで入れておく。
+	Mentions string
+	// SpoilerText / Sensitive は今の CW と閲覧注意。送り直さないと編集で
+	// 外れてしまうので、フォームに入れておく。
+	SpoilerText string
+	Sensitive   bool
+}
+
+// editStatusFormHandler は投稿の編集フォームを出す。
+func editStatusFormHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	actor, herr := resolveActor(r)
+	if herr != nil {
+		return herr
+	}
+	id, herr := statusIDFromRequest(r)
+	if herr != nil {
+		return herr
+	}
+	note, herr := loadStatus(r.Context(), actor, id)
+	if herr != nil {
+		return herr
+	}
+	page := statusEditPage{
+		pageBase:       newPageBase(r, "投稿を編集"),
+		ActorLocalPart: actor.LocalPart(),
+		StatusID:       id,
+		ObjectURI:      note.ID,
+		Source:         noteSourceText(note),
+		Mentions:       strings.Join(noteMentionURIs(note), " "),
+		SpoilerText:    note.Summary,
+		Sensitive:      note.Sensitive != nil && *note.Sensitive,
+	}
+	page.NoIndex = true
+	return renderPage(w, "status_edit", page)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+// 編集で変わるのは本文と mention だけで、公開範囲や添付は元のまま残る
+// こと。元の版は履歴に積むので書き換えないこと。
+func TestEditedNote(t *testing.T) {
+	const followers = "https://s.example/u/nana/followers"
+	const alice = "https://a.example/users/alice"
+	img := &activitystream.Object{Type: activitystream.ImageType, URL: "https://i.gyazo.com/x.png"}
+	prev := activitystream.NewNote("https://s.example/u/nana/status/1", "2026-01-01T00:00:00Z", "",
+		"<p>typo</p>", "https://s.example/u/nana", []string{followers}, nil, nil)
+	prev.Attachment = activitystream.Objects{img}
+
+	now := time.Date(2026, 1, 1, 0, 5, 0, 0, time.UTC)
+	got := editedNote(prev, "fixed @alice@a.example", []mention{{Handle: "@alice@a.example", ActorURI: alice}}, false, now)
+
+	if prev.Content != "<p>typo</p>" || prev.Updated != "" {
+		t.Errorf("prev was modified: %+v", prev)
+	}
+	if !strings.Contains(got.Content, "fixed") || !strings.Contains(got.Content, `href="`+alice+`"`) {
+		t.Errorf("Content = %q", got.Content)
+	}
+	if got.Updated != "2026-01-01T00:05:00Z" || got.Published != prev.Published {
+		t.Errorf("Updated = %q, Published = %q", got.Updated, got.Published)
+	}
+	if got.Source == nil || got.Source.Content != "fixed @alice@a.example" {
+		t.Errorf("Source = %+v", got.Source)
+	}
+	if len(got.To) != 1 || got.To[0] != followers || len(got.Cc) != 1 || got.Cc[0] != alice {
+		t.Errorf("To = %v, Cc = %v; want [%v] and [%v]", got.To, got.Cc, followers, alice)
+	}
+	if len(got.Attachment) != 1 || got.Attachment[0] != img {
+		t.Errorf("Attachment = %v", got.Attachment)
+	}
+}
+
+// mention を外した編集の Update も、外した相手に届けること。
+func TestEditRecipientsKeepRemovedMentions(t *testing.T) {
+	withTestConfig(t)
+	actor := Config.PrimaryActor()
+	const alice = "https://a.example/users/alice"
+	const bob = "https://b.example/users/bob"
+	const carol = "https://c.example/users/carol"
+	prev := activitystream.NewNote("https://s.example/u/nana/status/1", "2026-01-01T00:00:00Z", "",
+		"<p>@alice @bob</p>", actor.ID(), []string{activitystream.ToPublic}, []string{followersURI(actor), alice, bob, carol}, nil)
+	prev.Tag = []*activitystream.Object{
+		{Type: activitystream.MentionType, Href: alice},
+		{Type: activitystream.MentionType, Href: bob},
+	}
+	// bob を外して書き直す。carol は以前の編集で外した相手。
+	mentions := []mention{{Handle: "@alice@a.example", ActorURI: alice}}
+	note := editedNote(prev, "@alice@a.example だけ", mentions, false, time.Now())
+	got := editRecipients(actor, prev, note, mentions)
+	if !slices.Equal(got, []string{alice, bob, carol}) {
+		t.Errorf("editRecipients = %v, want [%v %v %v]", got, alice, bob, carol)
+	}
+}
+
+// source を持たない古い投稿は content の HTML から文面を起こす。
+func TestNoteSourceText(t *testing.T) {
+	withSource := &activitystream.Object{Content: "<p>x</p>", Source: noteSource("元の文面")}
+	if got := noteSourceText(withSource); got != "元の文面" {
+		t.Errorf("noteSourceText = %q, want the source", got)
+	}
+	old := &activitystream.Object{Content: renderContent("1行目\n2行目\n\n<b> & 段落", nil)}
+	if got, want := noteSourceText(old), "1行目\n2行目\n\n<b> & 段落"; got != want {
+		t.Errorf("noteSourceText = %q, want %q", got, want)
+	}
+}
+
+func TestStatusPageRendersEditHistory(t *testing.T) {
+	page := statusPage{
+		pageBase:       pageBase{Title: "nana", SiteName: "nana", LocalPart: "nana", Handle: "@nana", Authed: true},
+		ActorLocalPart: "bot",
+		Content:        "<p>fixed</p>",
+		Published:      "2026-01-01T00:00:00Z",
+		ObjectURI:      "https://s.example/u/bot/status/3",
+		StatusID:       3,
+		Updated:        "2026-01-01T00:05:00Z",
+		Revisions:      []statusRevision{{Content: "<p>typo</p>", At: "2026-01-01T00:00:00Z"}},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "status", page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"09:05 に編集", "編集履歴", "typo", `href="/u/bot/status/3/edit"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("page does not contain %q", want)
+		}
+	}
+}
+
+func TestStatusEditPageRenders(t *testing.T) {
+	page := statusEditPage{
+		pageBase:       pageBase{Title: "投稿を編集", SiteName: "nana", LocalPart: "nana", Handle: "@nana", Authed: true},
+		ActorLocalPart: "bot",
+		StatusID:       3,
+		ObjectURI:      "https://s.example/u/bot/status/3",
+		Source:         "<script>",
+		Mentions:       "https://a.example/users/alice",
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "status_edit", page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`action="/u/bot/statuses/3/edit"`, "&lt;script&gt;", `value="https://a.example/users/alice"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("page does not contain %q", want)
+		}
+	}
+}
+
+func TestEditRoutes(t *testing.T) {
+	r := newRouter()
+	for _, c := range []struct{ method, path string }{
+		{http.MethodPut, "/u/nana/status/1"},
+		{http.MethodGet, "/u/nana/status/1/edit"},
+		{http.MethodPost, "/u/nana/statuses/1/edit"},
+	} {
+		if h, _, _ := r.Lookup(c.method, c.path); h == nil {
+			t.Errorf("%v %v has no handler", c.method, c.path)
+		}
+	}
+}
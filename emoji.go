@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/httperror"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+// カスタム絵文字。Mastodon や Misskey は本文や表示名に :shortcode: を平文で
+// 入れ、画像は tag の Emoji で渡してくる。表示するときに tag を見て画像に
+// する。自分の投稿も同じ形で出す。本文に img を入れると相手のサニタイズで
+// 落ち、絵文字ごと消えてしまうため。
+
+// emojiPattern は本文中のインスタンスの絵文字を拾う。shortcode の形は
+// config の検証と同じ。
+var emojiPattern = regexp.MustCompile(`:([a-zA-Z0-9_]{2,}):`)
+
+// emojiURI はインスタンスの絵文字の URL。Emoji タグの id と icon に使う。
+// 画像の置き場所を移しても、リモートが控えたこの URL は切れない。
+func emojiURI(shortcode string) string { return Config.Origin + "/emoji/" + shortcode }
+
+func emojiTag(e *config.Emoji) *activitystream.Object {
+	return activitystream.NewEmoji(emojiURI(e.Shortcode), ":"+e.Shortcode+":", e.MediaType(), emojiURI(e.Shortcode))
+}
+
+// emojiTags は本文中のインスタンスの絵文字を、出てきた順に Emoji タグに
+// する。設定に無い shortcode は平文のまま残る。
+func emojiTags(text string) []*activitystream.Object {
+	seen := map[string]bool{}
+	var tags []*activitystream.Object
+	for _, m := range emojiPattern.FindAllStringSubmatch(text, -1) {
+		e, ok := Config.EmojiByShortcode(m[1])
+		if !ok || seen[e.Shortcode] {
+			continue
+		}
+		seen[e.Shortcode] = true
+		tags = append(tags, emojiTag(e))
+	}
+	return tags
+}
+
+// noteEmoji は tag の Emoji を shortcode から画像への対応にする。投稿にも
+// actor にも使う。画像の URL の scheme は描画時のサニタイズで確かめる。
+func noteEmoji(tags activitystream.Objects) web.Emoji {
+	var emoji web.Emoji
+	for _, t := range tags {
+		if t == nil || t.Type != activitystream.EmojiType || t.Icon == nil || t.Icon.URL == "" {
+			continue
+		}
+		shortcode := strings.Trim(t.Name, ":")
+		if shortcode == "" {
+			continue
+		}
+		if emoji == nil {
+			emoji = web.Emoji{}
+		}
+		emoji[shortcode] = t.Icon.URL
+	}
+	return emoji
+}
+
+// instanceEmoji はインスタンスの絵文字。ローカルの actor の表示名に使う。
+// 自分のページでは画像の実体を直接指す。
+func instanceEmoji() web.Emoji {
+	if len(Config.Emoji) == 0 {
+		return nil
+	}
+	emoji := make(web.Emoji, len(Config.Emoji))
+	for _, e := range Config.Emoji {
+		emoji[e.Shortcode] = e.URL
+	}
+	return emoji
+}
+
+// emojiHandler はインスタンスの絵文字の URL。ActivityPub で引かれたら
+// Emoji を返し、それ以外は画像の実体へ送る。画像そのものを返さないのは、
+// API Gateway でバイナリのレスポンスを扱っていないため (template.yml の
+// BinaryMediaTypes 参照)。
+func emojiHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	shortcode := httprouter.ParamsFromContext(r.Context()).ByName("shortcode")
+	e, ok := Config.EmojiByShortcode(shortcode)
+	if !ok {
+		return httperror.StatusNotFound("no such emoji", nil)
+	}
+	w.Header().Set("Vary", "Accept")
+	if wantsActivityJSON(r) {
+		tag := emojiTag(e)
+		tag.Context = activitystream.ContextActivityStreams
+		return respondAsJSON(w, http.StatusOK, tag)
+	}
+	// 置き場所は設定で変わりうるので恒久的なリダイレクトにはしない。
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.Redirect(w, r, e.URL, http.StatusFound)
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+func withTestEmoji(t *testing.T) {
+	t.Helper()
+	withTestConfig(t)
+	Config.Emoji = []*config.Emoji{{Shortcode: "nana", URL: "https://img.example/nana.png"}}
+}
+
+// 設定にある絵文字だけを、1度ずつ Emoji タグにすること。
+func TestEmojiTags(t *testing.T) {
+	withTestEmoji(t)
+	tags := emojiTags(":nana: と :nana: と :unknown: と 12:30:00")
+	if len(tags) != 1 {
+		t.Fatalf("emojiTags = %v, want 1 tag", tags)
+	}
+	got := tags[0]
+	if got.Type != activitystream.EmojiType || got.Name != ":nana:" || got.ID != "https://s.example/emoji/nana" ||
+		got.Icon == nil || got.Icon.URL != "https://s.example/emoji/nana" || got.Icon.MediaType != "image/png" {
+		t.Errorf("emoji tag = %+v (icon %+v)", got, got.Icon)
+	}
+	// 本文は :shortcode: のまま。
+	if content := renderContent(":nana:", nil); !strings.Contains(content, ":nana:") || strings.Contains(content, "<img") {
+		t.Errorf("renderContent = %q", content)
+	}
+}
+
+func TestNoteEmoji(t *testing.T) {
+	tags := activitystream.Objects{
+		activitystream.NewEmoji("https://m.example/emojis/1", ":blobcat:", "image/png", "https://m.example/blobcat.png"),
+		activitystream.NewMention("@a@m.example", "https://m.example/users/a"),
+		{Type: activitystream.EmojiType, Name: ":noicon:"},
+	}
+	got := noteEmoji(tags)
+	if len(got) != 1 || got["blobcat"] != "https://m.example/blobcat.png" {
+		t.Errorf("noteEmoji = %v", got)
+	}
+	if noteEmoji(nil) != nil {
+		t.Error("noteEmoji(nil) is not nil")
+	}
+}
+
+// 絵文字は tag にあるものだけが画像になり、本文にもとからある img や
+// http(s) 以外の画像は通らないこと。タグの中の :x: は書き換えないこと。
+func TestSanitizeWithEmoji(t *testing.T) {
+	emoji := web.Emoji{"blobcat": "https://m.example/blobcat.png", "evil": "javascript:alert(1)"}
+	got := string(web.SanitizeWithEmoji(
+		`<p>:blobcat: <img src="https://tracker.example/p.gif"> :evil: :other: <a href="https://m.example/:blobcat:">x</a></p>`, emoji))
+	if !strings.Contains(got, `<img class="custom-emoji" src="https://m.example/blobcat.png" alt=":blobcat:" title=":blobcat:">`) {
+		t.Errorf("emoji is not rendered: %q", got)
+	}
+	for _, bad := range []string{"tracker.example", "javascript:", `href="https://m.example/<img`} {
+		if strings.Contains(got, bad) {
+			t.Errorf("sanitized content contains %q: %q", bad, got)
+		}
+	}
+	if !strings.Contains(got, ":other:") {
+		t.Errorf("unknown shortcode is dropped: %q", got)
+	}
+
+	name := string(web.EmojifyText(`<b>nana</b> :blobcat:`, emoji))
+	if !strings.HasPrefix(name, "&lt;b&gt;nana&lt;/b&gt; <img class=\"custom-emoji\"") {
+		t.Errorf("EmojifyText = %q", name)
+	}
+}
+
+func TestEmojiPageRenders(t *testing.T) {
+	page := timelinePage{
+		pageBase: pageBase{Title: "タイムライン", SiteName: "nana", LocalPart: "nana", Handle: "@nana"},
+		Page:     1,
+		Items: []timelineItem{{
+			AuthorName:  ":blobcat: alice",
+			AuthorURI:   "https://m.example/users/alice",
+			AuthorEmoji: web.Emoji{"blobcat": "https://m.example/blobcat.png"},
+			Content:     "<p>:wave:</p>",
+			Emoji:       web.Emoji{"wave": "https://m.example/wave.png"},
+			ObjectURI:   "https://m.example/notes/1",
+		}},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "timeline", page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`src="https://m.example/blobcat.png"`, `src="https://m.example/wave.png"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("timeline does not contain %q", want)
+		}
+	}
+}
+
+// ブラウザには画像の実体へのリダイレクト、ActivityPub には Emoji を返す
+// こと。
+func TestEmojiHandler(t *testing.T) {
+	withTestEmoji(t)
+	router := newRouter()
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/emoji/nana", nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "https://img.example/nana.png" {
+		t.Errorf("GET /emoji/nana = %v %v", rec.Code, rec.Header().Get("Location"))
+	}
+
+	rec = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/emoji/nana", nil)
+	r.Header.Set("Accept", activitystream.ContentType)
+	router.ServeHTTP(rec, r)
+	var got activitystream.Object
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != activitystream.EmojiType || got.ID != "https://s.example/emoji/nana" {
+		t.Errorf("Emoji = %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/emoji/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /emoji/missing = %v", rec.Code)
+	}
+}
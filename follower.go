@@ -26,6 +26,7 @@ func saveFollower(ctx context.Context, partition string, actor *activitystream.O
 		Name:              name,
 		IconURL:           iconURL,
 		PreferredUsername: actor.PreferredUsername,
+		Emoji:             noteEmoji(actor.Tag),
 		ActivityID:        activityID,
 		State:             state,
 		At:                nowRFC3339(),
@@ -105,7 +106,7 @@ func collectionHandler(partition string, heading string) func(http.ResponseWrite
 				return respondAsJSON(w, http.StatusOK,
 					activitystream.NewOrderedCollection(uri, 0, "", ""))
 			}
-			return htmlCollectionHandler(w, r, actor, nil, heading)
+			return htmlCollectionHandler(w, r, actor, partition, nil, heading)
 		}
 		items, err := client.QueryKV(ctx, actorScoped(actor, partition))
 		if err != nil {
@@ -119,7 +120,7 @@ func collectionHandler(partition string, heading string) func(http.ResponseWrite
 			accepted = append(accepted, it)
 		}
 		if !wantsActivityJSON(r) {
-			return htmlCollectionHandler(w, r, actor, accepted, heading)
+			return htmlCollectionHandler(w, r, actor, partition, accepted, heading)
 		}
 		ids := make([]string, 0, len(accepted))
 		for _, it := range accepted {
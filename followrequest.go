@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/httperror"
+)
+
+// AutoAcceptFollow が偽の actor に来たフォロー要求は、followHandler が
+// FollowStatePending で followers に積む。ここはそれを手で承認・拒否する
+// ための私用エンドポイントである。保留中の要求はフォロワー数にも
+// コレクションにも出ないので、一覧はこのページにしか無い。
+//
+// 承認済みのフォロワーを外す (ソフトブロック) のも、Reject を送って記録を
+// 消すという点で拒否と同じなのでここに置く。
+
+type followRequestItem struct {
+	Name     string
+	ActorURI string
+	Acct     string
+	IconURL  string
+	At       string
+}
+
+type followRequestsPage struct {
+	pageBase
+	ActorLocalPart string
+	Requests       []followRequestItem
+}
+
+// followRequestsHandler は actor 宛ての保留中のフォロー要求を一覧する。
+func followRequestsHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	actor, herr := resolveActor(r)
+	if herr != nil {
+		return herr
+	}
+	items, err := client.QueryKV(ctx, actorScoped(actor, datastore.KVFollowers))
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot list the followers", err)
+	}
+	page := followRequestsPage{
+		pageBase:       newPageBase(r, actor.Name+" — フォロー要求"),
+		ActorLocalPart: actor.LocalPart(),
+		Requests:       pendingFollowRequests(items),
+	}
+	page.NoIndex = true
+	return renderPage(w, "follow_requests", page)
+}
+
+// pendingFollowRequests は followers の項目から保留中のものだけを
+// 表示用に取り出す。
+func pendingFollowRequests(items []*datastore.KVItem) []followRequestItem {
+	requests := make([]followRequestItem, 0, len(items))
+	for _, it := range items {
+		if it.State != datastore.FollowStatePending {
+			continue
+		}
+		requests = append(requests, followRequestItem{
+			Name:     it.Name,
+			ActorURI: it.SK,
+			Acct:     acctFromItem(it, it.SK),
+			IconURL:  it.IconURL,
+			At:       it.At,
+		})
+	}
+	return requests
+}
+
+// acceptFollowRequestHandler は保留中のフォロー要求を承認する。フォロワー
+// として数えてから Accept を送る。followHandler と同じく、逆順だと
+// Accept は届いたのにフォロワーとして記録されていない状態が起こり得る。
+func acceptFollowRequestHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	actor, herr := resolveActor(r)
+	if herr != nil {
+		return herr
+	}
+	item, herr := pendingFollowRequest(ctx, r, actor)
+	if herr != nil {
+		return herr
+	}
+
+	accepted := *item
+	accepted.State = datastore.FollowStateAccepted
+	if err := client.PutKV(ctx, &accepted); err != nil {
+		return httperror.StatusInternalServerError("cannot accept the follower", err)
+	}
+	accept := activitystream.NewAccept(storedFollow(actor, item), actor.ID(), newActivityID("accept"))
+	// 受信時の自動承認と同じく、配信キューに任せてリトライさせる。
+	if err := enqueueDelivery(ctx, actor.LocalPart(), item.Inbox, accept); err != nil {
+		return httperror.StatusInternalServerError("cannot queue the Accept", err)
+	}
+	logf("accepted follow from %v", item.SK)
+	return respondFollowRequestDone(w, r, actor, accept)
+}
+
+// rejectFollowRequestHandler は保留中のフォロー要求を拒否し、記録を消す。
+func rejectFollowRequestHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	actor, herr := resolveActor(r)
+	if herr != nil {
+		return herr
+	}
+	item, herr := pendingFollowRequest(ctx, r, actor)
+	if herr != nil {
+		return herr
+	}
+
+	reject, err := rejectFollower(ctx, actor, item)
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot reject the follow request", err)
+	}
+	logf("rejected follow from %v", item.SK)
+	return respondFollowRequestDone(w, r, actor, reject)
+}
+
+// removeFollowerHandler はフォロワーを外す。記録を消すだけだと、相手の
+// サーバはフォローしているつもりのまま残り、そのアカウントにも followers
+// 限定の投稿を配り続ける (こちらが送るのは sharedInbox 宛てで、誰に見せるか
+// は相手のサーバが自分のフォロー関係で決める)。元の Follow への Reject を
+// 送ると、Mastodon 互換の実装は向こう側のフォロー関係も消す。
+func removeFollowerHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	actor, herr := resolveActor(r)
+	if herr != nil {
+		return herr
+	}
+	item, herr := requestedFollower(ctx, r, actor)
+	if herr != nil {
+		return herr
+	}
+
+	reject, err := rejectFollower(ctx, actor, item)
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot remove the follower", err)
+	}
+	logf("removed follower %v", item.SK)
+	if isFormRequest(r) {
+		http.Redirect(w, r, "/u/"+actor.LocalPart()+"/followers", http.StatusSeeOther)
+		return nil
+	}
+	return respondAsJSON(w, http.StatusAccepted, reject)
+}
+
+// pendingFollowRequest は要求の actor で指定された保留中のフォロー要求を
+// 引く。
+func pendingFollowRequest(ctx context.Context, r *http.Request, actor *config.ActorConfig) (*datastore.KVItem, httperror.HttpError) {
+	item, herr := requestedFollower(ctx, r, actor)
+	if herr != nil {
+		return nil, herr
+	}
+	if item.State != datastore.FollowStatePending {
+		return nil, httperror.StatusUnprocessableEntity("that follow request is not pending", nil)
+	}
+	return item, nil
+}
+
+// requestedFollower は要求の actor で指定されたフォロワーの記録を、保留中か
+// どうかを問わず引く。form でも JSON でも受ける。
+func requestedFollower(ctx context.Context, r *http.Request, actor *config.ActorConfig) (*datastore.KVItem, httperror.HttpError) {
+	target := ""
+	if isFormRequest(r) {
+		if err := r.ParseForm(); err != nil {
+			return nil, httperror.StatusUnprocessableEntity("bad form", err)
+		}
+		target = strings.TrimSpace(r.PostFormValue("actor"))
+	} else {
+		var body struct {
+			Actor string `json:"actor"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, httperror.StatusUnprocessableEntity("bad request", err)
+		}
+		target = strings.TrimSpace(body.Actor)
+	}
+	if target == "" {
+		return nil, httperror.StatusUnprocessableEntity("actor must not be empty", nil)
+	}
+
+	item, err := client.GetKV(ctx, actorScoped(actor, datastore.KVFollowers), target)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil, httperror.StatusNotFound("not followed by that actor", err)
+		}
+		return nil, httperror.StatusInternalServerError("cannot look up the follower", err)
+	}
+	if item.Inbox == "" {
+		return nil, httperror.StatusUnprocessableEntity("the follower has no inbox", nil)
+	}
+	return item, nil
+}
+
+// rejectFollower は item の Follow への Reject を配信キューに積んでから、
+// フォロワーの記録を消す。
+//
+// Reject を積めなかったときは記録を残す。消してしまうと、相手はフォロー
+// しているつもりのまま、こちらからは二度と Reject を送れなくなる。
+func rejectFollower(ctx context.Context, actor *config.ActorConfig, item *datastore.KVItem) (*activitystream.Object, error) {
+	reject := activitystream.NewReject(storedFollow(actor, item), actor.ID(), newActivityID("reject"))
+	if err := enqueueDelivery(ctx, actor.LocalPart(), item.Inbox, reject); err != nil {
+		return nil, fmt.Errorf("queueing the Reject: %w", err)
+	}
+	if err := client.DeleteKV(ctx, item.PK, item.SK); err != nil {
+		return nil, fmt.Errorf("removing the follower: %w", err)
+	}
+	return reject, nil
+}
+
+// storedFollow は記録しておいた Follow を組み立て直す。受け取った Follow
+// そのものは残していないが、相手が突き合わせに使うのは id なので、
+// followHandler が控えた ActivityID があれば足りる。
+func storedFollow(actor *config.ActorConfig, item *datastore.KVItem) *activitystream.Object {
+	return &activitystream.Object{
+		ID:     item.ActivityID,
+		Type:   activitystream.FollowType,
+		Actor:  activitystream.URIRef(item.SK),
+		Object: activitystream.URIRef(actor.ID()),
+	}
+}
+
+func respondFollowRequestDone(w http.ResponseWriter, r *http.Request, actor *config.ActorConfig, activity *activitystream.Object) httperror.HttpError {
+	if isFormRequest(r) {
+		http.Redirect(w, r, "/u/"+actor.LocalPart()+"/follow_requests", http.StatusSeeOther)
+		return nil
+	}
+	return respondAsJSON(w, http.StatusAccepted, activity)
+}
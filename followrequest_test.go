@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+func TestPendingFollowRequests(t *testing.T) {
+	items := []*datastore.KVItem{
+		{SK: "https://a.example/users/alice", Name: "alice", PreferredUsername: "alice", State: datastore.FollowStatePending},
+		{SK: "https://b.example/users/bob", Name: "bob", State: datastore.FollowStateAccepted},
+	}
+	got := pendingFollowRequests(items)
+	if len(got) != 1 || got[0].ActorURI != "https://a.example/users/alice" || got[0].Acct != "@alice@a.example" {
+		t.Errorf("pendingFollowRequests = %+v", got)
+	}
+}
+
+// Accept / Reject の object は受け取った Follow の id を持つこと。相手は
+// それで自分の送った Follow と突き合わせる。
+func TestStoredFollow(t *testing.T) {
+	withTestConfig(t)
+	actor := Config.PrimaryActor()
+	item := &datastore.KVItem{SK: "https://a.example/users/alice", ActivityID: "https://a.example/follows/1"}
+	follow := storedFollow(actor, item)
+	if follow.ID != item.ActivityID || follow.Type != activitystream.FollowType ||
+		follow.Actor.ID() != item.SK || follow.Object.ID() != actor.ID() {
+		t.Errorf("storedFollow = %+v", follow)
+	}
+}
+
+func TestFollowRequestsPageRenders(t *testing.T) {
+	page := followRequestsPage{
+		pageBase:       pageBase{Title: "フォロー要求", SiteName: "nana", LocalPart: "nana", Handle: "@nana", Authed: true},
+		ActorLocalPart: "bot",
+		Requests:       []followRequestItem{{Name: "alice", ActorURI: "https://a.example/users/alice", Acct: "@alice@a.example"}},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "follow_requests", page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`action="/u/bot/follow_requests/accept"`, `action="/u/bot/follow_requests/reject"`, `value="https://a.example/users/alice"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("page does not contain %q", want)
+		}
+	}
+}
+
+func TestFollowRequestRoutes(t *testing.T) {
+	r := newRouter()
+	for _, c := range []struct{ method, path string }{
+		{http.MethodGet, "/u/nana/follow_requests"},
+		{http.MethodPost, "/u/nana/follow_requests/accept"},
+		{http.MethodPost, "/u/nana/follow_requests/reject"},
+		{http.MethodPost, "/u/nana/followers/remove"},
+	} {
+		if h, _, _ := r.Lookup(c.method, c.path); h == nil {
+			t.Errorf("%v %v has no handler", c.method, c.path)
+		}
+	}
+}
+
+func TestCollectionPageRendersRemoveButton(t *testing.T) {
+	page := collectionPage{
+		pageBase:     pageBase{Title: "フォロワー", SiteName: "nana", LocalPart: "nana", Handle: "@nana", Authed: true},
+		Heading:      "フォロワー",
+		Members:      []collectionMember{{Name: "alice", ActorURI: "https://a.example/users/alice", Acct: "@alice@a.example"}},
+		RemoveAction: "/u/nana/followers/remove",
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "collection", page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`action="/u/nana/followers/remove"`, `value="https://a.example/users/alice"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("page does not contain %q", want)
+		}
+	}
+
+	// 外す先が無ければボタンも出さない。
+	page.RemoveAction = ""
+	buf.Reset()
+	if err := web.Render(buf, "collection", page); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "フォロワーから外す") {
+		t.Errorf("page has a remove button without RemoveAction")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image/gif"
+)
+
+// GIF はコメント拡張やアプリケーション拡張 (XMP 等) にメタデータを持てる。
+// image/gif の DecodeAll はコマと表示の設定だけを読み、拡張は読み飛ばす
+// ので、それを EncodeAll で書き直せばアニメーションを保ったまま落とせる。
+//
+// DecodeAll は全部のコマを展開して持つ。画素数の上限 (maxImagePixels) は
+// 画面の大きさしか見ないので、小さな GIF でもコマを並べてメモリを食い
+// 潰せる。デコードする前にブロックを辿り、全部のコマの画素数を数える。
+
+// gifFramePixels は data の全部のコマの画素数の和を返す。ブロックの並びが
+// 壊れていれば error。
+func gifFramePixels(data []byte) (int, error) {
+	if len(data) < 13 {
+		return 0, errors.New("truncated header")
+	}
+	p := 13
+	if data[10]&0x80 != 0 {
+		p += 3 << (data[10]&7 + 1) // 大域カラーテーブル
+	}
+	// skipSubBlocks は p から並ぶサブブロックを終端の 0 まで飛ばす。
+	skipSubBlocks := func() error {
+		for {
+			if p >= len(data) {
+				return errors.New("truncated block")
+			}
+			n := int(data[p])
+			p += 1 + n
+			if n == 0 {
+				return nil
+			}
+		}
+	}
+	total := 0
+	for {
+		if p >= len(data) {
+			return 0, errors.New("missing trailer")
+		}
+		switch data[p] {
+		case 0x3B:
+			return total, nil
+		case 0x21:
+			p += 2
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+		case 0x2C:
+			if p+10 > len(data) {
+				return 0, errors.New("truncated image descriptor")
+			}
+			w := int(binary.LittleEndian.Uint16(data[p+5:]))
+			h := int(binary.LittleEndian.Uint16(data[p+7:]))
+			total += w * h
+			if data[p+9]&0x80 != 0 {
+				p += 3 << (data[p+9]&7 + 1) // 局所カラーテーブル
+			}
+			p += 11 // 画像記述子と LZW の最小符号長
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, errors.New("unknown block")
+		}
+	}
+}
+
+// reencodeGIF は data をコマと表示の設定だけから書き直す。デコードした
+// GIF も返す (最初のコマから blurhash を求めるため)。
+func reencodeGIF(data []byte) ([]byte, *gif.GIF, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	out := &bytes.Buffer{}
+	if err := gif.EncodeAll(out, g); err != nil {
+		return nil, nil, err
+	}
+	return out.Bytes(), g, nil
+}
@@ -25,9 +25,14 @@ var gyazoOembedURL = "https://api.gyazo.com/api/oembed"
 // 使うフォールバック値。
 const defaultHEICThumbnailWidth = 1000
 
-type gyazoUploadResult struct {
-	URL       string
-	MediaType string
+// gyazoMediaStore は Gyazo に置く mediaStore。HEIC を JPEG のサムネイルに
+// 差し替えるなど、Gyazo に固有の扱いはここで済ませる。
+type gyazoMediaStore struct {
+	accessToken string
+}
+
+func (s *gyazoMediaStore) Put(ctx context.Context, filename string, contentType string, data io.Reader) (*storedMedia, error) {
+	return uploadToGyazo(ctx, s.accessToken, filename, contentType, data)
 }
 
 // quoteEscaper は mime/multipart.CreateFormFile 内部にある同名の未公開
@@ -35,9 +40,8 @@ type gyazoUploadResult struct {
 var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
 
 // uploadToGyazo は画像データを Gyazo にアップロードし、直リンクの URL を
-// 返す。自前で画像ストレージ (S3 等) を持たずに投稿へ画像を添付するための
-// 手段として、まずは Gyazo に投げる。
-func uploadToGyazo(ctx context.Context, accessToken string, filename string, contentType string, data io.Reader) (*gyazoUploadResult, error) {
+// 返す。自前で画像ストレージを持たずに投稿へ画像を添付するための手段。
+func uploadToGyazo(ctx context.Context, accessToken string, filename string, contentType string, data io.Reader) (*storedMedia, error) {
 	body := &bytes.Buffer{}
 	mw := multipart.NewWriter(body)
 	if err := mw.WriteField("access_token", accessToken); err != nil {
@@ -47,13 +51,7 @@ func uploadToGyazo(ctx context.Context, accessToken string, filename string, con
 	// application/octet-stream に固定される。Gyazo はそれだと
 	// "Not an Image" で 400 を返すため、実際の画像の Content-Type を
 	// 自分でヘッダに積む。
-	if contentType == "" {
-		if t := mime.TypeByExtension(path.Ext(filename)); t != "" {
-			contentType = t
-		} else {
-			contentType = "application/octet-stream"
-		}
-	}
+	contentType = mediaType(filename, contentType)
 	h := textproto.MIMEHeader{}
 	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="imagedata"; filename="%s"`, quoteEscaper.Replace(filename)))
 	h.Set("Content-Type", contentType)
@@ -102,7 +100,7 @@ func uploadToGyazo(ctx context.Context, accessToken string, filename string, con
 	// タイムライン上で普通の画像として表示できるようにする。それ以外の
 	// 形式 (png/jpg/gif 等) はそのまま直リンクを使う。
 	resultURL := out.URL
-	mediaType := "application/octet-stream"
+	resultType := "application/octet-stream"
 	if isHEICUpload(out.Type, out.URL) {
 		width := defaultHEICThumbnailWidth
 		if out.PermalinkURL != "" {
@@ -116,15 +114,15 @@ func uploadToGyazo(ctx context.Context, accessToken string, filename string, con
 		}
 		if thumb, ok := gyazoHEICThumbnailURL(out.URL, width); ok {
 			resultURL = thumb
-			mediaType = "image/jpeg"
+			resultType = "image/jpeg"
 		}
 	} else if u, err := url.Parse(out.URL); err == nil {
 		if t := mime.TypeByExtension(path.Ext(u.Path)); t != "" {
-			mediaType = t
+			resultType = t
 		}
 	}
 
-	return &gyazoUploadResult{URL: resultURL, MediaType: mediaType}, nil
+	return &storedMedia{URL: resultURL, MediaType: resultType}, nil
 }
 
 // isHEICUpload は Gyazo のレスポンスが HEIC/HEIF 画像かどうかを判定する。
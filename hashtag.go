@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/httperror"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+// hashtagPattern は本文中の #tag を拾う。数字だけのものは拾わない
+// (Mastodon と同じ)。直前が語の一部や "/" のものも拾わない。URL の
+// フラグメントや、エスケープで生まれた "&#39;" を拾わないため。
+var hashtagPattern = regexp.MustCompile(`(^|[^/)&\p{L}\p{N}_])#([\p{L}\p{N}_]*[\p{L}_][\p{L}\p{N}_]*)`)
+
+// anchorPattern は renderContent が先に差し込んだリンク。ハッシュタグは
+// この中を避けて拾う。URL の中の "-#" のようなものをタグにしないため。
+var anchorPattern = regexp.MustCompile(`<a [^>]*>.*?</a>`)
+
+// normalizeTag はタグを索引と URL に使う形にする。大文字小文字は区別
+// しない。
+func normalizeTag(name string) string {
+	return strings.ToLower(strings.TrimPrefix(name, "#"))
+}
+
+// tagURI はタグのページの URI。Hashtag タグの href にも使う。
+func tagURI(name string) string {
+	return Config.Origin + "/tags/" + url.PathEscape(normalizeTag(name))
+}
+
+func tagPartition(tag string) string { return datastore.KVTags + "#" + tag }
+
+// hashtags は本文中のハッシュタグを、書かれた表記のまま出てきた順に
+// 返す。大文字小文字だけが違うものは最初の1つにまとめる。
+//
+// renderContent と同じく URL をリンクにしてから、その外だけを見る。
+// タグとリンクの拾い方を揃えないと、"https://a.example/x-#frag" のような
+// URL の中の # が、本文にリンクの無いタグとして連合に出る。
+func hashtags(text string) []string {
+	seen := map[string]bool{}
+	var tags []string
+	outsideAnchors(linkifyURLs(html.EscapeString(text)), func(s string) string {
+		for _, m := range hashtagPattern.FindAllStringSubmatch(s, -1) {
+			if n := normalizeTag(m[2]); !seen[n] {
+				seen[n] = true
+				tags = append(tags, m[2])
+			}
+		}
+		return s
+	})
+	return tags
+}
+
+// hashtagTags は content に載せる Hashtag タグを組む。リモートのタグ
+// 検索はこれを見る。本文にリンクがあるだけでは拾われない。
+func hashtagTags(text string) []*activitystream.Object {
+	names := hashtags(text)
+	tags := make([]*activitystream.Object, 0, len(names))
+	for _, name := range names {
+		tags = append(tags, activitystream.NewTag(activitystream.HashtagType, "#"+name, tagURI(name)))
+	}
+	return tags
+}
+
+// linkifyHashtags はエスケープ済みの本文中のハッシュタグをタグのページへの
+// リンクにする。既に差し込んだリンクの中は触らない。
+func linkifyHashtags(escaped string) string {
+	return outsideAnchors(escaped, linkifyHashtagsInText)
+}
+
+// outsideAnchors は escaped のうち差し込んだリンクの外の部分を f で
+// 置き換える。リンクはそのまま残す。
+func outsideAnchors(escaped string, f func(string) string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range anchorPattern.FindAllStringIndex(escaped, -1) {
+		b.WriteString(f(escaped[last:loc[0]]))
+		b.WriteString(escaped[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(f(escaped[last:]))
+	return b.String()
+}
+
+func linkifyHashtagsInText(s string) string {
+	return hashtagPattern.ReplaceAllStringFunc(s, func(m string) string {
+		sub := hashtagPattern.FindStringSubmatch(m)
+		return sub[1] + fmt.Sprintf(`<a href="%s" class="mention hashtag" rel="tag">#<span>%s</span></a>`,
+			html.EscapeString(tagURI(sub[2])), sub[2])
+	})
+}
+
+// noteHashtags は note の Hashtag タグを正規化した名前で返す。
+func noteHashtags(note *activitystream.Object) []string {
+	var tags []string
+	for _, t := range note.Tag {
+		if t != nil && t.Type == activitystream.HashtagType && t.Name != "" {
+			tags = append(tags, normalizeTag(t.Name))
+		}
+	}
+	return tags
+}
+
+// recordTags は自分の投稿をタグの索引に入れる。prev は編集前の版で、
+// 新しい投稿なら nil。編集で外したタグからは外す。索引に入れるのは公開の
+// 投稿だけ。未収載は一覧に出さないという約束なので、タグのページにも
+// 出さない。
+func recordTags(ctx context.Context, actor *config.ActorConfig, prev, note *activitystream.Object) {
+	current := noteHashtags(note)
+	if prev != nil {
+		for _, tag := range noteHashtags(prev) {
+			if !slices.Contains(current, tag) {
+				if err := client.DeleteKV(ctx, tagPartition(tag), note.ID); err != nil {
+					logf("removing %v from #%v failed: %v", note.ID, tag, err)
+				}
+			}
+		}
+	}
+	if noteVisibility(note, followersURI(actor)) != visibilityPublic {
+		return
+	}
+	for _, tag := range current {
+		if err := client.PutKV(ctx, &datastore.KVItem{
+			PK:          tagPartition(tag),
+			SK:          note.ID,
+			TargetActor: actor.ID(),
+			At:          note.Published,
+		}); err != nil {
+			// タグのページに出ないだけで、投稿そのものは済んでいる。
+			logf("indexing %v under #%v failed: %v", note.ID, tag, err)
+		}
+	}
+}
+
+// forgetTags は消した投稿をタグの索引から外す。
+func forgetTags(ctx context.Context, note *activitystream.Object) {
+	for _, tag := range noteHashtags(note) {
+		if err := client.DeleteKV(ctx, tagPartition(tag), note.ID); err != nil {
+			logf("removing %v from #%v failed: %v", note.ID, tag, err)
+		}
+	}
+}
+
+// localizeHashtags はリモートの本文中のハッシュタグのリンクを、こちらの
+// タグのページに向け直す。どのリンクがタグかは tag の Hashtag で判断する。
+// 本文の見た目からは判断しない。
+func localizeHashtags(content string, tags activitystream.Objects) string {
+	for _, t := range tags {
+		if t == nil || t.Type != activitystream.HashtagType || t.Href == "" || t.Name == "" {
+			continue
+		}
+		local := `href="` + html.EscapeString(tagURI(t.Name)) + `"`
+		for _, href := range []string{t.Href, html.EscapeString(t.Href)} {
+			content = strings.ReplaceAll(content, `href="`+href+`"`, local)
+		}
+	}
+	return content
+}
+
+// --- タグのページ -----------------------------------------------------
+
+type tagItem struct {
+	AuthorName  string
+	AuthorURI   string
+	IconURL     string
+	Content     string
+	Emoji       web.Emoji
+	Attachments []attachmentItem
+	Published   string
+	URL         string
+	Summary     string
+	Sensitive   bool
+}
+
+type tagPage struct {
+	pageBase
+	Tag      string
+	Items    []tagItem
+	Page     int
+	PrevPage int
+	NextPage int
+	HasPrev  bool
+	HasNext  bool
+}
+
+const tagPageSize = 20
+
+// tagHandler は自分たち (ローカルの actor) の公開の投稿のうち、そのタグを
+// 付けたものを新しい順に出す。
+func tagHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	tag := normalizeTag(httprouter.ParamsFromContext(ctx).ByName("tag"))
+	if tag == "" {
+		return httperror.StatusNotFound("no such tag", nil)
+	}
+	pageNum, err := intParam(r, "page", 1)
+	if err != nil {
+		return httperror.StatusUnprocessableEntity("bad page", err)
+	}
+	if pageNum < 1 {
+		return httperror.StatusUnprocessableEntity("page must be 1 or greater", nil)
+	}
+
+	entries, err := client.QueryKV(ctx, tagPartition(tag))
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot list the tagged statuses", err)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return publishedTime(entries[i].At).After(publishedTime(entries[j].At))
+	})
+	_, skip := statusesRange(pageNum, tagPageSize)
+	entries, hasNext := paginate(entries, skip, tagPageSize)
+
+	items := make([]tagItem, 0, len(entries))
+	for _, e := range entries {
+		owner, id, ok := actorAndIDFromStatusURI(e.SK)
+		if !ok {
+			continue
+		}
+		// 索引は投稿時点のもの。消したり公開範囲の違う版が残っていたり
+		// しても出さないよう、投稿そのものを読み直す。
+		note, herr := loadStatus(ctx, owner, id)
+		if herr != nil || noteVisibility(note, followersURI(owner)) != visibilityPublic {
+			continue
+		}
+		items = append(items, tagItem{
+			AuthorName:  owner.Name,
+			AuthorURI:   owner.ID(),
+			IconURL:     owner.IconURI,
+			Content:     note.Content,
+			Emoji:       noteEmoji(note.Tag),
+			Attachments: noteAttachments(note),
+			Published:   note.Published,
+			URL:         note.ID,
+			Summary:     note.Summary,
+			Sensitive:   noteSensitive(note),
+		})
+	}
+
+	page := tagPage{
+		pageBase: newPageBase(r, "#"+tag),
+		Tag:      tag,
+		Items:    items,
+		Page:     pageNum,
+		PrevPage: pageNum - 1,
+		NextPage: pageNum + 1,
+		HasPrev:  pageNum > 1,
+		HasNext:  hasNext,
+	}
+	return renderPage(w, "tag", page)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+func TestHashtags(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{"単独", "#golang", []string{"golang"}},
+		{"文中と日本語", "今日の #ごはん は #Go_lang", []string{"ごはん", "Go_lang"}},
+		{"大文字小文字はまとめる", "#Go と #go", []string{"Go"}},
+		{"数字だけは拾わない", "#123 位", nil},
+		{"URL のフラグメントは拾わない", "https://example.com/page#section", nil},
+		{"URL の中の -# も拾わない", "見て https://example.com/a-#frag #Go", []string{"Go"}},
+		{"語の途中は拾わない", "abc#def", nil},
+		{"エスケープした引用符は拾わない", "&#39;quoted&#39;", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := hashtags(tt.in)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("hashtags(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// 本文のハッシュタグはタグのページへのリンクになり、tag にも Hashtag が
+// 載ること。URL の中の # はタグにしないこと。
+func TestRenderContentLinksHashtags(t *testing.T) {
+	withTestConfig(t)
+	got := renderContent("見て #Go https://a.example/x-#frag", nil)
+	want := `<p>見て <a href="https://s.example/tags/go" class="mention hashtag" rel="tag">#<span>Go</span></a> <a href="https://a.example/x-#frag">https://a.example/x-#frag</a></p>`
+	if got != want {
+		t.Errorf("renderContent = %q\nwant %q", got, want)
+	}
+
+	tags := noteTags("#Go と #ごはん", []mention{{Handle: "@alice@a.example", ActorURI: "https://a.example/users/alice"}})
+	if len(tags) != 3 || tags[0].Type != activitystream.MentionType {
+		t.Fatalf("noteTags = %v", tags)
+	}
+	if tags[1].Type != activitystream.HashtagType || tags[1].Name != "#Go" || tags[1].Href != "https://s.example/tags/go" {
+		t.Errorf("tags[1] = %+v", tags[1])
+	}
+	if tags[2].Href != "https://s.example/tags/%E3%81%94%E3%81%AF%E3%82%93" {
+		t.Errorf("tags[2].Href = %v", tags[2].Href)
+	}
+}
+
+// リモートのタグのリンクは tag に Hashtag として書かれたものだけを
+// こちらのページへ向け直すこと。
+func TestLocalizeHashtags(t *testing.T) {
+	withTestConfig(t)
+	content := `<p><a href="https://m.example/tags/Go" class="mention hashtag">#<span>Go</span></a> <a href="https://m.example/about">about</a></p>`
+	tags := activitystream.Objects{activitystream.NewTag(activitystream.HashtagType, "#Go", "https://m.example/tags/Go")}
+	got := localizeHashtags(content, tags)
+	if !strings.Contains(got, `href="https://s.example/tags/go"`) {
+		t.Errorf("hashtag link is not localized: %v", got)
+	}
+	if !strings.Contains(got, `href="https://m.example/about"`) {
+		t.Errorf("a plain link is rewritten: %v", got)
+	}
+}
+
+func TestTagRoute(t *testing.T) {
+	if h, _, _ := newRouter().Lookup(http.MethodGet, "/tags/go"); h == nil {
+		t.Error("GET /tags/:tag has no handler")
+	}
+}
+
+func TestTagPageRenders(t *testing.T) {
+	page := tagPage{
+		pageBase: pageBase{Title: "#go", SiteName: "nana", LocalPart: "nana", Handle: "@nana"},
+		Tag:      "go",
+		Page:     1,
+		HasNext:  true,
+		NextPage: 2,
+		Items: []tagItem{
+			{AuthorName: "nana", AuthorURI: "https://s.example/u/nana", Content: "<p>#go</p>", URL: "https://s.example/u/nana/status/1", Summary: "CW"},
+		},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "tag", page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<h2 class=\"page-title\">#go</h2>", `href="/tags/go?page=2"`, `<details class="cw"><summary>CW</summary>`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("tag page does not contain %q", want)
+		}
+	}
+}
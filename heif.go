@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// HEIC (iPhone の写真) は Go でデコードできないので描き直せない。代わりに
+// コンテナ (ISO BMFF) を読み、EXIF と XMP の item の中身をその場でゼロに
+// 塗りつぶす。箱の大きさもオフセットも変えないので、画像の部分には触れずに
+// 済む。位置情報はこの EXIF / XMP に入っている。
+
+// heifBrands は ftyp の brand と、置くときの Content-Type。
+var heifBrands = map[string]string{
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"hevc": "image/heic",
+	"hevx": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+	"avif": "image/avif",
+}
+
+// heifContentType は data が HEIF (HEIC・AVIF を含む) なら Content-Type を
+// 返す。送られてきた Content-Type は信じず、ftyp の brand で決める。
+func heifContentType(data []byte) (string, bool) {
+	if len(data) < 16 || string(data[4:8]) != "ftyp" {
+		return "", false
+	}
+	size := int(binary.BigEndian.Uint32(data[:4]))
+	if size < 16 || size > len(data) {
+		return "", false
+	}
+	// mif1 は HEIC も AVIF も名乗るので、より具体的な brand があればそちら
+	// にする。
+	found := ""
+	for i := 8; i+4 <= size; i += 4 {
+		if i == 12 {
+			continue // minor_version
+		}
+		if ct, ok := heifBrands[string(data[i:i+4])]; ok && (found == "" || found == "image/heif") {
+			found = ct
+		}
+	}
+	return found, found != ""
+}
+
+// isoBox は ISO BMFF の箱1つ。body は中身の始まり、end は箱の終わり
+// (どちらも data 全体での位置)。
+type isoBox struct {
+	typ       string
+	body, end int
+}
+
+func readISOBoxes(data []byte, start, end int) ([]isoBox, error) {
+	var boxes []isoBox
+	for p := start; p < end; {
+		if p+8 > end {
+			return nil, errors.New("truncated box header")
+		}
+		size := uint64(binary.BigEndian.Uint32(data[p : p+4]))
+		typ := string(data[p+4 : p+8])
+		body := p + 8
+		switch size {
+		case 0:
+			size = uint64(end - p)
+		case 1:
+			if p+16 > end {
+				return nil, errors.New("truncated box header")
+			}
+			size = binary.BigEndian.Uint64(data[p+8 : p+16])
+			body = p + 16
+		}
+		if size < uint64(body-p) || size > uint64(end-p) {
+			return nil, fmt.Errorf("box %q has a bad size", typ)
+		}
+		boxes = append(boxes, isoBox{typ: typ, body: body, end: p + int(size)})
+		p += int(size)
+	}
+	return boxes, nil
+}
+
+// boxReader は箱の中身を先頭から読む。範囲を越えたら err を立て、以後は
+// 0 を返す。
+type boxReader struct {
+	b   []byte
+	p   int
+	err error
+}
+
+func (r *boxReader) take(n int) []byte {
+	if r.err != nil || n < 0 || r.p+n > len(r.b) {
+		r.err = errors.New("truncated box")
+		return make([]byte, n)
+	}
+	s := r.b[r.p : r.p+n]
+	r.p += n
+	return s
+}
+
+func (r *boxReader) u8() int  { return int(r.take(1)[0]) }
+func (r *boxReader) u16() int { return int(binary.BigEndian.Uint16(r.take(2))) }
+func (r *boxReader) u32() int { return int(binary.BigEndian.Uint32(r.take(4))) }
+
+// uN は iloc の可変長の整数 (0・4・8 バイト) を読む。
+func (r *boxReader) uN(n int) int {
+	switch n {
+	case 0:
+		return 0
+	case 4:
+		return r.u32()
+	case 8:
+		return int(binary.BigEndian.Uint64(r.take(8)))
+	}
+	r.err = fmt.Errorf("unsupported field size %d", n)
+	return 0
+}
+
+// cstring は NUL 終端の文字列を読む。
+func (r *boxReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.b[r.p:], 0)
+	if i < 0 {
+		r.err = errors.New("unterminated string")
+		return ""
+	}
+	s := string(r.b[r.p : r.p+i])
+	r.p += i + 1
+	return s
+}
+
+// heifMetadataItems は iinf から EXIF と XMP の item の id を拾う。
+func heifMetadataItems(data []byte, iinf isoBox) (map[int]bool, error) {
+	r := &boxReader{b: data[iinf.body:iinf.end]}
+	version := r.u8()
+	r.take(3)
+	if version == 0 {
+		r.u16()
+	} else {
+		r.u32()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	entries, err := readISOBoxes(data, iinf.body+r.p, iinf.end)
+	if err != nil {
+		return nil, err
+	}
+	items := map[int]bool{}
+	for _, e := range entries {
+		if e.typ != "infe" {
+			continue
+		}
+		er := &boxReader{b: data[e.body:e.end]}
+		v := er.u8()
+		er.take(3)
+		// version 0・1 の infe は item_type を持たない (古い形式)。
+		if v < 2 {
+			continue
+		}
+		id := 0
+		if v == 2 {
+			id = er.u16()
+		} else {
+			id = er.u32()
+		}
+		er.u16() // item_protection_index
+		switch string(er.take(4)) {
+		case "Exif":
+			items[id] = true
+		case "mime":
+			er.cstring() // item_name
+			if er.cstring() == "application/rdf+xml" {
+				items[id] = true
+			}
+		}
+		if er.err != nil {
+			return nil, er.err
+		}
+	}
+	return items, nil
+}
+
+// stripHEIFMetadata は EXIF と XMP の item の中身をゼロにした複製を返す。
+// 場所が分からない item があれば誤って残さないよう error にする。
+func stripHEIFMetadata(data []byte) ([]byte, error) {
+	top, err := readISOBoxes(data, 0, len(data))
+	if err != nil {
+		return nil, err
+	}
+	var meta *isoBox
+	for i := range top {
+		if top[i].typ == "meta" {
+			meta = &top[i]
+		}
+	}
+	if meta == nil {
+		return nil, errors.New("no meta box")
+	}
+	if meta.body+4 > meta.end {
+		return nil, errors.New("truncated meta box")
+	}
+	children, err := readISOBoxes(data, meta.body+4, meta.end)
+	if err != nil {
+		return nil, err
+	}
+	var iinf, iloc, idat *isoBox
+	for i := range children {
+		switch children[i].typ {
+		case "iinf":
+			iinf = &children[i]
+		case "iloc":
+			iloc = &children[i]
+		case "idat":
+			idat = &children[i]
+		}
+	}
+	if iinf == nil || iloc == nil {
+		return nil, errors.New("no iinf or iloc box")
+	}
+	targets, err := heifMetadataItems(data, *iinf)
+	if err != nil {
+		return nil, err
+	}
+
+	out := bytes.Clone(data)
+	r := &boxReader{b: data[iloc.body:iloc.end]}
+	version := r.u8()
+	r.take(3)
+	sizes := r.u8()
+	offsetSize, lengthSize := sizes>>4, sizes&0xF
+	sizes = r.u8()
+	baseOffsetSize, indexSize := sizes>>4, 0
+	if version == 1 || version == 2 {
+		indexSize = sizes & 0xF
+	}
+	count := 0
+	if version < 2 {
+		count = r.u16()
+	} else {
+		count = r.u32()
+	}
+	for k := 0; k < count && r.err == nil; k++ {
+		id := 0
+		if version < 2 {
+			id = r.u16()
+		} else {
+			id = r.u32()
+		}
+		method := 0
+		if version == 1 || version == 2 {
+			method = r.u16() & 0xF
+		}
+		dataRef := r.u16()
+		base := r.uN(baseOffsetSize)
+		extents := r.u16()
+		for e := 0; e < extents && r.err == nil; e++ {
+			if indexSize > 0 {
+				r.uN(indexSize)
+			}
+			extentOffset := r.uN(offsetSize)
+			length := r.uN(lengthSize)
+			if !targets[id] {
+				continue
+			}
+			// 0 は「ファイルの終わりまで」、dataRef が 0 でなければ別の
+			// ファイル。どちらも写真では使われないので、扱わずに断る。
+			if length <= 0 || dataRef != 0 {
+				return nil, fmt.Errorf("item %d has an unsupported extent", id)
+			}
+			// 8 バイトの値は int に収まらず負になることもある。足して
+			// 桁あふれしないよう、足す前にどれもファイルの大きさで抑える。
+			if base < 0 || base > len(data) || extentOffset < 0 || extentOffset > len(data) {
+				return nil, fmt.Errorf("item %d is out of the file", id)
+			}
+			offset := base + extentOffset
+			switch method {
+			case 0:
+			case 1:
+				if idat == nil {
+					return nil, fmt.Errorf("item %d refers to a missing idat", id)
+				}
+				offset += idat.body
+			default:
+				return nil, fmt.Errorf("item %d uses construction method %d", id, method)
+			}
+			if offset < 0 || length > len(out) || offset > len(out)-length {
+				return nil, fmt.Errorf("item %d is out of the file", id)
+			}
+			clear(out[offset : offset+length])
+		}
+		delete(targets, id)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(targets) > 0 {
+		return nil, errors.New("metadata item without a location")
+	}
+	return out, nil
+}
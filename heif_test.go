@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func isoBoxBytes(typ string, body ...[]byte) []byte {
+	b := bytes.Join(body, nil)
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(b)))
+	return append(append(out, typ...), b...)
+}
+
+func infeBytes(id uint16, itemType string, rest string) []byte {
+	b := []byte{2, 0, 0, 0}
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = append(b, itemType...)
+	return isoBoxBytes("infe", b, []byte(rest))
+}
+
+// heicWithMetadata は画像・EXIF・XMP の3つの item を mdat に持つ HEIC を作る。
+func heicWithMetadata() []byte {
+	payloads := [][]byte{
+		[]byte("HEVC-IMAGE-DATA"),
+		[]byte("\x00\x00\x00\x00MM\x00\x2aGPSLatitude 35.6"),
+		[]byte(`<x:xmpmeta><exif:GPSLatitude>35,36N</exif:GPSLatitude></x:xmpmeta>`),
+	}
+	build := func(mdatStart int) []byte {
+		ftyp := isoBoxBytes("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+		iinf := isoBoxBytes("iinf", []byte{0, 0, 0, 0, 0, 3},
+			infeBytes(1, "hvc1", "\x00"),
+			infeBytes(2, "Exif", "\x00"),
+			infeBytes(3, "mime", "\x00application/rdf+xml\x00"))
+		iloc := []byte{0, 0, 0, 0, 0x44, 0x00}
+		iloc = binary.BigEndian.AppendUint16(iloc, 3)
+		offset := mdatStart
+		for i, p := range payloads {
+			iloc = binary.BigEndian.AppendUint16(iloc, uint16(i+1))
+			iloc = binary.BigEndian.AppendUint16(iloc, 0)
+			iloc = binary.BigEndian.AppendUint16(iloc, 1)
+			iloc = binary.BigEndian.AppendUint32(iloc, uint32(offset))
+			iloc = binary.BigEndian.AppendUint32(iloc, uint32(len(p)))
+			offset += len(p)
+		}
+		meta := isoBoxBytes("meta", []byte{0, 0, 0, 0}, iinf, isoBoxBytes("iloc", iloc))
+		return append(append(ftyp, meta...), isoBoxBytes("mdat", payloads...)...)
+	}
+	head := build(0)
+	return build(len(head) - len(bytes.Join(payloads, nil)))
+}
+
+// HEIC は描き直せないので、EXIF と XMP の中身だけを消して画像は残すこと。
+func TestProcessImageStripsHEICMetadata(t *testing.T) {
+	data := heicWithMetadata()
+	got, err := processImage(data, "IMG_0001.HEIC", "application/octet-stream", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(got.Data, []byte("GPSLatitude")) {
+		t.Error("the location is left")
+	}
+	if !bytes.Contains(got.Data, []byte("HEVC-IMAGE-DATA")) || len(got.Data) != len(data) {
+		t.Error("the image data was changed")
+	}
+	if got.ContentType != "image/heic" {
+		t.Errorf("ContentType = %q", got.ContentType)
+	}
+	if !bytes.Contains(data, []byte("GPSLatitude")) {
+		t.Error("the input was modified")
+	}
+}
+
+// 場所の分からないメタデータがある HEIC は、残すより断ること。
+func TestProcessImageRejectsBrokenHEIC(t *testing.T) {
+	data := heicWithMetadata()
+	i := bytes.Index(data, []byte("iloc"))
+	data[i+4+6+1] = 2 // item の数を 2 にして XMP の場所を消す
+	if _, err := processImage(data, "IMG_0001.HEIC", "image/heic", 2048); !errors.Is(err, errBadImage) {
+		t.Errorf("processImage = %v, want errBadImage", err)
+	}
+}
+
+// iloc の 8 バイトの値で位置が桁あふれする HEIC も、panic せずに断ること。
+func TestProcessImageRejectsOverflowingHEICExtent(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		base   uint64
+		offset uint64
+	}{
+		{"offset", 0, 1<<63 - 5},
+		{"base", 1<<63 - 1, 10},
+		{"negative", 0, 1<<64 - 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ftyp := isoBoxBytes("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+			iinf := isoBoxBytes("iinf", []byte{0, 0, 0, 0, 0, 1}, infeBytes(1, "Exif", "\x00"))
+			iloc := []byte{0, 0, 0, 0, 0x84, 0x80}
+			iloc = binary.BigEndian.AppendUint16(iloc, 1)
+			iloc = binary.BigEndian.AppendUint16(iloc, 1)
+			iloc = binary.BigEndian.AppendUint16(iloc, 0)
+			iloc = binary.BigEndian.AppendUint64(iloc, tt.base)
+			iloc = binary.BigEndian.AppendUint16(iloc, 1)
+			iloc = binary.BigEndian.AppendUint64(iloc, tt.offset)
+			iloc = binary.BigEndian.AppendUint32(iloc, 20)
+			meta := isoBoxBytes("meta", []byte{0, 0, 0, 0}, iinf, isoBoxBytes("iloc", iloc))
+			data := append(append(ftyp, meta...), isoBoxBytes("mdat", []byte("\x00\x00\x00\x00MM\x00\x2aGPS"))...)
+			if _, err := processImage(data, "IMG_0001.HEIC", "image/heic", 2048); !errors.Is(err, errBadImage) {
+				t.Errorf("processImage = %v, want errBadImage", err)
+			}
+		})
+	}
+}
+
+func TestHEIFContentType(t *testing.T) {
+	for _, tt := range []struct {
+		brands string
+		want   string
+	}{
+		{"heic\x00\x00\x00\x00mif1heic", "image/heic"},
+		{"mif1\x00\x00\x00\x00mif1heic", "image/heic"},
+		{"avif\x00\x00\x00\x00mif1avif", "image/avif"},
+		{"mif1\x00\x00\x00\x00mif1", "image/heif"},
+		{"isom\x00\x00\x00\x00isomavc1", ""},
+	} {
+		got, _ := heifContentType(isoBoxBytes("ftyp", []byte(tt.brands)))
+		if got != tt.want {
+			t.Errorf("heifContentType(%q) = %q, want %q", tt.brands, got, tt.want)
+		}
+	}
+}
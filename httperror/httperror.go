@@ -43,6 +43,9 @@ func StatusForbidden(message string, root error) HttpError {
 func StatusBadRequest(message string, root error) HttpError {
 	return newStatusError(http.StatusBadRequest, message, root)
 }
+func StatusGone(message string, root error) HttpError {
+	return newStatusError(http.StatusGone, message, root)
+}
 func StatusUnprocessableEntity(message string, root error) HttpError {
 	return newStatusError(http.StatusUnprocessableEntity, message, root)
 }
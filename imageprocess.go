@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// 画像は置く前にここを通す。スマートフォンの写真は EXIF に撮影場所 (GPS)
+// を持っているので、デコードして描き直すことでメタデータを落とす。ついでに
+// 大きすぎる画像を縮め、添付に載せる大きさと blurhash を求める。
+//
+// Lambda では CGO_ENABLED=0 で build するので、標準ライブラリと
+// golang.org/x/image だけで済ませる (libvips 等は使えない)。
+
+// maxImagePixels はデコードする画像の画素数の上限。小さなファイルでも
+// 巨大な画像を名乗ってメモリを食い潰せる (decompression bomb) ので、
+// デコードする前にヘッダで見る。
+//
+// 上限は template.yml の Function の MemorySize (512MB) から決めている。
+// 最悪は 16bit の PNG で 1 画素 8 バイトなので、24M 画素で 192MB。画像は
+// 1枚ずつデコードする (imageAttachmentsFromRequest) ので、これに縮めた
+// 画像と multipart のボディ (8MB まで) が乗っても収まる。24M 画素あれば
+// スマートフォンの写真 (12M〜24M 画素) は通る。
+const maxImagePixels = 24_000_000
+
+// blurhashSourceEdge は blurhash を求める前に縮める大きさ。ぼかしの計算は
+// 画素数に比例して重いが、この程度で結果はほとんど変わらない。
+const blurhashSourceEdge = 64
+
+// jpegQuality は JPEG を描き直すときの品質。
+const jpegQuality = 90
+
+// processedImage は置く前の処理を済ませた画像。Width・Height・Blurhash は
+// デコードできない形式 (HEIC 等) では空。
+type processedImage struct {
+	Data        []byte
+	Filename    string
+	ContentType string
+	Width       int
+	Height      int
+	Blurhash    string
+}
+
+// errBadImage は送られてきた画像を処理できないこと。送った側の誤りなので
+// 422 にする。
+var errBadImage = errors.New("cannot process the image")
+
+// processImage は画像を置ける形にする。
+//
+//   - JPEG・PNG・WebP はデコードして描き直す。メタデータはこれで落ちる。
+//     JPEG の向き (EXIF の Orientation) は落とす前に画素へ反映する。
+//     長辺が maxEdge を超えていれば縮める。WebP は Go で書き出せないので、
+//     透過があれば PNG、無ければ JPEG にする。
+//   - GIF はアニメーションを壊さないよう、全部のコマを読んで書き直す
+//     (gif.go)。コメントや XMP の拡張はこれで落ちる。blurhash は最初の
+//     コマから求める。
+//   - HEIF (HEIC・AVIF) は Go でデコードできないので、EXIF と XMP だけを
+//     塗りつぶして置く (heif.go)。
+//   - それ以外は断る。メタデータを落とせないものや、画像でないものを置き場所
+//     に渡さないため。Content-Type は送られてきたものではなく中身で決める。
+func processImage(data []byte, filename string, contentType string, maxEdge int) (*processedImage, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		ct, ok := heifContentType(data)
+		if !ok {
+			return nil, fmt.Errorf("%v: %w: unsupported format %q", filename, errBadImage, contentType)
+		}
+		stripped, err := stripHEIFMetadata(data)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w: cannot strip the metadata: %v", filename, errBadImage, err)
+		}
+		return &processedImage{Data: stripped, Filename: filename, ContentType: ct}, nil
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, fmt.Errorf("%v: %w: %dx%d is more than %d pixels", filename, errBadImage, cfg.Width, cfg.Height, maxImagePixels)
+	}
+	if format == "gif" {
+		pixels, err := gifFramePixels(data)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w: reading the gif failed: %v", filename, errBadImage, err)
+		}
+		if pixels > maxImagePixels {
+			return nil, fmt.Errorf("%v: %w: the frames have %d pixels, more than %d", filename, errBadImage, pixels, maxImagePixels)
+		}
+		cleaned, g, err := reencodeGIF(data)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w: re-encoding the gif failed: %v", filename, errBadImage, err)
+		}
+		return &processedImage{
+			Data:        cleaned,
+			Filename:    filename,
+			ContentType: "image/gif",
+			Width:       cfg.Width,
+			Height:      cfg.Height,
+			Blurhash:    blurhash(scaleToFit(g.Image[0], blurhashSourceEdge, xdraw.ApproxBiLinear)),
+		}, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w: decoding %v failed: %v", filename, errBadImage, format, err)
+	}
+
+	// 回すのは縮めた後にする。縮める前に回すと、元の大きさの複製を
+	// 作ることになる。長辺で縮めるので、先に縮めても大きさは変わらない。
+	if maxEdge > 0 {
+		img = scaleToFit(img, maxEdge, xdraw.CatmullRom)
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	out := &bytes.Buffer{}
+	result := &processedImage{Filename: filename}
+	if format == "png" || (format == "webp" && !isOpaque(img)) {
+		if err := png.Encode(out, img); err != nil {
+			return nil, err
+		}
+		result.ContentType = "image/png"
+		result.Filename = replaceExt(filename, ".png")
+	} else {
+		if err := jpeg.Encode(out, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, err
+		}
+		result.ContentType = "image/jpeg"
+		if format != "jpeg" {
+			result.Filename = replaceExt(filename, ".jpg")
+		}
+	}
+	b := img.Bounds()
+	result.Data = out.Bytes()
+	result.Width, result.Height = b.Dx(), b.Dy()
+	result.Blurhash = blurhash(scaleToFit(img, blurhashSourceEdge, xdraw.ApproxBiLinear))
+	return result, nil
+}
+
+// scaleToFit は img の長辺が maxEdge を超えていれば、縦横比を保って縮める。
+// 超えていなければ img をそのまま返す。
+func scaleToFit(img image.Image, maxEdge int, scaler xdraw.Scaler) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxEdge && h <= maxEdge {
+		return img
+	}
+	if w >= h {
+		w, h = maxEdge, max(1, h*maxEdge/w)
+	} else {
+		w, h = max(1, w*maxEdge/h), maxEdge
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	scaler.Scale(dst, dst.Bounds(), img, b, xdraw.Src, nil)
+	return dst
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+func replaceExt(filename string, ext string) string {
+	return strings.TrimSuffix(filename, path.Ext(filename)) + ext
+}
+
+// jpegOrientation は JPEG の EXIF にある Orientation (1〜8) を返す。無い・
+// 読めないときは 1 (そのまま)。
+//
+// 写真の画素は撮ったときのセンサーの向きのまま保存され、見せる向きは
+// Orientation で示される。EXIF を落とすと向きの情報も消えるので、先に
+// 読んで画素を回しておく。
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		// SOS 以降は画像データで、APP1 はもう来ない。
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		if size < 2 || i+2+size > len(data) {
+			return 1
+		}
+		seg := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return exifOrientation(seg[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+// exifOrientation は TIFF 形式の EXIF の IFD0 から Orientation (0x0112) を
+// 拾う。
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	n := int(order.Uint16(tiff[ifd : ifd+2]))
+	for k := 0; k < n; k++ {
+		e := ifd + 2 + k*12
+		if e+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[e:e+2]) == 0x0112 {
+			if o := int(order.Uint16(tiff[e+8 : e+10])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation は EXIF の Orientation に従って画素を回す・裏返す。
+// 5〜8 は縦横が入れ替わる。img が NRGBA (scaleToFit で縮めたもの) なら
+// そのまま読み、複製は回した先の1枚だけにする。
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	src, ok := img.(*image.NRGBA)
+	if !ok || b.Min != (image.Point{}) {
+		src = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // 左右反転
+				dx, dy = w-1-x, y
+			case 3: // 180度
+				dx, dy = w-1-x, h-1-y
+			case 4: // 上下反転
+				dx, dy = x, h-1-y
+			case 5: // 左上と右下を結ぶ線で反転
+				dx, dy = y, x
+			case 6: // 時計回りに90度
+				dx, dy = h-1-y, x
+			case 7: // 右上と左下を結ぶ線で反転
+				dx, dy = h-1-y, w-1-x
+			case 8: // 反時計回りに90度
+				dx, dy = y, w-1-x
+			}
+			si := src.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func gradient(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x * 6), uint8(y * 8), uint8((x * y) % 256), 255})
+		}
+	}
+	return img
+}
+
+// 他の実装 (github.com/buckket/go-blurhash) と同じ文字列になること。
+func TestBlurhash(t *testing.T) {
+	if got, want := blurhash(gradient(40, 30)), "LqG91|2mwtX3l[WTjuf9gFfkfTfm"; got != want {
+		t.Errorf("blurhash = %q, want %q", got, want)
+	}
+}
+
+// jpegWithEXIF は APP1 に Orientation と GPS の領域を持つ JPEG を作る。
+func jpegWithEXIF(t *testing.T, img image.Image, orientation uint16) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	tiff := &bytes.Buffer{}
+	tiff.WriteString("MM")
+	_ = binary.Write(tiff, binary.BigEndian, uint16(42))
+	_ = binary.Write(tiff, binary.BigEndian, uint32(8))
+	_ = binary.Write(tiff, binary.BigEndian, uint16(1))
+	// tag, type (SHORT), count, value
+	_ = binary.Write(tiff, binary.BigEndian, []uint16{0x0112, 3})
+	_ = binary.Write(tiff, binary.BigEndian, uint32(1))
+	_ = binary.Write(tiff, binary.BigEndian, []uint16{orientation, 0})
+	_ = binary.Write(tiff, binary.BigEndian, uint32(0))
+	tiff.WriteString("GPSLatitude 35.6")
+	seg := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+
+	out := &bytes.Buffer{}
+	out.Write(buf.Bytes()[:2])
+	out.Write([]byte{0xFF, 0xE1})
+	_ = binary.Write(out, binary.BigEndian, uint16(len(seg)+2))
+	out.Write(seg)
+	out.Write(buf.Bytes()[2:])
+	return out.Bytes()
+}
+
+// 写真の EXIF は落とし、向きは画素に反映すること。
+func TestProcessImageStripsEXIF(t *testing.T) {
+	data := jpegWithEXIF(t, gradient(40, 20), 6)
+	if got := jpegOrientation(data); got != 6 {
+		t.Fatalf("jpegOrientation = %v", got)
+	}
+	got, err := processImage(data, "IMG_0001.JPG", "image/jpeg", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(got.Data, []byte("Exif")) || bytes.Contains(got.Data, []byte("GPSLatitude")) {
+		t.Error("the EXIF is left")
+	}
+	if got.Width != 20 || got.Height != 40 || got.ContentType != "image/jpeg" || got.Filename != "IMG_0001.JPG" || got.Blurhash == "" {
+		t.Errorf("processed = %+v", got)
+	}
+	if cfg, err := jpeg.DecodeConfig(bytes.NewReader(got.Data)); err != nil || cfg.Width != 20 || cfg.Height != 40 {
+		t.Errorf("DecodeConfig = %+v, %v", cfg, err)
+	}
+}
+
+// 縮めてから回しても、回した向きで長辺が上限に収まること。
+func TestProcessImageResizesRotatedPhoto(t *testing.T) {
+	got, err := processImage(jpegWithEXIF(t, gradient(400, 200), 6), "IMG_0002.JPG", "image/jpeg", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Width != 50 || got.Height != 100 {
+		t.Errorf("processed = %dx%d, want 50x100", got.Width, got.Height)
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	red := color.NRGBA{255, 0, 0, 255}
+	src.Set(0, 0, red)
+	for o, want := range map[int]image.Point{2: {1, 0}, 3: {1, 0}, 4: {0, 0}, 5: {0, 0}, 6: {0, 0}, 7: {0, 1}, 8: {0, 1}} {
+		got := applyOrientation(src, o)
+		if got.At(want.X, want.Y) != red {
+			t.Errorf("orientation %v: the red pixel is not at %v", o, want)
+		}
+	}
+}
+
+// 長辺が上限を超える画像は縦横比を保って縮めること。
+func TestProcessImageResizes(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, gradient(400, 200)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := processImage(buf.Bytes(), "shot.png", "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Width != 100 || got.Height != 50 || got.ContentType != "image/png" {
+		t.Errorf("processed = %+v", got)
+	}
+}
+
+// メタデータを落とせない形式や画像でないものは、名乗った Content-Type に
+// 関わらず断ること。
+func TestProcessImageRejectsUnknownFormats(t *testing.T) {
+	for _, data := range []string{"fake-heic-bytes", "<svg xmlns=\"http://www.w3.org/2000/svg\"/>"} {
+		if got, err := processImage([]byte(data), "IMG_0001.heic", "image/heic", 2048); !errors.Is(err, errBadImage) {
+			t.Errorf("processImage(%q) = %+v, %v, want errBadImage", data, got, err)
+		}
+	}
+}
+
+// 画素数の大きすぎる画像はデコードする前に断ること。
+func TestProcessImageRejectsTooManyPixels(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// IHDR の幅と高さを書き換え、CRC を付け直す。
+	binary.BigEndian.PutUint32(data[16:20], 10000)
+	binary.BigEndian.PutUint32(data[20:24], 10000)
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	if _, err := processImage(data, "bomb.png", "image/png", 2048); !errors.Is(err, errBadImage) {
+		t.Errorf("processImage = %v, want errBadImage", err)
+	}
+}
+
+// GIF のコメントや XMP は落とし、アニメーションは残すこと。
+func TestProcessImageStripsGIFExtensions(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	src := &gif.GIF{LoopCount: 0}
+	for i := 0; i < 2; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 4, 3), palette)
+		frame.SetColorIndex(i, 0, 1)
+		src.Image = append(src.Image, frame)
+		src.Delay = append(src.Delay, 10)
+	}
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, src); err != nil {
+		t.Fatal(err)
+	}
+	// 画面記述子 (と大域カラーテーブル) の後に、コメント拡張と XMP の
+	// アプリケーション拡張を差し込む。
+	encoded := buf.Bytes()
+	head := 13
+	if encoded[10]&0x80 != 0 {
+		head += 3 << (encoded[10]&7 + 1)
+	}
+	comment := append([]byte{0x21, 0xFE, 16}, "GPSLatitude 35.6\x00"...)
+	xmp := []byte("<x:xmpmeta><exif:GPSLatitude>35,36N</exif:GPSLatitude></x:xmpmeta>")
+	app := append([]byte{0x21, 0xFF, 11}, "XMP DataXMP"...)
+	app = append(append(app, byte(len(xmp))), xmp...)
+	app = append(app, 0)
+	data := append(append(append(append([]byte{}, encoded[:head]...), comment...), app...), encoded[head:]...)
+
+	got, err := processImage(data, "anim.gif", "image/gif", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(got.Data, []byte("GPSLatitude")) || bytes.Contains(got.Data, []byte("XMP DataXMP")) {
+		t.Error("the metadata is left")
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(got.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 2 || g.Delay[1] != 10 || g.LoopCount != 0 {
+		t.Errorf("the animation was changed: %d frames, delay %v, loop %v", len(g.Image), g.Delay, g.LoopCount)
+	}
+	if got.Width != 4 || got.Height != 3 || got.ContentType != "image/gif" || got.Blurhash == "" {
+		t.Errorf("processed = %+v", got)
+	}
+}
+
+// コマの画素数の和が大きすぎる GIF はデコードする前に断ること。
+func TestProcessImageRejectsTooManyGIFFramePixels(t *testing.T) {
+	data := []byte("GIF89a")
+	data = binary.LittleEndian.AppendUint16(data, 1000)
+	data = binary.LittleEndian.AppendUint16(data, 1000)
+	data = append(data, 0, 0, 0)
+	for i := 0; i < 30; i++ {
+		data = append(data, 0x2C, 0, 0, 0, 0)
+		data = binary.LittleEndian.AppendUint16(data, 1000)
+		data = binary.LittleEndian.AppendUint16(data, 1000)
+		data = append(data, 0, 2, 0)
+	}
+	data = append(data, 0x3B)
+	if _, err := processImage(data, "bomb.gif", "image/gif", 2048); !errors.Is(err, errBadImage) || !strings.Contains(err.Error(), "pixels") {
+		t.Errorf("processImage = %v, want errBadImage for the pixels", err)
+	}
+}
@@ -47,6 +47,14 @@ func postInboxHandler(w http.ResponseWriter, r *http.Request) httperror.HttpErro
 		return httperror.StatusUnprocessableEntity("activity has no type", nil)
 	}
 
+	// ブロックした相手は鍵を取りに行く前に弾く。名乗っているだけの actor
+	// で判断しているが、弾く方向にしか使わないので偽装されても困らない。
+	// 4xx を返せば相手はリトライしない。
+	keyID, _ := httpsigclient.KeyIDFromRequest(r)
+	if blockedSender(ctx, in.Actor.ID(), keyID) {
+		return httperror.StatusForbidden(fmt.Sprintf("%v is blocked", in.Actor.ID()), nil)
+	}
+
 	if herr := authenticateInbox(ctx, actor, r, body, in); herr != nil {
 		return herr
 	}
@@ -96,14 +104,18 @@ func dispatchInbox(w http.ResponseWriter, r *http.Request, actor *config.ActorCo
 		return acceptHandler(w, r, actor, in)
 	case activitystream.RejectType:
 		return rejectHandler(w, r, actor, in)
-	case activitystream.CreateType, activitystream.UpdateType:
+	case activitystream.CreateType:
 		return createHandler(w, r, actor, in)
+	case activitystream.UpdateType:
+		return updateHandler(w, r, actor, in)
 	case activitystream.AnnounceType:
 		return announceHandler(w, r, actor, in)
 	case activitystream.LikeType:
 		return likeHandler(w, r, actor, in)
 	case activitystream.DeleteType:
 		return deleteHandler(w, r, actor, in)
+	case activitystream.BlockType:
+		return blockHandler(w, r, actor, in)
 	}
 	// 知らない type をエラーにすると送信元が延々リトライするため、
 	// 受け取ったことにして捨てる。
@@ -112,8 +124,9 @@ func dispatchInbox(w http.ResponseWriter, r *http.Request, actor *config.ActorCo
 	return nil
 }
 
-// dispatchSubActorInbox は bot 等 sub actor の inbox。Follow / Undo に加え、
-// 自分の投稿への Like・Announce・返信 (Create/Update) を通知にする。
+// dispatchSubActorInbox は bot 等 sub actor の inbox。Follow / Block / Undo
+// に加え、自分の投稿への Like・Announce・返信 (Create) を通知にし、その
+// 返信の編集 (Update) を反映する。
 //
 // sub actor は誰もフォローせず following・timeline を持たないため、
 // 「フォロー相手の投稿をタイムラインに流す」経路 (announceHandler の他人の
@@ -132,12 +145,16 @@ func dispatchSubActorInbox(w http.ResponseWriter, r *http.Request, actor *config
 		return likeHandler(w, r, actor, in)
 	case activitystream.AnnounceType:
 		return announceHandler(w, r, actor, in)
-	case activitystream.CreateType, activitystream.UpdateType:
+	case activitystream.CreateType:
 		return createHandler(w, r, actor, in)
+	case activitystream.UpdateType:
+		return updateHandler(w, r, actor, in)
+	case activitystream.BlockType:
+		return blockHandler(w, r, actor, in)
 	case activitystream.UndoType:
 		if inner := in.Object.Item(); inner != nil {
 			switch inner.Type {
-			case activitystream.FollowType, activitystream.LikeType, activitystream.AnnounceType:
+			case activitystream.FollowType, activitystream.LikeType, activitystream.AnnounceType, activitystream.BlockType:
 				return undoHandler(w, r, actor, in)
 			}
 		}
@@ -380,6 +397,10 @@ func deleteHandler(w http.ResponseWriter, r *http.Request, actor *config.ActorCo
 		if err := removeFromTimeline(ctx, target); err != nil {
 			logf("removing %v from the timeline failed: %v", target, err)
 		}
+		forgetRemoteReply(ctx, target, in.Actor.ID())
+		if sameOrigin(target, in.Actor.ID()) {
+			forgetRemoteNote(ctx, target)
+		}
 		// 自分宛だった投稿が消されたときだけ通知にする。フォロー相手は
 		// 自分の投稿を消すたびに Delete を全フォロワーに配信するので、
 		// 全部通知にするとノイズにしかならない。
@@ -529,17 +550,19 @@ func followHandler(w http.ResponseWriter, r *http.Request, actor *config.ActorCo
 		return nil
 	}
 
-	// Lambda はレスポンスを返した時点で実行環境を凍結するため、goroutine に
-	// 投げた Accept は大抵送信されないまま殺される。同期的に送る。
-	if err := sendAccept(ctx, actor, in, remote.InboxURI()); err != nil {
-		return httperror.StatusInternalServerError("failed to send Accept", err)
+	// Accept も配信キューに積む。相手のサーバが一時的に落ちていても
+	// キューが再試行する。積めなければ 500 を返し、Follow を再送させる。
+	accept := activitystream.NewAccept(in, actor.ID(), newActivityID("accept"))
+	if err := enqueueDelivery(ctx, actor.LocalPart(), remote.InboxURI(), accept); err != nil {
+		return httperror.StatusInternalServerError("cannot queue the Accept", err)
 	}
 	logf("accepted follow from %v", actorID)
 	respondText(w, http.StatusAccepted, "accepted\n")
 	return nil
 }
 
-// undoHandler は Undo(Follow) / Undo(Like) / Undo(Announce) を処理する。
+// undoHandler は Undo(Follow) / Undo(Like) / Undo(Announce) / Undo(Block) を
+// 処理する。
 // 内側の type で分岐する。primary / sub actor どちらの inbox からも呼ばれる。
 func undoHandler(w http.ResponseWriter, r *http.Request, actor *config.ActorConfig, in *activitystream.Object) httperror.HttpError {
 	ctx := r.Context()
@@ -586,6 +609,14 @@ func undoHandler(w http.ResponseWriter, r *http.Request, actor *config.ActorConf
 			notifyOrLog(ctx, owner, in)
 		}
 		logf("%v undid their %v on %v", actorID, inner.Type, target)
+	case inner != nil && inner.Type == activitystream.BlockType:
+		if inner.Actor.ID() != "" && inner.Actor.ID() != actorID {
+			return httperror.StatusUnprocessableEntity("Undo(Block) actor mismatch", nil)
+		}
+		if err := client.DeleteKV(ctx, actorScoped(actor, datastore.KVBlockedBy), actorID); err != nil {
+			return httperror.StatusInternalServerError("cannot forget the block", err)
+		}
+		logf("%v unblocked %v", actorID, actor.ID())
 	default:
 		innerType := ""
 		if inner != nil {
@@ -638,6 +669,13 @@ func createHandler(w http.ResponseWriter, r *http.Request, actor *config.ActorCo
 	if note == nil {
 		return httperror.StatusUnprocessableEntity("Create has no embedded object", nil)
 	}
+	// 自分の投票への票は投稿ではないので、タイムラインにも通知にも出さない。
+	if isVote, err := receiveVote(ctx, in, note); err != nil {
+		return httperror.StatusInternalServerError("cannot record the vote", err)
+	} else if isVote {
+		respondText(w, http.StatusAccepted, "accepted\n")
+		return nil
+	}
 	toMe := notifiesMe(actor, in, note)
 	// フォロー相手の生投稿をタイムラインに流す経路は primary actor 専用。
 	// sub actor は following も timeline も持たないので、bot 宛のリプライを
@@ -658,6 +696,13 @@ func createHandler(w http.ResponseWriter, r *http.Request, actor *config.ActorCo
 			}
 		}
 	}
+	// 自分の投稿への返信は、通知とは別に replies の索引にも入れる。署名で
+	// 確かめたのは Create の actor なので、著者が本人で、投稿の id も
+	// 本人のオリジンにあるものに限る (update.go と同じ)。id を見ないと、
+	// 他のサーバの投稿を騙った返信を索引に入れられる。
+	if note.AttributedTo.ID() == in.Actor.ID() && sameOrigin(note.ID, in.Actor.ID()) {
+		recordReply(ctx, actor, note)
+	}
 	// 自分宛のものだけ通知にする。フォロー相手同士の会話まで通知にすると
 	// タイムラインの写しになって役に立たない。
 	if toMe {
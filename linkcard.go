@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/datastore"
+	"golang.org/x/net/html"
+)
+
+// リンクのプレビュー (カード)。投稿の本文にある最初のリンク (メンションと
+// ハッシュタグを除く) の OpenGraph / Twitter Card のメタデータを引き、
+// 投稿の下にカードとして出す。
+//
+// 引くのは描画するとき。引いた結果は KV に TTL 付きで控え、同じ URL を
+// ページを開くたびに取りに行かない。引けなかったことも控える (短めの
+// TTL で)。落ちているサイトへのリンクを含む投稿があるだけで、毎回
+// タイムアウトまで待たされるため。
+
+// linkCardTTL は引けたカードを控える期間、linkCardMissTTL は引けなかった
+// ことを控える期間。
+const (
+	linkCardTTL     = 24 * time.Hour
+	linkCardMissTTL = time.Hour
+)
+
+// maxLinkCardBody はカードを作るために読む HTML の上限。メタデータは
+// head にあるので、先頭だけ読めば足りる。
+const maxLinkCardBody = 512 << 10 // 512KiB
+
+// linkCardTimeout は1つのリンクを引くのに待つ時間。描画を待たせるので
+// 短くする。
+const linkCardTimeout = 5 * time.Second
+
+// カードに出す題と説明の長さの上限。
+const (
+	linkCardTitleLength       = 200
+	linkCardDescriptionLength = 300
+)
+
+// linkCard はリンクのプレビュー。Image は無いこともある。
+type linkCard struct {
+	URL         string
+	Title       string
+	Description string
+	Image       string
+	SiteName    string
+}
+
+// linkCardClient はリンクを引く HTTP クライアント。リダイレクト先にも
+// isFetchableURI を効かせる。最初の URL だけ見ても、内部アドレスへ
+// リダイレクトされれば意味が無い。
+var linkCardClient = &http.Client{
+	Timeout: linkCardTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if !isFetchableURI(req.URL.String()) {
+			return fmt.Errorf("refusing to follow a redirect to %v", req.URL)
+		}
+		return nil
+	},
+}
+
+// noteLinkURL は note のカードにするリンクを返す。無ければ空。
+//
+// 添付・投票・引用のある投稿にはカードを付けない (Mastodon と同じ)。
+// メンションとハッシュタグのリンクは tag の href と class で見分ける。
+func noteLinkURL(note *activitystream.Object) string {
+	if note == nil || len(note.Attachment) > 0 || note.Type == activitystream.QuestionType || note.QuotedURI() != "" {
+		return ""
+	}
+	skip := map[string]bool{}
+	for _, t := range note.Tag {
+		if t.Href != "" {
+			skip[t.Href] = true
+		}
+	}
+	z := html.NewTokenizer(strings.NewReader(note.Content))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "a" || !hasAttr {
+				continue
+			}
+			var href, class, rel string
+			for more := true; more; {
+				var k, v []byte
+				k, v, more = z.TagAttr()
+				switch string(k) {
+				case "href":
+					href = string(v)
+				case "class":
+					class = string(v)
+				case "rel":
+					rel = string(v)
+				}
+			}
+			if href == "" || skip[href] || hasWord(class, "mention") || hasWord(class, "hashtag") || hasWord(rel, "tag") {
+				continue
+			}
+			if u, err := url.Parse(href); err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" {
+				return href
+			}
+		}
+	}
+}
+
+// hasWord は空白区切りの属性値 (class や rel) が word を含むかを返す。
+func hasWord(attr string, word string) bool {
+	for _, w := range strings.Fields(attr) {
+		if strings.EqualFold(w, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchLinkCard は uri を引いてカードを作る。内部アドレスとブロックした
+// ドメインは引かない。
+func fetchLinkCard(ctx context.Context, uri string) (*linkCard, error) {
+	if !isFetchableURI(uri) {
+		return nil, fmt.Errorf("refusing to fetch %v", uri)
+	}
+	if domainBlocked(ctx, hostOf(uri)) {
+		return nil, fmt.Errorf("refusing to fetch %v from a blocked domain", uri)
+	}
+	return getLinkCard(ctx, uri)
+}
+
+// getLinkCard は uri の HTML を先頭 maxLinkCardBody だけ読んでカードを
+// 作る。題が無ければカードにしない。
+func getLinkCard(ctx context.Context, uri string) (*linkCard, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	resp, err := linkCardClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %v failed: %w", uri, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %v returned %v", uri, resp.Status)
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "text/html" && mediaType != "application/xhtml+xml") {
+		return nil, fmt.Errorf("%v is not HTML (%v)", uri, resp.Header.Get("Content-Type"))
+	}
+	// 文字コードの変換はしない。化けたカードを出すよりは出さない。
+	if cs := params["charset"]; cs != "" && !strings.EqualFold(cs, "utf-8") && !strings.EqualFold(cs, "utf8") {
+		return nil, fmt.Errorf("%v is not UTF-8 (%v)", uri, cs)
+	}
+	card := parseLinkCard(io.LimitReader(resp.Body, maxLinkCardBody), resp.Request.URL)
+	if card.Title == "" {
+		return nil, fmt.Errorf("%v has no title", uri)
+	}
+	card.URL = uri
+	return card, nil
+}
+
+// parseLinkCard は HTML の head から OpenGraph・Twitter Card・title を
+// 拾う。og: を優先する。base は画像の相対 URL を解決するのに使う。
+func parseLinkCard(r io.Reader, base *url.URL) *linkCard {
+	meta := map[string]string{}
+	var title string
+	inTitle := false
+	z := html.NewTokenizer(r)
+loop:
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			break loop
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = strings.TrimSpace(string(z.Text()))
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				break loop
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "body":
+				break loop
+			case "title":
+				inTitle = tt == html.StartTagToken
+			case "meta":
+				var key, content string
+				for more := hasAttr; more; {
+					var k, v []byte
+					k, v, more = z.TagAttr()
+					switch string(k) {
+					case "property", "name":
+						if key == "" {
+							key = strings.ToLower(strings.TrimSpace(string(v)))
+						}
+					case "content":
+						content = strings.TrimSpace(string(v))
+					}
+				}
+				if key != "" && content != "" {
+					if _, ok := meta[key]; !ok {
+						meta[key] = content
+					}
+				}
+			}
+		}
+	}
+
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := meta[k]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	card := &linkCard{
+		Title:       clipText(first("og:title", "twitter:title"), linkCardTitleLength),
+		Description: clipText(first("og:description", "twitter:description", "description"), linkCardDescriptionLength),
+		SiteName:    clipText(first("og:site_name"), linkCardTitleLength),
+	}
+	if card.Title == "" {
+		card.Title = clipText(title, linkCardTitleLength)
+	}
+	if img := first("og:image", "og:image:url", "og:image:secure_url", "twitter:image", "twitter:image:src"); img != "" && base != nil {
+		if u, err := base.Parse(img); err == nil && (u.Scheme == "https" || u.Scheme == "http") {
+			card.Image = u.String()
+		}
+	}
+	return card
+}
+
+// clipText は s を max 文字までにする。不正な UTF-8 は捨てる。
+func clipText(s string, max int) string {
+	s = strings.ToValidUTF8(strings.Join(strings.Fields(s), " "), "")
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max]) + "…"
+}
+
+// cachedLinkCard は KV に控えたカードを返す。控えが無い・期限切れなら
+// ok が false。引けなかったことを控えていれば card が nil で ok が true。
+func cachedLinkCard(ctx context.Context, uri string, now time.Time) (card *linkCard, ok bool) {
+	it, err := client.GetKV(ctx, datastore.KVLinkCards, uri)
+	if err != nil {
+		if !errors.Is(err, datastore.ErrNotFound) {
+			logf("reading the link card of %v failed: %v", uri, err)
+		}
+		return nil, false
+	}
+	// DynamoDB の TTL は消すのが遅れるので、自分でも期限を見る。
+	if it.TTL != 0 && it.TTL <= now.Unix() {
+		return nil, false
+	}
+	if it.Name == "" {
+		return nil, true
+	}
+	return &linkCard{URL: uri, Title: it.Name, Description: it.Content, Image: it.IconURL, SiteName: it.Summary}, true
+}
+
+// cacheLinkCard はカードを控える。card が nil なら引けなかったことを控える。
+func cacheLinkCard(ctx context.Context, uri string, card *linkCard, now time.Time) {
+	item := &datastore.KVItem{
+		PK:  datastore.KVLinkCards,
+		SK:  uri,
+		At:  now.UTC().Format(time.RFC3339),
+		TTL: now.Add(linkCardMissTTL).Unix(),
+	}
+	if card != nil {
+		item.Name = card.Title
+		item.Content = card.Description
+		item.IconURL = card.Image
+		item.Summary = card.SiteName
+		item.TTL = now.Add(linkCardTTL).Unix()
+	}
+	if err := client.PutKV(ctx, item); err != nil {
+		logf("caching the link card of %v failed: %v", uri, err)
+	}
+}
+
+// linkCardsFor は uris のカードを同じ順で返す。空の URI と引けなかった
+// ものは nil。控えに無いものは並行して引く。
+func linkCardsFor(ctx context.Context, uris []string) []*linkCard {
+	now := time.Now()
+	cards := make([]*linkCard, len(uris))
+	known := map[string]*linkCard{}
+	missing := map[string][]int{}
+	for i, uri := range uris {
+		if uri == "" {
+			continue
+		}
+		if card, ok := known[uri]; ok {
+			cards[i] = card
+			continue
+		}
+		if idx, ok := missing[uri]; ok {
+			missing[uri] = append(idx, i)
+			continue
+		}
+		if card, ok := cachedLinkCard(ctx, uri, now); ok {
+			known[uri] = card
+			cards[i] = card
+			continue
+		}
+		missing[uri] = []int{i}
+	}
+	var wg sync.WaitGroup
+	for uri, idx := range missing {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			card, err := fetchLinkCard(ctx, uri)
+			if err != nil {
+				logf("fetching the link card of %v failed: %v", uri, err)
+				card = nil
+			}
+			cacheLinkCard(ctx, uri, card, now)
+			// idx は URI ごとに別なので、ロックは要らない。
+			for _, i := range idx {
+				cards[i] = card
+			}
+		}()
+	}
+	wg.Wait()
+	return cards
+}
+
+// resolveLinkCards は items にリンクのカードを付ける。
+func resolveLinkCards(ctx context.Context, items []timelineItem) {
+	uris := make([]string, len(items))
+	for i := range items {
+		uris[i] = items[i].LinkURI
+	}
+	for i, card := range linkCardsFor(ctx, uris) {
+		items[i].Card = card
+	}
+}
+
+// resolveProfileLinkCards はプロフィールの固定した投稿と投稿にリンクの
+// カードを付ける。まとめて1度に引く。
+func resolveProfileLinkCards(ctx context.Context, pinned []profileStatusItem, items []profileStatusItem) {
+	uris := make([]string, 0, len(pinned)+len(items))
+	for _, it := range pinned {
+		uris = append(uris, it.linkURI)
+	}
+	for _, it := range items {
+		uris = append(uris, it.linkURI)
+	}
+	cards := linkCardsFor(ctx, uris)
+	for i := range pinned {
+		pinned[i].Card = cards[i]
+	}
+	for i := range items {
+		items[i].Card = cards[len(pinned)+i]
+	}
+}
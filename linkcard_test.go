@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+// カードにするのは最初の普通のリンク。メンションとハッシュタグは飛ばし、
+// 添付や引用のある投稿には付けないこと。
+func TestNoteLinkURL(t *testing.T) {
+	note := &activitystream.Object{
+		Type: activitystream.NoteType,
+		Content: `<p><span class="h-card"><a href="https://m.example/@alice" class="u-url mention">@alice</a></span> ` +
+			`<a href="https://s.example/tags/cat" class="mention hashtag" rel="tag">#cat</a> ` +
+			`<a href="https://m.example/users/bob">bob</a> <a href="https://news.example/a">記事</a></p>`,
+		Tag: activitystream.Objects{{Type: activitystream.MentionType, Href: "https://m.example/users/bob"}},
+	}
+	if got := noteLinkURL(note); got != "https://news.example/a" {
+		t.Errorf("noteLinkURL = %q", got)
+	}
+	note.Attachment = activitystream.Objects{{Type: activitystream.ImageType, URL: "https://i.example/a.png"}}
+	if got := noteLinkURL(note); got != "" {
+		t.Errorf("noteLinkURL with an attachment = %q", got)
+	}
+	quote := &activitystream.Object{Type: activitystream.NoteType, Content: "<p>x</p>"}
+	applyQuote(quote, "https://m.example/notes/1")
+	if got := noteLinkURL(quote); got != "" {
+		t.Errorf("noteLinkURL of a quote = %q", got)
+	}
+}
+
+func TestParseLinkCard(t *testing.T) {
+	base, _ := url.Parse("https://news.example/articles/1")
+	doc := `<!doctype html><html><head>
+<title>ページの題</title>
+<meta name="twitter:title" content="Twitter の題">
+<meta property="og:title" content="  記事の
+  題 ">
+<meta name="description" content="説明">
+<meta property="og:image" content="/img/a.jpg">
+<meta property="og:site_name" content="ニュース">
+</head><body><meta property="og:description" content="body の中は見ない"></body></html>`
+	got := parseLinkCard(strings.NewReader(doc), base)
+	if got.Title != "記事の 題" || got.Description != "説明" || got.Image != "https://news.example/img/a.jpg" || got.SiteName != "ニュース" {
+		t.Errorf("card = %+v", got)
+	}
+	got = parseLinkCard(strings.NewReader(`<html><head><title>題だけ</title><meta property="og:image" content="javascript:alert(1)"></head></html>`), base)
+	if got.Title != "題だけ" || got.Image != "" {
+		t.Errorf("card = %+v", got)
+	}
+}
+
+// 読むのは先頭だけで、内部アドレスへのリダイレクトには付いていかないこと。
+func TestGetLinkCard(t *testing.T) {
+	t.Setenv("ENV", "")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(`<html><head><meta property="og:title" content="題"></head></html>`))
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><head><!--` + strings.Repeat("x", maxLinkCardBody) + `--><meta property="og:title" content="題"></head></html>`))
+	})
+	mux.HandleFunc("/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	})
+	mux.HandleFunc("/sjis", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=Shift_JIS")
+		_, _ = w.Write([]byte(`<html><head><title>x</title></head></html>`))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	card, err := getLinkCard(ctx, srv.URL+"/ok")
+	if err != nil || card.Title != "題" || card.URL != srv.URL+"/ok" {
+		t.Errorf("/ok = %+v, %v", card, err)
+	}
+	for _, p := range []string{"/large", "/json", "/sjis", "/redirect"} {
+		if card, err := getLinkCard(ctx, srv.URL+p); err == nil {
+			t.Errorf("%v = %+v, want error", p, card)
+		}
+	}
+	if _, err := fetchLinkCard(ctx, srv.URL+"/ok"); err == nil {
+		t.Error("fetchLinkCard fetched an IP address")
+	}
+}
+
+func TestLinkCardRenders(t *testing.T) {
+	page := timelinePage{
+		pageBase: pageBase{Title: "タイムライン", SiteName: "nana", LocalPart: "nana", Handle: "@nana"},
+		Page:     1,
+		Items: []timelineItem{{
+			ObjectURI: "https://m.example/notes/1",
+			LinkURI:   "https://news.example/a",
+			Card:      &linkCard{URL: "https://news.example/a", Title: "記事の題", Description: "説明", Image: "https://news.example/a.jpg"},
+		}},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "timeline", page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<a class="card" href="https://news.example/a"`, `<strong>記事の題</strong>`, `referrerpolicy="no-referrer"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("timeline does not contain %q", want)
+		}
+	}
+}
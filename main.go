@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"slices"
@@ -26,6 +27,7 @@ import (
 	"github.com/nna774/s.nna774.net/webfinger"
 
 	"github.com/akrylysov/algnhsa"
+	"github.com/aws/aws-lambda-go/lambda"
 )
 
 const configFile = "config.yml"
@@ -84,20 +86,111 @@ func setup(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	// make dev では配信キューをプロセス内に持つ。dev サーバ自身が
+	// runDeliveryWorkerLoop で吐き出すので、worker を別に起動しなくてよい。
+	if config.IsDevelopment() {
+		deliveries = newMemoryDeliveryQueue()
+	} else {
+		deliveries = &kvDeliveryQueue{client: client}
+	}
+	media, err = newMediaStore(ctx, Config)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
+// workerEnv は Lambda をどの役割で起動するかを選ぶ環境変数。空なら
+// API Gateway からの HTTP を受ける。template.yml の DeliveryWorker は
+// workerDelivery を設定し、スケジュールで起動されて配信キューを吐き出す。
+// ScheduledPublisher は workerScheduled で、時刻の来た予約投稿を出し、
+// 投票を締め切る。
+const (
+	workerEnv       = "WORKER"
+	workerDelivery  = "delivery"
+	workerScheduled = "scheduled"
+)
+
+// deliveryWorkerHandler は配信 worker としての Lambda の入口。
+// EventBridge のスケジュールイベントの中身は使わない。
+func deliveryWorkerHandler(ctx context.Context) error {
+	return drainDeliveries(ctx, deliveries, time.Now())
+}
+
+// scheduledWorkerHandler は予約投稿 worker としての Lambda の入口。
+// 出した投稿の配信はキューに積むだけで、届けるのは DeliveryWorker。
+func scheduledWorkerHandler(ctx context.Context) error {
+	return runScheduledWork(ctx, time.Now())
+}
+
+// runScheduledWork は時刻の来た予約投稿を出し、締め切りの来た投票を
+// 締め切る。
+func runScheduledWork(ctx context.Context, now time.Time) error {
+	return errors.Join(publishDueStatuses(ctx, now), closeDuePolls(ctx, now))
+}
+
+// devDeliveryInterval は make dev で配信キューを吐き出す間隔。
+const devDeliveryInterval = 10 * time.Second
+
+// runDeliveryWorkerLoop は dev サーバの中で配信キューを定期的に吐き出す。
+// 本番ではスケジュール起動の DeliveryWorker がこれに当たる。
+func runDeliveryWorkerLoop(ctx context.Context) {
+	t := time.NewTicker(devDeliveryInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := drainDeliveries(ctx, deliveries, time.Now()); err != nil {
+				logf("draining deliveries failed: %v", err)
+			}
+		}
+	}
+}
+
+// runScheduledWorkerLoop は dev サーバの中で時刻の来た予約投稿を出し、
+// 投票を締め切る。
+// 本番ではスケジュール起動の ScheduledPublisher がこれに当たる。
+func runScheduledWorkerLoop(ctx context.Context) {
+	t := time.NewTicker(devDeliveryInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := runScheduledWork(ctx, time.Now()); err != nil {
+				logf("the scheduled work failed: %v", err)
+			}
+		}
+	}
+}
+
+// publishScheduledOnce は -publish-scheduled で1度だけ予約投稿を出し、
+// 投票を締め切る。
+// ScheduledPublisher の起動を手元で真似るためのもの。make dev の配信
+// キューはプロセス内にあるので、終わる前にここで吐き出しておく。
+func publishScheduledOnce(ctx context.Context) error {
+	if err := runScheduledWork(ctx, time.Now()); err != nil {
+		return err
+	}
+	return drainDeliveries(ctx, deliveries, time.Now())
+}
+
 const (
 	outboxKey = "outbox"
 	statusKey = "status"
 )
 
 // actorScoped は Actor 固有のリソース (outbox / status / followers /
-// following / mylikes / myboosts / likes / announced / myboostbyid) の
+// following / mylikes / myboosts / likes / announced / myboostbyid /
+// statushistory / blockedby / scheduled / openpolls) の
 // キーに localpart を前置する。primary actor (nana) も含め全 Actor を
 // 対称に扱う。
 //
-// notification / actorkey / seen / actorinfo / cursor はローカル Actor に
+// notification / actorkey / seen / actorinfo / cursor / deliveries /
+// hosthealth / blocks / domainblocks / mutes / filters はローカル Actor に
 // 依存しないインスタンス全体の共有リソースなので、これを通さず素の定数を
 // そのまま使う。
 func actorScoped(actor *config.ActorConfig, name string) string {
@@ -237,6 +330,7 @@ func jsonUserHander(w http.ResponseWriter, r *http.Request, actor *config.ActorC
 	// followers / following と同じく、中身を出すかは favoritesHandler 側で
 	// HideCollections を見て判断する。URI 自体は常に広告してよい。
 	resp.Liked = favoritesURI(actor)
+	resp.Featured = featuredURI(actor)
 	return respondAsJSON(w, http.StatusOK, resp)
 }
 
@@ -356,6 +450,11 @@ func outboxPageHandler(w http.ResponseWriter, r *http.Request) httperror.HttpErr
 	if err != nil {
 		return httperror.StatusInternalServerError("cannot read the outbox", err)
 	}
+	// 境界は direct を除く前の items で決める。除いた後で決めると、
+	// 末尾が direct だったページの次が同じ範囲を指してしまう。
+	bounds := items
+	reader := readerForStatus(ctx, r, actor, items...)
+	items = listableCreates(reader, actor, items)
 	// 昇順で引いた場合も、返すのは常に新しい順に揃える。
 	if order == datastore.Asc {
 		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
@@ -367,16 +466,16 @@ func outboxPageHandler(w http.ResponseWriter, r *http.Request) httperror.HttpErr
 		absoluteURI(r), outboxURI(actor), "", "", items)
 
 	// next はより古い方へ、prev はより新しい方へ。端では省く。
-	if len(items) > 0 {
-		newest, herr := statusIDOf(items[0])
+	if len(bounds) > 0 {
+		newest, herr := statusIDOf(bounds[0])
 		if herr != nil {
 			return herr
 		}
-		oldest, herr := statusIDOf(items[len(items)-1])
+		oldest, herr := statusIDOf(bounds[len(bounds)-1])
 		if herr != nil {
 			return herr
 		}
-		if len(items) == outboxPerPage {
+		if len(bounds) == outboxPerPage {
 			page.Next = fmt.Sprintf("%s/page?until_id=%d", outboxURI(actor), oldest)
 		}
 		page.Prev = fmt.Sprintf("%s/page?since_id=%d", outboxURI(actor), newest)
@@ -439,9 +538,24 @@ func statusHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
 		}
 		return httperror.StatusInternalServerError("cannot load the status", err)
 	}
+	if isTombstone(status) {
+		return goneStatusHandler(w, r, actor, status)
+	}
+	// 読めない相手には、存在を漏らさないよう無い投稿と同じ 404 を返す。
+	if !readerForStatus(r.Context(), r, actor, status).canRead(actor, status) {
+		return httperror.StatusNotFound("no such status", nil)
+	}
+	if restricted(actor, status) {
+		// 読み手によって中身が変わるので、共有キャッシュに載せない。
+		w.Header().Set("Cache-Control", "private")
+	}
 	if !wantsActivityJSON(r) {
 		return htmlStatusHandler(w, r, actor, id, status)
 	}
+	// replies を載せる前に作った投稿にも載せて返す。
+	if status.Replies == nil {
+		status.Replies = activitystream.URIRef(repliesURI(status.ID))
+	}
 	return respondAsJSON(w, http.StatusOK, status)
 }
 
@@ -466,6 +580,11 @@ func saveToOutbox(ctx context.Context, actor *config.ActorConfig, id int, create
 	if err := client.Put(ctx, actorScoped(actor, outboxKey), id, create); err != nil {
 		return err
 	}
+	// 件数は outbox の totalItems とプロフィールの投稿数に出るので、
+	// 見せない direct は数えない。
+	if noteVisibility(create, followersURI(actor)) == visibilityDirect {
+		return nil
+	}
 	_, err := client.Inc(ctx, actorScoped(actor, outboxKey))
 	return err
 }
@@ -514,6 +633,7 @@ func newRouter() *httprouter.Router {
 	pub(r, http.MethodGet, "/u/:user/status/:id", statusHandler)
 	pub(r, http.MethodGet, "/u/:user/status/:id/likes", statusLikesHandler)
 	pub(r, http.MethodGet, "/u/:user/status/:id/announces", statusAnnouncesHandler)
+	pub(r, http.MethodGet, "/u/:user/status/:id/replies", statusRepliesHandler)
 	// newActivityID が発行する Announce.ID (origin/announce/<nano>) を
 	// 引けるようにする。/u/:user 配下ではない (newActivityID がそう
 	// 発行しているため)。
@@ -521,6 +641,10 @@ func newRouter() *httprouter.Router {
 	pub(r, http.MethodGet, "/u/:user/followers", collectionHandler(datastore.KVFollowers, "フォロワー"))
 	pub(r, http.MethodGet, "/u/:user/following", collectionHandler(datastore.KVFollowing, "フォロー中"))
 	pub(r, http.MethodGet, "/u/:user/favorites", favoritesHandler)
+	pub(r, http.MethodGet, "/u/:user/featured", featuredHandler)
+	pub(r, http.MethodGet, "/tags/:tag", tagHandler)
+	pub(r, http.MethodGet, "/emoji/:shortcode", emojiHandler)
+	pub(r, http.MethodGet, "/media/:name", localMediaHandler)
 
 	pub(r, http.MethodGet, "/.well-known/webfinger", webfingerHandler)
 	pub(r, http.MethodGet, "/.well-known/host-meta", hostMetaHandler)
@@ -533,37 +657,93 @@ func newRouter() *httprouter.Router {
 
 	// --- 私用 (認証必須) ------------------------------------------------
 	priv(r, http.MethodGet, "/timeline", false, timelineHandler)
+	priv(r, http.MethodGet, "/thread", false, conversationHandler)
 	priv(r, http.MethodGet, "/notifications", false, notificationsHandler)
 	priv(r, http.MethodGet, "/remote", false, remoteProfileHandler)
 	// 他インスタンスのリモートフォローボタンから辿られる。webfinger の
 	// subscribe テンプレートで広告しているので実装が無いと 404 になる。
 	priv(r, http.MethodGet, "/authorize_interaction", false, authorizeInteractionHandler)
-	// 投稿の作成・削除は全 Actor (primary / sub actor 問わず) が持つ。
-	// bot のような sub actor はこの2つだけが私用エンドポイントで、
-	// following / likes / boosts は primary actor 専用。
+	priv(r, http.MethodGet, "/admin/deliveries", false, adminDeliveriesHandler)
+	// ブロックはインスタンス全体で共有するので :user を持たない。
+	priv(r, http.MethodGet, "/admin/blocks", false, adminBlocksHandler)
+	priv(r, http.MethodPost, "/admin/blocks", true, createBlockHandler)
+	priv(r, http.MethodPost, "/admin/blocks/remove", true, deleteBlockHandler)
+	// ミュートとフィルタ。表示にだけ効き、連合には関わらない。
+	priv(r, http.MethodGet, "/settings/mutes", false, mutesHandler)
+	priv(r, http.MethodPost, "/settings/mutes", true, createMuteHandler)
+	priv(r, http.MethodPost, "/settings/mutes/remove", true, deleteMuteHandler)
+	priv(r, http.MethodPost, "/settings/filters", true, createFilterHandler)
+	priv(r, http.MethodPost, "/settings/filters/remove", true, deleteFilterHandler)
+	// 投稿の作成・削除・編集とフォロワーの管理は全 Actor (primary /
+	// sub actor 問わず) が持つ。bot のような sub actor はこれらだけが私用
+	// エンドポイントで、following / likes / boosts は primary actor 専用。
 	priv(r, http.MethodPost, "/u/:user/statuses", true, postStatusHandler)
 	// HTML の form は DELETE を送れないので、フォーム用に POST 版も用意する。
 	priv(r, http.MethodPost, "/u/:user/statuses/:id/delete", true, deleteStatusHandler)
 	priv(r, http.MethodDelete, "/u/:user/status/:id", true, deleteStatusHandler)
+	priv(r, http.MethodPut, "/u/:user/status/:id", true, editStatusHandler)
+	// 編集も form からは POST で受ける。
+	priv(r, http.MethodGet, "/u/:user/status/:id/edit", false, editStatusFormHandler)
+	priv(r, http.MethodPost, "/u/:user/statuses/:id/edit", true, editStatusHandler)
+	// 固定 (featured への追加) と解除。
+	priv(r, http.MethodPost, "/u/:user/statuses/:id/pin", true, pinStatusHandler)
+	priv(r, http.MethodPost, "/u/:user/statuses/:id/unpin", true, unpinStatusHandler)
+	// AutoAcceptFollow が偽の actor に来たフォロー要求の承認・拒否。
+	// 保留中の要求は followers に pending で積まれている。
+	priv(r, http.MethodGet, "/u/:user/follow_requests", false, followRequestsHandler)
+	priv(r, http.MethodPost, "/u/:user/follow_requests/accept", true, acceptFollowRequestHandler)
+	priv(r, http.MethodPost, "/u/:user/follow_requests/reject", true, rejectFollowRequestHandler)
+	// フォロワーを外す。Reject を送って相手側のフォロー関係も消させる。
+	priv(r, http.MethodPost, "/u/:user/followers/remove", true, removeFollowerHandler)
 	priv(r, http.MethodPost, "/u/:user/following", true, followRequestHandler)
 	priv(r, http.MethodDelete, "/u/:user/following", true, unfollowRequestHandler)
 	priv(r, http.MethodPost, "/u/:user/likes", true, likeRequestHandler)
 	priv(r, http.MethodDelete, "/u/:user/likes", true, unlikeRequestHandler)
 	priv(r, http.MethodPost, "/u/:user/boosts", true, boostRequestHandler)
 	priv(r, http.MethodDelete, "/u/:user/boosts", true, unboostRequestHandler)
+	priv(r, http.MethodPost, "/u/:user/votes", true, voteRequestHandler)
+	// 予約投稿。作るのは scheduled_at を付けた /u/:user/statuses。一覧の
+	// ページは全 actor の分をまとめて出す。form 用に POST 版も用意する。
+	priv(r, http.MethodGet, "/scheduled", false, scheduledHandler)
+	priv(r, http.MethodGet, "/u/:user/scheduled", false, scheduledStatusesHandler)
+	priv(r, http.MethodPut, "/u/:user/scheduled/:id", true, editScheduledHandler)
+	priv(r, http.MethodDelete, "/u/:user/scheduled/:id", true, cancelScheduledHandler)
+	priv(r, http.MethodPost, "/u/:user/scheduled/:id/edit", true, editScheduledHandler)
+	priv(r, http.MethodPost, "/u/:user/scheduled/:id/cancel", true, cancelScheduledHandler)
 
 	return r
 }
 
 func main() {
+	publishOnce := flag.Bool("publish-scheduled", false,
+		"publish due scheduled statuses and close due polls once and exit (what the scheduled worker does)")
+	flag.Parse()
+
 	if err := setup(context.Background()); err != nil {
 		log.Fatalf("startup failed: %v", err)
 	}
 
+	if *publishOnce {
+		if err := publishScheduledOnce(context.Background()); err != nil {
+			log.Fatalf("publishing scheduled statuses failed: %v", err)
+		}
+		return
+	}
+	switch os.Getenv(workerEnv) {
+	case workerDelivery:
+		lambda.Start(deliveryWorkerHandler)
+		return
+	case workerScheduled:
+		lambda.Start(scheduledWorkerHandler)
+		return
+	}
+
 	r := newRouter()
 	h := &stripJSONSuffixHandler{handler: r}
 
 	if config.IsDevelopment() {
+		go runDeliveryWorkerLoop(context.Background())
+		go runScheduledWorkerLoop(context.Background())
 		http.ListenAndServe("localhost:8080", h)
 	} else {
 		algnhsa.ListenAndServe(h, &algnhsa.Options{RequestType: algnhsa.RequestTypeAPIGatewayV1})
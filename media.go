@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/httperror"
+)
+
+// mediaStore は投稿に添付する画像の置き場所。置き場所ごとの事情 (Gyazo の
+// HEIC など) は実装の中に閉じ込め、呼び出し側は URL と mediaType だけを
+// 受け取る。
+type mediaStore interface {
+	// Put は画像を置き、外から読める URL を返す。
+	Put(ctx context.Context, filename string, contentType string, data io.Reader) (*storedMedia, error)
+}
+
+// storedMedia は置いた画像。Note の attachment にそのまま載せる。
+type storedMedia struct {
+	URL       string
+	MediaType string
+}
+
+// media は画像の置き場所。setup で config.yml の media に従って入れる。
+// 置けない (Gyazo のトークンが無い) ときは nil で、画像投稿は使えない。
+var media mediaStore
+
+// newMediaStore は設定に従って画像の置き場所を作る。
+func newMediaStore(ctx context.Context, cnf *config.Config) (mediaStore, error) {
+	switch cnf.MediaBackend() {
+	case config.MediaBackendLocal:
+		return &localMediaStore{dir: cnf.MediaLocalDir(), baseURL: cnf.Origin + "/media/"}, nil
+	case config.MediaBackendS3:
+		s3 := cnf.Media.S3
+		r := s3.Region
+		if r == "" {
+			r = region
+		}
+		awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(r))
+		if err != nil {
+			return nil, err
+		}
+		return newS3MediaStore(s3, r, awsCfg.Credentials), nil
+	default:
+		if cnf.GyazoAccessToken() == "" {
+			return nil, nil
+		}
+		return &gyazoMediaStore{accessToken: cnf.GyazoAccessToken()}, nil
+	}
+}
+
+// mediaType は画像の mediaType を決める。送られてきた Content-Type が
+// 無ければファイル名の拡張子から推測する。
+func mediaType(filename string, contentType string) string {
+	if contentType != "" {
+		return contentType
+	}
+	if t := mime.TypeByExtension(path.Ext(filename)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// mediaKey は置く画像の名前。元のファイル名は使わない。撮った人の名前や
+// 日時が入っていることがあり、推測できる名前で公開したくない。拡張子だけ
+// 残す。ブラウザや配信側が種類を拡張子で判断するため。
+func mediaKey(filename string, contentType string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	ext := strings.ToLower(path.Ext(filename))
+	if ext == "" {
+		if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	return hex.EncodeToString(b) + ext, nil
+}
+
+// --- local -----------------------------------------------------------
+
+// localMediaStore は画像をファイルシステムに置き、/media/ から配る。
+// make dev で Gyazo や S3 に触らずに画像投稿を試すためのもの。
+type localMediaStore struct {
+	dir     string
+	baseURL string
+}
+
+func (s *localMediaStore) Put(ctx context.Context, filename string, contentType string, data io.Reader) (*storedMedia, error) {
+	key, err := mediaKey(filename, contentType)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, key), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return &storedMedia{URL: s.baseURL + key, MediaType: mediaType(filename, contentType)}, nil
+}
+
+// localMediaHandler は localMediaStore が置いた画像を返す。backend が local
+// でなければ 404。
+func localMediaHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	store, ok := media.(*localMediaStore)
+	if !ok {
+		return httperror.StatusNotFound("no such media", nil)
+	}
+	name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+	// :name はスラッシュを含まないが、.. や隠しファイルも拒む。
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return httperror.StatusNotFound("no such media", nil)
+	}
+	p := filepath.Join(store.dir, name)
+	if _, err := os.Stat(p); err != nil {
+		return httperror.StatusNotFound("no such media", err)
+	}
+	// 名前は置くたびに新しく作るので、中身は変わらない。
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFile(w, r, p)
+	return nil
+}
+
+// --- S3 --------------------------------------------------------------
+
+// s3MediaStore は S3 互換のストレージに置く。AWS の SDK の S3 クライアント
+// は使わず、PUT 1回を署名して送るだけにする。依存を増やさずに済み、
+// MinIO 等にもそのまま向けられる。
+type s3MediaStore struct {
+	// endpoint はバケットを含まない URL。path style で bucket を続ける。
+	endpoint  string
+	bucket    string
+	region    string
+	prefix    string
+	publicURL string
+	creds     aws.CredentialsProvider
+	signer    *v4.Signer
+}
+
+func newS3MediaStore(cnf config.S3MediaConfig, region string, creds aws.CredentialsProvider) *s3MediaStore {
+	endpoint := cnf.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	return &s3MediaStore{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    cnf.Bucket,
+		region:    region,
+		prefix:    strings.Trim(cnf.Prefix, "/"),
+		publicURL: strings.TrimSuffix(cnf.PublicURL, "/"),
+		creds:     creds,
+		signer:    v4.NewSigner(),
+	}
+}
+
+func (s *s3MediaStore) Put(ctx context.Context, filename string, contentType string, data io.Reader) (*storedMedia, error) {
+	name, err := mediaKey(filename, contentType)
+	if err != nil {
+		return nil, err
+	}
+	// 日付で分けておく。1つのプレフィックスに全部を置くと一覧が読みにくい。
+	key := time.Now().UTC().Format("2006/01/") + name
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	// 署名に本文のハッシュが要るので、先に読み切る。画像は
+	// maxImageUploadBytes までしか来ない。
+	body, err := io.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	typ := mediaType(filename, contentType)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.endpoint+"/"+s.bucket+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", typ)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	creds, err := s.creds.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("s3: cannot get credentials: %w", err)
+	}
+	if err := s.signer.SignHTTP(ctx, creds, req, payloadHash, "s3", s.region, time.Now()); err != nil {
+		return nil, fmt.Errorf("s3: signing failed: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 upload request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("s3 upload failed: %v: %s", resp.Status, b)
+	}
+	return &storedMedia{URL: s.publicURL + "/" + key, MediaType: typ}, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/nna774/s.nna774.net/config"
+)
+
+func withMediaStore(t *testing.T, store mediaStore) {
+	t.Helper()
+	old := media
+	media = store
+	t.Cleanup(func() { media = old })
+}
+
+// 置いた画像は元の名前を使わずに /media/ から読めること。
+func TestLocalMediaStore(t *testing.T) {
+	store := &localMediaStore{dir: t.TempDir(), baseURL: "https://s.example/media/"}
+	withMediaStore(t, store)
+	got, err := store.Put(context.Background(), "IMG_0001.PNG", "", strings.NewReader("fake-png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got.URL, "https://s.example/media/") || !strings.HasSuffix(got.URL, ".png") ||
+		strings.Contains(got.URL, "IMG_0001") || got.MediaType != "image/png" {
+		t.Fatalf("stored = %+v", got)
+	}
+
+	router := newRouter()
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, strings.TrimPrefix(got.URL, "https://s.example"), nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "fake-png" || !strings.Contains(rec.Header().Get("Cache-Control"), "immutable") {
+		t.Errorf("GET = %v %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+	for _, p := range []string{"/media/missing.png", "/media/..", "/media/.hidden"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %v = %v, want 404", p, rec.Code)
+		}
+	}
+}
+
+// backend が local でなければ /media/ は何も返さないこと。
+func TestLocalMediaHandlerWithoutLocalStore(t *testing.T) {
+	withMediaStore(t, &gyazoMediaStore{accessToken: "test-token"})
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/media/a.png", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET = %v, want 404", rec.Code)
+	}
+}
+
+// S3 互換のストレージ (MinIO 等) には、署名した PUT で path style に置くこと。
+func TestS3MediaStore(t *testing.T) {
+	var gotPath, gotAuth, gotType, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		gotPath, gotAuth, gotType, gotBody = r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("Content-Type"), string(b)
+	}))
+	defer srv.Close()
+
+	creds := aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "minio", SecretAccessKey: "minio123"}, nil
+	})
+	store := newS3MediaStore(config.S3MediaConfig{
+		Bucket: "media", Endpoint: srv.URL + "/", Prefix: "/s/", PublicURL: "https://media.s.example/",
+	}, "ap-northeast-1", creds)
+	got, err := store.Put(context.Background(), "cat.jpg", "image/jpeg", strings.NewReader("fake-jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(gotPath, "/media/s/") || !strings.HasSuffix(gotPath, ".jpg") || gotBody != "fake-jpeg" || gotType != "image/jpeg" {
+		t.Errorf("PUT %v (%v) %q", gotPath, gotType, gotBody)
+	}
+	if !strings.HasPrefix(gotAuth, "AWS4-HMAC-SHA256 Credential=minio/") || !strings.Contains(gotAuth, "/ap-northeast-1/s3/aws4_request") {
+		t.Errorf("Authorization = %q", gotAuth)
+	}
+	if got.URL != "https://media.s.example/"+strings.TrimPrefix(gotPath, "/media/") || got.MediaType != "image/jpeg" {
+		t.Errorf("stored = %+v", got)
+	}
+
+	store.endpoint = srv.URL + "/missing"
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+	})
+	if _, err := store.Put(context.Background(), "cat.jpg", "image/jpeg", strings.NewReader("x")); err == nil {
+		t.Error("Put succeeded against a failing endpoint")
+	}
+}
+
+// gyazo でトークンが無ければ、画像投稿は使えない (nil) こと。
+func TestNewMediaStore(t *testing.T) {
+	cnf := &config.Config{Origin: "https://s.example"}
+	if got, err := newMediaStore(context.Background(), cnf); err != nil || got != nil {
+		t.Errorf("gyazo without token = %v, %v", got, err)
+	}
+	cnf.Media = config.MediaConfig{Backend: config.MediaBackendLocal, LocalDir: "tmp/media"}
+	got, err := newMediaStore(context.Background(), cnf)
+	if s, ok := got.(*localMediaStore); err != nil || !ok || s.dir != "tmp/media" || s.baseURL != "https://s.example/media/" {
+		t.Errorf("local = %+v, %v", got, err)
+	}
+}
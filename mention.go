@@ -88,12 +88,16 @@ func handleFor(ctx context.Context, actor *config.ActorConfig, input, actorURI s
 // renderContent は入力の平文を ActivityStreams の content にする。
 //
 // content は HTML である。平文をそのまま入れると改行が失われ、"<" などが
-// 相手側で壊れる。エスケープしてから URL・メンションをリンクにし、段落に
-// 組む。順序を逆にすると、エスケープでリンクの山括弧まで潰れる。
+// 相手側で壊れる。エスケープしてから URL・メンション・ハッシュタグを
+// リンクにし、段落に組む。順序を逆にすると、エスケープでリンクの山括弧
+// まで潰れる。
 //
 // URL のリンク化はメンションより先に行う。逆にすると、メンションリンクの
 // href に入った actor URI（httpから始まる）をもう一度 URL として拾って
 // 二重にリンクを差し込んでしまう。
+//
+// カスタム絵文字の :shortcode: は平文のまま残す。画像は noteTags が Emoji
+// タグとして付け、表示する側がそれで展開する。
 func renderContent(text string, mentions []mention) string {
 	escaped := html.EscapeString(strings.ReplaceAll(text, "\r\n", "\n"))
 	escaped = linkifyURLs(escaped)
@@ -117,6 +121,8 @@ func renderContent(text string, mentions []mention) string {
 		return fmt.Sprintf(`<a href="%s" class="u-url mention">%s</a>`,
 			html.EscapeString(uri), html.EscapeString(handle))
 	})
+	// ハッシュタグは最後。差し込んだリンクの中を避けて拾う。
+	escaped = linkifyHashtags(escaped)
 
 	paragraphs := strings.Split(escaped, "\n\n")
 	var b strings.Builder
@@ -158,6 +164,12 @@ func mentionTags(mentions []mention) []*activitystream.Object {
 	return tags
 }
 
+// noteTags は投稿の tag。Mention と Hashtag、Emoji を並べる。
+func noteTags(text string, mentions []mention) []*activitystream.Object {
+	tags := append(mentionTags(mentions), hashtagTags(text)...)
+	return append(tags, emojiTags(text)...)
+}
+
 func mentionURIs(mentions []mention) []string {
 	uris := make([]string, 0, len(mentions))
 	for _, m := range mentions {
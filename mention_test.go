@@ -216,6 +216,7 @@ func TestAudience(t *testing.T) {
 		{visibilityPublic, []string{pub}, []string{followers, mentioned[0]}},
 		{visibilityUnlisted, []string{followers}, []string{pub, mentioned[0]}},
 		{visibilityFollowers, []string{followers}, []string{mentioned[0]}},
+		{visibilityDirect, []string{mentioned[0]}, nil},
 	} {
 		t.Run(tt.visibility, func(t *testing.T) {
 			req := &statusRequest{Content: "x", Visibility: tt.visibility}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/httperror"
+)
+
+// ミュートとフィルタは表示にだけ効く。ブロック (block.go) と違って相手には
+// 何も送らず、受信も配信もフォロー関係も変えない。タイムライン・通知・
+// /remote を描画するときに、読み込んだ contentFilters に照らして落とすか
+// 畳むだけである。
+
+// フィルタに一致したときの扱い。
+const (
+	// filterHide は一覧から落とす。
+	filterHide = "hide"
+	// filterWarn は警告の下に畳んで出す。
+	filterWarn = "warn"
+)
+
+// maxFilterPattern はフィルタの語・正規表現の長さの上限。描画のたびに
+// 全件に当てるので、長大な正規表現を登録できないようにしておく。
+const maxFilterPattern = 200
+
+type filterRule struct {
+	ID      string
+	Pattern string
+	Regex   bool
+	Action  string
+	re      *regexp.Regexp
+}
+
+// contentFilters は1回の描画で使うミュートとフィルタ。リクエストの最初に
+// loadContentFilters で1度だけ読む。
+type contentFilters struct {
+	mutes map[string]bool
+	rules []filterRule
+}
+
+// loadContentFilters はミュートとフィルタを KV から読む。読めなくても
+// ページは出したいので、失敗は空のフィルタに落とす。
+func loadContentFilters(ctx context.Context, now time.Time) *contentFilters {
+	f := &contentFilters{mutes: map[string]bool{}}
+	mutes, err := client.QueryKV(ctx, datastore.KVMutes)
+	if err != nil {
+		logf("loading mutes failed: %v", err)
+	}
+	for _, it := range mutes {
+		if muteExpired(it, now) {
+			continue
+		}
+		f.mutes[it.SK] = true
+	}
+	rules, err := client.QueryKV(ctx, datastore.KVFilters)
+	if err != nil {
+		logf("loading filters failed: %v", err)
+	}
+	for _, it := range rules {
+		rule, err := newFilterRule(it.SK, it.Pattern, it.Regex, it.FilterAction)
+		if err != nil {
+			logf("skipping filter %v: %v", it.SK, err)
+			continue
+		}
+		f.rules = append(f.rules, rule)
+	}
+	return f
+}
+
+// muteExpired は期限付きのミュートが切れているかを返す。
+func muteExpired(it *datastore.KVItem, now time.Time) bool {
+	return it.TTL != 0 && it.TTL <= now.Unix()
+}
+
+// newFilterRule はフィルタを組み立てる。正規表現はここで1度だけ
+// コンパイルする。
+func newFilterRule(id, pattern string, regex bool, action string) (filterRule, error) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" {
+		return filterRule{}, errors.New("empty pattern")
+	}
+	if len(pattern) > maxFilterPattern {
+		return filterRule{}, fmt.Errorf("pattern is longer than %d bytes", maxFilterPattern)
+	}
+	if action != filterHide && action != filterWarn {
+		return filterRule{}, fmt.Errorf("unknown action %q", action)
+	}
+	rule := filterRule{ID: id, Pattern: pattern, Regex: regex, Action: action}
+	if regex {
+		// 大文字小文字は区別しない。語のフィルタと揃える。
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return filterRule{}, err
+		}
+		rule.re = re
+	}
+	return rule, nil
+}
+
+// matches は本文の文字列 text がこのフィルタに一致するかを返す。
+func (rule filterRule) matches(text string) bool {
+	if rule.re != nil {
+		return rule.re.MatchString(text)
+	}
+	return strings.Contains(strings.ToLower(text), strings.ToLower(rule.Pattern))
+}
+
+// muted は actorURIs のいずれかをミュートしているかを返す。ブーストは
+// 著者とブーストした人の両方を渡す。
+func (f *contentFilters) muted(actorURIs ...string) bool {
+	for _, uri := range actorURIs {
+		if uri != "" && f.mutes[uri] {
+			return true
+		}
+	}
+	return false
+}
+
+// verdict は本文 content (HTML) に当てたフィルタの結果を返す。hide に
+// 一致すれば hide を、warn にだけ一致すれば warn と一致した語を返す。
+// 何にも一致しなければ空文字。
+//
+// HTML のまま照合するとタグや属性 (リンク先の URL など) に一致してしまう
+// ので、タグを落として実体参照を戻した文字列に当てる。
+func (f *contentFilters) verdict(content string) (action string, matched string) {
+	if len(f.rules) == 0 || content == "" {
+		return "", ""
+	}
+	text := html.UnescapeString(stripTags(content))
+	for _, rule := range f.rules {
+		if !rule.matches(text) {
+			continue
+		}
+		if rule.Action == filterHide {
+			return filterHide, rule.Pattern
+		}
+		if action == "" {
+			action, matched = filterWarn, rule.Pattern
+		}
+	}
+	return action, matched
+}
+
+// --- /settings/mutes ----------------------------------------------------
+
+type muteListItem struct {
+	ActorURI string
+	Name     string
+	Acct     string
+	// Until は期限。無期限なら空。
+	Until string
+}
+
+type mutesPage struct {
+	pageBase
+	Mutes   []muteListItem
+	Filters []filterRule
+}
+
+// muteDurations はミュートの期限の選択肢。form の値は time.ParseDuration
+// で読める形にしてある。
+var muteDurations = map[string]bool{"": true, "1h": true, "24h": true, "168h": true, "720h": true}
+
+// mutesHandler はミュートとフィルタの一覧と、追加・解除のフォームを出す。
+func mutesHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	now := time.Now()
+	page := mutesPage{pageBase: newPageBase(r, "ミュートとフィルタ")}
+	page.NoIndex = true
+	page.UnreadCount = len(unreadNotifications(ctx))
+
+	mutes, err := client.QueryKV(ctx, datastore.KVMutes)
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot list the mutes", err)
+	}
+	knownActors := map[string]*datastore.KVItem{}
+	for _, it := range mutes {
+		if muteExpired(it, now) {
+			continue
+		}
+		item := muteListItem{ActorURI: it.SK}
+		item.Name, _ = actorDisplayCached(ctx, knownActors, it.SK)
+		item.Acct = acctCached(ctx, knownActors, it.SK)
+		if it.TTL != 0 {
+			item.Until = time.Unix(it.TTL, 0).UTC().Format(time.RFC3339)
+		}
+		page.Mutes = append(page.Mutes, item)
+	}
+
+	rules, err := client.QueryKV(ctx, datastore.KVFilters)
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot list the filters", err)
+	}
+	for _, it := range rules {
+		// 壊れたものも解除できるよう、コンパイルできなくても一覧には出す。
+		page.Filters = append(page.Filters, filterRule{ID: it.SK, Pattern: it.Pattern, Regex: it.Regex, Action: it.FilterAction})
+	}
+	sort.SliceStable(page.Filters, func(i, j int) bool { return page.Filters[i].ID > page.Filters[j].ID })
+	return renderPage(w, "mutes", page)
+}
+
+// muteRequest はミュート・フィルタの追加と解除の要求。form でも JSON でも
+// 受ける。
+type muteRequest struct {
+	Actor    string `json:"actor"`
+	Duration string `json:"duration"`
+	Pattern  string `json:"pattern"`
+	Regex    bool   `json:"regex"`
+	Action   string `json:"action"`
+	ID       string `json:"id"`
+}
+
+func parseMuteRequest(r *http.Request) (muteRequest, httperror.HttpError) {
+	var req muteRequest
+	if isFormRequest(r) {
+		if err := r.ParseForm(); err != nil {
+			return req, httperror.StatusUnprocessableEntity("bad form", err)
+		}
+		req.Actor = r.PostFormValue("actor")
+		req.Duration = r.PostFormValue("duration")
+		req.Pattern = r.PostFormValue("pattern")
+		req.Regex = r.PostFormValue("regex") != ""
+		req.Action = r.PostFormValue("action")
+		req.ID = r.PostFormValue("id")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, httperror.StatusUnprocessableEntity("bad request", err)
+	}
+	req.Actor = strings.TrimSpace(req.Actor)
+	req.Duration = strings.TrimSpace(req.Duration)
+	req.ID = strings.TrimSpace(req.ID)
+	return req, nil
+}
+
+// muteTTL は期限の指定から KV の TTL を作る。無期限なら 0。
+func muteTTL(duration string, now time.Time) (int64, error) {
+	if !muteDurations[duration] {
+		return 0, fmt.Errorf("unsupported duration %q", duration)
+	}
+	if duration == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return 0, err
+	}
+	return now.Add(d).Unix(), nil
+}
+
+// createMuteHandler は actor をミュートする。同じ相手をもう1度ミュート
+// すると期限を付け直す。
+func createMuteHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	req, herr := parseMuteRequest(r)
+	if herr != nil {
+		return herr
+	}
+	if req.Actor == "" {
+		return httperror.StatusUnprocessableEntity("actor must not be empty", nil)
+	}
+	ttl, err := muteTTL(req.Duration, time.Now())
+	if err != nil {
+		return httperror.StatusUnprocessableEntity("bad duration", err)
+	}
+	// URI でも @user@host でも受ける。
+	actorURI, err := resolveActorURI(ctx, req.Actor)
+	if err != nil {
+		return httperror.StatusUnprocessableEntity("cannot resolve that actor", err)
+	}
+	if isLocalActor(actorURI) {
+		return httperror.StatusUnprocessableEntity("cannot mute a local actor", nil)
+	}
+	if err := client.PutKV(ctx, &datastore.KVItem{
+		PK:  datastore.KVMutes,
+		SK:  actorURI,
+		At:  nowRFC3339(),
+		TTL: ttl,
+	}); err != nil {
+		return httperror.StatusInternalServerError("cannot record the mute", err)
+	}
+	return respondMuteDone(w, r)
+}
+
+// deleteMuteHandler はミュートを解除する。
+func deleteMuteHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	req, herr := parseMuteRequest(r)
+	if herr != nil {
+		return herr
+	}
+	if req.Actor == "" {
+		return httperror.StatusUnprocessableEntity("actor must not be empty", nil)
+	}
+	if err := client.DeleteKV(r.Context(), datastore.KVMutes, req.Actor); err != nil {
+		return httperror.StatusInternalServerError("cannot remove the mute", err)
+	}
+	return respondMuteDone(w, r)
+}
+
+// createFilterHandler は語か正規表現のフィルタを足す。
+func createFilterHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	req, herr := parseMuteRequest(r)
+	if herr != nil {
+		return herr
+	}
+	if req.Action == "" {
+		req.Action = filterWarn
+	}
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	rule, err := newFilterRule(id, req.Pattern, req.Regex, req.Action)
+	if err != nil {
+		return httperror.StatusUnprocessableEntity("bad filter", err)
+	}
+	if err := client.PutKV(r.Context(), &datastore.KVItem{
+		PK:           datastore.KVFilters,
+		SK:           rule.ID,
+		Pattern:      rule.Pattern,
+		Regex:        rule.Regex,
+		FilterAction: rule.Action,
+		At:           nowRFC3339(),
+	}); err != nil {
+		return httperror.StatusInternalServerError("cannot record the filter", err)
+	}
+	return respondMuteDone(w, r)
+}
+
+// deleteFilterHandler はフィルタを消す。
+func deleteFilterHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	req, herr := parseMuteRequest(r)
+	if herr != nil {
+		return herr
+	}
+	if req.ID == "" {
+		return httperror.StatusUnprocessableEntity("id must not be empty", nil)
+	}
+	if err := client.DeleteKV(r.Context(), datastore.KVFilters, req.ID); err != nil {
+		return httperror.StatusInternalServerError("cannot remove the filter", err)
+	}
+	return respondMuteDone(w, r)
+}
+
+func respondMuteDone(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	if isFormRequest(r) {
+		next := r.PostFormValue("next")
+		if !isSafeRedirect(next) {
+			next = "/settings/mutes"
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return nil
+	}
+	respondText(w, http.StatusOK, "ok\n")
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+func mustFilterRule(t *testing.T, pattern string, regex bool, action string) filterRule {
+	t.Helper()
+	rule, err := newFilterRule("1", pattern, regex, action)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rule
+}
+
+func TestContentFiltersVerdict(t *testing.T) {
+	f := &contentFilters{rules: []filterRule{
+		mustFilterRule(t, "ネタバレ", false, filterWarn),
+		mustFilterRule(t, `spam\d+`, true, filterHide),
+	}}
+	for _, c := range []struct {
+		content, action, word string
+	}{
+		{"<p>今日の天気</p>", "", ""},
+		{"<p>最終回のネタバレ注意</p>", filterWarn, "ネタバレ"},
+		{"<p>SPAM42 を買おう</p>", filterHide, `spam\d+`},
+		// warn と hide の両方に一致すれば hide が勝つ。
+		{"<p>ネタバレ spam1</p>", filterHide, `spam\d+`},
+		// タグや属性の中には当てない。
+		{`<p><a href="https://spam1.example/">link</a></p>`, "", ""},
+		// 実体参照は戻してから当てる。
+		{"<p>&lt;ネタバレ&gt;</p>", filterWarn, "ネタバレ"},
+	} {
+		action, word := f.verdict(c.content)
+		if action != c.action || word != c.word {
+			t.Errorf("verdict(%q) = %q, %q; want %q, %q", c.content, action, word, c.action, c.word)
+		}
+	}
+}
+
+func TestNewFilterRuleRejects(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		regex   bool
+		action  string
+	}{
+		{"", false, filterWarn},
+		{"x", false, "delete"},
+		{"(", true, filterHide},
+		{strings.Repeat("x", maxFilterPattern+1), false, filterWarn},
+	} {
+		if _, err := newFilterRule("1", c.pattern, c.regex, c.action); err == nil {
+			t.Errorf("newFilterRule(%q, %v, %q) succeeded", c.pattern, c.regex, c.action)
+		}
+	}
+}
+
+func TestContentFiltersMuted(t *testing.T) {
+	f := &contentFilters{mutes: map[string]bool{"https://a.example/users/alice": true}}
+	if !f.muted("https://b.example/users/bob", "https://a.example/users/alice") {
+		t.Errorf("a boost by a muted actor is not muted")
+	}
+	if f.muted("https://b.example/users/bob", "") {
+		t.Errorf("an unmuted actor is muted")
+	}
+}
+
+func TestMuteExpiry(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if muteExpired(&datastore.KVItem{}, now) {
+		t.Errorf("a mute without TTL expired")
+	}
+	if !muteExpired(&datastore.KVItem{TTL: now.Add(-time.Second).Unix()}, now) {
+		t.Errorf("an old mute did not expire")
+	}
+	ttl, err := muteTTL("24h", now)
+	if err != nil || ttl != now.Add(24*time.Hour).Unix() {
+		t.Errorf("muteTTL(24h) = %v, %v", ttl, err)
+	}
+	if ttl, err := muteTTL("", now); err != nil || ttl != 0 {
+		t.Errorf("muteTTL(\"\") = %v, %v", ttl, err)
+	}
+	if _, err := muteTTL("-1h", now); err == nil {
+		t.Errorf("muteTTL accepted a negative duration")
+	}
+}
+
+func TestFilterRemoteStatuses(t *testing.T) {
+	f := &contentFilters{rules: []filterRule{
+		mustFilterRule(t, "hidden", false, filterHide),
+		mustFilterRule(t, "folded", false, filterWarn),
+	}}
+	got := filterRemoteStatuses(f, []remoteStatusItem{{Content: "hidden"}, {Content: "folded"}, {Content: "plain"}})
+	if len(got) != 2 || got[0].FilterWarning != "folded" || got[1].FilterWarning != "" {
+		t.Errorf("filterRemoteStatuses = %+v", got)
+	}
+}
+
+func TestTimelineRendersFilteredItemsFolded(t *testing.T) {
+	page := timelinePage{
+		pageBase: pageBase{Title: "タイムライン", SiteName: "nana", LocalPart: "nana", Handle: "@nana", Authed: true},
+		Items:    []timelineItem{{AuthorName: "alice", Content: "<p>ネタバレ</p>", FilterWarning: "ネタバレ"}},
+		Page:     1,
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "timeline", page); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `<details class="filtered"><summary>フィルタ「ネタバレ」に一致</summary>`) {
+		t.Errorf("timeline does not fold the filtered item")
+	}
+}
+
+func TestMutesPageRenders(t *testing.T) {
+	page := mutesPage{
+		pageBase: pageBase{Title: "ミュートとフィルタ", SiteName: "nana", LocalPart: "nana", Handle: "@nana", Authed: true},
+		Mutes:    []muteListItem{{ActorURI: "https://a.example/users/alice", Name: "alice", Until: "2026-01-02T00:00:00Z"}},
+		Filters:  []filterRule{{ID: "42", Pattern: "ネタバレ", Action: filterHide}},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "mutes", page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`value="https://a.example/users/alice"`, "2026-01-02 09:00 まで", `name="id" value="42"`, "隠す"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("page does not contain %q", want)
+		}
+	}
+}
+
+func TestMuteRoutes(t *testing.T) {
+	r := newRouter()
+	for _, c := range []struct{ method, path string }{
+		{http.MethodGet, "/settings/mutes"},
+		{http.MethodPost, "/settings/mutes"},
+		{http.MethodPost, "/settings/mutes/remove"},
+		{http.MethodPost, "/settings/filters"},
+		{http.MethodPost, "/settings/filters/remove"},
+	} {
+		if h, _, _ := r.Lookup(c.method, c.path); h == nil {
+			t.Errorf("%v %v has no handler", c.method, c.path)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/datastore"
+)
+
+// 公開のページに出すリモートの投稿 (スレッドの返信先と引用) の控え。ページを
+// 開かれるたびに署名付きで取りに行くと、誰でも (ログインせずに) こちらの
+// 鍵で相手のサーバを叩かせることができる。取った結果は KV に TTL 付きで
+// 控え、引けなかったことも短めの TTL で控える (linkcard.go と同じ)。
+//
+// 控えるのは Public 宛て (公開・未収載) のものだけ。フォロワー限定の投稿も
+// こちらの署名で返ってくることがあるが、それは控えずに引けなかったものと
+// 同じに扱う。
+
+// remoteNoteTTL は引けた投稿を控える期間、remoteNoteMissTTL は引けなかった
+// ことを控える期間。相手が消したことは Delete で分かる (forgetRemoteNote)
+// が、編集は届かないこともあるので長くは持たない。
+const (
+	remoteNoteTTL     = time.Hour
+	remoteNoteMissTTL = 10 * time.Minute
+)
+
+// errRemoteNoteUnavailable は控えに「引けなかった」とあること。
+var errRemoteNoteUnavailable = errors.New("the status was not available when last fetched")
+
+// publicRemoteNote は uri のリモートの投稿を、Public 宛てなら返す。控えが
+// あればそれを使い、無ければ取りに行って控える。
+func publicRemoteNote(ctx context.Context, actor *config.ActorConfig, uri string) (*activitystream.Object, error) {
+	if note, ok, err := cachedRemoteNote(ctx, uri, time.Now()); ok {
+		return note, err
+	}
+	return fetchPublicRemoteNote(ctx, actor, uri)
+}
+
+// fetchPublicRemoteNote は控えを見ずに fetchVerifiedNote で取り、結果を
+// 控える。Public 宛てでなければ引けなかったものとして扱う。
+func fetchPublicRemoteNote(ctx context.Context, actor *config.ActorConfig, uri string) (*activitystream.Object, error) {
+	now := time.Now()
+	note, err := fetchVerifiedNote(ctx, actor, uri)
+	if err == nil && !addressedToPublic(note) {
+		err = errors.New("the status is not public")
+	}
+	if err != nil {
+		// 呼んだ側の都合で切れたのなら、相手のせいではないので控えない。
+		if ctx.Err() == nil {
+			cacheRemoteNote(ctx, uri, nil, now)
+		}
+		return nil, err
+	}
+	cacheRemoteNote(ctx, uri, note, now)
+	return note, nil
+}
+
+// cachedRemoteNote は控えを引く。控えが無ければ ok は偽。引けなかった
+// ことの控えなら errRemoteNoteUnavailable を返す。
+func cachedRemoteNote(ctx context.Context, uri string, now time.Time) (note *activitystream.Object, ok bool, err error) {
+	it, err := client.GetKV(ctx, datastore.KVRemoteNotes, uri)
+	if err != nil {
+		if !errors.Is(err, datastore.ErrNotFound) {
+			logf("reading the cached status %v failed: %v", uri, err)
+		}
+		return nil, false, nil
+	}
+	// DynamoDB の TTL は消すのが遅れるので、自分でも期限を見る。
+	if it.TTL != 0 && it.TTL <= now.Unix() {
+		return nil, false, nil
+	}
+	if it.Payload == "" {
+		return nil, true, errRemoteNoteUnavailable
+	}
+	note = &activitystream.Object{}
+	if err := json.Unmarshal([]byte(it.Payload), note); err != nil {
+		logf("the cached status %v is broken: %v", uri, err)
+		return nil, false, nil
+	}
+	return note, true, nil
+}
+
+// cacheRemoteNote は投稿を控える。note が nil なら引けなかったことを控える。
+func cacheRemoteNote(ctx context.Context, uri string, note *activitystream.Object, now time.Time) {
+	item := &datastore.KVItem{
+		PK:  datastore.KVRemoteNotes,
+		SK:  uri,
+		At:  now.UTC().Format(time.RFC3339),
+		TTL: now.Add(remoteNoteMissTTL).Unix(),
+	}
+	if note != nil {
+		payload, err := json.Marshal(note)
+		if err != nil {
+			logf("encoding the status %v failed: %v", uri, err)
+			return
+		}
+		item.Payload = string(payload)
+		item.TTL = now.Add(remoteNoteTTL).Unix()
+	}
+	if err := client.PutKV(ctx, item); err != nil {
+		logf("caching the status %v failed: %v", uri, err)
+	}
+}
+
+// forgetRemoteNote は控えを捨てる。相手が投稿を消したり編集したりした
+// ときに呼ぶ。
+func forgetRemoteNote(ctx context.Context, uri string) {
+	if err := client.DeleteKV(ctx, datastore.KVRemoteNotes, uri); err != nil {
+		logf("removing the cached status %v failed: %v", uri, err)
+	}
+}
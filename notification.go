@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/nna774/s.nna774.net/activitystream"
 	"github.com/nna774/s.nna774.net/config"
@@ -97,6 +98,10 @@ func notifiesMe(actor *config.ActorConfig, in *activitystream.Object, note *acti
 	if owner, _, ok := actorAndIDFromStatusURI(note.InReplyTo.ID()); ok && owner == actor {
 		return true
 	}
+	// 自分の投稿の引用も、返信と同じく知らせる。
+	if quotesMine(actor, note) {
+		return true
+	}
 	me := actor.ID()
 	// 宛先は Activity 側にも Note 側にも書かれる。実装によってどちらに
 	// 入るかが違うので両方見る。
@@ -150,6 +155,9 @@ func advanceReadCursor(ctx context.Context, name string, to int) error {
 // 件数を Inc の値と既読位置の差で求めることもできるが、Undo で通知を
 // 消しても Inc の値は減らないため実際の件数と合わなくなる。実際に残って
 // いるものを引く。
+//
+// ミュートとフィルタで通知欄から落とすものは数えない。数えるとバッジだけ
+// 付いて開いても何も無い、ということが起きる。
 func unreadNotifications(ctx context.Context) map[int]bool {
 	cursor, err := readCursor(ctx, notificationKey)
 	if err != nil {
@@ -162,7 +170,19 @@ func unreadNotifications(ctx context.Context) map[int]bool {
 		return nil
 	}
 	unread := make(map[int]bool, len(entries))
+	if len(entries) == 0 {
+		return unread
+	}
+	filters := loadContentFilters(ctx, time.Now())
 	for _, e := range entries {
+		if filters.muted(e.Object.Actor.ID()) {
+			continue
+		}
+		if note := e.Object.Object.Item(); note != nil {
+			if action, _ := filters.verdict(note.Content); action == filterHide {
+				continue
+			}
+		}
 		unread[e.ID] = true
 	}
 	return unread
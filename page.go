@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"slices"
 	"sort"
 	"strings"
 	"time"
@@ -61,6 +62,12 @@ func commitURL() string {
 }
 
 func renderPage(w http.ResponseWriter, page string, data interface{}) httperror.HttpError {
+	return renderPageWithStatus(w, http.StatusOK, page, data)
+}
+
+// renderPageWithStatus は 200 以外で HTML を返す。削除済みの投稿 (410)
+// のように、ページは見せつつステータスで状態を伝えたいときに使う。
+func renderPageWithStatus(w http.ResponseWriter, code int, page string, data interface{}) httperror.HttpError {
 	// テンプレートの途中でエラーになると壊れた HTML を返してしまうため、
 	// 一旦バッファに書いてから流す。
 	buf := &bytes.Buffer{}
@@ -68,7 +75,7 @@ func renderPage(w http.ResponseWriter, page string, data interface{}) httperror.
 		return httperror.StatusInternalServerError("rendering "+page+" failed", err)
 	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(code)
 	_, _ = w.Write(buf.Bytes())
 	return nil
 }
@@ -85,31 +92,44 @@ type profilePage struct {
 	FollowingCount  int
 	FavoriteCount   int
 	HideCollections bool
-	Fields          activitystream.Objects
-	Statuses        []profileStatusItem
+	// ManualApproval はフォロー要求を手で承認する actor であることを示す。
+	// ログイン中だけ承認待ちの一覧へのリンクを出す。ブラウザでログイン
+	// するのは primary actor だけなので、sub actor では立てない。
+	ManualApproval bool
+	Fields         activitystream.Objects
+	Statuses       []profileStatusItem
 	// HasMore はプロフィールに出し切れなかった投稿があることを示す。
 	// 立っているときだけ投稿一覧へのリンクを出す。自分の Note の件数だけで
 	// 判定しており、ブーストの分は数えていない (myRecentBoosts が全件では
 	// なく直近 profileBoostScanLimit 件までしか遡らないため、正確な件数を
 	// 出せない)。
 	HasMore bool
+	// Pinned は固定した投稿。Statuses の前に出す。
+	Pinned []profileStatusItem
 }
 
 // profileStatusItem はプロフィールに並べる1件分。自分の投稿とブーストを
 // 混ぜて表示時刻順に並べるため、生の Note ではなくこちらに落とす。
 type profileStatusItem struct {
 	Content     string
+	Emoji       web.Emoji
 	Attachments []attachmentItem
-	Published   string
-	URL         string
-	InReplyTo   string
+	// Summary は CW、Sensitive は添付の閲覧注意。statusPage と同じ。
+	Summary   string
+	Sensitive bool
+	Published string
+	URL       string
+	InReplyTo string
 	// Boosted / AuthorName / AuthorURI / AnnounceURI は自分がブーストした
 	// 他人の投稿のときだけ入る。AnnounceURI は日時のリンク先に使う。
 	Boosted     bool
 	AuthorName  string
 	AuthorURI   string
 	AnnounceURI string
-	sortKey     time.Time
+	// Card はリンクのカード。linkURI はカードにするリンク。
+	Card    *linkCard
+	linkURI string
+	sortKey time.Time
 }
 
 const profileStatusCount = 20
@@ -151,6 +171,15 @@ func htmlUserHandler(w http.ResponseWriter, r *http.Request, actor *config.Actor
 	if err != nil {
 		return httperror.StatusInternalServerError("cannot read the outbox", err)
 	}
+	// もっと見るリンクの要否は除く前の件数で決める (下の hasMore)。
+	fetched := len(creates)
+	pinnedNotes, err := pinnedStatuses(ctx, actor)
+	if err != nil {
+		// 固定が読めなくても、普段の投稿は出せる。
+		logf("listing the pinned statuses of %v failed: %v", actor.ID(), err)
+	}
+	reader := readerForStatus(ctx, r, actor, append(slices.Clone(creates), pinnedNotes...)...)
+	creates = listableCreates(reader, actor, creates)
 	boosts, err := myRecentBoosts(ctx, actor, profileStatusCount)
 	if err != nil {
 		return httperror.StatusInternalServerError("cannot read the boosts", err)
@@ -165,10 +194,14 @@ func htmlUserHandler(w http.ResponseWriter, r *http.Request, actor *config.Actor
 		}
 		items = append(items, profileStatusItem{
 			Content:     note.Content,
+			Emoji:       noteEmoji(note.Tag),
 			Attachments: noteAttachments(note),
+			Summary:     note.Summary,
+			Sensitive:   noteSensitive(note),
 			Published:   note.Published,
 			URL:         note.ID,
 			InReplyTo:   note.InReplyTo.ID(),
+			linkURI:     noteLinkURL(note),
 			sortKey:     publishedTime(note.Published),
 		})
 	}
@@ -179,21 +212,42 @@ func htmlUserHandler(w http.ResponseWriter, r *http.Request, actor *config.Actor
 		}
 		items = append(items, profileStatusItem{
 			Content:     note.Content,
+			Emoji:       noteEmoji(note.Tag),
 			Attachments: noteAttachments(note),
+			Summary:     note.Summary,
+			Sensitive:   noteSensitive(note),
 			Published:   act.Published,
 			URL:         note.ID,
 			InReplyTo:   note.InReplyTo.ID(),
 			Boosted:     true,
 			AuthorURI:   note.AttributedTo.ID(),
 			AnnounceURI: act.ID,
+			linkURI:     noteLinkURL(note),
 			sortKey:     publishedTime(act.Published),
 		})
 	}
 	sort.SliceStable(items, func(i, j int) bool { return items[i].sortKey.After(items[j].sortKey) })
+	pinned := make([]profileStatusItem, 0, len(pinnedNotes))
+	for _, note := range pinnedNotes {
+		if !reader.canRead(actor, note) {
+			continue
+		}
+		pinned = append(pinned, profileStatusItem{
+			Content:     note.Content,
+			Emoji:       noteEmoji(note.Tag),
+			Attachments: noteAttachments(note),
+			Summary:     note.Summary,
+			Sensitive:   noteSensitive(note),
+			Published:   note.Published,
+			URL:         note.ID,
+			InReplyTo:   note.InReplyTo.ID(),
+			linkURI:     noteLinkURL(note),
+		})
+	}
 	// もっと見るリンクの要否は自分の Note の件数だけで決める。投稿一覧
 	// ページ自体が自分の Note しか出さないため、ブーストの分を足すと
 	// 実際には出せない「その先」に誘ってしまう。
-	hasMore := len(creates) >= profileStatusCount
+	hasMore := fetched >= profileStatusCount
 	if len(items) > profileStatusCount {
 		items = items[:profileStatusCount]
 	}
@@ -207,6 +261,7 @@ func htmlUserHandler(w http.ResponseWriter, r *http.Request, actor *config.Actor
 			items[i].AuthorName, _ = actorDisplayCached(ctx, knownActors, items[i].AuthorURI)
 		}
 	}
+	resolveProfileLinkCards(ctx, pinned, items)
 
 	page := profilePage{
 		pageBase:        newPageBase(r, actor.Name+" ("+"@"+actor.Username+")"),
@@ -215,9 +270,11 @@ func htmlUserHandler(w http.ResponseWriter, r *http.Request, actor *config.Actor
 		IconURL:         actor.IconURI,
 		StatusCount:     total,
 		HideCollections: actor.HideCollections,
+		ManualApproval:  actor.Primary && !actor.AutoAcceptFollow,
 		Fields:          profileFields(actor),
 		Statuses:        items,
 		HasMore:         hasMore,
+		Pinned:          pinned,
 	}
 	if !actor.HideCollections {
 		page.FollowerCount = countOrZero(ctx, actorScoped(actor, datastore.KVFollowers))
@@ -241,10 +298,14 @@ func countOrZero(ctx context.Context, partition string) int {
 type statusesItem struct {
 	StatusID    int
 	Content     string
+	Emoji       web.Emoji
 	Attachments []attachmentItem
-	Published   string
-	ObjectURI   string
-	InReplyTo   string
+	// Summary は CW、Sensitive は添付の閲覧注意。statusPage と同じ。
+	Summary   string
+	Sensitive bool
+	Published string
+	ObjectURI string
+	InReplyTo string
 	// Boosted / AuthorName / AuthorURI / AnnounceURI は自分がブーストした
 	// 他人の投稿のときだけ入る。profileStatusItem と同じ役割。
 	Boosted     bool
@@ -339,7 +400,12 @@ func statusesHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError
 		if err != nil && !errors.Is(err, datastore.ErrNotFound) {
 			return httperror.StatusInternalServerError("cannot read the outbox", err)
 		}
+		// ブラウザは署名しないので、ここで効くのは本人のログインだけ。
+		reader := identifyReader(ctx, r, actor)
 		for _, e := range entries {
+			if !reader.listable(actor, e.Object) {
+				continue
+			}
 			// outbox に入っているのは Create なので、中身の Note を取り出す。
 			note := e.Object.Object.Item()
 			if note == nil {
@@ -352,7 +418,10 @@ func statusesHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError
 			items = append(items, statusesItem{
 				StatusID:    e.ID,
 				Content:     note.Content,
+				Emoji:       noteEmoji(note.Tag),
 				Attachments: attachments,
+				Summary:     note.Summary,
+				Sensitive:   noteSensitive(note),
 				Published:   note.Published,
 				ObjectURI:   note.ID,
 				InReplyTo:   note.InReplyTo.ID(),
@@ -386,7 +455,10 @@ func statusesHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError
 			}
 			items = append(items, statusesItem{
 				Content:     note.Content,
+				Emoji:       noteEmoji(note.Tag),
 				Attachments: attachments,
+				Summary:     note.Summary,
+				Sensitive:   noteSensitive(note),
 				Published:   act.Published,
 				ObjectURI:   note.ID,
 				InReplyTo:   note.InReplyTo.ID(),
@@ -454,12 +526,15 @@ type collectionPage struct {
 	pageBase
 	Heading string
 	Members []collectionMember
+	// RemoveAction はフォロワーを外すフォームの送り先。自分のフォロワー
+	// 一覧をログイン中に見ているときだけ入る。
+	RemoveAction string
 }
 
 // htmlCollectionHandler はフォロワー / フォロー中を人間向けの一覧にする。
 // 中身は KV に持っている (saveFollower が名前とアイコンを控えている) ので
 // リモートへ取りに行かない。
-func htmlCollectionHandler(w http.ResponseWriter, r *http.Request, actor *config.ActorConfig, items []*datastore.KVItem, heading string) httperror.HttpError {
+func htmlCollectionHandler(w http.ResponseWriter, r *http.Request, actor *config.ActorConfig, partition string, items []*datastore.KVItem, heading string) httperror.HttpError {
 	members := make([]collectionMember, 0, len(items))
 	for _, it := range items {
 		members = append(members, collectionMember{
@@ -474,6 +549,11 @@ func htmlCollectionHandler(w http.ResponseWriter, r *http.Request, actor *config
 		Heading:  heading,
 		Members:  members,
 	}
+	// ブラウザでログインするのは primary actor だけなので、sub actor の
+	// 一覧には出さない (押しても bot のトークンが無く弾かれる)。
+	if partition == datastore.KVFollowers && page.Authed && actor.Primary {
+		page.RemoveAction = "/u/" + actor.LocalPart() + "/followers/remove"
+	}
 	return renderPage(w, "collection", page)
 }
 
@@ -567,6 +647,7 @@ type statusPage struct {
 	Name           string
 	IconURL        string
 	Content        string
+	Emoji          web.Emoji
 	Attachments    []attachmentItem
 	Published      string
 	ObjectURI      string
@@ -575,6 +656,54 @@ type statusPage struct {
 	StatusID       int
 	LikeCount      int
 	AnnounceCount  int
+	// Updated は最後に編集した時刻。編集していなければ空。
+	Updated string
+	// Revisions は編集前の版を新しい順に並べたもの。
+	Revisions []statusRevision
+	// Summary は CW。空でなければ本文と添付を畳む。Sensitive は添付だけを
+	// 畳む閲覧注意。
+	Summary   string
+	Sensitive bool
+	// Ancestors は返信先を古い順に、Replies は返信を深さ優先で並べたもの。
+	Ancestors []threadItem
+	Replies   []threadItem
+	// Pinnable は固定できる (direct でない) こと、Pinned は固定済みで
+	// あること。ログイン中だけ見る。
+	Pinnable bool
+	Pinned   bool
+	// Card はリンクのカード。
+	Card *linkCard
+}
+
+// statusGonePage は削除済みの投稿のページ。
+type statusGonePage struct {
+	pageBase
+	ActorLocalPart string
+	Name           string
+	Deleted        string
+}
+
+// goneStatusHandler は削除済みの投稿に 410 を返す。JSON を求める相手
+// (再取得しに来たリモートのサーバ) には Tombstone そのものを返す。
+func goneStatusHandler(w http.ResponseWriter, r *http.Request, actor *config.ActorConfig, tombstone *activitystream.Object) httperror.HttpError {
+	if wantsActivityJSON(r) {
+		return respondAsJSON(w, http.StatusGone, tombstone)
+	}
+	page := statusGonePage{
+		pageBase:       newPageBase(r, actor.Name+": 削除された投稿"),
+		ActorLocalPart: actor.LocalPart(),
+		Name:           actor.Name,
+		Deleted:        tombstone.Deleted,
+	}
+	page.NoIndex = true
+	return renderPageWithStatus(w, http.StatusGone, "status_gone", page)
+}
+
+// statusRevision は編集履歴の1版。At はその版になった時刻で、最初の版
+// なら投稿時刻。
+type statusRevision struct {
+	Content string
+	At      string
 }
 
 func htmlStatusHandler(w http.ResponseWriter, r *http.Request, actor *config.ActorConfig, id int, note *activitystream.Object) httperror.HttpError {
@@ -585,6 +714,7 @@ func htmlStatusHandler(w http.ResponseWriter, r *http.Request, actor *config.Act
 		Name:           actor.Name,
 		IconURL:        actor.IconURI,
 		Content:        note.Content,
+		Emoji:          noteEmoji(note.Tag),
 		Attachments:    noteAttachments(note),
 		Published:      note.Published,
 		ObjectURI:      note.ID,
@@ -593,6 +723,36 @@ func htmlStatusHandler(w http.ResponseWriter, r *http.Request, actor *config.Act
 		StatusID:       id,
 		LikeCount:      countReactors(ctx, actorScoped(actor, datastore.KVLikes), note.ID),
 		AnnounceCount:  countReactors(ctx, actorScoped(actor, datastore.KVAnnounced), note.ID),
+		Updated:        note.Updated,
+		Summary:        note.Summary,
+		Sensitive:      noteSensitive(note),
+		Ancestors:      threadAncestors(ctx, r, actor, note),
+		Replies:        threadDescendants(ctx, note.ID),
+	}
+	// CW を付けた投稿は、埋め込みのプレビューにも本文ではなく CW を出す。
+	if note.Summary != "" {
+		page.Excerpt = excerpt(note.Summary, 140)
+	}
+	if uri := noteLinkURL(note); uri != "" {
+		page.Card = linkCardsFor(ctx, []string{uri})[0]
+	}
+	if page.Authed {
+		page.Pinnable = noteVisibility(note, followersURI(actor)) != visibilityDirect
+		page.Pinned = isPinned(ctx, actor, note.ID)
+	}
+	if note.Updated != "" {
+		// 履歴が読めなくても投稿自体は出せるので、落とさない。
+		revs, err := statusHistory(ctx, actor, id)
+		if err != nil {
+			logf("reading the history of %v failed: %v", note.ID, err)
+		}
+		for _, rev := range revs {
+			at := rev.Updated
+			if at == "" {
+				at = rev.Published
+			}
+			page.Revisions = append(page.Revisions, statusRevision{Content: rev.Content, At: at})
+		}
 	}
 	return renderPage(w, "status", page)
 }
@@ -649,12 +809,16 @@ func statusReactorsHandler(w http.ResponseWriter, r *http.Request, pk, templateN
 	if herr != nil {
 		return herr
 	}
-	status, err := client.GetObject(ctx, actorScoped(actor, statusKey), id)
-	if err != nil {
-		if errors.Is(err, datastore.ErrNotFound) {
-			return httperror.StatusNotFound("no such status", err)
-		}
-		return httperror.StatusInternalServerError("cannot load the status", err)
+	status, herr := loadStatus(ctx, actor, id)
+	if herr != nil {
+		return herr
+	}
+	// 読めない投稿は、いいね・ブーストした人も見せず、存在も漏らさない。
+	if !readerForStatus(ctx, r, actor, status).canRead(actor, status) {
+		return httperror.StatusNotFound("no such status", nil)
+	}
+	if restricted(actor, status) {
+		w.Header().Set("Cache-Control", "private")
 	}
 
 	items, err := reactorsOf(ctx, actorScoped(actor, pk), status.ID)
@@ -727,6 +891,10 @@ type attachmentItem struct {
 	// クリックで原寸を見られるようにリンク先として使う。Gyazo 由来の
 	// 添付でなければ空文字。
 	PageURL string
+	// Width・Height は添付の大きさ。分かっていれば img に付け、読み込む前
+	// から場所を取っておく。
+	Width  int
+	Height int
 }
 
 // noteAttachments は note.Attachment のうち URL を持つものだけを表示用に
@@ -741,9 +909,11 @@ func noteAttachments(note *activitystream.Object) []attachmentItem {
 			continue
 		}
 		item := attachmentItem{
-			URL:  a.URL,
-			Name: a.Name,
-			Kind: attachmentKind(a.MediaType),
+			URL:    a.URL,
+			Name:   a.Name,
+			Kind:   attachmentKind(a.MediaType),
+			Width:  a.Width,
+			Height: a.Height,
 		}
 		if pageURL, ok := gyazoImagePageURL(a.URL); ok {
 			item.PageURL = pageURL
@@ -753,6 +923,12 @@ func noteAttachments(note *activitystream.Object) []attachmentItem {
 	return items
 }
 
+// noteSensitive は添付が閲覧注意かを返す。CW だけ付けて sensitive を
+// 付けない実装もあるが、その場合は CW ごと畳むので困らない。
+func noteSensitive(note *activitystream.Object) bool {
+	return note.Sensitive != nil && *note.Sensitive
+}
+
 func attachmentKind(mediaType string) string {
 	switch {
 	case strings.HasPrefix(mediaType, "image/"):
@@ -765,15 +941,22 @@ func attachmentKind(mediaType string) string {
 }
 
 type timelineItem struct {
-	AuthorName  string
-	AuthorURI   string
-	Acct        string
-	IconURL     string
-	Content     string
-	Attachments []attachmentItem
-	Published   string
-	ObjectURI   string
-	InReplyTo   string
+	AuthorName string
+	AuthorURI  string
+	Acct       string
+	IconURL    string
+	Content    string
+	// Emoji は本文の、AuthorEmoji と BoostedByEmoji は表示名のカスタム
+	// 絵文字。
+	Emoji          web.Emoji
+	AuthorEmoji    web.Emoji
+	BoostedByEmoji web.Emoji
+	Attachments    []attachmentItem
+	Published      string
+	// Updated は相手が編集した時刻。編集されていなければ空。
+	Updated   string
+	ObjectURI string
+	InReplyTo string
 	// Mine は自分の投稿かどうか。削除ボタンの出し分けに使う。
 	Mine bool
 	// StatusID は自分の投稿のときだけ入る。削除フォームに使う。
@@ -790,6 +973,26 @@ type timelineItem struct {
 	// 出し分けに使う。
 	Liked   bool
 	Boosted bool
+	// FilterWarning は warn のフィルタに一致したときの語。空でなければ
+	// 本文を畳んで出す。
+	FilterWarning string
+	// Summary は CW、Sensitive は添付の閲覧注意。statusPage と同じ。
+	Summary   string
+	Sensitive bool
+	// Poll は投票のときだけ入る。
+	Poll *pollItem
+	// QuoteURI は引用している投稿。Quote はそのカードで、引けたときだけ
+	// 入る (resolveQuotes)。
+	QuoteURI string
+	Quote    *quoteItem
+	// LinkURI はカードにするリンク。Card はそのカードで、引けたときだけ
+	// 入る (resolveLinkCards)。
+	LinkURI string
+	Card    *linkCard
+	// Depth と Focus は会話ページ (/thread) だけで使う。Depth は字下げの
+	// 段数、Focus は開いた投稿そのものかどうか。
+	Depth int
+	Focus bool
 	// sortKey は並べ替え用。published を解釈できたものはその時刻、
 	// 解釈できなければゼロ値。
 	sortKey time.Time
@@ -805,6 +1008,10 @@ type timelinePage struct {
 	NextPage       int
 	HasPrev        bool
 	HasNext        bool
+	// Thread は会話ページとして描くかどうか。ページ送りを出さず、字下げする。
+	Thread bool
+	// Quote は引用リンクから来たときの引用先。投稿フォームに入れる。
+	Quote string
 }
 
 const timelinePageSize = 40
@@ -820,6 +1027,50 @@ func publishedTime(s string) time.Time {
 	return time.Time{}
 }
 
+// noteItem は note を timeline の1件にする。ブーストかどうかといった
+// Activity 側の事情は呼び出し側で足す。
+func noteItem(note *activitystream.Object, authorURI, published string, mine bool, reactions reactionState) timelineItem {
+	content := note.Content
+	quoted := note.QuotedURI()
+	if quoted != "" {
+		content = stripQuoteInline(content)
+	}
+	return timelineItem{
+		AuthorURI:   authorURI,
+		Content:     localizeHashtags(content, note.Tag),
+		Emoji:       noteEmoji(note.Tag),
+		Attachments: noteAttachments(note),
+		Published:   published,
+		Updated:     note.Updated,
+		ObjectURI:   note.ID,
+		InReplyTo:   note.InReplyTo.ID(),
+		Mine:        mine,
+		Liked:       reactions.liked[note.ID],
+		Boosted:     reactions.boosted[note.ID],
+		Summary:     note.Summary,
+		Sensitive:   noteSensitive(note),
+		Poll:        notePoll(note, mine, reactions.voted[note.ID], time.Now()),
+		QuoteURI:    quoted,
+		LinkURI:     noteLinkURL(note),
+		sortKey:     publishedTime(published),
+	}
+}
+
+// resolveItemAuthors は items の著者とブーストした人の表示名・アイコンを
+// 埋める。同じ人が何度も出てくるので、リクエスト内でキャッシュする。
+func resolveItemAuthors(ctx context.Context, items []timelineItem) {
+	knownActors := map[string]*datastore.KVItem{}
+	for i := range items {
+		items[i].AuthorName, items[i].IconURL = actorDisplayCached(ctx, knownActors, items[i].AuthorURI)
+		items[i].AuthorEmoji = actorEmojiCached(ctx, knownActors, items[i].AuthorURI)
+		items[i].Acct = acctCached(ctx, knownActors, items[i].AuthorURI)
+		if items[i].BoostedByURI != "" {
+			items[i].BoostedByName, _ = actorDisplayCached(ctx, knownActors, items[i].BoostedByURI)
+			items[i].BoostedByEmoji = actorEmojiCached(ctx, knownActors, items[i].BoostedByURI)
+		}
+	}
+}
+
 // timelineHandler は primary actor 専用。sub actor (bot 等) は timeline を
 // 持たない。
 func timelineHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
@@ -851,6 +1102,9 @@ func timelineHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError
 	}
 
 	reactions := loadReactionState(ctx, primary)
+	// ミュートとフィルタで落とすのはページに切る前。後で落とすとページの
+	// 件数が揃わなくなる。
+	filters := loadContentFilters(ctx, time.Now())
 
 	items := make([]timelineItem, 0, len(received)+len(mine))
 	for _, act := range append(append([]*activitystream.Object{}, received...), mine...) {
@@ -871,17 +1125,19 @@ func timelineHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError
 		}
 
 		isMine := actorURI == primary.ID()
-		item := timelineItem{
-			AuthorURI:   actorURI,
-			Content:     note.Content,
-			Attachments: noteAttachments(note),
-			Published:   published,
-			ObjectURI:   note.ID,
-			InReplyTo:   note.InReplyTo.ID(),
-			Mine:        isMine,
-			Liked:       reactions.liked[note.ID],
-			Boosted:     reactions.boosted[note.ID],
-			sortKey:     publishedTime(published),
+		filterAction, filterWord := "", ""
+		if !isMine {
+			if filters.muted(actorURI, boostedBy) {
+				continue
+			}
+			filterAction, filterWord = filters.verdict(note.Content)
+			if filterAction == filterHide {
+				continue
+			}
+		}
+		item := noteItem(note, actorURI, published, isMine, reactions)
+		if filterAction == filterWarn {
+			item.FilterWarning = filterWord
 		}
 		if boostedBy != "" {
 			item.BoostedByURI = boostedBy
@@ -904,15 +1160,10 @@ func timelineHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError
 	// 著者名・アイコンの解決はここまで捨てずに残った分 (最大 timelinePageSize
 	// 件) だけにする。ソート前の全候補 (take 件 x2) に対してやると、
 	// 表示されない分まで DynamoDB を叩いて無駄に遅くなる。同じ投稿者が
-	// 何度も出てくることもあるので、リクエスト内でキャッシュもする。
-	knownActors := map[string]*datastore.KVItem{}
-	for i := range items {
-		items[i].AuthorName, items[i].IconURL = actorDisplayCached(ctx, knownActors, items[i].AuthorURI)
-		items[i].Acct = acctCached(ctx, knownActors, items[i].AuthorURI)
-		if items[i].BoostedByURI != "" {
-			items[i].BoostedByName, _ = actorDisplayCached(ctx, knownActors, items[i].BoostedByURI)
-		}
-	}
+	// 何度も出てくることもある (resolveItemAuthors がキャッシュする)。
+	resolveItemAuthors(ctx, items)
+	resolveQuotes(ctx, primary, items)
+	resolveLinkCards(ctx, items)
 
 	page := timelinePage{
 		pageBase:  newPageBase(r, "タイムライン"),
@@ -927,6 +1178,7 @@ func timelineHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError
 	page.UnreadCount = len(unreadNotifications(ctx))
 	// 返信リンクから来たときは mention 先を埋めておく。
 	page.MentionPrefill = r.URL.Query().Get("mentions")
+	page.Quote = r.URL.Query().Get("quote")
 	// 認証必須のページなので検索避けする。
 	page.NoIndex = true
 	// どの commit がデプロイされているか footer から追えるようにする。
@@ -960,6 +1212,17 @@ func cachedIconURL(ctx context.Context, actorURI string) string {
 	return ""
 }
 
+// cachedEmoji は表示名に使うカスタム絵文字を引く。authorName と対になる。
+func cachedEmoji(ctx context.Context, actorURI string) web.Emoji {
+	if isLocalActor(actorURI) {
+		return instanceEmoji()
+	}
+	if it := lookupKnownActor(ctx, actorURI); it != nil {
+		return it.Emoji
+	}
+	return nil
+}
+
 // actorDisplayCached は authorName / cachedIconURL をまとめて解決する。
 // 同じ actor を何度も表示するタイムラインのようなループ向けに、呼び出し元が
 // 用意したキャッシュを使って lookupKnownActor の呼び出しを actor ごとに
@@ -1021,6 +1284,23 @@ func acctFor(ctx context.Context, actorURI string) string {
 	return acctFromItem(lookupKnownActor(ctx, actorURI), actorURI)
 }
 
+// actorEmojiCached は cachedEmoji の、actorDisplayCached と同じキャッシュを
+// 使う版。
+func actorEmojiCached(ctx context.Context, cache map[string]*datastore.KVItem, actorURI string) web.Emoji {
+	if isLocalActor(actorURI) {
+		return instanceEmoji()
+	}
+	it, ok := cache[actorURI]
+	if !ok {
+		it = lookupKnownActor(ctx, actorURI)
+		cache[actorURI] = it
+	}
+	if it == nil {
+		return nil
+	}
+	return it.Emoji
+}
+
 func acctCached(ctx context.Context, cache map[string]*datastore.KVItem, actorURI string) string {
 	primary := Config.PrimaryActor()
 	if actorURI == primary.ID() {
@@ -1062,9 +1342,12 @@ const (
 type notificationItem struct {
 	Kind      string
 	ActorName string
-	ActorURI  string
-	Acct      string
-	IconURL   string
+	// ActorEmoji は表示名の、Emoji は本文のカスタム絵文字。
+	ActorEmoji web.Emoji
+	Emoji      web.Emoji
+	ActorURI   string
+	Acct       string
+	IconURL    string
 	// TargetURI は Like / Announce の対象になった自分の投稿、または
 	// 返信先の投稿。
 	TargetURI string
@@ -1076,7 +1359,18 @@ type notificationItem struct {
 	// ObjectURI は相手の投稿。返信リンクに使う。
 	ObjectURI string
 	Published string
-	Unread    bool
+	// Updated は返信・メンションが編集された時刻。
+	Updated string
+	// FilterWarning は返信・メンションの本文が warn のフィルタに一致した
+	// ときの語。
+	FilterWarning string
+	// Summary は返信・メンションの CW。
+	Summary string
+	// QuoteURI と Quote は返信・メンション・引用が引用している投稿。
+	// timelineItem と同じ。
+	QuoteURI string
+	Quote    *quoteItem
+	Unread   bool
 	// RecipientLocalPart はこの通知がどのローカル actor 宛だったか。
 	// notification は primary / sub 問わず共有ストリームなので、bot 宛の
 	// Follow も混ざって出る。primary 宛のときは空にして、テンプレート側で
@@ -1121,16 +1415,31 @@ func notificationsHandler(w http.ResponseWriter, r *http.Request) httperror.Http
 
 	// 同じ投稿に複数のいいねが付くのが普通なので、抜粋は使い回す。
 	excerpts := map[string]string{}
+	quotes := newQuoteResolver(Config.PrimaryActor())
+	filters := loadContentFilters(ctx, time.Now())
 	items := make([]notificationItem, 0, len(entries))
 	newest := 0
 	for _, e := range entries {
+		// 落としたものも既読には進める。ミュート中の相手の通知が未読の
+		// まま残り続けないように。
 		if e.ID > newest {
 			newest = e.ID
 		}
+		if filters.muted(e.Object.Actor.ID()) {
+			continue
+		}
 		item, ok := toNotificationItem(ctx, e.Object, excerpts)
 		if !ok {
 			continue
 		}
+		action, word := filters.verdict(item.Content)
+		if action == filterHide {
+			continue
+		}
+		if action == filterWarn {
+			item.FilterWarning = word
+		}
+		item.Quote = quotes.card(ctx, item.QuoteURI)
 		item.Unread = unread[e.ID]
 		items = append(items, item)
 	}
@@ -1162,6 +1471,7 @@ func toNotificationItem(ctx context.Context, act *activitystream.Object, excerpt
 		Published: act.Published,
 	}
 	item.ActorName = authorName(ctx, item.ActorURI)
+	item.ActorEmoji = cachedEmoji(ctx, item.ActorURI)
 	item.Acct = acctFor(ctx, item.ActorURI)
 	item.IconURL = cachedIconURL(ctx, item.ActorURI)
 
@@ -1193,6 +1503,12 @@ func toNotificationItem(ctx context.Context, act *activitystream.Object, excerpt
 		}
 		item.Kind = kindMention
 		item.Content = note.Content
+		if item.QuoteURI = note.QuotedURI(); item.QuoteURI != "" {
+			item.Content = stripQuoteInline(item.Content)
+		}
+		item.Emoji = noteEmoji(note.Tag)
+		item.Summary = note.Summary
+		item.Updated = note.Updated
 		item.ObjectURI = note.ID
 		item.TargetURI = note.InReplyTo.ID()
 		item.TargetExcerpt = myStatusExcerpt(ctx, item.TargetURI, excerpts)
@@ -1243,6 +1559,9 @@ func myStatusExcerpt(ctx context.Context, uri string, cache map[string]string) s
 		}
 		return ""
 	}
+	if isTombstone(note) {
+		return ""
+	}
 	cache[uri] = excerpt(note.Content, 60)
 	return cache[uri]
 }
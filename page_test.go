@@ -263,6 +263,32 @@ func TestNoteAttachments(t *testing.T) {
 	}
 }
 
+// 画像の説明は alt と title の両方に出すこと。title はマウスを載せたときに
+// 読める。
+func TestTimelineRendersAltText(t *testing.T) {
+	page := timelinePage{
+		pageBase: pageBase{Title: "タイムライン", SiteName: "nana", LocalPart: "nana", Handle: "@nana"},
+		Page:     1,
+		Items: []timelineItem{{
+			ObjectURI: "https://m.example/notes/1",
+			Attachments: []attachmentItem{
+				{URL: "https://m.example/a.png", Name: "窓辺の猫", Kind: "image"},
+				{URL: "https://m.example/b.png", Kind: "image", Width: 640, Height: 480},
+			},
+		}},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "timeline", page); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `<img src="https://m.example/a.png" alt="窓辺の猫" title="窓辺の猫" loading="lazy">`) {
+		t.Errorf("alt text is not rendered:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `<img src="https://m.example/b.png" alt="" width="640" height="480" loading="lazy">`) {
+		t.Errorf("an image without alt text has a title, or the size is not rendered:\n%s", buf.String())
+	}
+}
+
 // Gyazo 由来の画像添付は、サムネイルをクリックすると Gyazo の画像ページへ
 // リンクしていることを HTML 出力で確認する。
 func TestStatusesPageRenderLinksGyazoThumbnailToImagePage(t *testing.T) {
@@ -380,6 +406,39 @@ func TestTimelinePagerRender(t *testing.T) {
 	}
 }
 
+// プロフィールでも CW の付いた投稿は畳み、閲覧注意の添付は隠すこと。
+// 固定した投稿も同じ。
+func TestProfilePageFoldsContentWarnings(t *testing.T) {
+	img := []attachmentItem{{Kind: "image", URL: "https://i.example/a.png"}}
+	page := profilePage{
+		pageBase: pageBase{Title: "prof", SiteName: "nana", LocalPart: "nana", Handle: "@nana"},
+		Pinned: []profileStatusItem{
+			{Content: "<p>固定のネタバレ</p>", Summary: "固定の CW", URL: "https://s.example/u/nana/status/1"},
+		},
+		Statuses: []profileStatusItem{
+			{Content: "<p>ネタバレ</p>", Summary: "映画の感想", URL: "https://s.example/u/nana/status/2"},
+			{Content: "<p>写真</p>", Sensitive: true, Attachments: img, URL: "https://s.example/u/nana/status/3"},
+		},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "profile", page); err != nil {
+		t.Fatalf("rendering profile failed: %v", err)
+	}
+	html := buf.String()
+	for _, want := range []string{
+		`<details class="cw"><summary>固定の CW</summary>`,
+		`<details class="cw"><summary>映画の感想</summary>`,
+		`<details class="cw"><summary>閲覧注意のメディア</summary>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("rendered page does not contain %q", want)
+		}
+	}
+	if strings.Count(html, "<details") != strings.Count(html, "</details>") {
+		t.Errorf("unbalanced details:\n%s", html)
+	}
+}
+
 // プロフィールに自分のブーストが「著者名 の投稿をブースト」の形で出ること、
 // 自分の投稿には出ないことを確かめる。
 func TestProfilePageRendersBoosts(t *testing.T) {
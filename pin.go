@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/httperror"
+)
+
+// 固定した投稿は actor の featured コレクションとして出す。Mastodon は
+// actor を取り込むときにこれを読み、プロフィールの先頭に並べる。固定・
+// 解除はフォロワーに Add / Remove で知らせる。受け取った側はそれで
+// featured を読み直す。
+
+// pinLimit は固定できる投稿の数。Mastodon と同じ。
+const pinLimit = 5
+
+func featuredURI(actor *config.ActorConfig) string { return actor.ID() + "/featured" }
+
+// pinnedStatuses は actor が固定した投稿を、固定した新しい順に返す。消した
+// 投稿や読めなくなった投稿は飛ばす。
+func pinnedStatuses(ctx context.Context, actor *config.ActorConfig) ([]*activitystream.Object, error) {
+	items, err := client.QueryKV(ctx, actorScoped(actor, datastore.KVPins))
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].At > items[j].At })
+	notes := make([]*activitystream.Object, 0, len(items))
+	for _, it := range items {
+		id, herr := statusIDFromURI(it.SK)
+		if herr != nil {
+			continue
+		}
+		note, herr := loadStatus(ctx, actor, id)
+		if herr != nil {
+			continue
+		}
+		notes = append(notes, note)
+	}
+	return notes, nil
+}
+
+// featuredHandler は固定した投稿の OrderedCollection。読み手が読めない
+// 投稿 (フォロワー限定など) は載せない。ブラウザで開かれたらプロフィールへ
+// 送る。
+func featuredHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	actor, herr := resolveActor(r)
+	if herr != nil {
+		return herr
+	}
+	w.Header().Set("Vary", "Accept")
+	if !wantsActivityJSON(r) {
+		http.Redirect(w, r, actor.ID(), http.StatusSeeOther)
+		return nil
+	}
+	notes, err := pinnedStatuses(ctx, actor)
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot list the pinned statuses", err)
+	}
+	notes = readableNotes(ctx, r, actor, notes)
+	return respondAsJSON(w, http.StatusOK, activitystream.NewOrderedCollectionOfObjects(featuredURI(actor), notes))
+}
+
+// readableNotes は notes のうち r の読み手が読めるものだけを返す。
+func readableNotes(ctx context.Context, r *http.Request, actor *config.ActorConfig, notes []*activitystream.Object) []*activitystream.Object {
+	reader := readerForStatus(ctx, r, actor, notes...)
+	readable := make([]*activitystream.Object, 0, len(notes))
+	for _, n := range notes {
+		if reader.canRead(actor, n) {
+			readable = append(readable, n)
+		}
+	}
+	return readable
+}
+
+// isPinned は note が固定されているかを返す。
+func isPinned(ctx context.Context, actor *config.ActorConfig, noteID string) bool {
+	_, err := client.GetKV(ctx, actorScoped(actor, datastore.KVPins), noteID)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		logf("checking the pin of %v failed: %v", noteID, err)
+	}
+	return err == nil
+}
+
+// pinStatusHandler は自分の投稿を固定する。direct は固定できない。
+// 既に固定してあれば何もしない。
+func pinStatusHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	actor, herr := resolveActor(r)
+	if herr != nil {
+		return herr
+	}
+	id, herr := statusIDFromRequest(r)
+	if herr != nil {
+		return herr
+	}
+	note, herr := loadStatus(ctx, actor, id)
+	if herr != nil {
+		return herr
+	}
+	if noteVisibility(note, followersURI(actor)) == visibilityDirect {
+		return httperror.StatusUnprocessableEntity("direct statuses cannot be pinned", nil)
+	}
+	if isPinned(ctx, actor, note.ID) {
+		return respondPinned(w, r, note, nil)
+	}
+	n, err := client.CountKV(ctx, actorScoped(actor, datastore.KVPins))
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot count the pinned statuses", err)
+	}
+	if n >= pinLimit {
+		return httperror.StatusUnprocessableEntity("too many pinned statuses", nil)
+	}
+
+	add := activitystream.NewAdd(newActivityID("add"), actor.ID(), note.ID, featuredURI(actor))
+	if err := client.PutKV(ctx, &datastore.KVItem{
+		PK:         actorScoped(actor, datastore.KVPins),
+		SK:         note.ID,
+		ActivityID: add.ID,
+		At:         nowRFC3339(),
+	}); err != nil {
+		return httperror.StatusInternalServerError("cannot pin the status", err)
+	}
+	sendFeaturedChange(ctx, actor, add)
+	return respondPinned(w, r, note, add)
+}
+
+// unpinStatusHandler は固定を外す。固定していなければ何もしない。
+func unpinStatusHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	actor, herr := resolveActor(r)
+	if herr != nil {
+		return herr
+	}
+	id, herr := statusIDFromRequest(r)
+	if herr != nil {
+		return herr
+	}
+	note, herr := loadStatus(ctx, actor, id)
+	if herr != nil {
+		return herr
+	}
+	if !isPinned(ctx, actor, note.ID) {
+		return respondPinned(w, r, note, nil)
+	}
+	if err := client.DeleteKV(ctx, actorScoped(actor, datastore.KVPins), note.ID); err != nil {
+		return httperror.StatusInternalServerError("cannot unpin the status", err)
+	}
+	remove := activitystream.NewRemove(newActivityID("remove"), actor.ID(), note.ID, featuredURI(actor))
+	sendFeaturedChange(ctx, actor, remove)
+	return respondPinned(w, r, note, remove)
+}
+
+// sendFeaturedChange は Add / Remove をフォロワーに届ける。届かなくても
+// 固定そのものは済んでいる。相手は次に actor を取り込むときに読み直す。
+func sendFeaturedChange(ctx context.Context, actor *config.ActorConfig, activity *activitystream.Object) {
+	inboxes, err := followerInboxes(ctx, actor)
+	if err != nil {
+		logf("cannot list follower inboxes for %v: %v", activity.ID, err)
+		return
+	}
+	if err := deliver(ctx, actor, inboxes, activity); err != nil {
+		logf("%v of %v had delivery failures: %v", activity.Type, activity.Object.ID(), err)
+	}
+}
+
+// respondPinned はフォームからなら投稿のページへ戻し、そうでなければ
+// 送った Activity を返す。何も送らなかった (既にその状態だった) ときは
+// 204。
+func respondPinned(w http.ResponseWriter, r *http.Request, note, activity *activitystream.Object) httperror.HttpError {
+	if isFormRequest(r) {
+		http.Redirect(w, r, note.ID, http.StatusSeeOther)
+		return nil
+	}
+	if activity == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return respondAsJSON(w, http.StatusOK, activity)
+}
+
+// forgetPin は消した投稿の固定を外す。Delete が届けば相手の featured
+// からも消えるので、Remove は送らない。
+func forgetPin(ctx context.Context, actor *config.ActorConfig, noteID string) {
+	if err := client.DeleteKV(ctx, actorScoped(actor, datastore.KVPins), noteID); err != nil {
+		logf("removing the pin of %v failed: %v", noteID, err)
+	}
+}
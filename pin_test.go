@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nna774/s.nna774.net/web"
+)
+
+func TestPinRoutes(t *testing.T) {
+	r := newRouter()
+	cases := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/u/nana/featured"},
+		{http.MethodPost, "/u/nana/statuses/1/pin"},
+		{http.MethodPost, "/u/nana/statuses/1/unpin"},
+	}
+	for _, c := range cases {
+		if h, _, _ := r.Lookup(c.method, c.path); h == nil {
+			t.Errorf("%v %v has no handler", c.method, c.path)
+		}
+	}
+}
+
+// 固定した投稿はプロフィールの普段の投稿より前に出ること。
+func TestProfilePageRendersPinnedFirst(t *testing.T) {
+	page := profilePage{
+		pageBase: pageBase{Title: "prof", SiteName: "nana", LocalPart: "nana", Handle: "@nana"},
+		Pinned: []profileStatusItem{
+			{Content: "<p>固定した投稿</p>", URL: "https://s.example/u/nana/status/1", Published: "2026-01-01T00:00:00Z"},
+		},
+		Statuses: []profileStatusItem{
+			{Content: "<p>新しい投稿</p>", URL: "https://s.example/u/nana/status/2", Published: "2026-01-02T00:00:00Z"},
+		},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "profile", page); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	pinned, latest := strings.Index(out, "固定した投稿"), strings.Index(out, "新しい投稿")
+	if pinned < 0 || latest < 0 || pinned > latest {
+		t.Errorf("pinned status is not on top (pinned %d, latest %d)", pinned, latest)
+	}
+}
+
+// 個別投稿ページの固定ボタンは状態に応じて出し分けること。direct の
+// 投稿には出さないこと。
+func TestStatusPagePinButton(t *testing.T) {
+	cases := []struct {
+		name     string
+		pinnable bool
+		pinned   bool
+		want     string
+		notWant  string
+	}{
+		{"固定していない", true, false, "/statuses/1/pin\"", "/statuses/1/unpin"},
+		{"固定済み", true, true, "/statuses/1/unpin", "/statuses/1/pin\""},
+		{"direct", false, false, "", "/statuses/1/pin"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			page := statusPage{
+				pageBase:       pageBase{Title: "nana", SiteName: "nana", LocalPart: "nana", Handle: "@nana", Authed: true},
+				ActorLocalPart: "nana",
+				Content:        "<p>hi</p>",
+				StatusID:       1,
+				Pinnable:       c.pinnable,
+				Pinned:         c.pinned,
+			}
+			buf := &bytes.Buffer{}
+			if err := web.Render(buf, "status", page); err != nil {
+				t.Fatal(err)
+			}
+			out := buf.String()
+			if c.want != "" && !strings.Contains(out, c.want) {
+				t.Errorf("page does not contain %q", c.want)
+			}
+			if strings.Contains(out, c.notWant) {
+				t.Errorf("page contains %q", c.notWant)
+			}
+		})
+	}
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/httperror"
+)
+
+// 投票は Note の代わりに Question として出す。選択肢は oneOf (単一選択) か
+// anyOf (複数選択) に並べる。票は、選択肢を name に、投票を inReplyTo に
+// 入れた Note の Create として届く。数え直した結果は Update で配る。
+
+// 作れる投票の制限。Mastodon の既定値に合わせる。
+const (
+	pollMaxOptions      = 4
+	pollMaxOptionLength = 50
+	pollMinExpiry       = 5 * time.Minute
+	pollMaxExpiry       = 30 * 24 * time.Hour
+	pollDefaultExpiry   = 24 * time.Hour
+)
+
+// normalizePoll は投票の選択肢を trim し、空のものを捨ててから検証する。
+// form は選択肢の入力欄を常に全部送ってくるので、空欄は書かなかったもの
+// として扱う。選択肢が1つも無ければ投票ではない。
+func (req *statusRequest) normalizePoll() error {
+	options := make([]string, 0, len(req.PollOptions))
+	for _, o := range req.PollOptions {
+		if o = strings.TrimSpace(o); o != "" {
+			options = append(options, o)
+		}
+	}
+	req.PollOptions = options
+	if len(options) == 0 {
+		return nil
+	}
+	if len(options) < 2 || len(options) > pollMaxOptions {
+		return fmt.Errorf("a poll needs 2 to %d options, got %d", pollMaxOptions, len(options))
+	}
+	for i, o := range options {
+		if len([]rune(o)) > pollMaxOptionLength {
+			return fmt.Errorf("poll option %q is longer than %d characters", o, pollMaxOptionLength)
+		}
+		if slices.Contains(options[:i], o) {
+			return fmt.Errorf("duplicate poll option %q", o)
+		}
+	}
+	if req.PollExpiresIn == 0 {
+		req.PollExpiresIn = int(pollDefaultExpiry / time.Second)
+	}
+	expiry := time.Duration(req.PollExpiresIn) * time.Second
+	if expiry < pollMinExpiry || expiry > pollMaxExpiry {
+		return fmt.Errorf("poll_expires_in must be between %d and %d seconds", int(pollMinExpiry/time.Second), int(pollMaxExpiry/time.Second))
+	}
+	return nil
+}
+
+// parsePollForm は form の投票の項目を読む。poll_options は選択肢ごとの
+// 入力欄で、同じ名前で複数来る。
+func (req *statusRequest) parsePollForm(r *http.Request) error {
+	req.PollOptions = r.PostForm["poll_options"]
+	if s := strings.TrimSpace(r.PostFormValue("poll_expires_in")); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("bad poll_expires_in: %w", err)
+		}
+		req.PollExpiresIn = n
+	}
+	req.PollMultiple = r.PostFormValue("poll_multiple") != ""
+	return nil
+}
+
+// applyPoll は note を req の投票にする。票は0から数える。
+func applyPoll(note *activitystream.Object, req *statusRequest, now time.Time) {
+	options := make(activitystream.Objects, 0, len(req.PollOptions))
+	for _, o := range req.PollOptions {
+		options = append(options, activitystream.NewPollOption(o, 0))
+	}
+	note.Type = activitystream.QuestionType
+	if req.PollMultiple {
+		note.AnyOf = options
+	} else {
+		note.OneOf = options
+	}
+	note.EndTime = now.Add(time.Duration(req.PollExpiresIn) * time.Second).UTC().Format(time.RFC3339)
+	voters := 0
+	note.VotersCount = &voters
+}
+
+// pollOptions は Question の選択肢と、複数選択かどうかを返す。
+func pollOptions(q *activitystream.Object) (activitystream.Objects, bool) {
+	if len(q.AnyOf) > 0 {
+		return q.AnyOf, true
+	}
+	return q.OneOf, false
+}
+
+// pollClosed は締め切られているかを返す。closed が無くても endTime を
+// 過ぎていれば締め切りとみなす。締め切りの Update を送ってこない実装がある。
+func pollClosed(q *activitystream.Object, now time.Time) bool {
+	if q.Closed != "" {
+		return true
+	}
+	end, err := time.Parse(time.RFC3339, q.EndTime)
+	return err == nil && !now.Before(end)
+}
+
+// pollVotes は選択肢の票数。replies.totalItems に入っている。
+func pollVotes(option *activitystream.Object) int {
+	if c := option.Replies.Item(); c != nil && c.TotalItems != nil {
+		return *c.TotalItems
+	}
+	return 0
+}
+
+// hasPollOption は name が選択肢にあるかを返す。
+func hasPollOption(options activitystream.Objects, name string) bool {
+	return slices.ContainsFunc(options, func(o *activitystream.Object) bool { return o != nil && o.Name == name })
+}
+
+// --- 票を受ける -------------------------------------------------------
+
+func votePrefix(questionURI string) string { return questionURI + "#" }
+
+// receiveVote は note が自分の投票への票なら記録して真を返す。票でなければ
+// 偽を返し、呼び出し側がふつうの投稿として扱う。票は本文を持たず、name に
+// 選択肢を入れてくる。票を書けなければ error を返す。送った側に再送して
+// もらうため、受け取ったことにはしない。
+//
+// 票は1票ずつ KV に置き、数は読むたびに数え直す (countedPoll)。保存して
+// ある Question の票数を読んで足して書き戻すと、同時に届いた票の片方が
+// 消える。単一選択の票は投票者ごとに1項目にし、まだ無いときだけ書く。
+// 先に入れた票があるかを読んでから書くと、同時に届いた2票が両方通る。
+//
+// 数え直した結果は Update で配る。配り先はフォロワーと投票した本人。
+// 本人がフォロワーとは限らず、送らないと自分の票が結果に出ない。
+func receiveVote(ctx context.Context, in, note *activitystream.Object) (bool, error) {
+	if note.Name == "" || note.Content != "" {
+		return false, nil
+	}
+	owner, id, ok := actorAndIDFromStatusURI(note.InReplyTo.ID())
+	if !ok {
+		return false, nil
+	}
+	q, herr := loadStatus(ctx, owner, id)
+	if herr != nil || q.Type != activitystream.QuestionType {
+		return false, nil
+	}
+
+	voter := in.Actor.ID()
+	// 署名で確かめたのは Create の actor なので、票の著者もその本人に限る。
+	if note.AttributedTo.ID() != voter {
+		logf("inbox: ignoring a vote on %v attributed to %v but sent by %v", q.ID, note.AttributedTo.ID(), voter)
+		return true, nil
+	}
+	now := time.Now()
+	if pollClosed(q, now) {
+		logf("inbox: ignoring a vote from %v on the closed poll %v", voter, q.ID)
+		return true, nil
+	}
+	options, multiple := pollOptions(q)
+	if !hasPollOption(options, note.Name) {
+		logf("inbox: ignoring a vote from %v for %q, which %v does not offer", voter, note.Name, q.ID)
+		return true, nil
+	}
+	vote := &datastore.KVItem{
+		PK:          actorScoped(owner, datastore.KVVotes),
+		SK:          voteKey(q.ID, voter, note.Name, multiple),
+		Name:        note.Name,
+		TargetActor: voter,
+		ActivityID:  in.ID,
+		At:          nowRFC3339(),
+	}
+	if multiple {
+		// 同じ票が二度届いても SK が同じなので数は増えない。
+		if err := client.PutKV(ctx, vote); err != nil {
+			return true, fmt.Errorf("recording the vote of %v on %v: %w", voter, q.ID, err)
+		}
+	} else if err := client.PutKVIfAbsent(ctx, vote); err != nil {
+		if !errors.Is(err, datastore.ErrConditionFailed) {
+			return true, fmt.Errorf("recording the vote of %v on %v: %w", voter, q.ID, err)
+		}
+		logf("inbox: ignoring a second vote from %v on %v", voter, q.ID)
+		return true, nil
+	}
+	logf("%v voted for %q on %v", voter, note.Name, q.ID)
+	// 今入れた票も数に入るよう、書いた後で読み直す。
+	publishVoteCounts(ctx, owner, countedPoll(ctx, owner, q), voter, now)
+	return true, nil
+}
+
+// voteKey は票の SK。単一選択は投票者ごとに1つ、複数選択は投票者と選択肢
+// ごとに1つ。
+func voteKey(questionURI, voter, option string, multiple bool) string {
+	if !multiple {
+		return votePrefix(questionURI) + voter
+	}
+	return votePrefix(questionURI) + voter + "#" + option
+}
+
+// votesOn は votes のうち questionURI への票だけを返す。
+func votesOn(votes []*datastore.KVItem, questionURI string) []*datastore.KVItem {
+	prefix := votePrefix(questionURI)
+	return slices.DeleteFunc(votes, func(v *datastore.KVItem) bool { return !strings.HasPrefix(v.SK, prefix) })
+}
+
+// countedPoll は自分の投票 q の票数を KV の票から数え直した写しを返す。
+// 読めなければ q をそのまま返す。
+func countedPoll(ctx context.Context, owner *config.ActorConfig, q *activitystream.Object) *activitystream.Object {
+	votes, err := client.QueryKV(ctx, actorScoped(owner, datastore.KVVotes))
+	if err != nil {
+		logf("loading the votes on %v failed: %v", q.ID, err)
+		return q
+	}
+	return withVoteCounts(q, votesOn(votes, q.ID))
+}
+
+// withVoteCounts は q の票数と投票者数を votes から数え直した写しを返す。
+// q 自体は書き換えない。
+func withVoteCounts(q *activitystream.Object, votes []*datastore.KVItem) *activitystream.Object {
+	counts := map[string]int{}
+	voters := map[string]bool{}
+	for _, v := range votes {
+		counts[v.Name]++
+		voters[v.TargetActor] = true
+	}
+	options, multiple := pollOptions(q)
+	counted := make(activitystream.Objects, 0, len(options))
+	for _, o := range options {
+		counted = append(counted, activitystream.NewPollOption(o.Name, counts[o.Name]))
+	}
+	next := *q
+	if multiple {
+		next.AnyOf = counted
+	} else {
+		next.OneOf = counted
+	}
+	n := len(voters)
+	next.VotersCount = &n
+	return &next
+}
+
+// publishVoteCounts は数え直した投票を Update で配る。保存してある
+// Question は書き換えない。数は読むときに数え直すので要らず、書き戻すと
+// その間の編集を古い本文で上書きしかねない。
+//
+// updated は付けない。Mastodon は updated の無い Update を編集ではなく
+// 票数の更新として扱い、「編集済み」を付けない。
+func publishVoteCounts(ctx context.Context, owner *config.ActorConfig, q *activitystream.Object, voter string, now time.Time) {
+	// 票は1秒に何票も来うるので、id はナノ秒で分ける。同じ id だと受け
+	// 取った側に重複として捨てられる。
+	update := activitystream.NewUpdate(fmt.Sprintf("%s#votes/%d", q.ID, now.UnixNano()), owner.ID(), q.To, q.Cc, q)
+	inboxes, err := noteInboxes(ctx, owner, q, []string{voter})
+	if err != nil {
+		logf("cannot list the inboxes for the vote counts of %v: %v", q.ID, err)
+		return
+	}
+	if err := deliver(ctx, owner, inboxes, update); err != nil {
+		logf("Update of the vote counts of %v had delivery failures: %v", q.ID, err)
+	}
+}
+
+// --- 締め切る ---------------------------------------------------------
+
+// recordOpenPoll は締め切りの Update を送るために、投稿した投票を控える。
+func recordOpenPoll(ctx context.Context, owner *config.ActorConfig, q *activitystream.Object) error {
+	return client.PutKV(ctx, &datastore.KVItem{
+		PK: actorScoped(owner, datastore.KVOpenPolls),
+		SK: q.ID,
+		At: q.EndTime,
+	})
+}
+
+// closeDuePolls は endTime を過ぎた投票の締め切りを配る。予約投稿の
+// worker から呼ぶ。endTime を過ぎた投票は、Update が無くても票を受け
+// 付けない (pollClosed)。ここで送るのは、相手のサーバに最終の票数と
+// 締め切ったことを知らせるため。
+func closeDuePolls(ctx context.Context, now time.Time) error {
+	var errs []error
+	for _, owner := range Config.Actors {
+		items, err := client.QueryKV(ctx, actorScoped(owner, datastore.KVOpenPolls))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot list open polls of %v: %w", owner.LocalPart(), err))
+			continue
+		}
+		for _, it := range items {
+			end, err := time.Parse(time.RFC3339, it.At)
+			if err == nil && now.Before(end) {
+				continue
+			}
+			if err := closePoll(ctx, owner, it, now); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// closePoll は投票を1つ締め切り、最終の票数を Update で配る。
+//
+// 控えを取り出して (TakeKV) から送るので、worker が重なっても送るのは
+// 1度だけになる。投票を読めない一時的な失敗のときは控えを戻し、次の
+// 起動でやり直す。消した投票には何も送らない (Delete が届いている)。
+func closePoll(ctx context.Context, owner *config.ActorConfig, open *datastore.KVItem, now time.Time) error {
+	taken, err := client.TakeKV(ctx, open.PK, open.SK)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("cannot take the open poll %v: %w", open.SK, err)
+	}
+	putBack := func(cause error) error {
+		if err := client.PutKVIfAbsent(ctx, taken); err != nil {
+			logf("cannot put back the open poll %v: %v", open.SK, err)
+		}
+		return fmt.Errorf("cannot close the poll %v: %w", open.SK, cause)
+	}
+	_, id, ok := actorAndIDFromStatusURI(open.SK)
+	if !ok {
+		logf("dropping the open poll %v, which is not a local status", open.SK)
+		return nil
+	}
+	q, herr := loadStatus(ctx, owner, id)
+	if herr != nil {
+		if herr.Code() >= http.StatusInternalServerError {
+			return putBack(herr)
+		}
+		logf("not closing the poll %v: %v", open.SK, herr)
+		return nil
+	}
+	if q.Type != activitystream.QuestionType {
+		return nil
+	}
+	votes, err := client.QueryKV(ctx, actorScoped(owner, datastore.KVVotes))
+	if err != nil {
+		return putBack(err)
+	}
+	update, voters := pollCloseUpdate(owner, q, votesOn(votes, q.ID))
+	inboxes, err := noteInboxes(ctx, owner, q, voters)
+	if err != nil {
+		return putBack(err)
+	}
+	if err := deliver(ctx, owner, inboxes, update); err != nil {
+		logf("Update closing the poll %v had delivery failures: %v", q.ID, err)
+	}
+	logf("closed the poll %v", q.ID)
+	return nil
+}
+
+// pollCloseUpdate は q を締め切った Update と、その配り先に足す投票者を
+// 返す。投票者はフォロワーとは限らず、送らないと最終の結果が届かない。
+// closed には endTime を入れる。保存してある Question は書き換えない
+// (publishVoteCounts と同じ)。
+func pollCloseUpdate(owner *config.ActorConfig, q *activitystream.Object, votes []*datastore.KVItem) (*activitystream.Object, []string) {
+	closed := withVoteCounts(q, votes)
+	closed.Closed = activitystream.Closed(q.EndTime)
+	var voters []string
+	for _, v := range votes {
+		if !slices.Contains(voters, v.TargetActor) {
+			voters = append(voters, v.TargetActor)
+		}
+	}
+	return activitystream.NewUpdate(q.ID+"#closed", owner.ID(), q.To, q.Cc, closed), voters
+}
+
+// --- リモートの投票に入れる ---------------------------------------------
+
+// voteRequestHandler はリモートの投票に票を入れる。選択肢ごとに、name に
+// 選択肢を入れた Note の Create を投票の著者に直接送る。primary actor
+// 専用。
+func voteRequestHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	primary, herr := resolvePrimaryActor(r)
+	if herr != nil {
+		return herr
+	}
+	var body struct {
+		Question string   `json:"question"`
+		Choices  []string `json:"choices"`
+	}
+	if isFormRequest(r) {
+		if err := r.ParseForm(); err != nil {
+			return httperror.StatusUnprocessableEntity("bad form", err)
+		}
+		body.Question = r.PostFormValue("question")
+		body.Choices = r.PostForm["choice"]
+	} else if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return httperror.StatusUnprocessableEntity("bad request", err)
+	}
+	questionURI := strings.TrimSpace(body.Question)
+	if questionURI == "" {
+		return httperror.StatusUnprocessableEntity("question must not be empty", nil)
+	}
+	if _, _, ok := actorAndIDFromStatusURI(questionURI); ok {
+		return httperror.StatusUnprocessableEntity("cannot vote on a local poll", nil)
+	}
+
+	if _, err := client.GetKV(ctx, actorScoped(primary, datastore.KVMyVotes), questionURI); err == nil {
+		return httperror.StatusUnprocessableEntity("already voted", nil)
+	} else if !errors.Is(err, datastore.ErrNotFound) {
+		return httperror.StatusInternalServerError("cannot look up the vote", err)
+	}
+	q, err := fetchVerifiedNote(ctx, primary, questionURI)
+	if err != nil {
+		return httperror.StatusUnprocessableEntity("cannot fetch the poll", err)
+	}
+	if q.Type != activitystream.QuestionType {
+		return httperror.StatusUnprocessableEntity("that status is not a poll", nil)
+	}
+	if pollClosed(q, time.Now()) {
+		return httperror.StatusUnprocessableEntity("the poll is closed", nil)
+	}
+	choices, herr := validVoteChoices(q, body.Choices)
+	if herr != nil {
+		return herr
+	}
+
+	author := q.AttributedTo.ID()
+	if isBlockedBy(ctx, primary, author) {
+		return httperror.StatusUnprocessableEntity("that actor blocks you", nil)
+	}
+	remote, err := fetchActor(ctx, primary, author)
+	if err != nil {
+		return httperror.StatusUnprocessableEntity("cannot fetch the author of the poll", err)
+	}
+	inbox := remote.InboxURI()
+	if inbox == "" {
+		return httperror.StatusUnprocessableEntity("the author advertises no inbox", nil)
+	}
+
+	creates := voteCreates(primary, q, choices)
+	// 配信より先に記録する。二重に投票しないため。
+	if err := client.PutKV(ctx, &datastore.KVItem{
+		PK:          actorScoped(primary, datastore.KVMyVotes),
+		SK:          q.ID,
+		TargetActor: author,
+		Content:     strings.Join(choices, "\n"),
+		At:          nowRFC3339(),
+	}); err != nil {
+		return httperror.StatusInternalServerError("cannot record the vote", err)
+	}
+	for _, create := range creates {
+		if err := enqueueDelivery(ctx, primary.LocalPart(), inbox, create); err != nil {
+			return httperror.StatusInternalServerError("cannot queue the vote", err)
+		}
+	}
+
+	if isFormRequest(r) {
+		http.Redirect(w, r, "/timeline", http.StatusSeeOther)
+		return nil
+	}
+	return respondAsJSON(w, http.StatusAccepted, creates)
+}
+
+// validVoteChoices は choices を検証し、重複を除いて返す。単一選択の投票に
+// 複数の票は入れられない。
+func validVoteChoices(q *activitystream.Object, choices []string) ([]string, httperror.HttpError) {
+	options, multiple := pollOptions(q)
+	var valid []string
+	for _, c := range choices {
+		if !hasPollOption(options, c) {
+			return nil, httperror.StatusUnprocessableEntity(fmt.Sprintf("the poll has no option %q", c), nil)
+		}
+		valid = appendUnique(valid, c)
+	}
+	if len(valid) == 0 {
+		return nil, httperror.StatusUnprocessableEntity("choose at least one option", nil)
+	}
+	if !multiple && len(valid) > 1 {
+		return nil, httperror.StatusUnprocessableEntity("the poll allows only one choice", nil)
+	}
+	return valid, nil
+}
+
+// voteCreates は選択肢ごとの票を Create に包む。票は投票の著者にだけ宛てる。
+// 本文は持たせない。受け取った側はそれで票とふつうの返信を見分ける。
+func voteCreates(actor *config.ActorConfig, q *activitystream.Object, choices []string) []*activitystream.Object {
+	author := q.AttributedTo.ID()
+	base := newActivityID("vote")
+	creates := make([]*activitystream.Object, 0, len(choices))
+	for i, c := range choices {
+		note := &activitystream.Object{
+			ID:           fmt.Sprintf("%s/%d", base, i),
+			Type:         activitystream.NoteType,
+			Name:         c,
+			AttributedTo: activitystream.URIRef(actor.ID()),
+			To:           []string{author},
+			InReplyTo:    activitystream.URIRef(q.ID),
+		}
+		creates = append(creates, noteToCreate(note))
+	}
+	return creates
+}
+
+// --- 表示 -------------------------------------------------------------
+
+// pollOptionItem は投票の選択肢1つ分。Percent は票の割合 (0-100)。
+type pollOptionItem struct {
+	Name    string
+	Count   int
+	Percent int
+	// Chosen は自分が選んだものかどうか。
+	Chosen bool
+}
+
+// pollItem は投票の表示。CanVote が立っているときだけ投票のフォームを
+// 出す。自分の投票・締め切り済み・投票済みには結果だけを出す。
+type pollItem struct {
+	URI         string
+	Options     []pollOptionItem
+	Multiple    bool
+	VotersCount int
+	EndTime     string
+	Closed      bool
+	CanVote     bool
+}
+
+// notePoll は note が投票なら表示用に落とす。voted は自分が入れた票。
+//
+// 割合の分母は票の合計。複数選択では1人が何票も入れるので、Mastodon と
+// 同じく投票者数を分母にする。
+func notePoll(note *activitystream.Object, mine bool, voted []string, now time.Time) *pollItem {
+	if note.Type != activitystream.QuestionType {
+		return nil
+	}
+	options, multiple := pollOptions(note)
+	p := &pollItem{
+		URI:      note.ID,
+		Multiple: multiple,
+		EndTime:  note.EndTime,
+		Closed:   pollClosed(note, now),
+	}
+	total := 0
+	for _, o := range options {
+		if o == nil {
+			continue
+		}
+		n := pollVotes(o)
+		total += n
+		p.Options = append(p.Options, pollOptionItem{Name: o.Name, Count: n, Chosen: slices.Contains(voted, o.Name)})
+	}
+	if note.VotersCount != nil {
+		p.VotersCount = *note.VotersCount
+	}
+	if multiple && p.VotersCount > 0 {
+		total = p.VotersCount
+	}
+	for i := range p.Options {
+		if total > 0 {
+			p.Options[i].Percent = p.Options[i].Count * 100 / total
+		}
+	}
+	p.CanVote = !mine && !p.Closed && len(voted) == 0
+	return p
+}
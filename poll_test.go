@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+func TestNormalizePoll(t *testing.T) {
+	t.Run("空欄は捨て、期間の既定は1日", func(t *testing.T) {
+		req := &statusRequest{Content: "どっち", PollOptions: []string{" はい ", "", "いいえ", "  "}}
+		if err := req.normalize(); err != nil {
+			t.Fatal(err)
+		}
+		if len(req.PollOptions) != 2 || req.PollOptions[0] != "はい" || req.PollExpiresIn != 86400 {
+			t.Errorf("req = %+v", req)
+		}
+	})
+	t.Run("選択肢が無ければ投票ではない", func(t *testing.T) {
+		req := &statusRequest{Content: "x", PollOptions: []string{"", ""}}
+		if err := req.normalize(); err != nil || req.PollOptions == nil || len(req.PollOptions) != 0 || req.PollExpiresIn != 0 {
+			t.Errorf("req = %+v, err = %v", req, err)
+		}
+	})
+	for name, req := range map[string]*statusRequest{
+		"選択肢が1つ":  {PollOptions: []string{"a"}},
+		"選択肢が多すぎ": {PollOptions: []string{"a", "b", "c", "d", "e"}},
+		"選択肢が重複":  {PollOptions: []string{"a", "a"}},
+		"選択肢が長すぎ": {PollOptions: []string{"a", strings.Repeat("あ", pollMaxOptionLength+1)}},
+		"期間が短すぎ":  {PollOptions: []string{"a", "b"}, PollExpiresIn: 60},
+		"期間が長すぎ":  {PollOptions: []string{"a", "b"}, PollExpiresIn: 31 * 86400},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := req.normalize(); err == nil {
+				t.Errorf("normalize accepted %+v", req)
+			}
+		})
+	}
+}
+
+func TestParsePollForm(t *testing.T) {
+	form := url.Values{
+		"content":         {"どっち"},
+		"poll_options":    {"はい", "いいえ", "", ""},
+		"poll_expires_in": {"3600"},
+		"poll_multiple":   {"1"},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/u/nana/statuses", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req, err := parseStatusRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.PollOptions) != 2 || req.PollExpiresIn != 3600 || !req.PollMultiple {
+		t.Errorf("req = %+v", req)
+	}
+}
+
+func TestApplyPoll(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	note := &activitystream.Object{Type: activitystream.NoteType}
+	applyPoll(note, &statusRequest{PollOptions: []string{"a", "b"}, PollExpiresIn: 3600}, now)
+	if note.Type != activitystream.QuestionType || len(note.OneOf) != 2 || note.AnyOf != nil ||
+		note.EndTime != "2026-10-17T13:00:00Z" || note.VotersCount == nil || *note.VotersCount != 0 {
+		t.Errorf("single choice poll = %+v", note)
+	}
+
+	note = &activitystream.Object{Type: activitystream.NoteType}
+	applyPoll(note, &statusRequest{PollOptions: []string{"a", "b"}, PollExpiresIn: 3600, PollMultiple: true}, now)
+	if len(note.AnyOf) != 2 || note.OneOf != nil {
+		t.Errorf("multiple choice poll = %+v", note)
+	}
+}
+
+func TestPollClosed(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		q    *activitystream.Object
+		want bool
+	}{
+		{&activitystream.Object{EndTime: "2026-10-18T00:00:00Z"}, false},
+		{&activitystream.Object{EndTime: "2026-10-17T00:00:00Z"}, true},
+		{&activitystream.Object{EndTime: "2026-10-18T00:00:00Z", Closed: "true"}, true},
+		{&activitystream.Object{}, false},
+	} {
+		if got := pollClosed(c.q, now); got != c.want {
+			t.Errorf("pollClosed(%+v) = %v, want %v", c.q, got, c.want)
+		}
+	}
+}
+
+// 票は選択肢ごとに、投票者は人数で数えること。元の Question は書き換え
+// ないこと。
+func TestWithVoteCounts(t *testing.T) {
+	q := &activitystream.Object{
+		ID:    "https://s.example/u/nana/status/1",
+		Type:  activitystream.QuestionType,
+		AnyOf: activitystream.Objects{activitystream.NewPollOption("a", 0), activitystream.NewPollOption("b", 0)},
+	}
+	votes := []*datastore.KVItem{
+		{SK: q.ID + "#https://m.example/users/alice#a", Name: "a", TargetActor: "https://m.example/users/alice"},
+		{SK: q.ID + "#https://m.example/users/alice#b", Name: "b", TargetActor: "https://m.example/users/alice"},
+		{SK: q.ID + "#https://m.example/users/bob#a", Name: "a", TargetActor: "https://m.example/users/bob"},
+		{SK: "https://s.example/u/nana/status/2#https://m.example/users/bob#a", Name: "a", TargetActor: "https://m.example/users/bob"},
+	}
+	got := withVoteCounts(q, votesOn(votes, q.ID))
+	if pollVotes(got.AnyOf[0]) != 2 || pollVotes(got.AnyOf[1]) != 1 || got.VotersCount == nil || *got.VotersCount != 2 {
+		t.Errorf("counted = %+v", got)
+	}
+	if pollVotes(q.AnyOf[0]) != 0 || q.VotersCount != nil {
+		t.Errorf("the original question was modified: %+v", q)
+	}
+}
+
+// 単一選択の票は選択肢によらず投票者ごとに1つの SK になること。条件付きの
+// 書き込みで2票目を弾くのはこれに頼っている。
+func TestVoteKey(t *testing.T) {
+	const q = "https://s.example/u/nana/status/1"
+	const alice = "https://m.example/users/alice"
+	if voteKey(q, alice, "a", false) != voteKey(q, alice, "b", false) {
+		t.Error("single-choice votes for different options have different keys")
+	}
+	if voteKey(q, alice, "a", true) == voteKey(q, alice, "b", true) {
+		t.Error("multiple-choice votes for different options share a key")
+	}
+	if got := voteKey(q, alice, "a", false); len(votesOn([]*datastore.KVItem{{SK: got}}, q)) != 1 {
+		t.Errorf("votesOn does not find %v", got)
+	}
+}
+
+func TestValidVoteChoices(t *testing.T) {
+	single := &activitystream.Object{OneOf: activitystream.Objects{activitystream.NewPollOption("a", 0), activitystream.NewPollOption("b", 0)}}
+	multiple := &activitystream.Object{AnyOf: single.OneOf}
+	if got, herr := validVoteChoices(multiple, []string{"a", "b", "a"}); herr != nil || len(got) != 2 {
+		t.Errorf("multiple = %v, %v", got, herr)
+	}
+	for name, c := range map[string]struct {
+		q       *activitystream.Object
+		choices []string
+	}{
+		"無い選択肢":   {single, []string{"c"}},
+		"未選択":     {single, nil},
+		"単一選択に二票": {single, []string{"a", "b"}},
+	} {
+		if _, herr := validVoteChoices(c.q, c.choices); herr == nil {
+			t.Errorf("%v: accepted %v", name, c.choices)
+		}
+	}
+}
+
+// 票は本文を持たず、選択肢ごとに投票の著者にだけ宛てた Note で送ること。
+func TestVoteCreates(t *testing.T) {
+	withTestConfig(t)
+	q := &activitystream.Object{
+		ID:           "https://m.example/users/alice/statuses/2",
+		AttributedTo: activitystream.URIRef("https://m.example/users/alice"),
+	}
+	creates := voteCreates(Config.PrimaryActor(), q, []string{"a", "b"})
+	if len(creates) != 2 || creates[0].ID == creates[1].ID {
+		t.Fatalf("creates = %v", creates)
+	}
+	note := creates[0].Object.Item()
+	if note == nil || note.Name != "a" || note.Content != "" || note.InReplyTo.ID() != q.ID ||
+		len(note.To) != 1 || note.To[0] != "https://m.example/users/alice" || note.AttributedTo.ID() != "https://s.example/u/nana" {
+		t.Errorf("vote = %+v", note)
+	}
+}
+
+func TestNotePoll(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	voters := 4
+	q := &activitystream.Object{
+		ID:          "https://m.example/users/alice/statuses/2",
+		Type:        activitystream.QuestionType,
+		OneOf:       activitystream.Objects{activitystream.NewPollOption("a", 3), activitystream.NewPollOption("b", 1)},
+		EndTime:     "2026-10-18T00:00:00Z",
+		VotersCount: &voters,
+	}
+	p := notePoll(q, false, nil, now)
+	if p == nil || !p.CanVote || p.Multiple || p.Options[0].Percent != 75 || p.Options[1].Percent != 25 {
+		t.Fatalf("poll = %+v", p)
+	}
+	if p := notePoll(q, false, []string{"b"}, now); p.CanVote || !p.Options[1].Chosen {
+		t.Errorf("voted poll = %+v", p)
+	}
+	if p := notePoll(q, true, nil, now); p.CanVote {
+		t.Error("can vote on my own poll")
+	}
+	if notePoll(&activitystream.Object{Type: activitystream.NoteType}, false, nil, now) != nil {
+		t.Error("a Note has a poll")
+	}
+}
+
+func TestPollRenders(t *testing.T) {
+	page := timelinePage{
+		pageBase: pageBase{Title: "タイムライン", SiteName: "nana", LocalPart: "nana", Handle: "@nana"},
+		Page:     1,
+		Items: []timelineItem{
+			{ObjectURI: "https://m.example/notes/1", Poll: &pollItem{
+				URI: "https://m.example/notes/1", Multiple: true, CanVote: true,
+				Options: []pollOptionItem{{Name: "a"}, {Name: "b"}},
+			}},
+			{ObjectURI: "https://m.example/notes/2", Poll: &pollItem{
+				URI: "https://m.example/notes/2", Closed: true, VotersCount: 2,
+				Options: []pollOptionItem{{Name: "c", Count: 2, Percent: 100, Chosen: true}},
+			}},
+		},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "timeline", page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`action="/u/nana/votes"`, `<input type="checkbox" name="choice" value="a">`,
+		`name="poll_options"`, `100% c`, `締め切り済み`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("timeline does not contain %q", want)
+		}
+	}
+}
+
+func TestVoteRoute(t *testing.T) {
+	if h, _, _ := newRouter().Lookup(http.MethodPost, "/u/nana/votes"); h == nil {
+		t.Error("POST /u/nana/votes is not routed")
+	}
+}
+
+// failingVoteStore は票の書き込みだけが失敗する datastore.Client。
+type failingVoteStore struct{ objectStore }
+
+func (failingVoteStore) PutKVIfAbsent(ctx context.Context, item *datastore.KVItem) error {
+	return errors.New("throttled")
+}
+
+// 票を書けなければ、受け取ったことにせず error を返すこと。送った側が
+// 再送できるよう、inbox は 500 を返す。
+func TestReceiveVoteReportsWriteFailure(t *testing.T) {
+	withTestConfig(t)
+	actor := Config.PrimaryActor()
+	saved := client
+	t.Cleanup(func() { client = saved })
+	q := &activitystream.Object{
+		ID:      myStatusURI(actor, 1),
+		Type:    activitystream.QuestionType,
+		OneOf:   activitystream.Objects{activitystream.NewPollOption("a", 0), activitystream.NewPollOption("b", 0)},
+		EndTime: time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	}
+	client = failingVoteStore{objectStore{objects: map[int]*activitystream.Object{1: q}}}
+
+	const voter = "https://a.example/users/alice"
+	vote := &activitystream.Object{Name: "a", AttributedTo: activitystream.URIRef(voter), InReplyTo: activitystream.URIRef(q.ID)}
+	in := &activitystream.Object{ID: "https://a.example/votes/1", Actor: activitystream.URIRef(voter)}
+	isVote, err := receiveVote(context.Background(), in, vote)
+	if !isVote || err == nil {
+		t.Errorf("receiveVote = %v, %v, want true and an error", isVote, err)
+	}
+}
+
+// 締め切りの Update は closed と最終の票数を持ち、投票者にも届くこと。
+func TestPollCloseUpdate(t *testing.T) {
+	withTestConfig(t)
+	owner := Config.PrimaryActor()
+	q := &activitystream.Object{
+		ID:      myStatusURI(owner, 1),
+		Type:    activitystream.QuestionType,
+		AnyOf:   activitystream.Objects{activitystream.NewPollOption("a", 0), activitystream.NewPollOption("b", 0)},
+		EndTime: "2026-10-17T13:00:00Z",
+		To:      []string{activitystream.ToPublic},
+	}
+	const alice, bob = "https://a.example/users/alice", "https://b.example/users/bob"
+	votes := []*datastore.KVItem{
+		{SK: voteKey(q.ID, alice, "a", true), Name: "a", TargetActor: alice},
+		{SK: voteKey(q.ID, alice, "b", true), Name: "b", TargetActor: alice},
+		{SK: voteKey(q.ID, bob, "a", true), Name: "a", TargetActor: bob},
+	}
+	update, voters := pollCloseUpdate(owner, q, votes)
+	closed := update.Object.Item()
+	if update.Type != activitystream.UpdateType || closed == nil || closed.Closed != "2026-10-17T13:00:00Z" {
+		t.Fatalf("update = %+v", update)
+	}
+	if pollVotes(closed.AnyOf[0]) != 2 || pollVotes(closed.AnyOf[1]) != 1 || *closed.VotersCount != 2 {
+		t.Errorf("counts = %v, %v, voters %v", pollVotes(closed.AnyOf[0]), pollVotes(closed.AnyOf[1]), *closed.VotersCount)
+	}
+	if len(voters) != 2 || voters[0] != alice || voters[1] != bob {
+		t.Errorf("voters = %v", voters)
+	}
+	if q.Closed != "" {
+		t.Error("the stored question was modified")
+	}
+}
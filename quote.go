@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/httperror"
+	"github.com/nna774/s.nna774.net/web"
+	"golang.org/x/net/html"
+)
+
+// 引用。ブーストと違い、自分の投稿として本文を付けて他人の投稿を載せる。
+// 引用先は quoteUrl (Misskey・新しい Mastodon) と _misskey_quote (Misskey
+// の旧称) と FEP-e232 の Link の tag の3通りで示す。引用を解さない実装の
+// ために、本文の末尾にも「RE: URL」を入れる。Mastodon はこれを
+// quote-inline の class で見分け、引用として出すときは消す。
+
+// quotableStatus は引用する投稿を引き、引用してよいかを確かめる。自分の
+// 投稿は datastore から、他人の投稿は取りに行って引く。
+//
+// 引用できるのは public と unlisted だけ。フォロワー限定や direct を引用
+// すると、見せる相手を絞った本文を引用した側の読者に広げてしまう。
+func quotableStatus(ctx context.Context, actor *config.ActorConfig, uri string) (*activitystream.Object, httperror.HttpError) {
+	var note *activitystream.Object
+	if owner, id, ok := actorAndIDFromStatusURI(uri); ok {
+		n, herr := loadStatus(ctx, owner, id)
+		if herr != nil {
+			return nil, herr
+		}
+		note = n
+	} else {
+		n, err := fetchVerifiedNote(ctx, actor, uri)
+		if err != nil {
+			return nil, httperror.StatusUnprocessableEntity("cannot fetch the quoted status", err)
+		}
+		note = n
+	}
+	switch noteVisibility(note, "") {
+	case visibilityPublic, visibilityUnlisted:
+		return note, nil
+	}
+	return nil, httperror.StatusUnprocessableEntity("only public or unlisted statuses can be quoted", nil)
+}
+
+// applyQuote は note を uri の引用にする。本文の「RE: URL」もここで足す
+// ので、本文を作り直したら (編集) また呼ぶ。
+func applyQuote(note *activitystream.Object, uri string) {
+	note.SetQuote(uri)
+	note.Content += quoteInline(uri)
+}
+
+// quoteInline は引用を解さない実装に見せる「RE: URL」。
+func quoteInline(uri string) string {
+	u := html.EscapeString(uri)
+	return `<p class="quote-inline">RE: <a href="` + u + `">` + u + `</a></p>`
+}
+
+// stripQuoteInline は本文の「RE: URL」を消す。引用をカードで出すときは
+// 同じ URL が二重に見えるので。Mastodon が出すのは p と span の2通りで、
+// 中のリンクには表示を詰めるための span (invisible・ellipsis) が入れ子に
+// なっている。正規表現で最初の閉じタグまでを消すと途中で切れるので、
+// 字句に分けて同じ名前のタグの入れ子を数え、対応する閉じタグまでを消す。
+func stripQuoteInline(content string) string {
+	z := html.NewTokenizer(strings.NewReader(content))
+	var b strings.Builder
+	skipping := "" // 消している要素の名前
+	depth := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			// 閉じられていない quote-inline は終わりまで消えたままになる。
+			return b.String()
+		}
+		if skipping != "" {
+			name, _ := z.TagName()
+			switch {
+			case tt == html.StartTagToken && string(name) == skipping:
+				depth++
+			case tt == html.EndTagToken && string(name) == skipping:
+				depth--
+				if depth == 0 {
+					skipping = ""
+				}
+			}
+			continue
+		}
+		if tt == html.StartTagToken {
+			// TagName・TagAttr を呼ぶと Raw は使えなくなるので、先に写す。
+			raw := string(z.Raw())
+			name, hasAttr := z.TagName()
+			if tag := string(name); (tag == "p" || tag == "span") && hasAttr && hasQuoteInlineClass(z) {
+				skipping, depth = tag, 1
+				continue
+			}
+			b.WriteString(raw)
+			continue
+		}
+		b.Write(z.Raw())
+	}
+}
+
+// hasQuoteInlineClass は字句の途中にあるタグの class に quote-inline が
+// あるかを返す。
+func hasQuoteInlineClass(z *html.Tokenizer) bool {
+	for more := true; more; {
+		var k, v []byte
+		k, v, more = z.TagAttr()
+		if string(k) == "class" && hasWord(string(v), "quote-inline") {
+			return true
+		}
+	}
+	return false
+}
+
+// quoteRecipients は引用した投稿の著者のうち、配信で届ける必要のある
+// ものを返す。引用されたことは、ブーストと同じく著者がフォロワーで
+// なくても知らせる。ローカルの actor には配信しない (outbox から見える)。
+func quoteRecipients(quoted *activitystream.Object) []string {
+	if quoted == nil {
+		return nil
+	}
+	author := quoted.AttributedTo.ID()
+	if author == "" || isLocalActor(author) {
+		return nil
+	}
+	return []string{author}
+}
+
+// quotesMine は note が actor の投稿を引用しているかを返す。
+func quotesMine(actor *config.ActorConfig, note *activitystream.Object) bool {
+	owner, _, ok := actorAndIDFromStatusURI(note.QuotedURI())
+	return ok && owner == actor
+}
+
+// quoteItem は引用された投稿のカード。引けなかったときは作らず、URI への
+// リンクだけを出す。
+type quoteItem struct {
+	URI         string
+	AuthorURI   string
+	AuthorName  string
+	AuthorEmoji web.Emoji
+	Acct        string
+	Content     string
+	Emoji       web.Emoji
+	Summary     string
+	Published   string
+}
+
+// 引用のカードを作るためにリモートへ取りに行く回数と時間の上限。1ページの
+// 描画で引用が多くても、落ちているサーバがあっても、描画をその分だけ
+// 待たせないように (conversation.go と同じ考え)。控えにあるものは数えない。
+const (
+	quoteFetchLimit = 10
+	quoteTimeout    = 5 * time.Second
+)
+
+// quoteResolver は引用された投稿をカードにする。同じ投稿が同じページに
+// 何度も引用されることがあるので、リクエスト内で覚えておく。引けなかった
+// ことも覚える。リモートの投稿は KV の控え (notecache.go) を使い、控えに
+// 無いものだけを quoteFetchLimit 回・quoteTimeout まで取りに行く。
+type quoteResolver struct {
+	actor       *config.ActorConfig
+	cards       map[string]*quoteItem
+	knownActors map[string]*datastore.KVItem
+	// budget は残りのリモート取得回数、deadline は取りに行ってよい期限。
+	budget   int
+	deadline time.Time
+}
+
+func newQuoteResolver(actor *config.ActorConfig) *quoteResolver {
+	return &quoteResolver{
+		actor:       actor,
+		cards:       map[string]*quoteItem{},
+		knownActors: map[string]*datastore.KVItem{},
+		budget:      quoteFetchLimit,
+		deadline:    time.Now().Add(quoteTimeout),
+	}
+}
+
+// card は uri の投稿のカードを返す。引けなければ nil。他人の投稿は
+// fetchVerifiedNote で中身を確かめた、Public 宛てのものだけを出す。
+func (qr *quoteResolver) card(ctx context.Context, uri string) *quoteItem {
+	if uri == "" {
+		return nil
+	}
+	if card, ok := qr.cards[uri]; ok {
+		return card
+	}
+	var card *quoteItem
+	if note, err := qr.fetch(ctx, uri); err != nil {
+		logf("cannot resolve the quoted status %v: %v", uri, err)
+	} else {
+		author := note.AttributedTo.ID()
+		card = &quoteItem{
+			URI:       note.ID,
+			AuthorURI: author,
+			Content:   localizeHashtags(note.Content, note.Tag),
+			Emoji:     noteEmoji(note.Tag),
+			Summary:   note.Summary,
+			Published: note.Published,
+		}
+		card.AuthorName, _ = actorDisplayCached(ctx, qr.knownActors, author)
+		card.AuthorEmoji = actorEmojiCached(ctx, qr.knownActors, author)
+		card.Acct = acctCached(ctx, qr.knownActors, author)
+	}
+	qr.cards[uri] = card
+	return card
+}
+
+func (qr *quoteResolver) fetch(ctx context.Context, uri string) (*activitystream.Object, error) {
+	if owner, id, ok := actorAndIDFromStatusURI(uri); ok {
+		note, herr := loadStatus(ctx, owner, id)
+		if herr != nil {
+			return nil, herr
+		}
+		return note, nil
+	}
+	if note, ok, err := cachedRemoteNote(ctx, uri, time.Now()); ok {
+		return note, err
+	}
+	if qr.budget <= 0 || !time.Now().Before(qr.deadline) {
+		// 控えに無く、取りに行く余裕も無い。URI へのリンクだけを出す。
+		return nil, errors.New("no budget left to fetch quotes")
+	}
+	qr.budget--
+	ctx, cancel := context.WithDeadline(ctx, qr.deadline)
+	defer cancel()
+	return fetchPublicRemoteNote(ctx, qr.actor, uri)
+}
+
+// resolveQuotes は items のうち引用しているものにカードを付ける。
+func resolveQuotes(ctx context.Context, actor *config.ActorConfig, items []timelineItem) {
+	qr := newQuoteResolver(actor)
+	for i := range items {
+		items[i].Quote = qr.card(ctx, items[i].QuoteURI)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+// 引用を解さない実装のための「RE: URL」は、カードで出すときには消すこと。
+func TestQuoteInline(t *testing.T) {
+	const quoted = "https://m.example/notes/1?a=1&b=2"
+	note := &activitystream.Object{Content: "<p>これ</p>"}
+	applyQuote(note, quoted)
+	if !strings.Contains(note.Content, `RE: <a href="https://m.example/notes/1?a=1&amp;b=2">`) || note.QuotedURI() != quoted {
+		t.Fatalf("quote = %+v", note)
+	}
+	if got := stripQuoteInline(note.Content); got != "<p>これ</p>" {
+		t.Errorf("stripQuoteInline = %q", got)
+	}
+	// Mastodon は span で出してくる。
+	if got := stripQuoteInline(`<p>これ<span class="quote-inline"><br>RE: <a href="x">x</a></span></p>`); got != "<p>これ</p>" {
+		t.Errorf("stripQuoteInline(span) = %q", got)
+	}
+}
+
+// Mastodon の「RE: URL」はリンクの中に span が入れ子になっている。
+// 最初の </span> で切らずに、要素全体を消すこと。
+func TestStripQuoteInlineMastodonMarkup(t *testing.T) {
+	const link = `<a href="https://m.example/@a/1" rel="nofollow noopener" target="_blank">` +
+		`<span class="invisible">https://</span><span class="ellipsis">m.example/@a/1</span><span class="invisible"></span></a>`
+	for _, tt := range []struct{ in, want string }{
+		{
+			`<p>これ</p><p class="quote-inline">RE: ` + link + `</p>`,
+			`<p>これ</p>`,
+		},
+		{
+			`<p>これ<span class="quote-inline"><br>RE: ` + link + `</span> です</p><p>続き</p>`,
+			`<p>これ です</p><p>続き</p>`,
+		},
+		{
+			// 他の class と並んでいても、quote-inline でない span は残す。
+			`<p class="quote-inline extra">RE: x</p><p><span class="h-card">@a</span></p>`,
+			`<p><span class="h-card">@a</span></p>`,
+		},
+	} {
+		if got := stripQuoteInline(tt.in); got != tt.want {
+			t.Errorf("stripQuoteInline(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// 編集で本文を作り直しても引用は残ること。
+func TestEditedNoteKeepsQuote(t *testing.T) {
+	withTestConfig(t)
+	const quoted = "https://m.example/notes/1"
+	prev := activitystream.NewNote(myStatusURI(Config.PrimaryActor(), 1), "", "", "", "https://s.example/u/nana", nil, nil, nil)
+	applyQuote(prev, quoted)
+	got := editedNote(prev, "書き直した", nil, false, time.Now())
+	if got.QuotedURI() != quoted || !strings.Contains(got.Content, "書き直した") || strings.Count(got.Content, "RE: ") != 1 {
+		t.Errorf("edited = %+v", got)
+	}
+	links := 0
+	for _, tag := range got.Tag {
+		if tag.Type == activitystream.LinkType {
+			links++
+		}
+	}
+	if links != 1 {
+		t.Errorf("edited has %d quote links", links)
+	}
+}
+
+// 引用された側には配信で知らせ、自分の投稿の引用は通知にすること。
+func TestQuoteRecipientsAndNotifications(t *testing.T) {
+	withTestConfig(t)
+	primary := Config.PrimaryActor()
+	remote := &activitystream.Object{AttributedTo: activitystream.URIRef("https://m.example/users/alice")}
+	if got := quoteRecipients(remote); len(got) != 1 || got[0] != "https://m.example/users/alice" {
+		t.Errorf("quoteRecipients(remote) = %v", got)
+	}
+	local := &activitystream.Object{AttributedTo: activitystream.URIRef(primary.ID())}
+	if got := quoteRecipients(local); got != nil {
+		t.Errorf("quoteRecipients(local) = %v", got)
+	}
+
+	note := &activitystream.Object{ID: "https://m.example/notes/2", QuoteURL: myStatusURI(primary, 3)}
+	in := &activitystream.Object{Type: activitystream.CreateType, Actor: activitystream.URIRef("https://m.example/users/alice")}
+	if !notifiesMe(primary, in, note) {
+		t.Error("a quote of my status does not notify me")
+	}
+	note.QuoteURL = "https://m.example/notes/1"
+	if notifiesMe(primary, in, note) {
+		t.Error("a quote of someone else's status notifies me")
+	}
+}
+
+func TestQuoteCardRenders(t *testing.T) {
+	page := timelinePage{
+		pageBase: pageBase{Title: "タイムライン", SiteName: "nana", LocalPart: "nana", Handle: "@nana"},
+		Page:     1,
+		Quote:    "https://m.example/notes/9",
+		Items: []timelineItem{
+			{ObjectURI: "https://m.example/notes/2", Content: "<p>これ</p>", QuoteURI: "https://m.example/notes/1", Quote: &quoteItem{
+				URI: "https://m.example/notes/1", AuthorURI: "https://m.example/users/alice", AuthorName: "alice",
+				Content: "<p>引用された本文</p>",
+			}},
+			{ObjectURI: "https://m.example/notes/3", QuoteURI: "https://m.example/notes/gone"},
+		},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "timeline", page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<blockquote class="quote">`, `引用された本文`, `引用: <a href="https://m.example/notes/gone">`,
+		`<input type="hidden" name="quote" value="https://m.example/notes/9">`, `href="/timeline?quote=https%3a%2f%2fm.example%2fnotes%2f2"`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("timeline does not contain %q", want)
+		}
+	}
+}
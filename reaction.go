@@ -63,6 +63,9 @@ func likeRequestHandler(w http.ResponseWriter, r *http.Request) httperror.HttpEr
 	if herr != nil {
 		return herr
 	}
+	if isBlockedBy(ctx, primary, actorURI) {
+		return httperror.StatusUnprocessableEntity("that actor blocks you", nil)
+	}
 
 	actor, err := fetchActor(ctx, primary, actorURI)
 	if err != nil {
@@ -102,8 +105,8 @@ func likeRequestHandler(w http.ResponseWriter, r *http.Request) httperror.HttpEr
 	}); err != nil {
 		return httperror.StatusInternalServerError("cannot record the like", err)
 	}
-	if err := sendToInbox(ctx, primary, inbox, like); err != nil {
-		return httperror.StatusInternalServerError("cannot deliver the Like", err)
+	if err := enqueueDelivery(ctx, primary.LocalPart(), inbox, like); err != nil {
+		return httperror.StatusInternalServerError("cannot queue the Like", err)
 	}
 	return respondAsJSON(w, http.StatusAccepted, like)
 }
@@ -132,8 +135,8 @@ func unlikeRequestHandler(w http.ResponseWriter, r *http.Request) httperror.Http
 	like := activitystream.NewLike(item.ActivityID, primary.ID(), object)
 	undo := activitystream.NewUndo(like, primary.ID(), newActivityID("undo"))
 	if item.Inbox != "" {
-		if err := sendToInbox(ctx, primary, item.Inbox, undo); err != nil {
-			logf("Undo(Like) to %v failed: %v", item.Inbox, err)
+		if err := enqueueDelivery(ctx, primary.LocalPart(), item.Inbox, undo); err != nil {
+			logf("queueing Undo(Like) to %v failed: %v", item.Inbox, err)
 		}
 	}
 	if err := client.DeleteKV(ctx, actorScoped(primary, datastore.KVMyLikes), object); err != nil {
@@ -205,7 +208,10 @@ func boostRequestHandler(w http.ResponseWriter, r *http.Request) httperror.HttpE
 	}
 	// 著者はフォロワーでないことが多いが、ブーストされたことは知らせる必要が
 	// ある。postStatusHandler の mention 配信と同じ理由。
-	if a, err := fetchActor(ctx, primary, actorURI); err == nil {
+	// こちらをブロックしている相手には知らせない。
+	if isBlockedBy(ctx, primary, actorURI) {
+		logf("not delivering the boost to %v, who blocks %v", actorURI, primary.ID())
+	} else if a, err := fetchActor(ctx, primary, actorURI); err == nil {
 		if inbox := a.InboxURI(); inbox != "" {
 			inboxes = appendUnique(inboxes, inbox)
 		}
@@ -275,10 +281,11 @@ func unboostRequestHandler(w http.ResponseWriter, r *http.Request) httperror.Htt
 
 // reactionState は自分がいいね・ブースト済みの投稿 URI の集合。timeline の
 // 描画のたびに投稿ごとへ問い合わせるのではなく、パーティション全体を1回
-// ずつ引いて集合を作る。
+// ずつ引いて集合を作る。voted は投票済みの投票と、入れた選択肢。
 type reactionState struct {
 	liked   map[string]bool
 	boosted map[string]bool
+	voted   map[string][]string
 }
 
 // reactorsOf は自分の投稿 (KVLikes / KVAnnounced) に対して、誰が反応したかを
@@ -301,7 +308,7 @@ func reactorsOf(ctx context.Context, pk, objectURI string) ([]*datastore.KVItem,
 }
 
 func loadReactionState(ctx context.Context, actor *config.ActorConfig) reactionState {
-	state := reactionState{liked: map[string]bool{}, boosted: map[string]bool{}}
+	state := reactionState{liked: map[string]bool{}, boosted: map[string]bool{}, voted: map[string][]string{}}
 	if items, err := client.QueryKV(ctx, actorScoped(actor, datastore.KVMyLikes)); err != nil {
 		logf("loading liked statuses failed: %v", err)
 	} else {
@@ -316,5 +323,12 @@ func loadReactionState(ctx context.Context, actor *config.ActorConfig) reactionS
 			state.boosted[it.SK] = true
 		}
 	}
+	if items, err := client.QueryKV(ctx, actorScoped(actor, datastore.KVMyVotes)); err != nil {
+		logf("loading voted polls failed: %v", err)
+	} else {
+		for _, it := range items {
+			state.voted[it.SK] = strings.Split(it.Content, "\n")
+		}
+	}
 	return state
 }
@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/nna774/s.nna774.net/activitystream"
 	"github.com/nna774/s.nna774.net/config"
 	"github.com/nna774/s.nna774.net/datastore"
 	"github.com/nna774/s.nna774.net/httperror"
+	"github.com/nna774/s.nna774.net/web"
 )
 
 // remoteStatusesLimit はリモートプロフィールに出す投稿の件数の上限。
@@ -17,10 +20,16 @@ const remoteStatusesLimit = profileStatusCount
 
 type remoteStatusItem struct {
 	Content     string
+	Emoji       web.Emoji
 	Published   string
 	ObjectURI   string
 	InReplyTo   string
 	Attachments []attachmentItem
+	// FilterWarning は warn のフィルタに一致したときの語。
+	FilterWarning string
+	// Summary は CW、Sensitive は添付の閲覧注意。
+	Summary   string
+	Sensitive bool
 }
 
 type remoteProfilePage struct {
@@ -31,11 +40,13 @@ type remoteProfilePage struct {
 	// Found が立っているときだけプロフィール本体を描画する。
 	Found bool
 
-	Name        string
-	ActorURI    string
-	Acct        string
-	IconURL     string
-	Summary     string
+	Name     string
+	ActorURI string
+	Acct     string
+	IconURL  string
+	Summary  string
+	// Emoji は表示名と自己紹介のカスタム絵文字。
+	Emoji       web.Emoji
 	StatusCount int
 	Statuses    []remoteStatusItem
 
@@ -43,6 +54,11 @@ type remoteProfilePage struct {
 	// 出し分けに使う。両方偽ならまだフォローしていない。
 	Following     bool
 	FollowPending bool
+	// Muted はこの相手をミュート中かどうか。わざわざ見に来たページなので
+	// 投稿は隠さず、ミュートの切り替えだけ出す。
+	Muted bool
+	// Here はこのページ自身の URL。ミュートの切り替え後にここへ戻る。
+	Here string
 }
 
 // remoteProfileHandler はリモートの actor をハンドルまたは URL で引き、
@@ -82,7 +98,12 @@ func remoteProfileHandler(w http.ResponseWriter, r *http.Request) httperror.Http
 	page.Acct = acctOf(actor)
 	page.Name, page.IconURL = actorDisplay(actor)
 	page.Summary = actor.Summary
+	page.Emoji = noteEmoji(actor.Tag)
 	page.Statuses, page.StatusCount = remoteRecentStatuses(ctx, primary, actor)
+	filters := loadContentFilters(ctx, time.Now())
+	page.Muted = filters.muted(actor.ID)
+	page.Here = "/remote?actor=" + url.QueryEscape(actor.ID)
+	page.Statuses = filterRemoteStatuses(filters, page.Statuses)
 
 	switch followStateOf(ctx, primary, actor.ID) {
 	case datastore.FollowStateAccepted:
@@ -94,6 +115,23 @@ func remoteProfileHandler(w http.ResponseWriter, r *http.Request) httperror.Http
 	return renderPage(w, "remote", page)
 }
 
+// filterRemoteStatuses はフィルタに当てて、hide に一致したものを落とし、
+// warn に一致したものに印を付ける。
+func filterRemoteStatuses(filters *contentFilters, statuses []remoteStatusItem) []remoteStatusItem {
+	kept := statuses[:0]
+	for _, st := range statuses {
+		action, word := filters.verdict(st.Content)
+		if action == filterHide {
+			continue
+		}
+		if action == filterWarn {
+			st.FilterWarning = word
+		}
+		kept = append(kept, st)
+	}
+	return kept
+}
+
 // acctOf は取得済みの actor から @user@host 表記を組む。id の URL 構造は
 // 実装によって異なる（Misskey は id に内部 ID を使うなど）ため、URL を
 // パースせず preferredUsername を信頼する。
@@ -162,10 +200,13 @@ func remoteRecentStatuses(ctx context.Context, requester *config.ActorConfig, ac
 		}
 		items = append(items, remoteStatusItem{
 			Content:     note.Content,
+			Emoji:       noteEmoji(note.Tag),
 			Published:   note.Published,
 			ObjectURI:   note.ID,
 			InReplyTo:   note.InReplyTo.ID(),
 			Attachments: noteAttachments(note),
+			Summary:     note.Summary,
+			Sensitive:   noteSensitive(note),
 		})
 	}
 	return items, total
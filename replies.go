@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/httperror"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+// 自分の投稿への返信は、通知とは別に KVReplies に索引しておく。通知は
+// notificationScanLimit を超えると遡れなくなるが、投稿の replies
+// コレクションと個別投稿ページのスレッド表示はいつまでも出したい。
+//
+// 索引するのは Public 宛ての返信 (公開・未収載) だけ。replies コレクションは
+// 誰でも読めるので、フォロワー限定や direct の返信を載せると漏れる。
+
+// threadAncestorLimit は個別投稿ページで遡る返信先の数の上限。返信先が
+// リモートなら1つごとに取りに行くので、際限なく辿らせない。
+const threadAncestorLimit = 10
+
+// threadMaxDepth はスレッドの字下げの上限。これより深い返信も出すが、
+// 字下げはここで止める。
+const threadMaxDepth = 5
+
+// repliesURI は投稿の replies コレクションの URI。
+func repliesURI(noteID string) string { return noteID + "/replies" }
+
+// addressedToPublic は note が Public 宛て (公開か未収載) かを返す。
+func addressedToPublic(note *activitystream.Object) bool {
+	return addressedTo(note, activitystream.ToPublic)
+}
+
+// recordReply は note がローカルの投稿への Public 宛ての返信なら索引に
+// 入れる。同じ返信をもう一度入れると上書きするので、編集の反映にも使う。
+func recordReply(ctx context.Context, actor *config.ActorConfig, note *activitystream.Object) {
+	parent := note.InReplyTo.ID()
+	owner, _, ok := actorAndIDFromStatusURI(parent)
+	if !ok || note.ID == "" || !addressedToPublic(note) {
+		return
+	}
+	author := note.AttributedTo.ID()
+	at := note.Published
+	if at == "" {
+		at = nowRFC3339()
+	}
+	if err := client.PutKV(ctx, &datastore.KVItem{
+		PK:          actorScoped(owner, datastore.KVReplies),
+		SK:          note.ID,
+		InReplyTo:   parent,
+		TargetActor: author,
+		Content:     note.Content,
+		Summary:     note.Summary,
+		Emoji:       noteEmoji(note.Tag),
+		At:          at,
+	}); err != nil {
+		// 索引に入らなくても返信そのもの (通知) は届いている。
+		logf("indexing the reply %v to %v failed: %v", note.ID, parent, err)
+		return
+	}
+	// スレッドに名前とアイコンを出すため。
+	cacheActorInfo(ctx, actor, author)
+}
+
+// refreshReply は索引に控えてある返信なら、編集後の note で差し替える。
+// 控えていなければ何もせず偽を返す。新しく索引に入れることはしない。
+func refreshReply(ctx context.Context, actor *config.ActorConfig, note *activitystream.Object) bool {
+	owner, _, ok := actorAndIDFromStatusURI(note.InReplyTo.ID())
+	if !ok || note.ID == "" {
+		return false
+	}
+	partition := actorScoped(owner, datastore.KVReplies)
+	if _, err := client.GetKV(ctx, partition, note.ID); err != nil {
+		if !errors.Is(err, datastore.ErrNotFound) {
+			logf("looking up the reply %v failed: %v", note.ID, err)
+		}
+		return false
+	}
+	if !addressedToPublic(note) {
+		// 編集で Public 宛てでなくなった返信は、誰でも読める索引から外す。
+		if err := client.DeleteKV(ctx, partition, note.ID); err != nil {
+			logf("removing the reply %v from the index failed: %v", note.ID, err)
+		}
+		return true
+	}
+	recordReply(ctx, actor, note)
+	return true
+}
+
+// forgetReply は消された返信を索引から外す。Delete には返信先が書かれて
+// いないので、どの actor の索引に入っているかは分からない。全部から消す。
+func forgetReply(ctx context.Context, noteID string) {
+	for _, a := range Config.Actors {
+		if err := client.DeleteKV(ctx, actorScoped(a, datastore.KVReplies), noteID); err != nil {
+			logf("removing the reply %v from the index of %v failed: %v", noteID, a.ID(), err)
+		}
+	}
+}
+
+// forgetRemoteReply はリモートから届いた Delete で返信を索引から外す。
+// 消してよいのは、控えた返信の著者が Delete の actor と同じオリジンに
+// いるときだけ。確かめないと、どのサーバからでも他人の返信を索引から
+// 消せてしまう。
+func forgetRemoteReply(ctx context.Context, noteID string, deleter string) {
+	for _, a := range Config.Actors {
+		partition := actorScoped(a, datastore.KVReplies)
+		it, err := client.GetKV(ctx, partition, noteID)
+		if err != nil {
+			if !errors.Is(err, datastore.ErrNotFound) {
+				logf("looking up the reply %v failed: %v", noteID, err)
+			}
+			continue
+		}
+		if !sameOrigin(it.TargetActor, deleter) {
+			logf("inbox: %v cannot delete the reply %v by %v", deleter, noteID, it.TargetActor)
+			continue
+		}
+		if err := client.DeleteKV(ctx, partition, noteID); err != nil {
+			logf("removing the reply %v from the index of %v failed: %v", noteID, a.ID(), err)
+		}
+	}
+}
+
+// repliesTo は items のうち parent への返信を古い順に返す。
+func repliesTo(items []*datastore.KVItem, parent string) []*datastore.KVItem {
+	replies := make([]*datastore.KVItem, 0)
+	for _, it := range items {
+		if it.InReplyTo == parent {
+			replies = append(replies, it)
+		}
+	}
+	sort.SliceStable(replies, func(i, j int) bool { return replies[i].At < replies[j].At })
+	return replies
+}
+
+// statusRepliesHandler は投稿の replies コレクション。返信の URI を古い
+// 順に並べる。ブラウザで開かれたらスレッドを出す個別投稿ページへ送る。
+func statusRepliesHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	actor, herr := resolveActor(r)
+	if herr != nil {
+		return herr
+	}
+	id, herr := statusIDFromRequest(r)
+	if herr != nil {
+		return herr
+	}
+	status, herr := loadStatus(ctx, actor, id)
+	if herr != nil {
+		return herr
+	}
+	// 返信先が読めない相手には、返信の一覧も見せない。
+	if !readerForStatus(ctx, r, actor, status).canRead(actor, status) {
+		return httperror.StatusNotFound("no such status", nil)
+	}
+	w.Header().Set("Vary", "Accept")
+	if !wantsActivityJSON(r) {
+		http.Redirect(w, r, status.ID, http.StatusSeeOther)
+		return nil
+	}
+
+	items, err := client.QueryKV(ctx, actorScoped(actor, datastore.KVReplies))
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot list the replies", err)
+	}
+	replies := repliesTo(items, status.ID)
+	ids := make([]string, 0, len(replies))
+	for _, it := range replies {
+		ids = append(ids, it.SK)
+	}
+	return respondAsJSON(w, http.StatusOK, activitystream.NewOrderedCollectionOfIDs(repliesURI(status.ID), ids))
+}
+
+// threadItem は個別投稿ページのスレッドの1件。
+type threadItem struct {
+	AuthorName string
+	AuthorURI  string
+	IconURL    string
+	Content    string
+	// Emoji は本文の、AuthorEmoji は表示名のカスタム絵文字。
+	Emoji       web.Emoji
+	AuthorEmoji web.Emoji
+	Summary     string
+	URL         string
+	Published   string
+	// Depth は字下げの段数。返信先の側 (Ancestors) では常に 0。
+	Depth int
+}
+
+// threadAuthor は著者の表示名とアイコンを引く。ローカルの actor は設定から
+// 取る (sub actor は KV のキャッシュに無い)。
+func threadAuthor(ctx context.Context, actorURI string) (name, iconURL string) {
+	for _, a := range Config.Actors {
+		if a.ID() == actorURI {
+			return a.Name, a.IconURI
+		}
+	}
+	return authorName(ctx, actorURI), cachedIconURL(ctx, actorURI)
+}
+
+// threadAncestors は note の返信先を遡り、古い順に返す。ローカルの投稿は
+// r の読み手が読めるものだけ、リモートの投稿は Public 宛てのものだけを
+// 出す。リモートの投稿を取るときはこちらの署名が付くので、フォロワー限定の
+// 投稿も返ってくることがあり、それをこの公開ページに出してはならない。
+// リモートの投稿は KV の控えから出す (notecache.go)。辿れなくなったところ
+// で止める。
+func threadAncestors(ctx context.Context, r *http.Request, actor *config.ActorConfig, note *activitystream.Object) []threadItem {
+	var ancestors []threadItem
+	seen := map[string]bool{note.ID: true}
+	for uri := note.InReplyTo.ID(); uri != "" && len(ancestors) < threadAncestorLimit; {
+		if seen[uri] {
+			// 循環する inReplyTo を送ってくる相手がいても止まるように。
+			break
+		}
+		seen[uri] = true
+		parent := threadParent(ctx, r, actor, uri)
+		if parent == nil {
+			break
+		}
+		name, icon := threadAuthor(ctx, parent.AttributedTo.ID())
+		ancestors = append(ancestors, threadItem{
+			AuthorName:  name,
+			AuthorURI:   parent.AttributedTo.ID(),
+			IconURL:     icon,
+			Content:     parent.Content,
+			Emoji:       noteEmoji(parent.Tag),
+			AuthorEmoji: cachedEmoji(ctx, parent.AttributedTo.ID()),
+			Summary:     parent.Summary,
+			URL:         parent.ID,
+			Published:   parent.Published,
+		})
+		uri = parent.InReplyTo.ID()
+	}
+	slices.Reverse(ancestors)
+	return ancestors
+}
+
+// threadParent は返信先 uri の投稿を、スレッドに出してよければ返す。
+func threadParent(ctx context.Context, r *http.Request, actor *config.ActorConfig, uri string) *activitystream.Object {
+	if owner, id, ok := actorAndIDFromStatusURI(uri); ok {
+		parent, herr := loadStatus(ctx, owner, id)
+		if herr != nil {
+			return nil
+		}
+		if !readerForStatus(ctx, r, owner, parent).canRead(owner, parent) {
+			return nil
+		}
+		return parent
+	}
+	// 誰でも開けるページなので、開かれるたびに取りに行かない。
+	parent, err := publicRemoteNote(ctx, actor, uri)
+	if err != nil {
+		logf("cannot fetch %v for a thread: %v", uri, err)
+		return nil
+	}
+	return parent
+}
+
+// threadDescendants は noteID への返信を、返信の返信まで含めて深さ優先で
+// 並べる。索引にあるのはローカルの投稿への返信だけなので、辿れるのは
+// 自分 (ローカルの actor) の投稿を経由する枝に限られる。
+func threadDescendants(ctx context.Context, noteID string) []threadItem {
+	var items []*datastore.KVItem
+	for _, a := range Config.Actors {
+		part, err := client.QueryKV(ctx, actorScoped(a, datastore.KVReplies))
+		if err != nil {
+			logf("loading the replies of %v failed: %v", a.ID(), err)
+			continue
+		}
+		items = append(items, part...)
+	}
+	var descendants []threadItem
+	seen := map[string]bool{noteID: true}
+	var walk func(parent string, depth int)
+	walk = func(parent string, depth int) {
+		for _, it := range repliesTo(items, parent) {
+			if seen[it.SK] {
+				continue
+			}
+			seen[it.SK] = true
+			name, icon := threadAuthor(ctx, it.TargetActor)
+			descendants = append(descendants, threadItem{
+				AuthorName:  name,
+				AuthorURI:   it.TargetActor,
+				IconURL:     icon,
+				Content:     it.Content,
+				Emoji:       it.Emoji,
+				AuthorEmoji: cachedEmoji(ctx, it.TargetActor),
+				Summary:     it.Summary,
+				URL:         it.SK,
+				Published:   it.At,
+				Depth:       min(depth, threadMaxDepth),
+			})
+			walk(it.SK, depth+1)
+		}
+	}
+	walk(noteID, 0)
+	return descendants
+}
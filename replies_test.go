@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+// 返信先ごとに古い順に並ぶこと。別の投稿への返信は混ざらないこと。
+func TestRepliesTo(t *testing.T) {
+	const parent = "https://s.example/u/nana/status/1"
+	items := []*datastore.KVItem{
+		{SK: "https://a.example/notes/2", InReplyTo: parent, At: "2026-01-01T00:02:00Z"},
+		{SK: "https://a.example/notes/3", InReplyTo: "https://s.example/u/nana/status/9", At: "2026-01-01T00:00:00Z"},
+		{SK: "https://a.example/notes/1", InReplyTo: parent, At: "2026-01-01T00:01:00Z"},
+	}
+	got := repliesTo(items, parent)
+	if len(got) != 2 || got[0].SK != "https://a.example/notes/1" || got[1].SK != "https://a.example/notes/2" {
+		t.Errorf("repliesTo = %v", got)
+	}
+}
+
+func TestRepliesRouteIsPublic(t *testing.T) {
+	h, _, _ := newRouter().Lookup(http.MethodGet, "/u/nana/status/1/replies")
+	if h == nil {
+		t.Fatal("GET /u/:user/status/:id/replies is not routed")
+	}
+}
+
+func TestStatusPageRendersThread(t *testing.T) {
+	page := statusPage{
+		pageBase:       pageBase{Title: "nana", SiteName: "nana", LocalPart: "nana", Handle: "@nana"},
+		ActorLocalPart: "nana",
+		Content:        "<p>reply</p>",
+		Published:      "2026-01-01T00:01:00Z",
+		ObjectURI:      "https://s.example/u/nana/status/2",
+		Ancestors: []threadItem{
+			{AuthorName: "alice", AuthorURI: "https://a.example/users/alice", Content: "<p>root</p>", URL: "https://a.example/notes/1"},
+		},
+		Replies: []threadItem{
+			{AuthorName: "bob", AuthorURI: "https://b.example/users/bob", Content: "<p>child</p>", URL: "https://b.example/notes/3"},
+			{AuthorName: "carol", AuthorURI: "https://c.example/users/carol", Content: "<p>grandchild</p>", Summary: "ネタバレ", URL: "https://c.example/notes/4", Depth: 1},
+		},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "status", page); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	root, focus, child := strings.Index(out, "root"), strings.Index(out, "<p>reply</p>"), strings.Index(out, "child")
+	if root < 0 || focus < 0 || child < 0 || !(root < focus && focus < child) {
+		t.Errorf("thread is not in order (root %d, focus %d, child %d)", root, focus, child)
+	}
+	for _, want := range []string{`class="thread-item depth-1"`, `<details class="cw"><summary>ネタバレ</summary>`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("page does not contain %q", want)
+		}
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/httperror"
+)
+
+// 予約投稿。scheduled_at を付けた投稿は id を振らずに KV の scheduled に
+// 控えておき、時刻が来たらスケジュール起動の worker (WORKER=scheduled)
+// が postStatusHandler と同じ prepareStatus / publishStatus を通して出す。
+// 出すまでは連合には何も送らず、outbox にも載らない。
+
+// minScheduleLead は予約できる最も近い時刻。Mastodon と同じく5分先から
+// にしてある。worker は1分おきにしか起動しないので、それより近い予約は
+// 意味を持たない。
+const minScheduleLead = 5 * time.Minute
+
+// scheduledFailed は出そうとして諦めた予約の State。worker はこれを
+// 飛ばし、/scheduled に理由と共に出す。編集すれば State は消え、もう1度
+// 出そうとする。
+const scheduledFailed = "failed"
+
+// scheduleZone は form の datetime-local を読むときの時間帯。画面の時刻は
+// 日本時間で出している (web の datetime) ので、入力もそれに合わせる。
+var scheduleZone = time.FixedZone("Asia/Tokyo", 9*60*60)
+
+// datetime-local の値は秒が付くことも付かないこともある。
+var datetimeLocalLayouts = []string{"2006-01-02T15:04", "2006-01-02T15:04:05"}
+
+// normalizeScheduledAt は scheduled_at を RFC3339 (UTC) に揃える。API からは
+// RFC3339 で、form からは datetime-local (日本時間) で来る。空なら空のまま。
+func normalizeScheduledAt(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC().Format(time.RFC3339), nil
+	}
+	for _, layout := range datetimeLocalLayouts {
+		if t, err := time.ParseInLocation(layout, s, scheduleZone); err == nil {
+			return t.UTC().Format(time.RFC3339), nil
+		}
+	}
+	return "", fmt.Errorf("bad scheduled_at %q", s)
+}
+
+// checkScheduledAt は正規化済みの scheduled_at が十分に先かを確かめる。
+func checkScheduledAt(scheduledAt string, now time.Time) error {
+	t, err := time.Parse(time.RFC3339, scheduledAt)
+	if err != nil {
+		return fmt.Errorf("bad scheduled_at %q", scheduledAt)
+	}
+	if t.Before(now.Add(minScheduleLead)) {
+		return fmt.Errorf("scheduled_at must be at least %v ahead", minScheduleLead)
+	}
+	return nil
+}
+
+// scheduledStatus は控えてある予約投稿。JSON での形は Mastodon の
+// ScheduledStatus に寄せてある。
+type scheduledStatus struct {
+	ID          string                 `json:"id"`
+	ScheduledAt string                 `json:"scheduled_at"`
+	Params      *statusRequest         `json:"params"`
+	Attachments activitystream.Objects `json:"media_attachments"`
+	// Failed と LastError は出そうとして諦めたときだけ入る。
+	Failed    bool   `json:"failed,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+	// stored は読み出したときの KV の項目。出す直前に取り出した項目と
+	// 比べ、その間に編集されていないかを見る。
+	stored *datastore.KVItem
+}
+
+// scheduledPayload は KVItem.Payload に入れるもの。添付は予約した時点で
+// アップロードを済ませ、その URL 等を控える。
+type scheduledPayload struct {
+	Request     *statusRequest         `json:"request"`
+	Attachments activitystream.Objects `json:"attachments,omitempty"`
+}
+
+func scheduledFromItem(it *datastore.KVItem) (*scheduledStatus, error) {
+	var p scheduledPayload
+	if err := json.Unmarshal([]byte(it.Payload), &p); err != nil {
+		return nil, fmt.Errorf("scheduled status %v: %w", it.SK, err)
+	}
+	if p.Request == nil {
+		return nil, fmt.Errorf("scheduled status %v has no request", it.SK)
+	}
+	return &scheduledStatus{
+		ID:          it.SK,
+		ScheduledAt: it.At,
+		Params:      p.Request,
+		Attachments: p.Attachments,
+		Failed:      it.State == scheduledFailed,
+		LastError:   it.LastError,
+		stored:      it,
+	}, nil
+}
+
+func scheduledToItem(actor *config.ActorConfig, s *scheduledStatus) (*datastore.KVItem, error) {
+	payload, err := json.Marshal(scheduledPayload{Request: s.Params, Attachments: s.Attachments})
+	if err != nil {
+		return nil, err
+	}
+	item := &datastore.KVItem{
+		PK:        actorScoped(actor, datastore.KVScheduled),
+		SK:        s.ID,
+		At:        s.ScheduledAt,
+		Payload:   string(payload),
+		LastError: s.LastError,
+	}
+	if s.Failed {
+		item.State = scheduledFailed
+	}
+	return item, nil
+}
+
+// saveScheduled は予約を無条件に書く。新しく控えるときと、worker が取り
+// 出した (TakeKV) 予約を書き戻すときに使う。
+func saveScheduled(ctx context.Context, actor *config.ActorConfig, s *scheduledStatus) error {
+	item, err := scheduledToItem(actor, s)
+	if err != nil {
+		return err
+	}
+	return client.PutKV(ctx, item)
+}
+
+// updateScheduled は控えてある予約を書き換える。読んでから書くまでに
+// worker が出した・取り消されたものは書き戻さず、datastore.ErrNotFound を
+// 返す。無条件に書くと、出した予約が生き返ってもう1度出てしまう。
+func updateScheduled(ctx context.Context, actor *config.ActorConfig, s *scheduledStatus) error {
+	item, err := scheduledToItem(actor, s)
+	if err != nil {
+		return err
+	}
+	return client.PutKVIfExists(ctx, item)
+}
+
+// loadScheduledStatuses は actor の予約投稿を出す時刻の順に返す。読めない
+// 項目は飛ばす。
+func loadScheduledStatuses(ctx context.Context, actor *config.ActorConfig) ([]*scheduledStatus, error) {
+	items, err := client.QueryKV(ctx, actorScoped(actor, datastore.KVScheduled))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*scheduledStatus, 0, len(items))
+	for _, it := range items {
+		s, err := scheduledFromItem(it)
+		if err != nil {
+			logf("%v", err)
+			continue
+		}
+		out = append(out, s)
+	}
+	sortScheduled(out)
+	return out, nil
+}
+
+// sortScheduled は出す時刻の順に並べる。RFC3339 (UTC) は文字列の順が
+// 時刻の順と一致する。同時刻なら控えた順。
+func sortScheduled(ss []*scheduledStatus) {
+	sort.SliceStable(ss, func(i, j int) bool {
+		if ss[i].ScheduledAt != ss[j].ScheduledAt {
+			return ss[i].ScheduledAt < ss[j].ScheduledAt
+		}
+		return ss[i].ID < ss[j].ID
+	})
+}
+
+// due は s を now の時点で出すべきかを返す。
+func (s *scheduledStatus) due(now time.Time) bool {
+	t, err := time.Parse(time.RFC3339, s.ScheduledAt)
+	return err == nil && !t.After(now)
+}
+
+// newScheduledID は予約の id を振る。SK が控えた順に並ぶようゼロ埋めした
+// ナノ秒にしてある。
+func newScheduledID(now time.Time) string {
+	return fmt.Sprintf("%020d", now.UnixNano())
+}
+
+// scheduleStatus は postStatusHandler から呼ばれ、検証済みの投稿を予約と
+// して控える。
+func scheduleStatus(w http.ResponseWriter, r *http.Request, actor *config.ActorConfig, req *statusRequest, attachments activitystream.Objects) httperror.HttpError {
+	s := &scheduledStatus{
+		ID:          newScheduledID(time.Now()),
+		ScheduledAt: req.ScheduledAt,
+		Params:      req,
+		Attachments: attachments,
+	}
+	if err := saveScheduled(r.Context(), actor, s); err != nil {
+		return httperror.StatusInternalServerError("cannot save the scheduled status", err)
+	}
+	if isFormRequest(r) {
+		http.Redirect(w, r, "/scheduled", http.StatusSeeOther)
+		return nil
+	}
+	// まだ投稿はできていないので 201 ではなく 202 を返す。
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return respondJSONWithoutActivityType(w, http.StatusAccepted, s)
+}
+
+// scheduledIDFromRequest は経路の :id を読む。newScheduledID の振る数字
+// 以外は KV を引く前に弾く。
+func scheduledIDFromRequest(r *http.Request) (string, httperror.HttpError) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return "", httperror.StatusNotFound("no such scheduled status", err)
+	}
+	return id, nil
+}
+
+func loadScheduledStatus(ctx context.Context, actor *config.ActorConfig, id string) (*scheduledStatus, httperror.HttpError) {
+	it, err := client.GetKV(ctx, actorScoped(actor, datastore.KVScheduled), id)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil, httperror.StatusNotFound("no such scheduled status", err)
+		}
+		return nil, httperror.StatusInternalServerError("cannot load the scheduled status", err)
+	}
+	s, err := scheduledFromItem(it)
+	if err != nil {
+		return nil, httperror.StatusInternalServerError("cannot read the scheduled status", err)
+	}
+	return s, nil
+}
+
+// scheduledListItem は /scheduled の1行。
+type scheduledListItem struct {
+	ActorLocalPart string
+	Handle         string
+	ID             string
+	ScheduledAt    string
+	// LocalTime は編集フォームの datetime-local に入れる値 (日本時間)。
+	LocalTime   string
+	Content     string
+	SpoilerText string
+	Visibility  string
+	Mentions    string
+	Sensitive   bool
+	Images      int
+	PollOptions []string
+	InReplyTo   string
+	Quote       string
+	Failed      bool
+	LastError   string
+}
+
+type scheduledPage struct {
+	pageBase
+	Items []scheduledListItem
+}
+
+func newScheduledListItem(actor *config.ActorConfig, s *scheduledStatus) scheduledListItem {
+	item := scheduledListItem{
+		ActorLocalPart: actor.LocalPart(),
+		Handle:         "@" + actor.Username,
+		ID:             s.ID,
+		ScheduledAt:    s.ScheduledAt,
+		Content:        s.Params.Content,
+		SpoilerText:    s.Params.SpoilerText,
+		Visibility:     s.Params.Visibility,
+		Mentions:       strings.Join(s.Params.Mentions, " "),
+		Sensitive:      s.Params.Sensitive,
+		Images:         len(s.Attachments),
+		PollOptions:    s.Params.PollOptions,
+		InReplyTo:      s.Params.InReplyTo,
+		Quote:          s.Params.Quote,
+		Failed:         s.Failed,
+		LastError:      s.LastError,
+	}
+	if t, err := time.Parse(time.RFC3339, s.ScheduledAt); err == nil {
+		item.LocalTime = t.In(scheduleZone).Format(datetimeLocalLayouts[0])
+	}
+	return item
+}
+
+// scheduledHandler は全 actor の予約投稿を出す時刻の順に並べ、編集と
+// 取り消しのフォームを付けて出す。bot のお知らせも primary actor の
+// ログインで管理できるよう、:user を持たない1つのページにしてある。
+func scheduledHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	page := scheduledPage{pageBase: newPageBase(r, "予約投稿")}
+	page.NoIndex = true
+	page.UnreadCount = len(unreadNotifications(ctx))
+
+	for _, actor := range Config.Actors {
+		ss, err := loadScheduledStatuses(ctx, actor)
+		if err != nil {
+			return httperror.StatusInternalServerError("cannot list the scheduled statuses", err)
+		}
+		for _, s := range ss {
+			page.Items = append(page.Items, newScheduledListItem(actor, s))
+		}
+	}
+	sort.SliceStable(page.Items, func(i, j int) bool { return page.Items[i].ScheduledAt < page.Items[j].ScheduledAt })
+	return renderPage(w, "scheduled", page)
+}
+
+// scheduledStatusesHandler は actor の予約投稿を JSON で返す。bot が自分の
+// 予約を確かめるためのもの。
+func scheduledStatusesHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	actor, herr := resolveActor(r)
+	if herr != nil {
+		return herr
+	}
+	ss, err := loadScheduledStatuses(r.Context(), actor)
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot list the scheduled statuses", err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return respondJSONWithoutActivityType(w, http.StatusOK, ss)
+}
+
+// editScheduledHandler は予約投稿の本文・CW・公開範囲・宛先・時刻を
+// 書き換える。投票・引用・返信先・添付は予約したときのまま。scheduled_at
+// を空で送れば時刻は変えない。出すのに失敗していたものは、編集すると
+// もう1度出そうとする (時刻が過ぎていれば次の worker の起動で出る)。
+func editScheduledHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	ctx := r.Context()
+	actor, herr := resolveActor(r)
+	if herr != nil {
+		return herr
+	}
+	id, herr := scheduledIDFromRequest(r)
+	if herr != nil {
+		return herr
+	}
+	req, err := parseStatusRequest(r)
+	if err != nil {
+		return httperror.StatusUnprocessableEntity("bad status request", err)
+	}
+	s, herr := loadScheduledStatus(ctx, actor, id)
+	if herr != nil {
+		return herr
+	}
+
+	if req.ScheduledAt != "" && req.ScheduledAt != s.ScheduledAt {
+		// 時刻を動かさない編集は、出す間際でも通す。
+		if err := checkScheduledAt(req.ScheduledAt, time.Now()); err != nil {
+			return httperror.StatusUnprocessableEntity(err.Error(), nil)
+		}
+		s.ScheduledAt = req.ScheduledAt
+	}
+	p := *s.Params
+	p.Content = req.Content
+	p.SpoilerText = req.SpoilerText
+	p.Sensitive = req.Sensitive
+	p.Visibility = req.Visibility
+	p.Mentions = req.Mentions
+	p.ScheduledAt = s.ScheduledAt
+	if _, herr := prepareStatus(ctx, actor, &p, s.Attachments); herr != nil {
+		return herr
+	}
+	s.Params = &p
+	s.Failed = false
+	s.LastError = ""
+	if err := updateScheduled(ctx, actor, s); err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return httperror.StatusNotFound("the scheduled status was already published or canceled", err)
+		}
+		return httperror.StatusInternalServerError("cannot save the scheduled status", err)
+	}
+	if isFormRequest(r) {
+		http.Redirect(w, r, "/scheduled", http.StatusSeeOther)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return respondJSONWithoutActivityType(w, http.StatusOK, s)
+}
+
+// cancelScheduledHandler は予約投稿を取り消す。出す前なので連合には何も
+// 送らなくてよい。
+func cancelScheduledHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
+	actor, herr := resolveActor(r)
+	if herr != nil {
+		return herr
+	}
+	id, herr := scheduledIDFromRequest(r)
+	if herr != nil {
+		return herr
+	}
+	if err := client.DeleteKV(r.Context(), actorScoped(actor, datastore.KVScheduled), id); err != nil {
+		return httperror.StatusInternalServerError("cannot cancel the scheduled status", err)
+	}
+	if isFormRequest(r) {
+		http.Redirect(w, r, "/scheduled", http.StatusSeeOther)
+		return nil
+	}
+	respondText(w, http.StatusOK, "ok\n")
+	return nil
+}
+
+// publishDueStatuses は時刻の来た予約投稿を出す。スケジュール起動の worker
+// と -publish-scheduled の入口。
+func publishDueStatuses(ctx context.Context, now time.Time) error {
+	var errs []error
+	for _, actor := range Config.Actors {
+		ss, err := loadScheduledStatuses(ctx, actor)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot list scheduled statuses of %v: %w", actor.LocalPart(), err))
+			continue
+		}
+		for _, s := range ss {
+			if s.Failed || !s.due(now) {
+				continue
+			}
+			publishScheduled(ctx, actor, s)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// publishScheduled は予約投稿を1つ出す。
+//
+// 出すのは高々1度にする。publishStatus は id を振って保存してから配信する
+// ので、途中で失敗したものを繰り返すと同じ投稿が2つ連合に出かねない。
+// そこで、検証を通ったら予約を取り出して (TakeKV) から出し、出せなかったら
+// failed として書き戻して人に任せる。検証の段階での一時的な失敗 (5xx)
+// だけは、まだ何もしていないので次の起動でやり直す。
+//
+// 取り出しは条件付きの削除なので、worker が重なっても予約を受け取るのは
+// 1つだけになる。読んでから取り出すまでに編集されていたら、検証した中身と
+// 違うので戻して次の起動に任せる。
+func publishScheduled(ctx context.Context, actor *config.ActorConfig, s *scheduledStatus) {
+	draft, herr := prepareStatus(ctx, actor, s.Params, s.Attachments)
+	if herr != nil {
+		if herr.Code() >= http.StatusInternalServerError {
+			logf("scheduled status %v of %v will be retried: %v", s.ID, actor.LocalPart(), herr)
+			return
+		}
+		failScheduled(ctx, actor, s, herr, false)
+		return
+	}
+	taken, err := client.TakeKV(ctx, actorScoped(actor, datastore.KVScheduled), s.ID)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			logf("scheduled status %v of %v was taken by another run or canceled", s.ID, actor.LocalPart())
+			return
+		}
+		logf("cannot take scheduled status %v of %v: %v", s.ID, actor.LocalPart(), err)
+		return
+	}
+	if v := s.stored; v == nil || taken.Payload != v.Payload || taken.At != v.At || taken.State != v.State {
+		logf("scheduled status %v of %v was edited while publishing, putting it back", s.ID, actor.LocalPart())
+		if err := client.PutKVIfAbsent(ctx, taken); err != nil {
+			logf("cannot put back scheduled status %v of %v: %v", s.ID, actor.LocalPart(), err)
+		}
+		return
+	}
+	create, herr := publishStatus(ctx, actor, draft)
+	if herr != nil {
+		failScheduled(ctx, actor, s, herr, true)
+		return
+	}
+	logf("published scheduled status %v of %v as %v", s.ID, actor.LocalPart(), create.ID)
+}
+
+// failScheduled は予約を failed として書き戻す。taken は publishScheduled
+// が既に取り出しているかで、取り出す前なら、その間に取り消されたものを
+// 生き返らせないよう、まだあるときだけ書く。
+func failScheduled(ctx context.Context, actor *config.ActorConfig, s *scheduledStatus, cause error, taken bool) {
+	logf("giving up scheduled status %v of %v: %v", s.ID, actor.LocalPart(), cause)
+	s.Failed = true
+	s.LastError = cause.Error()
+	save := updateScheduled
+	if taken {
+		save = saveScheduled
+	}
+	if err := save(ctx, actor, s); err != nil {
+		logf("cannot record the failure of scheduled status %v of %v: %v", s.ID, actor.LocalPart(), err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nna774/s.nna774.net/auth"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/web"
+)
+
+// API の RFC3339 も form の datetime-local (日本時間) も UTC に揃うこと。
+func TestNormalizeScheduledAt(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"2026-10-18T09:30:00+09:00", "2026-10-18T00:30:00Z"},
+		{"2026-10-18T00:30:00Z", "2026-10-18T00:30:00Z"},
+		{"2026-10-18T09:30", "2026-10-18T00:30:00Z"},
+		{" 2026-10-18T09:30:15 ", "2026-10-18T00:30:15Z"},
+	} {
+		got, err := normalizeScheduledAt(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeScheduledAt(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := normalizeScheduledAt("tomorrow"); err == nil {
+		t.Error("normalizeScheduledAt accepted a bad time")
+	}
+}
+
+func TestParseStatusRequestScheduledAt(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/u/bot/statuses", strings.NewReader("content=x&scheduled_at=2026-10-18T09%3A30"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	got, err := parseStatusRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ScheduledAt != "2026-10-18T00:30:00Z" {
+		t.Errorf("ScheduledAt = %q", got.ScheduledAt)
+	}
+}
+
+func TestCheckScheduledAt(t *testing.T) {
+	now := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	if err := checkScheduledAt("2026-10-17T00:01:00Z", now); err == nil {
+		t.Error("a status 1 minute ahead was scheduled")
+	}
+	if err := checkScheduledAt("2026-10-17T00:10:00Z", now); err != nil {
+		t.Errorf("checkScheduledAt = %v", err)
+	}
+}
+
+// KV に控えた形から読み戻せ、時刻が来たかを判断できること。
+func TestScheduledFromItem(t *testing.T) {
+	it := &datastore.KVItem{
+		SK:        "00000000000000000042",
+		At:        "2026-10-17T00:10:00Z",
+		Payload:   `{"request":{"content":"お知らせ","visibility":"unlisted","poll_options":["a","b"]},"attachments":[{"type":"Image","url":"https://i.example/a.png"}]}`,
+		State:     scheduledFailed,
+		LastError: "gone",
+	}
+	s, err := scheduledFromItem(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != it.SK || s.Params.Content != "お知らせ" || len(s.Params.PollOptions) != 2 || len(s.Attachments) != 1 || !s.Failed || s.LastError != "gone" || s.stored != it {
+		t.Errorf("scheduled = %+v", s)
+	}
+	now := time.Date(2026, 10, 17, 0, 10, 0, 0, time.UTC)
+	if !s.due(now) || s.due(now.Add(-time.Second)) {
+		t.Error("due is wrong")
+	}
+	if _, err := scheduledFromItem(&datastore.KVItem{SK: "1", Payload: `{}`}); err == nil {
+		t.Error("an item without a request was read")
+	}
+}
+
+func TestSortScheduled(t *testing.T) {
+	ss := []*scheduledStatus{
+		{ID: "3", ScheduledAt: "2026-10-18T00:00:00Z"},
+		{ID: "2", ScheduledAt: "2026-10-17T00:00:00Z"},
+		{ID: "1", ScheduledAt: "2026-10-18T00:00:00Z"},
+	}
+	sortScheduled(ss)
+	if ss[0].ID != "2" || ss[1].ID != "1" || ss[2].ID != "3" {
+		t.Errorf("order = %v %v %v", ss[0].ID, ss[1].ID, ss[2].ID)
+	}
+}
+
+// 過ぎた時刻の予約は、画像を置いたり KV に控えたりする前に弾くこと。
+func TestPostStatusRejectsPastSchedule(t *testing.T) {
+	withTestConfig(t)
+	saved := authenticators
+	t.Cleanup(func() { authenticators = saved })
+	a, err := auth.New("bot-token", "session-secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticators = map[string]*auth.Authenticator{"bot": a}
+
+	r := httptest.NewRequest(http.MethodPost, "/u/bot/statuses",
+		strings.NewReader(`{"content":"お知らせ","scheduled_at":"2020-01-01T00:00:00Z"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer bot-token")
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, r)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %v, want 422", w.Code)
+	}
+}
+
+func TestScheduledPageRenders(t *testing.T) {
+	page := scheduledPage{
+		pageBase: pageBase{Title: "予約投稿", SiteName: "nana", LocalPart: "nana", Handle: "@nana", Authed: true},
+		Items: []scheduledListItem{{
+			ActorLocalPart: "bot", Handle: "@bot", ID: "42",
+			ScheduledAt: "2026-10-18T00:30:00Z", LocalTime: "2026-10-18T09:30",
+			Content: "メンテナンスのお知らせ", Visibility: visibilityFollowers,
+			Failed: true, LastError: "the quoted status was deleted",
+		}},
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "scheduled", page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"2026-10-18 09:30 に投稿",
+		`action="/u/bot/scheduled/42/cancel"`,
+		`action="/u/bot/scheduled/42/edit"`,
+		`value="2026-10-18T09:30"`,
+		`<option value="followers" selected>`,
+		"出せなかった: the quoted status was deleted",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("page does not contain %q", want)
+		}
+	}
+}
+
+func TestScheduledRoutes(t *testing.T) {
+	r := newRouter()
+	for _, c := range []struct{ method, path string }{
+		{http.MethodGet, "/scheduled"},
+		{http.MethodGet, "/u/bot/scheduled"},
+		{http.MethodPut, "/u/bot/scheduled/42"},
+		{http.MethodDelete, "/u/bot/scheduled/42"},
+		{http.MethodPost, "/u/bot/scheduled/42/edit"},
+		{http.MethodPost, "/u/bot/scheduled/42/cancel"},
+	} {
+		if h, _, _ := r.Lookup(c.method, c.path); h == nil {
+			t.Errorf("%v %v has no handler", c.method, c.path)
+		}
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
@@ -23,6 +28,9 @@ const (
 	visibilityPublic    = "public"
 	visibilityUnlisted  = "unlisted"
 	visibilityFollowers = "followers"
+	// visibilityDirect は mention した相手だけに届ける。Public も
+	// フォロワーコレクションも宛先に入れない。
+	visibilityDirect = "direct"
 )
 
 // statusRequest は投稿エンドポイントが受ける入力。JSON と form の
@@ -32,28 +40,59 @@ type statusRequest struct {
 	Visibility string   `json:"visibility"`
 	InReplyTo  string   `json:"in_reply_to"`
 	Mentions   []string `json:"mentions"`
+	// SpoilerText は CW (content warning)。空でなければ本文はこの下に
+	// 畳まれる。名前は Mastodon の API に合わせてある。
+	SpoilerText string `json:"spoiler_text"`
+	// Sensitive は添付を閲覧注意にする。
+	Sensitive bool `json:"sensitive"`
+	// PollOptions があれば投票として出す。PollExpiresIn は締め切りまでの
+	// 秒数、PollMultiple は複数選択。名前は Mastodon の API に合わせてある
+	// (入れ子の poll ではなく form でも送れる平らな形にしている)。編集では
+	// 見ない。
+	PollOptions   []string `json:"poll_options"`
+	PollExpiresIn int      `json:"poll_expires_in"`
+	PollMultiple  bool     `json:"poll_multiple"`
+	// Quote は引用する投稿の URI。編集では見ない (引用先は変えられない)。
+	Quote string `json:"quote"`
+	// ScheduledAt があれば、その時刻まで出さずに予約として控える
+	// (scheduled.go)。normalize が RFC3339 (UTC) に揃える。編集では見ない。
+	ScheduledAt string `json:"scheduled_at"`
 }
 
-// normalize は content の trim と visibility の検証だけを行う。content が
+// normalize は content の trim と visibility の検証、予約日時の正規化
+// だけを行う。content が
 // 空でよいかどうかは画像添付の有無に依るため、ここでは判断しない
-// (postStatusHandler が imageAttachmentFromRequest の結果と合わせて見る)。
+// (postStatusHandler が imageAttachmentsFromRequest の結果と合わせて見る)。
+//
+// CW を付けた投稿は sensitive も立てる。Mastodon は CW 付きの投稿の添付を
+// 必ず畳むので、それと揃える。
 func (req *statusRequest) normalize() error {
 	req.Content = strings.TrimSpace(req.Content)
+	req.Quote = strings.TrimSpace(req.Quote)
+	req.SpoilerText = strings.TrimSpace(req.SpoilerText)
+	if req.SpoilerText != "" {
+		req.Sensitive = true
+	}
 	switch req.Visibility {
 	case "":
 		req.Visibility = visibilityPublic
-	case visibilityPublic, visibilityUnlisted, visibilityFollowers:
+	case visibilityPublic, visibilityUnlisted, visibilityFollowers, visibilityDirect:
 	default:
 		return fmt.Errorf("unknown visibility %q", req.Visibility)
 	}
-	return nil
+	scheduledAt, err := normalizeScheduledAt(req.ScheduledAt)
+	if err != nil {
+		return err
+	}
+	req.ScheduledAt = scheduledAt
+	return req.normalizePoll()
 }
 
 // requireContentOrAttachment は content と画像添付の少なくとも一方を要求
 // する。画像だけの投稿を許すため content 単体では必須にできないが、
 // 両方無い投稿は空でしかないので弾く。
-func requireContentOrAttachment(content string, attachment *activitystream.Object) error {
-	if content == "" && attachment == nil {
+func requireContentOrAttachment(content string, attachments activitystream.Objects) error {
+	if content == "" && len(attachments) == 0 {
 		return errors.New("content must not be empty unless an image is attached")
 	}
 	return nil
@@ -68,6 +107,10 @@ func (req *statusRequest) audience(followers string, mentioned []string) (to []s
 		cc = []string{activitystream.ToPublic}
 	case visibilityFollowers:
 		to = []string{followers}
+	case visibilityDirect:
+		// mention 先だけを宛先にする。Mastodon の direct と同じく to に
+		// 置く。
+		return append([]string{}, mentioned...), nil
 	default:
 		to = []string{activitystream.ToPublic}
 		cc = []string{followers}
@@ -98,6 +141,13 @@ func parseStatusRequest(r *http.Request) (*statusRequest, error) {
 		if m := strings.TrimSpace(r.PostFormValue("mentions")); m != "" {
 			req.Mentions = strings.Fields(m)
 		}
+		req.SpoilerText = r.PostFormValue("spoiler_text")
+		req.Quote = r.PostFormValue("quote")
+		req.Sensitive = r.PostFormValue("sensitive") != ""
+		req.ScheduledAt = r.PostFormValue("scheduled_at")
+		if err := req.parsePollForm(r); err != nil {
+			return nil, err
+		}
 	} else if err := json.NewDecoder(r.Body).Decode(req); err != nil {
 		return nil, err
 	}
@@ -119,7 +169,8 @@ func isFormRequest(r *http.Request) bool {
 }
 
 // postStatusHandler は新しい Note を作り、保存してフォロワーに配信する。
-// primary actor だけでなく sub actor (bot 等) も使える。
+// primary actor だけでなく sub actor (bot 等) も使える。scheduled_at が
+// あれば今は出さず、予約として控える (scheduled.go)。
 func postStatusHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
 	ctx := r.Context()
 	actor, herr := resolveActor(r)
@@ -131,24 +182,88 @@ func postStatusHandler(w http.ResponseWriter, r *http.Request) httperror.HttpErr
 	if err != nil {
 		return httperror.StatusUnprocessableEntity("bad status request", err)
 	}
+	if req.ScheduledAt != "" {
+		// 画像を置く前に弾く。過去の日時を指定した投稿のために画像を
+		// アップロードしても無駄になる。
+		if err := checkScheduledAt(req.ScheduledAt, time.Now()); err != nil {
+			return httperror.StatusUnprocessableEntity(err.Error(), nil)
+		}
+	}
 
 	// 画像は id 発行より前に済ませる。アップロードに失敗した投稿のために
 	// 連番を無駄に消費しないため。
-	attachment, herr := imageAttachmentFromRequest(ctx, r)
+	attachments, herr := imageAttachmentsFromRequest(ctx, r)
+	if herr != nil {
+		return herr
+	}
+	draft, herr := prepareStatus(ctx, actor, req, attachments)
 	if herr != nil {
 		return herr
 	}
-	if err := requireContentOrAttachment(req.Content, attachment); err != nil {
-		return httperror.StatusUnprocessableEntity(err.Error(), nil)
+	if req.ScheduledAt != "" {
+		return scheduleStatus(w, r, actor, req, attachments)
 	}
 
+	create, herr := publishStatus(ctx, actor, draft)
+	if herr != nil {
+		return herr
+	}
+	if isFormRequest(r) {
+		// リロードで二重投稿しないよう 303 でタイムラインに戻す。
+		http.Redirect(w, r, "/timeline", http.StatusSeeOther)
+		return nil
+	}
+	return respondAsJSON(w, http.StatusCreated, create)
+}
+
+// statusDraft は検証を通った、まだ id を振っていない投稿。
+type statusDraft struct {
+	req         *statusRequest
+	attachments activitystream.Objects
+	quoted      *activitystream.Object
+	mentions    []mention
+}
+
+// prepareStatus は投稿を出す前の検証と、引用先・mention 先の解決を行う。
+// 予約投稿は控えるときと出すときの2度これを通る。控えてから出すまでの
+// 間に引用先が消えたり、mention 先の解決結果が変わったりし得るため。
+func prepareStatus(ctx context.Context, actor *config.ActorConfig, req *statusRequest, attachments activitystream.Objects) (*statusDraft, httperror.HttpError) {
+	if err := requireContentOrAttachment(req.Content, attachments); err != nil {
+		return nil, httperror.StatusUnprocessableEntity(err.Error(), nil)
+	}
+	if len(req.PollOptions) > 0 && len(attachments) > 0 {
+		// Mastodon は添付付きの投票を表示しない。
+		return nil, httperror.StatusUnprocessableEntity("a poll cannot have an attachment", nil)
+	}
+	draft := &statusDraft{req: req, attachments: attachments}
+	if req.Quote != "" {
+		quoted, herr := quotableStatus(ctx, actor, req.Quote)
+		if herr != nil {
+			return nil, herr
+		}
+		draft.quoted = quoted
+	}
+
+	// 本文中の @user@host も明示指定もまとめて解決する。
+	draft.mentions = collectMentions(ctx, actor, req.Content, req.Mentions)
+	if req.Visibility == visibilityDirect && len(draft.mentions) == 0 {
+		// 宛先の無い direct は誰にも届かず、自分にしか見えない。連番を
+		// 消費する前に弾く。
+		return nil, httperror.StatusUnprocessableEntity("a direct status needs at least one mention", nil)
+	}
+	return draft, nil
+}
+
+// publishStatus は draft に id を振って Note にし、保存して配信する。
+// 返すのは outbox に積んだ Create。投稿エンドポイントと予約投稿の
+// worker が共に使う。
+func publishStatus(ctx context.Context, actor *config.ActorConfig, draft *statusDraft) (*activitystream.Object, httperror.HttpError) {
+	req, mentions, quoted := draft.req, draft.mentions, draft.quoted
 	id, err := client.Inc(ctx, actorScoped(actor, statusKey))
 	if err != nil {
-		return httperror.StatusInternalServerError("cannot allocate a status id", err)
+		return nil, httperror.StatusInternalServerError("cannot allocate a status id", err)
 	}
 
-	// 本文中の @user@host も明示指定もまとめて解決する。
-	mentions := collectMentions(ctx, actor, req.Content, req.Mentions)
 	to, cc := req.audience(followersURI(actor), mentionURIs(mentions))
 
 	note := activitystream.NewNote(
@@ -157,54 +272,159 @@ func postStatusHandler(w http.ResponseWriter, r *http.Request) httperror.HttpErr
 		// Date ヘッダ書式 (RFC1123) を流用してはならない。以前の実装は
 		// そうなっていた。
 		time.Now().UTC().Format(time.RFC3339),
-		"", renderContent(req.Content, mentions), actor.ID(), to, cc, mentionTags(mentions))
+		"", renderContent(req.Content, mentions), actor.ID(), to, cc, noteTags(req.Content, mentions))
 	if req.InReplyTo != "" {
 		note.InReplyTo = activitystream.URIRef(req.InReplyTo)
 	}
-	if attachment != nil {
-		note.Attachment = activitystream.Objects{attachment}
+	note.Attachment = draft.attachments
+	note.Source = noteSource(req.Content)
+	note.Replies = activitystream.URIRef(repliesURI(note.ID))
+	applyContentWarning(note, req)
+	if len(req.PollOptions) > 0 {
+		applyPoll(note, req, time.Now())
+	}
+	if quoted != nil {
+		applyQuote(note, quoted.ID)
 	}
 	create := noteToCreate(note)
 
 	// 配信より先に保存する。逆順だと、配信されたのに自分の outbox には
 	// 無い投稿ができてしまう。
 	if err := saveStatus(ctx, actor, id, note); err != nil {
-		return httperror.StatusInternalServerError("cannot save the status", err)
+		return nil, httperror.StatusInternalServerError("cannot save the status", err)
 	}
 	if err := saveToOutbox(ctx, actor, id, create); err != nil {
-		return httperror.StatusInternalServerError("cannot save to the outbox", err)
+		return nil, httperror.StatusInternalServerError("cannot save to the outbox", err)
+	}
+	if note.Type == activitystream.QuestionType {
+		// 控えられなくても投票は成り立つ。締め切りの Update が出ない
+		// だけなので、投稿は失敗にしない。
+		if err := recordOpenPoll(ctx, actor, note); err != nil {
+			logf("cannot record the open poll %v: %v", note.ID, err)
+		}
+	}
+	// 自分の投稿への返信 (スレッドの続き) も、他人からの返信と同じく索引
+	// に入れる。
+	recordReply(ctx, actor, note)
+	recordTags(ctx, actor, nil, note)
+
+	inboxes, err := noteInboxes(ctx, actor, note, append(mentionURIs(mentions), quoteRecipients(quoted)...))
+	if err != nil {
+		return nil, httperror.StatusInternalServerError("cannot list follower inboxes", err)
+	}
+
+	deliveryErr := deliver(ctx, actor, inboxes, create)
+	if deliveryErr != nil {
+		// 保存は済んでいるので投稿自体は成立している。失敗した宛先だけ
+		// 報告する。
+		logf("status %v was saved but delivery had failures: %v", note.ID, deliveryErr)
 	}
+	return create, nil
+}
+
+// loadStatus は actor の投稿 id を引く。無ければ 404、消した投稿
+// (Tombstone) なら 410 を返す。
+func loadStatus(ctx context.Context, actor *config.ActorConfig, id int) (*activitystream.Object, httperror.HttpError) {
+	note, err := client.GetObject(ctx, actorScoped(actor, statusKey), id)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil, httperror.StatusNotFound("no such status", err)
+		}
+		return nil, httperror.StatusInternalServerError("cannot load the status", err)
+	}
+	if isTombstone(note) {
+		return nil, httperror.StatusGone("the status was deleted", nil)
+	}
+	// 投票の票数は保存せず、KV の票から数える (receiveVote)。
+	if note.Type == activitystream.QuestionType {
+		note = countedPoll(ctx, actor, note)
+	}
+	return note, nil
+}
+
+// isTombstone は o が削除の跡かを返す。
+func isTombstone(o *activitystream.Object) bool {
+	return o.Type == activitystream.TombstoneType
+}
+
+// noteInboxes は note の配信先を返す。direct ならフォロワーには配らず、
+// 宛先の actor にだけ届ける。そうでなければ statusInboxes と同じ。
+func noteInboxes(ctx context.Context, actor *config.ActorConfig, note *activitystream.Object, mentioned []string) ([]string, error) {
+	if noteVisibility(note, followersURI(actor)) == visibilityDirect {
+		// 編集で mention を外しても to には残るので、mentioned ではなく
+		// to を見る。外した相手にも Update / Delete を届けるため。
+		return mentionedInboxes(ctx, actor, note.To, nil), nil
+	}
+	return statusInboxes(ctx, actor, mentioned)
+}
 
+// statusInboxes は投稿の配信先を返す。フォロワーに加えて mention 先にも
+// 届ける。
+func statusInboxes(ctx context.Context, actor *config.ActorConfig, mentioned []string) ([]string, error) {
 	inboxes, err := followerInboxes(ctx, actor)
 	if err != nil {
-		return httperror.StatusInternalServerError("cannot list follower inboxes", err)
+		return nil, err
 	}
+	return mentionedInboxes(ctx, actor, mentioned, inboxes), nil
+}
+
+// mentionedInboxes は mention 先の inbox を inboxes に足して返す。
+func mentionedInboxes(ctx context.Context, actor *config.ActorConfig, mentioned []string, inboxes []string) []string {
 	// mention 先はフォロワーでなくても届ける必要がある。フォローされて
 	// いない相手に話しかけられるのはこの経路だけである。
-	for _, m := range mentions {
-		mentioned, err := fetchActor(ctx, actor, m.ActorURI)
+	for _, uri := range mentioned {
+		// こちらをブロックしている相手には送らない。
+		if isBlockedBy(ctx, actor, uri) {
+			logf("not delivering to %v, who blocks %v", uri, actor.ID())
+			continue
+		}
+		remote, err := fetchActor(ctx, actor, uri)
 		if err != nil {
-			logf("cannot fetch mentioned actor %v: %v", m.ActorURI, err)
+			logf("cannot fetch mentioned actor %v: %v", uri, err)
 			continue
 		}
-		if inbox := mentioned.InboxURI(); inbox != "" {
+		if inbox := remote.InboxURI(); inbox != "" {
 			inboxes = appendUnique(inboxes, inbox)
 		}
 	}
+	return inboxes
+}
 
-	deliveryErr := deliver(ctx, actor, inboxes, create)
-	if deliveryErr != nil {
-		// 保存は済んでいるので投稿自体は成立している。失敗した宛先だけ
-		// 報告する。
-		logf("status %v was saved but delivery had failures: %v", note.ID, deliveryErr)
+// noteVisibility は to / cc から公開範囲を読み取る。保存した Note は
+// 公開範囲を別に持たないので、表示や配信の出し分けはこれで決める。
+func noteVisibility(note *activitystream.Object, followers string) string {
+	switch {
+	case slices.Contains(note.To, activitystream.ToPublic):
+		return visibilityPublic
+	case slices.Contains(note.Cc, activitystream.ToPublic):
+		return visibilityUnlisted
+	case addressedTo(note, followers):
+		return visibilityFollowers
+	default:
+		return visibilityDirect
 	}
+}
 
-	if isFormRequest(r) {
-		// リロードで二重投稿しないよう 303 でタイムラインに戻す。
-		http.Redirect(w, r, "/timeline", http.StatusSeeOther)
-		return nil
+// addressedTo は note の to か cc に uri が入っているかを返す。
+func addressedTo(note *activitystream.Object, uri string) bool {
+	return slices.Contains(note.To, uri) || slices.Contains(note.Cc, uri)
+}
+
+// applyContentWarning は CW と閲覧注意を Note に載せる。CW は summary に
+// 入れる。Mastodon も Misskey も summary を CW として読み、本文を畳む。
+// 付けないときは消す (編集で CW を外せるように)。
+func applyContentWarning(note *activitystream.Object, req *statusRequest) {
+	note.Summary = req.SpoilerText
+	note.Sensitive = nil
+	if req.Sensitive {
+		sensitive := true
+		note.Sensitive = &sensitive
 	}
-	return respondAsJSON(w, http.StatusCreated, create)
+}
+
+// noteSource は Note に添える元の平文。
+func noteSource(text string) *activitystream.Object {
+	return &activitystream.Object{Content: text, MediaType: "text/plain"}
 }
 
 // deleteStatusHandler は投稿を消し、Delete を配信する。primary actor だけ
@@ -220,16 +440,13 @@ func deleteStatusHandler(w http.ResponseWriter, r *http.Request) httperror.HttpE
 		return herr
 	}
 
-	note, err := client.GetObject(ctx, actorScoped(actor, statusKey), id)
-	if err != nil {
-		if errors.Is(err, datastore.ErrNotFound) {
-			return httperror.StatusNotFound("no such status", err)
-		}
-		return httperror.StatusInternalServerError("cannot load the status", err)
+	note, herr := loadStatus(ctx, actor, id)
+	if herr != nil {
+		return herr
 	}
 
 	del := activitystream.NewDelete(newActivityID("delete"), actor.ID(), note.To, note.ID)
-	inboxes, err := followerInboxes(ctx, actor)
+	inboxes, err := deleteInboxes(ctx, actor, note)
 	if err != nil {
 		return httperror.StatusInternalServerError("cannot list follower inboxes", err)
 	}
@@ -237,12 +454,20 @@ func deleteStatusHandler(w http.ResponseWriter, r *http.Request) httperror.HttpE
 		logf("Delete of %v had delivery failures: %v", note.ID, err)
 	}
 
-	if err := client.DeleteObject(ctx, actorScoped(actor, statusKey), id); err != nil {
+	// 消さずに Tombstone で上書きする。取りに来た相手に「元から無い」
+	// ではなく「消した」と伝えるため (410)。連番は Inc でしか振らない
+	// ので、跡を残しておけば同じ id が別の投稿に使われることもない。
+	tombstone := activitystream.NewTombstone(note.ID, note.Type, nowRFC3339())
+	if err := saveStatus(ctx, actor, id, tombstone); err != nil {
 		return httperror.StatusInternalServerError("cannot delete the status", err)
 	}
 	if err := client.DeleteObject(ctx, actorScoped(actor, outboxKey), id); err != nil {
 		logf("removing %v from the outbox failed: %v", note.ID, err)
 	}
+	deleteStatusHistory(ctx, actor, id)
+	forgetReply(ctx, note.ID)
+	forgetPin(ctx, actor, note.ID)
+	forgetTags(ctx, note)
 
 	if isFormRequest(r) {
 		http.Redirect(w, r, "/timeline", http.StatusSeeOther)
@@ -251,6 +476,15 @@ func deleteStatusHandler(w http.ResponseWriter, r *http.Request) httperror.HttpE
 	return respondAsJSON(w, http.StatusOK, del)
 }
 
+// deleteInboxes は Delete の配信先を返す。direct は宛先にだけ届いている
+// ので、フォロワーには送らない。
+func deleteInboxes(ctx context.Context, actor *config.ActorConfig, note *activitystream.Object) ([]string, error) {
+	if noteVisibility(note, followersURI(actor)) == visibilityDirect {
+		return mentionedInboxes(ctx, actor, note.To, nil), nil
+	}
+	return followerInboxes(ctx, actor)
+}
+
 // followRequestHandler は自分から相手をフォローする。タイムラインに
 // 中身を入れるために必要。primary actor 専用。
 func followRequestHandler(w http.ResponseWriter, r *http.Request) httperror.HttpError {
@@ -299,8 +533,10 @@ func followRequestHandler(w http.ResponseWriter, r *http.Request) httperror.Http
 	if err := saveFollower(ctx, actorScoped(primary, datastore.KVFollowing), actor, follow.ID, datastore.FollowStatePending); err != nil {
 		return httperror.StatusInternalServerError("cannot record the follow", err)
 	}
-	if err := sendToInbox(ctx, primary, inbox, follow); err != nil {
-		return httperror.StatusInternalServerError("cannot deliver the Follow", err)
+	// 送信は配信キューに任せる。相手が落ちていてもリトライされ、Accept が
+	// 返ってくるまでは pending のまま残る。
+	if err := enqueueDelivery(ctx, primary.LocalPart(), inbox, follow); err != nil {
+		return httperror.StatusInternalServerError("cannot queue the Follow", err)
 	}
 
 	if isFormRequest(r) {
@@ -338,13 +574,13 @@ func unfollowRequestHandler(w http.ResponseWriter, r *http.Request) httperror.Ht
 	if inbox == "" {
 		inbox = item.SharedInbox
 	}
-	// 配送に失敗したのにローカルの記録だけ消すと、相手には follow が生きた
-	// ままなのにこちらは「解除した」つもりになる。しかも target のレコードが
-	// 無いのでこのハンドラ自体を二度と呼べず、二度と解除できなくなる。
-	// 届くまでローカルの記録を残し、失敗はエラーとして呼び出し元に返す。
+	// 配信キューに積めてから記録を消す。キューは永続的で、届くまで再試行
+	// する。積めないのに記録だけ消すと、相手には follow が生きたままなのに
+	// target のレコードが無いのでこのハンドラ自体を二度と呼べず、二度と
+	// 解除できなくなる。
 	if inbox != "" {
-		if err := sendToInbox(ctx, primary, inbox, undo); err != nil {
-			return httperror.StatusInternalServerError("cannot deliver the Undo(Follow)", err)
+		if err := enqueueDelivery(ctx, primary.LocalPart(), inbox, undo); err != nil {
+			return httperror.StatusInternalServerError("cannot queue the Undo(Follow)", err)
 		}
 	}
 	if err := client.DeleteKV(ctx, actorScoped(primary, datastore.KVFollowing), target); err != nil {
@@ -377,39 +613,130 @@ func mentionName(ctx context.Context, requester *config.ActorConfig, actorURI st
 	return "@" + actor.PreferredUsername + "@" + host
 }
 
-// imageAttachmentFromRequest は "image" フィールドに画像が来ていれば Gyazo
+// maxImageAttachments は1つの投稿に付けられる画像の数。Mastodon と同じ。
+const maxImageAttachments = 4
+
+// maxAltTextLength は画像の説明 (alt) の長さの上限。Mastodon と同じ。
+const maxAltTextLength = 1500
+
+// imageAttachmentsFromRequest は "image" フィールドに画像が来ていれば Gyazo
 // にアップロードし、Note.Attachment に載せる Object を作る。フィールドが
 // 無ければ (nil, nil) を返す。
 //
+// image は同じ名前で最大 maxImageAttachments 個まで来てよい。n 個目の画像
+// の説明は n 個目の alt で、添付の name に入れる。form は alt の入力欄を
+// 常に全部送ってくるので、画像より alt が多くても構わない。
+//
+// アップロードは並行して行う。1枚ずつだと枚数分だけ待たされる。画像の
+// 合計は maxImageUploadBytes までにする。ParseMultipartForm の上限は
+// メモリに置く分だけで、超えた分はディスクに逃げてしまうので別に見る。
+//
 // multipart/form-data のときしか見てはいけない。
 // application/x-www-form-urlencoded にファイル部分は存在しないので
 // r.FormFile を呼ぶと "request Content-Type isn't multipart/form-data" で
 // 失敗する。isFormRequest はこの2つをまとめて form 判定してしまうため、
 // ここでは multipart かどうかを別途見て、そうでなければ素通りする。
-func imageAttachmentFromRequest(ctx context.Context, r *http.Request) (*activitystream.Object, httperror.HttpError) {
+func imageAttachmentsFromRequest(ctx context.Context, r *http.Request) (activitystream.Objects, httperror.HttpError) {
 	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
 		return nil, nil
 	}
-	file, header, err := r.FormFile("image")
-	if err != nil {
-		if errors.Is(err, http.ErrMissingFile) {
-			return nil, nil
+	if r.MultipartForm == nil {
+		if err := r.ParseMultipartForm(maxImageUploadBytes); err != nil {
+			return nil, httperror.StatusUnprocessableEntity("bad image upload", err)
+		}
+	}
+	headers := r.MultipartForm.File["image"]
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	if len(headers) > maxImageAttachments {
+		return nil, httperror.StatusUnprocessableEntity(fmt.Sprintf("at most %d images can be attached", maxImageAttachments), nil)
+	}
+	var total int64
+	for _, h := range headers {
+		total += h.Size
+	}
+	if total > maxImageUploadBytes {
+		return nil, httperror.StatusUnprocessableEntity(fmt.Sprintf("images must be %d bytes or less in total", maxImageUploadBytes), nil)
+	}
+	alts := r.MultipartForm.Value["alt"]
+	names := make([]string, len(headers))
+	for i := range headers {
+		if i < len(alts) {
+			names[i] = strings.TrimSpace(alts[i])
+		}
+		if len([]rune(names[i])) > maxAltTextLength {
+			return nil, httperror.StatusUnprocessableEntity(fmt.Sprintf("alt text must be %d characters or less", maxAltTextLength), nil)
 		}
-		return nil, httperror.StatusUnprocessableEntity("bad image upload", err)
 	}
-	defer file.Close()
 
-	if Config.GyazoAccessToken() == "" {
+	store := media
+	if store == nil {
 		return nil, httperror.StatusInternalServerError("image upload is not configured", nil)
 	}
-	result, err := uploadToGyazo(ctx, Config.GyazoAccessToken(), header.Filename, header.Header.Get("Content-Type"), file)
+	// デコードは1枚ずつ行う。4枚を並行してデコードすると、それぞれの
+	// 画素がいっぺんにメモリに乗る (maxImagePixels 参照)。並行にするのは
+	// 待ちの長いアップロードだけ。
+	maxEdge := Config.MediaMaxImageEdge()
+	images := make([]*processedImage, len(headers))
+	for i, h := range headers {
+		img, err := readImage(h, maxEdge)
+		if err != nil {
+			if errors.Is(err, errBadImage) {
+				return nil, httperror.StatusUnprocessableEntity("cannot process the images", err)
+			}
+			return nil, httperror.StatusInternalServerError("cannot read the images", err)
+		}
+		images[i] = img
+	}
+	attachments := make(activitystream.Objects, len(headers))
+	errs := make([]error, len(headers))
+	var wg sync.WaitGroup
+	for i, img := range images {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attachments[i], errs[i] = uploadImage(ctx, store, img, names[i])
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		if errors.Is(err, errBadImage) {
+			return nil, httperror.StatusUnprocessableEntity("cannot process the images", err)
+		}
+		return nil, httperror.StatusInternalServerError("cannot upload the images", err)
+	}
+	return attachments, nil
+}
+
+// readImage は multipart の画像を1枚読み、processImage に通す。
+func readImage(h *multipart.FileHeader, maxEdge int) (*processedImage, error) {
+	file, err := h.Open()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	return processImage(data, h.Filename, h.Header.Get("Content-Type"), maxEdge)
+}
+
+// uploadImage は readImage で処理した画像を store に置き、添付にする。
+func uploadImage(ctx context.Context, store mediaStore, img *processedImage, name string) (*activitystream.Object, error) {
+	result, err := store.Put(ctx, img.Filename, img.ContentType, bytes.NewReader(img.Data))
 	if err != nil {
-		return nil, httperror.StatusInternalServerError("cannot upload the image to gyazo", err)
+		return nil, fmt.Errorf("%v: %w", img.Filename, err)
 	}
 	return &activitystream.Object{
 		Type:      activitystream.ImageType,
 		URL:       result.URL,
 		MediaType: result.MediaType,
+		Name:      name,
+		Width:     img.Width,
+		Height:    img.Height,
+		Blurhash:  img.Blurhash,
 	}, nil
 }
 
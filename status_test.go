@@ -2,6 +2,9 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/png"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
@@ -9,17 +12,17 @@ import (
 	"testing"
 
 	"github.com/nna774/s.nna774.net/activitystream"
-	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/web"
 )
 
 // content と画像添付のどちらも無い投稿だけを拒否し、画像だけの投稿は
 // 許すことを確かめる。
 func TestRequireContentOrAttachment(t *testing.T) {
-	img := &activitystream.Object{Type: activitystream.ImageType, URL: "https://i.gyazo.com/x.png"}
+	img := activitystream.Objects{{Type: activitystream.ImageType, URL: "https://i.gyazo.com/x.png"}}
 	for _, tt := range []struct {
 		name       string
 		content    string
-		attachment *activitystream.Object
+		attachment activitystream.Objects
 		wantErr    bool
 	}{
 		{"本文のみ", "hi", nil, false},
@@ -65,6 +68,65 @@ func TestParseStatusRequestReadsMultipartFields(t *testing.T) {
 	}
 }
 
+// CW と閲覧注意のチェックが form から読め、CW を付けると sensitive も
+// 立つことを確かめる。
+func TestParseStatusRequestContentWarning(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		form          string
+		wantSummary   string
+		wantSensitive bool
+	}{
+		{"CW あり", "content=x&spoiler_text=+%E3%83%8D%E3%82%BF%E3%83%90%E3%83%AC+", "ネタバレ", true},
+		{"閲覧注意のみ", "content=x&sensitive=1", "", true},
+		{"どちらも無し", "content=x", "", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/u/nana/statuses", strings.NewReader(tt.form))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			got, err := parseStatusRequest(req)
+			if err != nil {
+				t.Fatalf("parseStatusRequest: %v", err)
+			}
+			if got.SpoilerText != tt.wantSummary || got.Sensitive != tt.wantSensitive {
+				t.Errorf("got (%q, %v), want (%q, %v)", got.SpoilerText, got.Sensitive, tt.wantSummary, tt.wantSensitive)
+			}
+		})
+	}
+}
+
+// 編集で CW や閲覧注意を外したら、Note からも消えることを確かめる。
+func TestApplyContentWarningClears(t *testing.T) {
+	sensitive := true
+	note := &activitystream.Object{Summary: "old", Sensitive: &sensitive}
+	applyContentWarning(note, &statusRequest{})
+	if note.Summary != "" || note.Sensitive != nil {
+		t.Errorf("got (%q, %v), want cleared", note.Summary, note.Sensitive)
+	}
+	applyContentWarning(note, &statusRequest{SpoilerText: "cw", Sensitive: true})
+	if note.Summary != "cw" || !noteSensitive(note) {
+		t.Errorf("got (%q, %v), want (\"cw\", true)", note.Summary, note.Sensitive)
+	}
+}
+
+func TestStatusPageFoldsContentWarning(t *testing.T) {
+	page := statusPage{
+		pageBase:  pageBase{Title: "nana", SiteName: "nana", LocalPart: "nana", Handle: "@nana"},
+		Content:   "<p>spoiler</p>",
+		Published: "2026-01-01T00:00:00Z",
+		ObjectURI: "https://s.example/u/nana/status/1",
+		Summary:   "ネタバレ",
+		Sensitive: true,
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "status", page); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `<details class="cw"><summary>ネタバレ</summary>`) {
+		t.Errorf("page does not fold the content under the CW:\n%s", buf.String())
+	}
+}
+
 // image フィールドを含まない通常の form-urlencoded な投稿 (curl 等) まで
 // FormFile 経由で弾いてしまわないことを確かめる。multipart 以外では
 // FormFile が "request Content-Type isn't multipart/form-data" を返すため、
@@ -73,12 +135,12 @@ func TestImageAttachmentFromRequestIgnoresNonMultipart(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/u/nana/statuses", strings.NewReader("content=hi"))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	attachment, herr := imageAttachmentFromRequest(req.Context(), req)
+	attachments, herr := imageAttachmentsFromRequest(req.Context(), req)
 	if herr != nil {
-		t.Fatalf("imageAttachmentFromRequest: %v", herr)
+		t.Fatalf("imageAttachmentsFromRequest: %v", herr)
 	}
-	if attachment != nil {
-		t.Errorf("attachment = %+v, want nil", attachment)
+	if attachments != nil {
+		t.Errorf("attachments = %+v, want nil", attachments)
 	}
 }
 
@@ -92,21 +154,19 @@ func TestImageAttachmentFromRequestNoFile(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/u/nana/statuses", body)
 	req.Header.Set("Content-Type", mw.FormDataContentType())
 
-	attachment, herr := imageAttachmentFromRequest(req.Context(), req)
+	attachments, herr := imageAttachmentsFromRequest(req.Context(), req)
 	if herr != nil {
-		t.Fatalf("imageAttachmentFromRequest: %v", herr)
+		t.Fatalf("imageAttachmentsFromRequest: %v", herr)
 	}
-	if attachment != nil {
-		t.Errorf("attachment = %+v, want nil", attachment)
+	if attachments != nil {
+		t.Errorf("attachments = %+v, want nil", attachments)
 	}
 }
 
 // Gyazo のトークンを設定し忘れたまま画像付き投稿が来た場合、静かに無視せず
 // エラーを返さなければならない。さもないと画像だけ消えた投稿になる。
-func TestImageAttachmentFromRequestWithoutGyazoToken(t *testing.T) {
-	old := Config
-	Config = &config.Config{}
-	defer func() { Config = old }()
+func TestImageAttachmentFromRequestWithoutMediaStore(t *testing.T) {
+	withMediaStore(t, nil)
 
 	body := &bytes.Buffer{}
 	mw := multipart.NewWriter(body)
@@ -121,7 +181,135 @@ func TestImageAttachmentFromRequestWithoutGyazoToken(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/u/nana/statuses", body)
 	req.Header.Set("Content-Type", mw.FormDataContentType())
 
-	if _, herr := imageAttachmentFromRequest(req.Context(), req); herr == nil {
-		t.Error("imageAttachmentFromRequest succeeded, want error (no gyazo token configured)")
+	if _, herr := imageAttachmentsFromRequest(req.Context(), req); herr == nil {
+		t.Error("imageAttachmentsFromRequest succeeded, want error (no gyazo token configured)")
+	}
+}
+
+// imageRequest は images の数だけ画像を付けた投稿のリクエストを作る。
+func imageRequest(t *testing.T, images []string, alts ...string) *http.Request {
+	t.Helper()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	_ = mw.WriteField("content", "hi")
+	for i, data := range images {
+		part, err := mw.CreateFormFile("image", fmt.Sprintf("%d.png", i))
+		if err != nil {
+			t.Fatalf("CreateFormFile: %v", err)
+		}
+		_, _ = part.Write([]byte(data))
+	}
+	for _, alt := range alts {
+		_ = mw.WriteField("alt", alt)
+	}
+	_ = mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/u/nana/statuses", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// 枚数と合計の大きさの上限は、アップロードする前に見ること。
+func TestImageAttachmentsFromRequestLimits(t *testing.T) {
+	for name, req := range map[string]*http.Request{
+		"多すぎる":    imageRequest(t, []string{"a", "b", "c", "d", "e"}),
+		"大きすぎる":   imageRequest(t, []string{strings.Repeat("a", maxImageUploadBytes/2), strings.Repeat("b", maxImageUploadBytes/2+1)}),
+		"説明が長すぎる": imageRequest(t, []string{"a"}, strings.Repeat("あ", maxAltTextLength+1)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, herr := imageAttachmentsFromRequest(req.Context(), req); herr == nil || herr.Code() != http.StatusUnprocessableEntity {
+				t.Errorf("imageAttachmentsFromRequest = %v, want 422", herr)
+			}
+		})
+	}
+}
+
+// 画像の説明は添付の name に入ること。
+func TestUploadImageCarriesAltText(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"url":"https://i.gyazo.com/abc.png","type":"png"}`))
+	}))
+	defer srv.Close()
+	old := gyazoUploadURL
+	gyazoUploadURL = srv.URL
+	defer func() { gyazoUploadURL = old }()
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, gradient(4, 4)); err != nil {
+		t.Fatal(err)
+	}
+	req := imageRequest(t, []string{buf.String()})
+	if err := req.ParseMultipartForm(maxImageUploadBytes); err != nil {
+		t.Fatal(err)
+	}
+	img, err := readImage(req.MultipartForm.File["image"][0], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := uploadImage(req.Context(), &gyazoMediaStore{accessToken: "test-token"}, img, "猫の写真")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != activitystream.ImageType || got.URL != "https://i.gyazo.com/abc.png" || got.Name != "猫の写真" {
+		t.Errorf("attachment = %+v", got)
+	}
+}
+
+// 保存した Note の to / cc から、投稿時の公開範囲を読み戻せること。
+func TestNoteVisibility(t *testing.T) {
+	const followers = "https://s.example/u/nana/followers"
+	mentioned := []string{"https://a.example/users/alice"}
+	for _, v := range []string{visibilityPublic, visibilityUnlisted, visibilityFollowers, visibilityDirect} {
+		t.Run(v, func(t *testing.T) {
+			req := &statusRequest{Visibility: v}
+			to, cc := req.audience(followers, mentioned)
+			note := &activitystream.Object{To: to, Cc: cc}
+			if got := noteVisibility(note, followers); got != v {
+				t.Errorf("noteVisibility = %q, want %q", got, v)
+			}
+		})
+	}
+}
+
+// 消した投稿を取りに来たリモートのサーバには、Tombstone を 410 で返す。
+// 404 だと元から無かったのと区別がつかない。
+func TestGoneStatusHandlerServesTombstone(t *testing.T) {
+	withTestConfig(t)
+	actor := Config.PrimaryActor()
+	tombstone := activitystream.NewTombstone(myStatusURI(actor, 3), activitystream.NoteType, "2026-01-01T00:00:00Z")
+
+	r := httptest.NewRequest(http.MethodGet, "/u/nana/status/3", nil)
+	r.Header.Set("Accept", activitystream.ContentType)
+	w := httptest.NewRecorder()
+	if herr := goneStatusHandler(w, r, actor, tombstone); herr != nil {
+		t.Fatal(herr)
+	}
+	if w.Code != http.StatusGone {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusGone)
+	}
+	var got activitystream.Object
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != activitystream.TombstoneType || got.ID != tombstone.ID || got.FormerType != activitystream.NoteType {
+		t.Errorf("body = %+v", got)
+	}
+}
+
+func TestStatusGonePageRenders(t *testing.T) {
+	page := statusGonePage{
+		pageBase:       pageBase{Title: "nana", SiteName: "nana", LocalPart: "nana", Handle: "@nana"},
+		ActorLocalPart: "nana",
+		Name:           "nana",
+		Deleted:        "2026-01-01T00:00:00Z",
+	}
+	buf := &bytes.Buffer{}
+	if err := web.Render(buf, "status_gone", page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"削除されました", "09:00 に削除"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("page does not contain %q", want)
+		}
 	}
 }
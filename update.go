@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/config"
+	"github.com/nna774/s.nna774.net/datastore"
+	"github.com/nna774/s.nna774.net/httperror"
+)
+
+// updateHandler は Update を処理する。primary / sub actor どちらの inbox
+// からも呼ばれる。
+//
+// 以前は Create と同じ createHandler に流しており、リモートで編集される
+// たびに同じ投稿がタイムラインにもう1件積まれ、通知も二重に出ていた。
+func updateHandler(w http.ResponseWriter, r *http.Request, actor *config.ActorConfig, in *activitystream.Object) httperror.HttpError {
+	obj := in.Object.Item()
+	if obj == nil {
+		// 中身を引きに行ってまで反映するほどのものではない。
+		logf("inbox: ignoring Update of %v without an embedded object", in.Object.ID())
+		respondText(w, http.StatusAccepted, "accepted\n")
+		return nil
+	}
+	if isActorType(obj.Type) {
+		return actorUpdateHandler(w, r, in, obj)
+	}
+	return noteUpdateHandler(w, r, actor, in, obj)
+}
+
+// isActorType は type が actor を表すかを返す。Update の object が投稿か
+// プロフィールかを見分けるのに使う。
+func isActorType(t string) bool {
+	switch t {
+	case activitystream.PersonType, activitystream.ServiceType,
+		"Application", "Group", "Organization":
+		return true
+	}
+	return false
+}
+
+// actorUpdateHandler はプロフィールの更新を、その actor を控えてある KV の
+// 項目 (各 actor の followers / following と actorinfo) に反映する。
+//
+// 控えは saveFollower や cacheActorInfo が書いたきりなので、放っておくと
+// 改名やアイコンの差し替え、inbox の引っ越しに追従できない。フォロー関係の
+// 項目は期限切れもしないため、配信先が古い inbox のままになる。
+func actorUpdateHandler(w http.ResponseWriter, r *http.Request, in *activitystream.Object, remote *activitystream.Object) httperror.HttpError {
+	ctx := r.Context()
+	// 署名で確かめたのは Update の actor だけである。他人のプロフィールを
+	// 書き換えさせない。
+	if remote.ID == "" || remote.ID != in.Actor.ID() {
+		return httperror.StatusUnprocessableEntity(
+			fmt.Sprintf("Update of %v is not from the actor itself (%v)", remote.ID, in.Actor.ID()), nil)
+	}
+
+	partitions := make([]string, 0, 2*len(Config.Actors)+1)
+	for _, a := range Config.Actors {
+		partitions = append(partitions, actorScoped(a, datastore.KVFollowers), actorScoped(a, datastore.KVFollowing))
+	}
+	partitions = append(partitions, datastore.KVActorInfo)
+
+	refreshed := 0
+	for _, partition := range partitions {
+		it, err := client.GetKV(ctx, partition, remote.ID)
+		if err != nil {
+			if !errors.Is(err, datastore.ErrNotFound) {
+				logf("looking up %v in %v failed: %v", remote.ID, partition, err)
+			}
+			continue
+		}
+		next, changed := refreshedActorItem(it, remote)
+		if !changed {
+			continue
+		}
+		if partition == datastore.KVActorInfo {
+			// 引き直したのと同じなので寿命も延ばす。
+			next.At = nowRFC3339()
+			next.TTL = time.Now().Add(actorInfoTTL).Unix()
+		}
+		if err := client.PutKV(ctx, next); err != nil {
+			return httperror.StatusInternalServerError("cannot refresh the actor", err)
+		}
+		refreshed++
+	}
+
+	if err := invalidateActorKey(ctx, remote); err != nil {
+		logf("invalidating the key of %v failed: %v", remote.ID, err)
+	}
+
+	logf("%v updated its profile (%d records refreshed)", remote.ID, refreshed)
+	respondText(w, http.StatusAccepted, "accepted\n")
+	return nil
+}
+
+// refreshedActorItem は控えてある項目 it に remote の表示名・アイコン・
+// inbox を写した写しを返す。it 自体は書き換えない。何も変わらなければ
+// 偽を返す。
+//
+// 空の値では上書きしない。Update に載る actor は取得したものと同じ形の
+// はずだが、endpoints を省く実装があり、sharedInbox を消すと配信が
+// まとまらなくなる。表示名の絵文字は表示名と組なので、表示名が載って
+// いれば一緒に入れ替える (絵文字を外した表示名なら空にする)。
+func refreshedActorItem(it *datastore.KVItem, remote *activitystream.Object) (*datastore.KVItem, bool) {
+	next := *it
+	name, iconURL := actorDisplay(remote)
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{
+		{&next.Name, name},
+		{&next.IconURL, iconURL},
+		{&next.PreferredUsername, remote.PreferredUsername},
+		{&next.Inbox, remote.Inbox},
+		{&next.SharedInbox, sharedInboxOf(remote)},
+	} {
+		if f.src != "" {
+			*f.dst = f.src
+		}
+	}
+	if name != "" {
+		next.Emoji = noteEmoji(remote.Tag)
+	}
+	changed := next.Name != it.Name || next.IconURL != it.IconURL ||
+		next.PreferredUsername != it.PreferredUsername ||
+		next.Inbox != it.Inbox || next.SharedInbox != it.SharedInbox ||
+		!maps.Equal(next.Emoji, it.Emoji)
+	return &next, changed
+}
+
+// invalidateActorKey は remote が名乗る鍵がキャッシュと食い違っていれば
+// キャッシュを捨てる。次に署名を検証するときに publicKeyForKeyID が
+// 引き直す。鍵を差し替えた直後の投稿が、TTL が切れるまで古い鍵で検証
+// されて弾かれ続けるのを防ぐ。
+func invalidateActorKey(ctx context.Context, remote *activitystream.Object) error {
+	if remote.PublicKey == nil || remote.PublicKey.ID == "" {
+		return nil
+	}
+	cached, err := client.GetKV(ctx, datastore.KVActorKey, remote.PublicKey.ID)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if !actorKeyChanged(cached, remote) {
+		return nil
+	}
+	logf("%v changed its key %v", remote.ID, remote.PublicKey.ID)
+	return client.DeleteKV(ctx, datastore.KVActorKey, remote.PublicKey.ID)
+}
+
+// actorKeyChanged はキャッシュ済みの鍵 cached と remote が名乗る鍵が
+// 食い違うかを返す。PEM の改行の違いだけでは捨てない。
+func actorKeyChanged(cached *datastore.KVItem, remote *activitystream.Object) bool {
+	if remote.PublicKey == nil || remote.PublicKey.PublicKeyPem == "" {
+		return false
+	}
+	if strings.TrimSpace(cached.PublicKeyPem) != strings.TrimSpace(remote.PublicKey.PublicKeyPem) {
+		return true
+	}
+	owner := remote.PublicKey.Owner
+	return owner != "" && owner != cached.Owner
+}
+
+// noteUpdateHandler は編集された投稿を、既に積んであるタイムラインと通知の
+// 中で差し替える。
+//
+// どこにも無くても、初めて見る投稿だとは限らない。走査する範囲より古い
+// もの、返信のフィルタで落としたもの、Delete で消したものもそうなる。以前は
+// Create と同じく扱っていたため、それらがもう1度積まれて通知も出直して
+// いた。控えていない投稿の Update は捨てる。
+func noteUpdateHandler(w http.ResponseWriter, r *http.Request, actor *config.ActorConfig, in *activitystream.Object, note *activitystream.Object) httperror.HttpError {
+	ctx := r.Context()
+	author := in.Actor.ID()
+	// 署名で確かめたのは Update の actor だけである。他人の投稿を書き換え
+	// させないよう、投稿の著者と出どころが actor 本人であることを見る。
+	if note.AttributedTo.ID() != author || !sameOrigin(note.ID, author) {
+		return httperror.StatusUnprocessableEntity(
+			fmt.Sprintf("Update of %v is not from its author (%v)", note.ID, author), nil)
+	}
+
+	// 控えた返信先の写しも古くなる。取り直させる。
+	forgetRemoteNote(ctx, note.ID)
+
+	edited := *note
+	// 編集済みの印。updated を付けない実装もあるので、受け取った時刻で
+	// 補う。ただし投票の updated の無い Update は票数の更新であって編集
+	// ではない。
+	if edited.Updated == "" && edited.Type != activitystream.QuestionType {
+		edited.Updated = nowRFC3339()
+	}
+
+	replaced := 0
+	// timeline は primary actor しか持たない。
+	if actor.Primary {
+		n, err := replaceEditedEntries(ctx, timelineKey, timelineScanLimit, &edited, author)
+		if err != nil {
+			return httperror.StatusInternalServerError("cannot update the timeline", err)
+		}
+		replaced += n
+	}
+	n, err := replaceEditedEntries(ctx, notificationKey, notificationScanLimit, &edited, author)
+	if err != nil {
+		return httperror.StatusInternalServerError("cannot update the notifications", err)
+	}
+	replaced += n
+
+	// 索引に控えた返信の本文も差し替える。返信の索引はいつまでも残るので、
+	// タイムラインの走査の範囲より古い返信もここで拾える。
+	if refreshReply(ctx, actor, &edited) {
+		replaced++
+	}
+	if replaced == 0 {
+		logf("inbox: ignoring Update of %v from %v, which is not stored here", note.ID, author)
+		respondText(w, http.StatusAccepted, "accepted\n")
+		return nil
+	}
+	logf("%v edited %v (%d entries updated)", author, note.ID, replaced)
+	respondText(w, http.StatusAccepted, "accepted\n")
+	return nil
+}
+
+// replaceEditedEntries は連番の列 key を直近 limit 件遡り、note を包んで
+// いるもの (Create・Update・Announce) の中身を差し替える。連番はそのまま
+// なので並び順も未読も変わらない。差し替えた件数を返す。
+func replaceEditedEntries(ctx context.Context, key string, limit int, note *activitystream.Object, author string) (int, error) {
+	entries, err := client.TakeEntries(ctx, key, datastore.Inf, limit, datastore.Desc)
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		act, ok := withEditedNote(e.Object, note, author)
+		if !ok {
+			continue
+		}
+		if err := client.Put(ctx, key, e.ID, act); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// withEditedNote は act が note を包んでいれば、中身を差し替えた写しを
+// 返す。act 自体は書き換えない。
+//
+// 積んである方の著者も確かめる。id だけで突き合わせると、別人の投稿と
+// 同じ id を名乗る Update で中身をすり替えられる。
+func withEditedNote(act *activitystream.Object, note *activitystream.Object, author string) (*activitystream.Object, bool) {
+	inner := act.Object.Item()
+	if inner == nil || inner.ID != note.ID {
+		return nil, false
+	}
+	if inner.AttributedTo.ID() != author {
+		logf("inbox: %v tried to edit %v, written by %v", author, note.ID, inner.AttributedTo.ID())
+		return nil, false
+	}
+	replaced := *act
+	replaced.Object = activitystream.ObjectRef(note)
+	return &replaced, true
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nna774/s.nna774.net/activitystream"
+	"github.com/nna774/s.nna774.net/datastore"
+)
+
+func TestWithEditedNote(t *testing.T) {
+	const author = "https://pawoo.net/users/x"
+	const uri = author + "/statuses/1"
+	stored := &activitystream.Object{
+		ID:   "https://pawoo.net/users/x/statuses/1/activity",
+		Type: activitystream.CreateType,
+		Object: activitystream.ObjectRef(&activitystream.Object{
+			ID: uri, Type: activitystream.NoteType, Content: "<p>typo</p>",
+			AttributedTo: activitystream.URIRef(author),
+		}),
+	}
+	edited := &activitystream.Object{
+		ID: uri, Type: activitystream.NoteType, Content: "<p>fixed</p>",
+		AttributedTo: activitystream.URIRef(author), Updated: "2026-01-01T00:05:00Z",
+	}
+
+	got, ok := withEditedNote(stored, edited, author)
+	if !ok {
+		t.Fatal("withEditedNote did not replace the note")
+	}
+	if got.ID != stored.ID || got.Object.Item().Content != "<p>fixed</p>" || got.Object.Item().Updated == "" {
+		t.Errorf("replaced = %+v / %+v", got, got.Object.Item())
+	}
+	if stored.Object.Item().Content != "<p>typo</p>" {
+		t.Errorf("stored entry was modified")
+	}
+
+	other := *edited
+	other.ID = author + "/statuses/2"
+	if _, ok := withEditedNote(stored, &other, author); ok {
+		t.Errorf("replaced an entry for another note")
+	}
+	// 積んである投稿の著者と Update の actor が違うものは差し替えない。
+	if _, ok := withEditedNote(stored, edited, "https://pawoo.net/users/y"); ok {
+		t.Errorf("replaced a note written by someone else")
+	}
+}
+
+// 他人の投稿を名乗る Update は datastore に触る前に弾く。
+func TestNoteUpdateHandlerRejectsNonAuthor(t *testing.T) {
+	withTestConfig(t)
+	const actor = "https://evil.example/users/y"
+	for _, note := range []*activitystream.Object{
+		{ID: "https://pawoo.net/users/x/statuses/1", Type: activitystream.NoteType,
+			AttributedTo: activitystream.URIRef("https://pawoo.net/users/x")},
+		// 著者は自分と名乗っていても、投稿の出どころが別のサーバ。
+		{ID: "https://pawoo.net/users/x/statuses/1", Type: activitystream.NoteType,
+			AttributedTo: activitystream.URIRef(actor)},
+	} {
+		in := &activitystream.Object{Type: activitystream.UpdateType, Actor: activitystream.URIRef(actor),
+			Object: activitystream.ObjectRef(note)}
+		r := httptest.NewRequest(http.MethodPost, "/u/nana/inbox", nil)
+		herr := updateHandler(httptest.NewRecorder(), r, Config.PrimaryActor(), in)
+		if herr == nil || herr.Code() != http.StatusUnprocessableEntity {
+			t.Errorf("updateHandler(%v by %v) = %v, want 422", note.ID, note.AttributedTo.ID(), herr)
+		}
+	}
+}
+
+func TestIsActorType(t *testing.T) {
+	for typ, want := range map[string]bool{
+		activitystream.PersonType:  true,
+		activitystream.ServiceType: true,
+		"Group":                    true,
+		activitystream.NoteType:    false,
+		"Question":                 false,
+	} {
+		if got := isActorType(typ); got != want {
+			t.Errorf("isActorType(%q) = %v, want %v", typ, got, want)
+		}
+	}
+}
+
+func TestRefreshedActorItem(t *testing.T) {
+	it := &datastore.KVItem{
+		PK: "nana:followers", SK: "https://pawoo.net/users/x",
+		Name: "old", IconURL: "https://pawoo.net/old.png", PreferredUsername: "x",
+		Inbox: "https://pawoo.net/users/x/inbox", SharedInbox: "https://pawoo.net/inbox",
+		State: datastore.FollowStateAccepted,
+	}
+	remote := &activitystream.Object{
+		ID: "https://pawoo.net/users/x", Type: activitystream.PersonType,
+		Name: "new", PreferredUsername: "x",
+		Icon:  &activitystream.Object{URL: "https://pawoo.net/new.png"},
+		Inbox: "https://pawoo.net/users/x/inbox2",
+	}
+
+	got, changed := refreshedActorItem(it, remote)
+	if !changed {
+		t.Fatal("refreshedActorItem reported no change")
+	}
+	if got.Name != "new" || got.IconURL != "https://pawoo.net/new.png" || got.Inbox != "https://pawoo.net/users/x/inbox2" {
+		t.Errorf("refreshed = %+v", got)
+	}
+	// endpoints を省いた Update で sharedInbox を消さない。フォロー状態も残す。
+	if got.SharedInbox != it.SharedInbox || got.State != datastore.FollowStateAccepted || got.PK != it.PK {
+		t.Errorf("refreshed = %+v", got)
+	}
+	if it.Name != "old" {
+		t.Errorf("stored item was modified")
+	}
+
+	if _, changed := refreshedActorItem(got, remote); changed {
+		t.Errorf("refreshing twice reported a change")
+	}
+}
+
+// 表示名の絵文字は表示名と一緒に入れ替わること。
+func TestRefreshedActorItemReplacesNameEmoji(t *testing.T) {
+	it := &datastore.KVItem{
+		SK: "https://misskey.example/users/x", Name: ":old: x",
+		Emoji: map[string]string{"old": "https://misskey.example/old.png"},
+	}
+	remote := &activitystream.Object{
+		ID: "https://misskey.example/users/x", Name: ":new: x",
+		Tag: activitystream.Objects{
+			activitystream.NewEmoji("https://misskey.example/emojis/new", ":new:", "image/png", "https://misskey.example/new.png"),
+		},
+	}
+	got, changed := refreshedActorItem(it, remote)
+	if !changed || len(got.Emoji) != 1 || got.Emoji["new"] != "https://misskey.example/new.png" {
+		t.Errorf("refreshed emoji = %v (changed %v)", got.Emoji, changed)
+	}
+}
+
+func TestActorKeyChanged(t *testing.T) {
+	const owner = "https://pawoo.net/users/x"
+	cached := &datastore.KVItem{PublicKeyPem: "-----BEGIN PUBLIC KEY-----\nA\n-----END PUBLIC KEY-----\n", Owner: owner}
+	key := func(pem, owner string) *activitystream.Object {
+		return &activitystream.Object{ID: owner, PublicKey: &activitystream.PublicKey{ID: owner + "#main-key", Owner: owner, PublicKeyPem: pem}}
+	}
+	for _, c := range []struct {
+		name   string
+		remote *activitystream.Object
+		want   bool
+	}{
+		{"same", key("-----BEGIN PUBLIC KEY-----\nA\n-----END PUBLIC KEY-----", owner), false},
+		{"rotated", key("-----BEGIN PUBLIC KEY-----\nB\n-----END PUBLIC KEY-----", owner), true},
+		{"new owner", key(cached.PublicKeyPem, "https://pawoo.net/users/y"), true},
+		{"no key", &activitystream.Object{ID: owner}, false},
+	} {
+		if got := actorKeyChanged(cached, c.remote); got != c.want {
+			t.Errorf("%v: actorKeyChanged = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// 他人のプロフィールを名乗る Update は datastore に触る前に弾く。
+func TestActorUpdateRejectsOthers(t *testing.T) {
+	withTestConfig(t)
+	in := &activitystream.Object{Type: activitystream.UpdateType, Actor: activitystream.URIRef("https://evil.example/users/y"),
+		Object: activitystream.ObjectRef(&activitystream.Object{ID: "https://pawoo.net/users/x", Type: activitystream.PersonType})}
+	r := httptest.NewRequest(http.MethodPost, "/u/nana/inbox", nil)
+	herr := updateHandler(httptest.NewRecorder(), r, Config.PrimaryActor(), in)
+	if herr == nil || herr.Code() != http.StatusUnprocessableEntity {
+		t.Errorf("updateHandler = %v, want 422", herr)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/microcosm-cc/bluemonday"
@@ -17,7 +19,7 @@ var templateFS embed.FS
 // ページごとに独立したテンプレートセットを作る。各ページが自分の
 // "content" を定義するため、1つのセットに全部入れると名前が衝突する。
 var pages = func() map[string]*template.Template {
-	names := []string{"profile", "status", "statuses", "timeline", "notifications", "login", "collection", "remote", "favorites", "announce", "status_likes", "status_announces"}
+	names := []string{"profile", "status", "statuses", "timeline", "notifications", "login", "collection", "remote", "favorites", "announce", "status_likes", "status_announces", "admin_deliveries", "status_edit", "follow_requests", "admin_blocks", "mutes", "status_gone", "tag", "scheduled"}
 	m := make(map[string]*template.Template, len(names))
 	for _, name := range names {
 		m[name] = template.Must(template.New(name).Funcs(funcs).
@@ -31,7 +33,9 @@ var pages = func() map[string]*template.Template {
 // 他インスタンス由来の content は信用できない HTML である。自分で
 // 許可リストを書くと必ず抜けが出るため、この用途向けに作られた
 // bluemonday を使う。
-var policy = func() *bluemonday.Policy {
+var policy = newPolicy()
+
+func newPolicy() *bluemonday.Policy {
 	p := bluemonday.NewPolicy()
 	p.AllowElements("p", "br", "span", "em", "strong", "b", "i", "code", "pre", "blockquote", "ul", "ol", "li")
 	// Mastodon のメンションやハッシュタグのリンクを残す。
@@ -43,6 +47,17 @@ var policy = func() *bluemonday.Policy {
 	p.RequireNoFollowOnLinks(true)
 	p.AddTargetBlankToFullyQualifiedLinks(true)
 	return p
+}
+
+// emojiPolicy は policy にカスタム絵文字の img を足したもの。本文の img を
+// そのまま通すと追跡用の画像などを何でも貼れてしまうため、policy では
+// 落とす。絵文字の img は policy を通した後に emojify が差し込み、これで
+// もう一度確かめる。
+var emojiPolicy = func() *bluemonday.Policy {
+	p := newPolicy()
+	p.AllowAttrs("src", "alt", "title").OnElements("img")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^custom-emoji$`)).OnElements("img")
+	return p
 }()
 
 // Sanitize はリモート由来の HTML を安全な断片に落とす。
@@ -50,9 +65,65 @@ func Sanitize(html string) template.HTML {
 	return template.HTML(policy.Sanitize(html))
 }
 
+// Emoji はカスタム絵文字の shortcode (コロン無し) から画像の URL への
+// 対応。リモートのものは投稿や actor の tag に載っている Emoji から作る。
+type Emoji map[string]string
+
+// SanitizeWithEmoji は Sanitize した上で、emoji にある :shortcode: を画像に
+// する。
+func SanitizeWithEmoji(html string, emoji Emoji) template.HTML {
+	s := policy.Sanitize(html)
+	if len(emoji) == 0 {
+		return template.HTML(s)
+	}
+	return template.HTML(emojiPolicy.Sanitize(emojify(s, emoji)))
+}
+
+// EmojifyText は表示名などの平文をエスケープし、:shortcode: を画像にする。
+func EmojifyText(text string, emoji Emoji) template.HTML {
+	s := template.HTMLEscapeString(text)
+	if len(emoji) == 0 {
+		return template.HTML(s)
+	}
+	return template.HTML(emojiPolicy.Sanitize(emojify(s, emoji)))
+}
+
+// shortcodePattern は Mastodon と Misskey の shortcode を両方拾う。
+// Misskey は "+" と "-" も使う。
+var shortcodePattern = regexp.MustCompile(`:([a-zA-Z0-9_+-]+):`)
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// emojify はサニタイズ済みの HTML の、タグの外にある :shortcode: だけを
+// img にする。リンクの href などに入った ":x:" を書き換えないため。
+func emojify(s string, emoji Emoji) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range tagPattern.FindAllStringIndex(s, -1) {
+		b.WriteString(emojifyText(s[last:loc[0]], emoji))
+		b.WriteString(s[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(emojifyText(s[last:], emoji))
+	return b.String()
+}
+
+func emojifyText(s string, emoji Emoji) string {
+	return shortcodePattern.ReplaceAllStringFunc(s, func(m string) string {
+		url, ok := emoji[m[1:len(m)-1]]
+		if !ok {
+			return m
+		}
+		return fmt.Sprintf(`<img class="custom-emoji" src="%s" alt="%s" title="%s">`,
+			template.HTMLEscapeString(url), m, m)
+	})
+}
+
 var funcs = template.FuncMap{
-	"sanitize": Sanitize,
-	"datetime": humanTime,
+	"sanitize":      Sanitize,
+	"sanitizeEmoji": SanitizeWithEmoji,
+	"emojify":       EmojifyText,
+	"datetime":      humanTime,
 }
 
 // jst は表示用のタイムゾーン。Lambda 実行環境のプロセスタイムゾーンは